@@ -0,0 +1,304 @@
+// AArch64のコード生成
+// 中間表現を、GNUアセンブラの記法のAArch64のアセンブリにする。呼び出し規約はAAPCS64
+// レジスタ割り当てはせず、仮想レジスタはすべてスタック上の領域に置く。演算は作業用のx9からx11で行う
+
+package aarch64
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/kijimaD/gogo/ir"
+)
+
+// スタック上の領域1つの大きさ。ポインタも入るように8バイトにする
+const slotWidth = 8
+
+// 引数を渡すレジスタの数。x0からx7を使い、残りはスタックに置く
+const numArgRegs = 8
+
+// アセンブリを書き出す
+type Emitter struct {
+	w io.Writer
+}
+
+func NewEmitter(w io.Writer) *Emitter {
+	return &Emitter{w: w}
+}
+
+// 中間表現のモジュール全体を出力する
+func (e *Emitter) EmitModule(m *ir.Module) error {
+	for _, line := range Compile(m) {
+		if _, err := fmt.Fprintln(e.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 中間表現のモジュール全体をアセンブリの行の列にする
+func Compile(m *ir.Module) []string {
+	code := []string{}
+	if len(m.Data) > 0 {
+		code = append(code, "\t.data")
+		for _, d := range m.Data {
+			code = append(code, d.Name+":", fmt.Sprintf("\t.string \"%s\"", d.Value))
+		}
+	}
+	code = append(code, "\t.text")
+	for _, f := range m.Funcs {
+		code = append(code, emitFunc(f)...)
+	}
+	return code
+}
+
+// 関数のスタックフレーム。配置はir.LayoutStackで決める
+// spの直上に、8個目より後ろの引数を渡す領域を置く。関数の中ではspを動かさない
+type frame struct {
+	*ir.StackLayout
+	f    *ir.Func
+	code []string
+}
+
+func newFrame(f *ir.Func) *frame {
+	return &frame{StackLayout: ir.LayoutStack(f, slotWidth, numArgRegs), f: f}
+}
+
+func (fr *frame) label(b *ir.Block) string {
+	return fmt.Sprintf(".L%s_%s", fr.f.Name, b.Name)
+}
+
+func (fr *frame) emit(format string, args ...interface{}) {
+	fr.code = append(fr.code, "\t"+fmt.Sprintf(format, args...))
+}
+
+func (fr *frame) emitLabel(name string) {
+	fr.code = append(fr.code, name+":")
+}
+
+func emitFunc(f *ir.Func) []string {
+	fr := newFrame(f)
+	fr.code = append(fr.code, "\t.global "+f.Name)
+	fr.emitLabel(f.Name)
+	fr.emit("stp x29, x30, [sp, #-16]!")
+	fr.emit("mov x29, sp")
+	if fr.Size > 0 {
+		if fr.Size <= 4095 {
+			fr.emit("sub sp, sp, #%d", fr.Size)
+		} else {
+			fr.movImm(16, int64(fr.Size))
+			fr.emit("sub sp, sp, x16")
+		}
+	}
+	preds := f.Preds()
+	for i, b := range f.Blocks {
+		// ジャンプしてこない入口のブロックにはラベルはいらない
+		if i > 0 || len(preds[b]) > 0 {
+			fr.emitLabel(fr.label(b))
+		}
+		for _, phi := range b.Phis() {
+			fr.emit("ldr x9, %s", fr.mem(fr.Incoming[phi.Dst]))
+			fr.emit("str x9, %s", fr.mem(fr.Slots[phi.Dst]))
+		}
+		for _, instr := range b.Instrs {
+			fr.emitInstr(b, instr)
+		}
+	}
+	return fr.code
+}
+
+// spからoffの位置にあるメモリのオペランド
+// ldrbの即値に収まらないほど遠ければ、アドレスをx16に計算する
+func (fr *frame) mem(off int) string {
+	if off <= 4095 {
+		return fmt.Sprintf("[sp, #%d]", off)
+	}
+	fr.movImm(16, int64(off))
+	fr.emit("add x16, sp, x16")
+	return "[x16]"
+}
+
+// 型の幅に合わせたレジスタの名前。ポインタはx、それ以外はw
+func reg(n int, t ir.Type) string {
+	if t == ir.Ptr {
+		return fmt.Sprintf("x%d", n)
+	}
+	return fmt.Sprintf("w%d", n)
+}
+
+// 即値をレジスタxnに入れる。16ビットに収まらなければmovkで16ビットずつ埋める
+func (fr *frame) movImm(n int, v int64) {
+	if -65536 < v && v < 65536 {
+		fr.emit("mov x%d, #%d", n, v)
+		return
+	}
+	u := uint64(v)
+	fr.emit("movz x%d, #%d", n, u&0xffff)
+	for shift := 16; shift < 64; shift += 16 {
+		if chunk := (u >> shift) & 0xffff; chunk != 0 {
+			fr.emit("movk x%d, #%d, lsl #%d", n, chunk, shift)
+		}
+	}
+}
+
+// 値をレジスタxnに読み込む
+func (fr *frame) load(v ir.Value, n int) {
+	switch v := v.(type) {
+	case *ir.Const:
+		fr.movImm(n, v.Value)
+	case *ir.Global:
+		fr.emit("adrp x%d, %s", n, v.Name)
+		fr.emit("add x%d, x%d, :lo12:%s", n, n, v.Name)
+	case *ir.Reg:
+		if off, ok := fr.Allocas[v]; ok {
+			if off <= 4095 {
+				fr.emit("add x%d, sp, #%d", n, off)
+			} else {
+				fr.movImm(n, int64(off))
+				fr.emit("add x%d, sp, x%d", n, n)
+			}
+			return
+		}
+		fr.emit("ldr x%d, %s", n, fr.mem(fr.Slots[v]))
+	default:
+		log.Fatal("invalid value:", v)
+	}
+}
+
+// レジスタxnの値を、仮想レジスタの領域に書き込む
+func (fr *frame) def(dst *ir.Reg, n int) {
+	fr.emit("str x%d, %s", n, fr.mem(fr.Slots[dst]))
+}
+
+// アドレスを表すオペランド。allocaした領域なら直接、それ以外はxnを経由する
+func (fr *frame) addr(v ir.Value, n int) string {
+	if r, ok := v.(*ir.Reg); ok {
+		if off, ok := fr.Allocas[r]; ok {
+			return fr.mem(off)
+		}
+	}
+	fr.load(v, n)
+	return fmt.Sprintf("[x%d]", n)
+}
+
+var arith = map[ir.Op]string{
+	ir.OpAdd: "add",
+	ir.OpSub: "sub",
+	ir.OpMul: "mul",
+	ir.OpDiv: "sdiv",
+}
+
+var cond = map[ir.Op]string{
+	ir.OpEq: "eq",
+	ir.OpNe: "ne",
+	ir.OpLt: "lt",
+	ir.OpLe: "le",
+	ir.OpGt: "gt",
+	ir.OpGe: "ge",
+}
+
+// 命令を出力する
+func (fr *frame) emitInstr(b *ir.Block, instr *ir.Instr) {
+	switch op := instr.Op; {
+	case op == ir.OpAlloca:
+		// 領域はフレームを作るときに確保している
+	case op == ir.OpLoad:
+		src := fr.addr(instr.Args[0], 10)
+		switch instr.Type {
+		case ir.I8:
+			fr.emit("ldrsb w9, %s", src)
+		default:
+			fr.emit("ldr %s, %s", reg(9, instr.Type), src)
+		}
+		fr.def(instr.Dst, 9)
+	case op == ir.OpStore:
+		fr.load(instr.Args[0], 9)
+		dst := fr.addr(instr.Args[1], 10)
+		switch instr.Type {
+		case ir.I8:
+			fr.emit("strb w9, %s", dst)
+		default:
+			fr.emit("str %s, %s", reg(9, instr.Type), dst)
+		}
+	case op.IsCompare():
+		fr.load(instr.Args[0], 9)
+		fr.load(instr.Args[1], 10)
+		fr.emit("cmp %s, %s", reg(9, instr.Type), reg(10, instr.Type))
+		fr.emit("cset w9, %s", cond[op])
+		fr.def(instr.Dst, 9)
+	case op.IsBinary():
+		fr.load(instr.Args[0], 9)
+		fr.load(instr.Args[1], 10)
+		fr.emit("%s %s, %s, %s", arith[op], reg(9, instr.Type), reg(9, instr.Type), reg(10, instr.Type))
+		fr.def(instr.Dst, 9)
+	case op == ir.OpSext:
+		fr.load(instr.Args[0], 9)
+		switch instr.Type {
+		case ir.I8:
+			fr.emit("sxtb %s, w9", reg(9, instr.To))
+		case ir.I32:
+			fr.emit("sxtw x9, w9")
+		}
+		fr.def(instr.Dst, 9)
+	case op == ir.OpTrunc, op == ir.OpCopy:
+		// 下位のバイトだけを使うので、値はそのままでよい
+		fr.load(instr.Args[0], 9)
+		fr.def(instr.Dst, 9)
+	case op == ir.OpPhi:
+		// 値はブロックの先頭で書き込んでいる
+	case op == ir.OpCall:
+		fr.emitCall(instr)
+	case op == ir.OpJmp:
+		fr.emitJump(b, instr.Targets[0])
+	case op == ir.OpBr:
+		fr.load(instr.Args[0], 9)
+		els := fr.label(instr.Targets[1])
+		if len(instr.Targets[1].Phis()) > 0 {
+			// phiの値を書き込む処理は、進む先ごとに分ける
+			els = fr.label(b) + ".else"
+		}
+		fr.emit("cbz %s, %s", reg(9, instr.Type), els)
+		fr.emitJump(b, instr.Targets[0])
+		if len(instr.Targets[1].Phis()) > 0 {
+			fr.emitLabel(els)
+			fr.emitJump(b, instr.Targets[1])
+		}
+	case op == ir.OpRet:
+		if len(instr.Args) > 0 {
+			fr.load(instr.Args[0], 0)
+		}
+		fr.emit("mov sp, x29")
+		fr.emit("ldp x29, x30, [sp], #16")
+		fr.emit("ret")
+	default:
+		log.Fatal("invalid instruction:", instr)
+	}
+}
+
+// fromからtoに進む。toのphiには、fromから来たときの値を書いておく
+// phiどうしで値を入れ替えることがあるので、phiの領域には直接書かない
+func (fr *frame) emitJump(from *ir.Block, to *ir.Block) {
+	for _, m := range ir.PhiMoves(from, to) {
+		fr.load(m.Src, 9)
+		fr.emit("str x9, %s", fr.mem(fr.Incoming[m.Phi]))
+	}
+	fr.emit("b %s", fr.label(to))
+}
+
+// AAPCS64にしたがって関数を呼ぶ。9個目からの引数は、spの直上の領域に置く
+// Linuxでは可変長引数もほかの引数と同じように渡す
+func (fr *frame) emitCall(instr *ir.Instr) {
+	for i := numArgRegs; i < len(instr.Args); i++ {
+		fr.load(instr.Args[i], 9)
+		fr.emit("str x9, %s", fr.mem((i-numArgRegs)*slotWidth))
+	}
+	// 値はすべてメモリか即値なので、引数のレジスタに直接読み込める
+	for i := 0; i < len(instr.Args) && i < numArgRegs; i++ {
+		fr.load(instr.Args[i], i)
+	}
+	fr.emit("bl %s", instr.Callee)
+	if instr.Dst != nil {
+		fr.def(instr.Dst, 0)
+	}
+}
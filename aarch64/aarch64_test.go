@@ -0,0 +1,201 @@
+package aarch64
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/gogo/ir"
+	"github.com/kijimaD/gogo/ir/irtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func emit(t *testing.T, m *ir.Module) string {
+	t.Helper()
+	var buf bytes.Buffer
+	assert.NoError(t, NewEmitter(&buf).EmitModule(m))
+	return buf.String()
+}
+
+func TestEmitModule(t *testing.T) {
+	m, err := ir.Parse(`
+data @.s0 = "a"
+
+func @mymain() i32 {
+entry:
+	%1 = alloca i32
+	store i32 1, %1
+	%2 = load i32 %1
+	%3 = call i32 @printf(ptr @.s0, i32 %2)
+	%4 = add i32 %2, 70000
+	ret i32 %4
+}
+`)
+	assert.NoError(t, err)
+	expect := `	.data
+.s0:
+	.string "a"
+	.text
+	.global mymain
+mymain:
+	stp x29, x30, [sp, #-16]!
+	mov x29, sp
+	sub sp, sp, #32
+	mov x9, #1
+	str w9, [sp, #0]
+	ldr w9, [sp, #0]
+	str x9, [sp, #8]
+	adrp x0, .s0
+	add x0, x0, :lo12:.s0
+	ldr x1, [sp, #8]
+	bl printf
+	str x0, [sp, #16]
+	ldr x9, [sp, #8]
+	movz x10, #4464
+	movk x10, #1, lsl #16
+	add w9, w9, w10
+	str x9, [sp, #24]
+	ldr x0, [sp, #24]
+	mov sp, x29
+	ldp x29, x30, [sp], #16
+	ret
+`
+	assert.Equal(t, expect, emit(t, m))
+}
+
+// phiの値は、飛んでくる前のブロックで別の領域に書いておく
+func TestEmitModulePhi(t *testing.T) {
+	m, err := ir.Parse(`
+func @mymain() i32 {
+entry:
+	br i32 1, a, b
+a:
+	jmp b
+b:
+	%1 = phi i32 [2, a], [3, entry]
+	ret i32 %1
+}
+`)
+	assert.NoError(t, err)
+	expect := `	.text
+	.global mymain
+mymain:
+	stp x29, x30, [sp, #-16]!
+	mov x29, sp
+	sub sp, sp, #16
+	mov x9, #1
+	cbz w9, .Lmymain_entry.else
+	b .Lmymain_a
+.Lmymain_entry.else:
+	mov x9, #3
+	str x9, [sp, #8]
+	b .Lmymain_b
+.Lmymain_a:
+	mov x9, #2
+	str x9, [sp, #8]
+	b .Lmymain_b
+.Lmymain_b:
+	ldr x9, [sp, #8]
+	str x9, [sp, #0]
+	ldr x0, [sp, #0]
+	mov sp, x29
+	ldp x29, x30, [sp], #16
+	ret
+`
+	assert.Equal(t, expect, emit(t, m))
+}
+
+// 8個目より後ろの引数は、spの直上に置く
+func TestEmitModuleStackArgs(t *testing.T) {
+	code := emit(t, irtest.Load(t, "call", 0))
+	assert.Contains(t, code, "\tmov x9, #0\n\tstr x9, [sp, #0]\n\tmov x9, #0\n\tstr x9, [sp, #8]\n\tadrp x0, .s0\n")
+	assert.Equal(t, 4, strings.Count(code, "\tbl "))
+}
+
+// AArch64に特有の命令の選び方
+func TestEmitInstr(t *testing.T) {
+	tests := []struct {
+		instrs string
+		expect string
+	}{
+		// 16ビットに収まらない即値は、movzとmovkで16ビットずつ作る
+		{"%1 = add i32 2147483647, 1", "\tmovz x9, #65535\n\tmovk x9, #32767, lsl #16\n\tmov x10, #1\n\tadd w9, w9, w10\n"},
+		{"%1 = add i32 -70000, 0", "\tmovz x9, #61072\n\tmovk x9, #65534, lsl #16\n\tmovk x9, #65535, lsl #32\n\tmovk x9, #65535, lsl #48\n"},
+		{"%1 = add i32 -65535, 0", "\tmov x9, #-65535\n"},
+		// 比較はcmpとcsetにする。i32はwのレジスタで比べる
+		{"%1 = lt i32 1, 2", "\tcmp w9, w10\n\tcset w9, lt\n"},
+		{"%1 = ne i32 1, 2", "\tcmp w9, w10\n\tcset w9, ne\n"},
+		{"%1 = div i32 7, 2", "\tsdiv w9, w9, w10\n"},
+		// i8はldrsbで符号拡張しながら読み、strbで書く
+		{"%1 = alloca i8\n\tstore i8 -56, %1\n\t%2 = load i8 %1", "\tmov x9, #-56\n\tstrb w9, [sp, #0]\n\tldrsb w9, [sp, #0]\n"},
+		{"%1 = sext i8 200 to i32", "\tsxtb w9, w9\n"},
+		{"%1 = add ptr @.s0, 1", "\tadrp x9, .s0\n\tadd x9, x9, :lo12:.s0\n\tmov x10, #1\n\tadd x9, x9, x10\n"},
+	}
+	for _, tt := range tests {
+		m := irtest.Parse(t, "data @.s0 = \"a\"\nfunc @mymain() i32 {\nentry:\n\t"+tt.instrs+"\n\tret i32 0\n}\n", 0)
+		assert.Contains(t, emit(t, m), tt.expect, tt.instrs)
+	}
+}
+
+// ldrとstrの即値に収まらない位置は、x16にアドレスを計算する
+func TestEmitModuleLargeFrame(t *testing.T) {
+	var src strings.Builder
+	src.WriteString("func @mymain() i32 {\nentry:\n")
+	for i := 1; i <= 600; i++ {
+		fmt.Fprintf(&src, "\t%%%d = add i32 %d, 1\n", i, i)
+	}
+	src.WriteString("\tret i32 %600\n}\n")
+	code := emit(t, irtest.Parse(t, src.String(), 0))
+	assert.Contains(t, code, "\tmov x16, #4800\n\tsub sp, sp, x16\n")
+	assert.Contains(t, code, "\tstr x9, [sp, #4088]\n")
+	assert.Contains(t, code, "\tmov x16, #4096\n\tadd x16, sp, x16\n\tstr x9, [x16]\n")
+}
+
+// クロスアセンブラがあれば、アセンブルできることを確かめる
+func TestEmitModuleAssemble(t *testing.T) {
+	var args []string
+	if path, err := exec.LookPath("aarch64-linux-gnu-as"); err == nil {
+		args = []string{path}
+	} else if path, err := exec.LookPath("llvm-mc"); err == nil {
+		args = []string{path, "-triple=aarch64-linux-gnu", "-filetype=obj"}
+	} else {
+		t.Skip("assembler for aarch64 is not found")
+	}
+
+	dir := t.TempDir()
+	for _, name := range irtest.Programs {
+		for level := 0; level <= 2; level++ {
+			s := filepath.Join(dir, "a.s")
+			assert.NoError(t, os.WriteFile(s, []byte(emit(t, irtest.Load(t, name, level))), 0o644))
+			out, err := exec.Command(args[0], append(args[1:], "-o", filepath.Join(dir, "a.o"), s)...).CombinedOutput()
+			assert.NoError(t, err, string(out))
+		}
+	}
+}
+
+// クロスコンパイラとqemuがあれば、実行して結果を確かめる
+func TestEmitModuleRun(t *testing.T) {
+	for _, tool := range []string{"aarch64-linux-gnu-gcc", "qemu-aarch64"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not found", tool)
+		}
+	}
+
+	dir := t.TempDir()
+	for _, name := range irtest.Programs {
+		for level := 0; level <= 2; level++ {
+			s := filepath.Join(dir, "a.s")
+			exe := filepath.Join(dir, "a")
+			assert.NoError(t, os.WriteFile(s, []byte(emit(t, irtest.Load(t, name, level))), 0o644))
+			out, err := exec.Command("aarch64-linux-gnu-gcc", "-static", "-o", exe, s, "../c/driver.c").CombinedOutput()
+			assert.NoError(t, err, string(out))
+			out, err = exec.Command("qemu-aarch64", exe).Output()
+			assert.NoError(t, err)
+			assert.Equal(t, irtest.Output(t, name), string(out), "%s -O%d", name, level)
+		}
+	}
+}
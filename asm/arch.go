@@ -0,0 +1,97 @@
+package asm
+
+// 命令セットの違い
+// 32ビットのx86も、64ビットのレジスタの名前で命令を組み立ててから、to32で32ビットの名前に書き換える
+type arch struct {
+	wordSize    int   // ポインタとスタック上の領域1つの大きさ
+	argRegs     []Reg // 引数を渡すレジスタ。空ならすべてスタックに積む
+	callerSaved []Reg // 仮想レジスタに割り当てる、呼び出し元が保存するレジスタ
+	calleeSaved []Reg // 仮想レジスタに割り当てる、呼び出し先が保存するレジスタ
+	tmp         Reg   // 転送の循環を切るときに使う作業用のレジスタ
+}
+
+// x86-64。System V ABI
+// %rax、%rcx、%rdx、%r11は命令を組み立てるときの作業用に空けておく
+var amd64 = &arch{
+	wordSize:    8,
+	argRegs:     []Reg{"rdi", "rsi", "rdx", "rcx", "r8", "r9"},
+	callerSaved: []Reg{"rdi", "rsi", "r8", "r9", "r10"},
+	calleeSaved: []Reg{"rbx", "r12", "r13", "r14", "r15"},
+	tmp:         r11,
+}
+
+// 32ビットのx86。引数をスタックで渡すcdecl
+// %ebx、%esi、%ediは呼び出し先が保存する。%eax、%ecx、%edxは作業用に空けておく
+var i386 = &arch{
+	wordSize:    4,
+	calleeSaved: []Reg{"rbx", "rsi", "rdi"},
+	tmp:         rdx,
+}
+
+// スタック上の変数の位置を、%rbpからのオフセットに変換する
+func (a *arch) offset(pos int) int {
+	return -pos * a.wordSize
+}
+
+// 8ビットの名前があるレジスタか。32ビットのx86では%esiと%ediの下位8ビットは使えない
+func (a *arch) hasByteReg(r Reg) bool {
+	if a.wordSize == 8 {
+		return true
+	}
+	switch r {
+	case "rax", "rbx", "rcx", "rdx":
+		return true
+	default:
+		return false
+	}
+}
+
+// 64ビットのレジスタを32ビットの名前に書き換える
+// ラベルは%ripからの相対位置ではなく、絶対アドレスで指す
+func to32(code []*Instr) []*Instr {
+	for _, i := range code {
+		if i.Kind != KindInstr {
+			continue
+		}
+		switch i.Op {
+		case "movq":
+			i.Op = "movl"
+		case "movslq":
+			// ポインタも32ビットなので、符号拡張はいらない
+			i.Op = "mov"
+		}
+		for j, a := range i.Args {
+			i.Args[j] = operand32(a)
+		}
+	}
+	return code
+}
+
+func operand32(o Operand) Operand {
+	switch o := o.(type) {
+	case Reg:
+		return reg32(o)
+	case Mem:
+		if o.Base == rip {
+			o.Base = ""
+		} else if o.Base != "" {
+			o.Base = reg32(o.Base)
+		}
+		return o
+	}
+	return o
+}
+
+// 32ビットの名前。すでに32ビットや8ビットの名前ならそのまま
+func reg32(r Reg) Reg {
+	switch r {
+	case rbp:
+		return "ebp"
+	case rsp:
+		return "esp"
+	}
+	if names, ok := regNames[r]; ok {
+		return names[1]
+	}
+	return r
+}
@@ -4,115 +4,542 @@ import (
 	"fmt"
 	"log"
 
-	"github.com/kijimaD/gogo/ast"
-	"github.com/kijimaD/gogo/parser"
-	"github.com/kijimaD/gogo/token"
+	"github.com/kijimaD/gogo/ir"
 )
 
-var varPos = 1
+// スタック上の変数の位置を、x86-64の%rbpからのオフセットに変換する
+func VarOffset(pos int) int {
+	return amd64.offset(pos)
+}
+
+// 中間表現のモジュール全体を出力する
+func (e *Emitter) EmitModule(m *ir.Module) error {
+	return e.Emit(Compile(m))
+}
+
+// 中間表現のモジュール全体を、32ビットのx86のアセンブリにして出力する
+func (e *Emitter) EmitModuleI386(m *ir.Module) error {
+	return e.Emit(CompileI386(m))
+}
+
+// 中間表現のモジュール全体を命令の列にする。関数ごとにのぞき穴最適化をかける
+func Compile(m *ir.Module) []*Instr {
+	return compile(m, amd64)
+}
+
+// 中間表現のモジュール全体を、32ビットのx86の命令の列にする
+// 64ビットのレジスタの名前で組み立ててから、32ビットの名前に書き換える
+func CompileI386(m *ir.Module) []*Instr {
+	return to32(compile(m, i386))
+}
+
+func compile(m *ir.Module, a *arch) []*Instr {
+	code := emitData(m.Data)
+	code = append(code, &Instr{Kind: KindDirective, Op: ".text"})
+	for _, f := range m.Funcs {
+		code = append(code, Peephole(emitFunc(f, a))...)
+	}
+	return code
+}
+
+// 文字列にデータラベルをつける
+func emitData(data []*ir.Data) []*Instr {
+	code := []*Instr{}
+	if len(data) == 0 {
+		return code
+	}
+	code = append(code, &Instr{Kind: KindDirective, Op: ".data"})
+	for _, d := range data {
+		code = append(code, &Instr{Kind: KindLabel, Op: d.Name})
+		code = append(code, &Instr{Kind: KindDirective, Op: ".string", Args: []Operand{Str(d.Value)}})
+	}
+	return code
+}
 
-// 変数の位置をアセンブリコードの中で正しいメモリアドレスに変換するための定数。1つの変数は4バイトに格納されている
-const varWidth = 4
+// 関数のスタックフレームと、仮想レジスタを置く場所
+// allocaで確保した変数を先に、そのあとに退避する呼び出し先保存のレジスタと、レジスタに入らなかった仮想レジスタを置く
+type frame struct {
+	f       *ir.Func
+	arch    *arch
+	locs    map[*ir.Reg]loc
+	allocas map[*ir.Reg]int // allocaで確保した領域の位置
+	saved   []loc           // 関数の中で使う呼び出し先保存のレジスタと、退避先
+	size    int
+	code    []*Instr
+}
 
-var regs = []string{"rdi", "rsi", "rdx", "rcx", "r8", "r9"}
+func newFrame(f *ir.Func, a *arch) *frame {
+	fr := &frame{f: f, arch: a, locs: map[*ir.Reg]loc{}, allocas: map[*ir.Reg]int{}}
+	pos := 0
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Op == ir.OpAlloca {
+				pos++
+				fr.allocas[instr.Dst] = a.offset(pos)
+			}
+		}
+	}
 
-func emitBinop(i ast.InfixExpression) {
-	var op string
-	switch i.Operator {
-	case token.PLUS:
-		op = "add"
-	case token.MINUS:
-		op = "sub"
-	case token.ASTERISK:
-		op = "imul"
-	case token.SLASH:
-		op = ""
+	intervals := liveIntervals(f)
+	linearScan(intervals, a)
+	used := map[Reg]bool{}
+	for _, it := range intervals {
+		if it.spilled {
+			continue
+		}
+		fr.locs[it.r] = loc{reg: it.reg}
+		used[it.reg] = true
+	}
+	for _, reg := range a.calleeSaved {
+		if used[reg] {
+			pos++
+			fr.saved = append(fr.saved, loc{reg: reg, off: a.offset(pos)})
+		}
+	}
+	for _, it := range intervals {
+		if it.spilled {
+			pos++
+			fr.locs[it.r] = loc{off: a.offset(pos)}
+		}
+	}
+	// 関数を呼ぶときに%rspが16バイト境界にそろうようにする
+	// 戻り番地と退避した%rbpの分だけ、フレームの前でずれている
+	fr.size = (pos*a.wordSize+2*a.wordSize+15)/16*16 - 2*a.wordSize
+	return fr
+}
+
+func (fr *frame) label(b *ir.Block) Sym {
+	return Sym(fmt.Sprintf(".L%s_%s", fr.f.Name, b.Name))
+}
+
+func (fr *frame) emit(op string, args ...Operand) {
+	fr.code = append(fr.code, &Instr{Kind: KindInstr, Op: op, Args: args})
+}
+
+func (fr *frame) emitLabel(name Sym) {
+	fr.code = append(fr.code, &Instr{Kind: KindLabel, Op: string(name)})
+}
+
+func emitFunc(f *ir.Func, a *arch) []*Instr {
+	fr := newFrame(f, a)
+	fr.code = append(fr.code, &Instr{Kind: KindDirective, Op: ".global", Args: []Operand{Sym(f.Name)}})
+	fr.emitLabel(Sym(f.Name))
+	fr.emit("push", rbp)
+	fr.emit("mov", rsp, rbp)
+	if fr.size > 0 {
+		fr.emit("sub", Imm(fr.size), rsp)
+	}
+	for _, s := range fr.saved {
+		fr.emit("mov", s.reg, mem(s.off))
+	}
+	preds := f.Preds()
+	for i, b := range f.Blocks {
+		// ジャンプしてこない入口のブロックにはラベルはいらない
+		if i > 0 || len(preds[b]) > 0 {
+			fr.emitLabel(fr.label(b))
+		}
+		for _, instr := range b.Instrs {
+			fr.emitInstr(b, instr)
+		}
+	}
+	return fr.code
+}
+
+// 64ビットのレジスタ名と、下位32ビット、8ビットの名前
+var regNames = map[Reg][3]Reg{
+	"rax": {"rax", "eax", "al"},
+	"rbx": {"rbx", "ebx", "bl"},
+	"rcx": {"rcx", "ecx", "cl"},
+	"rdx": {"rdx", "edx", "dl"},
+	"rsi": {"rsi", "esi", "sil"},
+	"rdi": {"rdi", "edi", "dil"},
+	"r8":  {"r8", "r8d", "r8b"},
+	"r9":  {"r9", "r9d", "r9b"},
+	"r10": {"r10", "r10d", "r10b"},
+	"r11": {"r11", "r11d", "r11b"},
+	"r12": {"r12", "r12d", "r12b"},
+	"r13": {"r13", "r13d", "r13b"},
+	"r14": {"r14", "r14d", "r14b"},
+	"r15": {"r15", "r15d", "r15b"},
+}
+
+// 型の幅に合わせたレジスタのオペランド
+func regName(r Reg, t ir.Type) Reg {
+	switch t {
+	case ir.I8:
+		return regNames[r][2]
+	case ir.I32:
+		return regNames[r][1]
 	default:
-		log.Fatal("invalid operand:", op)
+		return regNames[r][0]
 	}
+}
 
-	if i.Operator == token.SLASH {
-		emitExpr(i.Left)
-		fmt.Printf("push %%rax\n\t")
-		emitExpr(i.Right)
-		fmt.Printf("mov %%eax, %%ebx\n\t")
-		fmt.Printf("pop %%rax\n\t")
-		fmt.Printf("mov $0, %%edx\n\t")
-		fmt.Printf("idiv %%ebx\n\t")
-	} else {
-		emitExpr(i.Right)
-		fmt.Printf("push %%rax\n\t")
-		emitExpr(i.Left)
-		fmt.Printf("pop %%rbx\n\t")
-		fmt.Printf("%s %%ebx, %%eax\n\t", op)
+// 型の幅に合わせたレジスタのオペランド
+// 8ビットの名前がないレジスタなら、scratchにコピーしてその名前を使う
+func (fr *frame) regName(r Reg, t ir.Type, scratch Reg) Reg {
+	if t == ir.I8 && !fr.arch.hasByteReg(r) {
+		fr.emit("mov", r, scratch)
+		r = scratch
 	}
+	return regName(r, t)
 }
 
-func emitDeclStmt(ds *ast.DeclStatement) {
-	fmt.Printf("mov %%eax, -%d(%%rbp)\n\t", ds.Pos*varWidth)
+// 値が置いてある場所。allocaの結果や定数には場所がない
+func (fr *frame) locOf(v ir.Value) (loc, bool) {
+	r, ok := v.(*ir.Reg)
+	if !ok {
+		return loc{}, false
+	}
+	l, ok := fr.locs[r]
+	return l, ok
 }
 
-// TODO: varに変える
-func emitVar(v *ast.Var) {
-	fmt.Printf("mov %%eax, -%d(%%rbp)\n\t", v.Pos*varWidth)
+// 値をdstに書き込む
+func (fr *frame) move(dst loc, v ir.Value) {
+	switch v := v.(type) {
+	case *ir.Const:
+		if dst.inReg() {
+			fr.emit("mov", Imm(v.Value), dst.reg)
+		} else {
+			fr.emit("movq", Imm(v.Value), mem(dst.off))
+		}
+	case *ir.Global:
+		r := dst.reg
+		if !dst.inReg() {
+			r = "rax"
+		}
+		fr.emit("lea", Mem{Base: rip, Symbol: v.Name}, r)
+		fr.copyLoc(dst, loc{reg: r})
+	case *ir.Reg:
+		if off, ok := fr.allocas[v]; ok {
+			r := dst.reg
+			if !dst.inReg() {
+				r = "rax"
+			}
+			fr.emit("lea", mem(off), r)
+			fr.copyLoc(dst, loc{reg: r})
+			return
+		}
+		fr.copyLoc(dst, fr.locs[v])
+	default:
+		log.Fatal("invalid value:", v)
+	}
 }
 
-// 定義した文字列にデータラベルをつける
-func EmitDataSection(p *parser.Parser) {
-	if len(p.Strs) == 0 {
-		return
+// 場所srcの値をdstにコピーする。メモリどうしは%raxを経由する
+func (fr *frame) copyLoc(dst loc, src loc) {
+	switch {
+	case src == dst:
+	case dst.inReg() && src.inReg():
+		fr.emit("mov", src.reg, dst.reg)
+	case dst.inReg():
+		fr.emit("mov", mem(src.off), dst.reg)
+	case src.inReg():
+		fr.emit("mov", src.reg, mem(dst.off))
+	default:
+		fr.emit("mov", mem(src.off), rax)
+		fr.emit("mov", rax, mem(dst.off))
+	}
+}
+
+// 命令の入力に使えるオペランド。即値、レジスタ、メモリのどれか
+// アドレスはscratchのレジスタに計算する
+func (fr *frame) operand(v ir.Value, t ir.Type, scratch Reg) Operand {
+	if c, ok := v.(*ir.Const); ok {
+		return Imm(c.Value)
+	}
+	if l, ok := fr.locOf(v); ok {
+		if l.inReg() {
+			return fr.regName(l.reg, t, scratch)
+		}
+		return mem(l.off)
+	}
+	fr.move(loc{reg: scratch}, v)
+	return regName(scratch, t)
+}
+
+// レジスタにある値のオペランド。レジスタになければscratchに読み込む
+func (fr *frame) regOperand(v ir.Value, t ir.Type, scratch Reg) Reg {
+	if l, ok := fr.locOf(v); ok && l.inReg() {
+		return fr.regName(l.reg, t, scratch)
 	}
-	for i, str := range p.Strs {
-		fmt.Printf("\t.data\n")
-		fmt.Printf(".s%d:\n\t", i)
-		fmt.Printf(".string \"")
-		fmt.Printf(`%s`, str)
-		fmt.Printf("\"\n")
-	}
-	fmt.Printf("\t")
-}
-
-func EmitStmt(stmt ast.Statement) {
-	switch s := stmt.(type) {
-	case *ast.ExpressionStatement:
-		exp := s.Expression
-		emitExpr(exp)
-	case *ast.DeclStatement:
-		exp := s.Value
-		emitExpr(exp)
-		emitDeclStmt(s)
+	fr.move(loc{reg: scratch}, v)
+	return regName(scratch, t)
+}
+
+// 結果を計算するレジスタ。仮想レジスタがスタックにあれば%raxで計算して、defで書き込む
+func (fr *frame) target(dst *ir.Reg) Reg {
+	if l := fr.locs[dst]; l.inReg() {
+		return l.reg
+	}
+	return "rax"
+}
+
+// レジスタregで計算した結果を、仮想レジスタの場所に書き込む
+func (fr *frame) def(dst *ir.Reg, r Reg) {
+	fr.copyLoc(fr.locs[dst], loc{reg: r})
+}
+
+// アドレスを表すオペランド。allocaした領域なら直接、それ以外はレジスタを経由する
+func (fr *frame) addr(v ir.Value) Operand {
+	if r, ok := v.(*ir.Reg); ok {
+		if off, ok := fr.allocas[r]; ok {
+			return mem(off)
+		}
+	}
+	return Mem{Base: fr.regOperand(v, ir.Ptr, rcx)}
+}
+
+var arith = map[ir.Op]string{
+	ir.OpAdd: "add",
+	ir.OpSub: "sub",
+	ir.OpMul: "imul",
+}
+
+var setcc = map[ir.Op]string{
+	ir.OpEq: "sete",
+	ir.OpNe: "setne",
+	ir.OpLt: "setl",
+	ir.OpLe: "setle",
+	ir.OpGt: "setg",
+	ir.OpGe: "setge",
+}
+
+// メモリに書き込む命令。即値を書き込むときのために幅を明示する
+var movSuffix = map[ir.Type]string{
+	ir.I8:  "movb",
+	ir.I32: "movl",
+	ir.Ptr: "movq",
+}
+
+// 命令を出力する
+// 結果と入力の生存区間は重なるので、結果のレジスタに書き込んでも入力は壊れない
+func (fr *frame) emitInstr(b *ir.Block, instr *ir.Instr) {
+	switch op := instr.Op; {
+	case op == ir.OpAlloca:
+		// 領域はフレームを作るときに確保している
+	case op == ir.OpLoad:
+		src := fr.addr(instr.Args[0])
+		t := fr.target(instr.Dst)
+		switch instr.Type {
+		case ir.I8:
+			fr.emit("movsbl", src, regName(t, ir.I32))
+		default:
+			fr.emit("mov", src, regName(t, instr.Type))
+		}
+		fr.def(instr.Dst, t)
+	case op == ir.OpStore:
+		// メモリからメモリへは書き込めないので、即値でなければレジスタを経由する
+		var v Operand
+		if c, ok := instr.Args[0].(*ir.Const); ok {
+			v = Imm(c.Value)
+		} else {
+			v = fr.regOperand(instr.Args[0], instr.Type, rax)
+		}
+		fr.emit(movSuffix[instr.Type], v, fr.addr(instr.Args[1]))
+	case op == ir.OpDiv:
+		fr.move(loc{reg: "rax"}, instr.Args[0])
+		y := fr.operand(instr.Args[1], instr.Type, "rcx")
+		if _, ok := y.(Imm); ok {
+			fr.move(loc{reg: "rcx"}, instr.Args[1])
+			y = regName("rcx", instr.Type)
+		}
+		fr.emit("cltd")
+		fr.emit("idivl", y)
+		fr.def(instr.Dst, "rax")
+	case op.IsCompare():
+		x := fr.regOperand(instr.Args[0], instr.Type, "rax")
+		y := fr.operand(instr.Args[1], instr.Type, "rcx")
+		t := fr.target(instr.Dst)
+		fr.emit("cmp", y, x)
+		fr.emit(setcc[op], al)
+		fr.emit("movzbl", al, regName(t, ir.I32))
+		fr.def(instr.Dst, t)
+	case op.IsBinary():
+		t := fr.target(instr.Dst)
+		fr.move(loc{reg: t}, instr.Args[0])
+		y := fr.operand(instr.Args[1], instr.Type, "rcx")
+		fr.emit(arith[op], y, regName(t, instr.Type))
+		fr.def(instr.Dst, t)
+	case op == ir.OpSext:
+		t := fr.target(instr.Dst)
+		if _, ok := instr.Args[0].(*ir.Const); ok {
+			fr.move(loc{reg: t}, instr.Args[0])
+		} else {
+			x := fr.operand(instr.Args[0], instr.Type, "rax")
+			switch instr.Type {
+			case ir.I8:
+				fr.emit("movsbl", x, regName(t, ir.I32))
+			case ir.I32:
+				fr.emit("movslq", x, regName(t, ir.Ptr))
+			}
+		}
+		fr.def(instr.Dst, t)
+	case op == ir.OpTrunc, op == ir.OpCopy:
+		// 下位のバイトだけを使うので、値はそのままでよい
+		fr.parallelMove([]move{{fr.locs[instr.Dst], instr.Args[0]}})
+	case op == ir.OpPhi:
+		// 値は飛んでくる前のブロックで書き込んでいる
+	case op == ir.OpCall:
+		fr.emitCall(instr)
+	case op == ir.OpJmp:
+		fr.emitJump(b, instr.Targets[0])
+	case op == ir.OpBr:
+		cond := fr.regOperand(instr.Args[0], instr.Type, "rax")
+		fr.emit("cmp", Imm(0), cond)
+		if len(instr.Targets[1].Phis()) == 0 {
+			fr.emit("je", fr.label(instr.Targets[1]))
+			fr.emitJump(b, instr.Targets[0])
+			break
+		}
+		// phiの値を書き込む処理は、進む先ごとに分ける
+		els := Sym(fmt.Sprintf("%s.else", fr.label(b)))
+		fr.emit("je", els)
+		fr.emitJump(b, instr.Targets[0])
+		fr.emitLabel(els)
+		fr.emitJump(b, instr.Targets[1])
+	case op == ir.OpRet:
+		if len(instr.Args) > 0 {
+			fr.move(loc{reg: "rax"}, instr.Args[0])
+		}
+		for _, s := range fr.saved {
+			fr.emit("mov", mem(s.off), s.reg)
+		}
+		fr.emit("leave")
+		fr.emit("ret")
 	default:
-		log.Fatal("not support statement:", s)
-	}
-}
-
-func emitExpr(node ast.Node) {
-	switch n := node.(type) {
-	case *ast.IntegerLiteral:
-		fmt.Printf("mov $%d, %%eax\n\t", int(n.Value))
-	case *ast.StringLiteral:
-		fmt.Printf("lea .s%d(%%rip), %%rax\n\t", n.ID)
-	case *ast.CharLiteral:
-		fmt.Printf("mov $%d, %%eax\n\t", n.Value)
-	case *ast.Var:
-		emitVar(n)
-	case *ast.InfixExpression:
-		emitBinop(*n)
-	case *ast.FuncallExpression:
-		for i := 1; i < len(n.Args); i++ {
-			fmt.Printf("push %%%s\n\t", regs[i])
-		}
-		for i := 0; i < len(n.Args); i++ {
-			emitExpr(n.Args[i])
-			fmt.Printf("push %%rax\n\t")
-		}
-		for i := len(n.Args) - 1; i >= 0; i-- {
-			fmt.Printf("pop %%%s\n\t", regs[i])
-		}
-		fmt.Printf("mov $0, %%eax\n\t")
-		fmt.Printf("call %s\n\t", n.Function.String())
-		for i := len(n.Args) - 1; i > 0; i-- {
-			fmt.Printf("pop %%%s\n\t", regs[i])
+		log.Fatal("invalid instruction:", instr)
+	}
+}
+
+// 値をdstに書き込む転送
+type move struct {
+	dst loc
+	src ir.Value
+}
+
+// 転送をすべて同時に行う
+// ほかの転送が読む場所には、読み終わってから書き込む。循環していれば1つを作業用のレジスタに退避して輪を切る
+func (fr *frame) parallelMove(moves []move) {
+	pending := []move{}
+	for _, m := range moves {
+		if l, ok := fr.locOf(m.src); ok && l == m.dst {
+			continue
 		}
+		pending = append(pending, m)
+	}
+
+	// 退避した値を読む転送は、この仮想レジスタを読むことにする
+	tmp := &ir.Reg{Ty: ir.Ptr}
+	fr.locs[tmp] = loc{reg: fr.arch.tmp}
+	defer delete(fr.locs, tmp)
+
+	for len(pending) > 0 {
+		ready := -1
+		for i, m := range pending {
+			if !fr.isRead(pending, m.dst) {
+				ready = i
+				break
+			}
+		}
+		if ready < 0 {
+			saved := pending[0].dst
+			fr.copyLoc(loc{reg: fr.arch.tmp}, saved)
+			for i, m := range pending {
+				if l, ok := fr.locOf(m.src); ok && l == saved {
+					pending[i].src = tmp
+				}
+			}
+			continue
+		}
+		fr.move(pending[ready].dst, pending[ready].src)
+		pending = append(pending[:ready], pending[ready+1:]...)
+	}
+}
+
+// 場所lを読む転送があるか
+func (fr *frame) isRead(moves []move, l loc) bool {
+	for _, m := range moves {
+		if src, ok := fr.locOf(m.src); ok && src == l {
+			return true
+		}
+	}
+	return false
+}
+
+// fromからtoに進む。toのphiには、fromから来たときの値を書き込む
+func (fr *frame) emitJump(from *ir.Block, to *ir.Block) {
+	moves := []move{}
+	for _, phi := range to.Phis() {
+		for i, p := range phi.Preds {
+			if p == from {
+				moves = append(moves, move{fr.locs[phi.Dst], phi.Args[i]})
+				break
+			}
+		}
+	}
+	fr.parallelMove(moves)
+	fr.emit("jmp", fr.label(to))
+}
+
+// System V ABIにしたがって関数を呼ぶ。7個目からの引数はスタックに積む
+// 呼び出し元が保存するレジスタは、関数呼び出しをまたいで生きている値には割り当てていない
+func (fr *frame) emitCall(instr *ir.Instr) {
+	regs := fr.arch.argRegs
+	if len(regs) == 0 {
+		fr.emitCdeclCall(instr)
+		return
+	}
+	stack := 0
+	if n := len(instr.Args) - len(regs); n > 0 {
+		stack = n
+		if n%2 == 1 {
+			fr.emit("sub", Imm(8), rsp)
+			stack++
+		}
+		for i := len(instr.Args) - 1; i >= len(regs); i-- {
+			fr.move(loc{reg: "rax"}, instr.Args[i])
+			fr.emit("push", rax)
+		}
+	}
+	moves := []move{}
+	for i := 0; i < len(instr.Args) && i < len(regs); i++ {
+		moves = append(moves, move{loc{reg: regs[i]}, instr.Args[i]})
+	}
+	fr.parallelMove(moves)
+	// 可変長引数の関数には、ベクタレジスタで渡す引数の数を%alで伝える
+	fr.emit("mov", Imm(0), eax)
+	fr.emit("call", Sym(instr.Callee))
+	if stack > 0 {
+		fr.emit("add", Imm(stack*8), rsp)
+	}
+	if instr.Dst != nil {
+		fr.def(instr.Dst, "rax")
+	}
+}
+
+// cdeclにしたがって関数を呼ぶ。引数はすべて後ろから順にスタックに積む
+// 呼び出すときに%espが16バイト境界にそろうように、先に詰め物をする
+func (fr *frame) emitCdeclCall(instr *ir.Instr) {
+	size := len(instr.Args) * fr.arch.wordSize
+	pad := (16 - size%16) % 16
+	if pad > 0 {
+		fr.emit("sub", Imm(pad), rsp)
+	}
+	for i := len(instr.Args) - 1; i >= 0; i-- {
+		if c, ok := instr.Args[i].(*ir.Const); ok {
+			fr.emit("push", Imm(c.Value))
+			continue
+		}
+		fr.move(loc{reg: "rax"}, instr.Args[i])
+		fr.emit("push", rax)
+	}
+	fr.emit("call", Sym(instr.Callee))
+	if size+pad > 0 {
+		fr.emit("add", Imm(size+pad), rsp)
+	}
+	if instr.Dst != nil {
+		fr.def(instr.Dst, "rax")
 	}
 }
@@ -0,0 +1,786 @@
+package asm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kijimaD/gogo/elf"
+	"github.com/kijimaD/gogo/ir"
+	"github.com/kijimaD/gogo/opt"
+	"github.com/stretchr/testify/assert"
+)
+
+// 分岐とphiを含む中間表現をアセンブルして実行する
+func TestEmitModuleRun(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("cc is not found")
+	}
+
+	// 1から10までの和と、2つの変数の値の入れ替えを繰り返した結果
+	// 入れ替えはphiどうしが互いを参照するので、値を書き込む順に気をつける必要がある
+	src := `
+func @mymain() i32 {
+entry:
+	%1 = alloca i32
+	%2 = alloca i32
+	%3 = alloca i32
+	%4 = alloca i32
+	store i32 0, %1
+	store i32 1, %2
+	store i32 2, %3
+	store i32 3, %4
+	jmp loop
+loop:
+	%5 = load i32 %2
+	%6 = load i32 %1
+	%7 = add i32 %6, %5
+	store i32 %7, %1
+	%8 = add i32 %5, 1
+	store i32 %8, %2
+	%9 = load i32 %3
+	%10 = load i32 %4
+	store i32 %10, %3
+	store i32 %9, %4
+	%11 = le i32 %8, 9
+	br i32 %11, loop, done
+done:
+	%12 = load i32 %1
+	%13 = load i32 %3
+	%14 = load i32 %4
+	%15 = mul i32 %12, 100
+	%16 = mul i32 %13, 10
+	%17 = add i32 %15, %16
+	%18 = add i32 %17, %14
+	ret i32 %18
+}
+`
+	for level := 0; level <= 2; level++ {
+		m, err := ir.Parse(src)
+		assert.NoError(t, err)
+		assert.NoError(t, opt.NewManager(level).Run(m))
+		assert.Equal(t, "4532\n", run(t, m), "-O%d", level)
+	}
+}
+
+func run(t *testing.T, m *ir.Module) string {
+	t.Helper()
+	var buf bytes.Buffer
+	assert.NoError(t, NewEmitter(&buf).EmitModule(m))
+
+	dir := t.TempDir()
+	s := filepath.Join(dir, "a.s")
+	exe := filepath.Join(dir, "a")
+	assert.NoError(t, os.WriteFile(s, buf.Bytes(), 0o644))
+	out, err := exec.Command("cc", "-o", exe, s, "../c/driver.c").CombinedOutput()
+	assert.NoError(t, err, string(out))
+	out, err = exec.Command(exe).Output()
+	assert.NoError(t, err)
+	return string(out)
+}
+
+// 同時に生きている値がレジスタより多く、関数呼び出しをまたぐものもある
+const pressure = `
+func @mymain() i32 {
+entry:
+	%1 = call i32 @sum2(i32 1, i32 0)
+	%2 = add i32 %1, 1
+	%3 = add i32 %2, 1
+	%4 = add i32 %3, 1
+	%5 = add i32 %4, 1
+	%6 = add i32 %5, 1
+	%7 = add i32 %6, 1
+	%8 = add i32 %7, 1
+	%9 = add i32 %8, 1
+	%10 = add i32 %9, 1
+	%11 = add i32 %10, 1
+	%12 = add i32 %11, 1
+	%13 = call i32 @sum5(i32 %1, i32 %2, i32 %3, i32 %4, i32 %5)
+	%14 = add i32 %13, %6
+	%15 = add i32 %14, %7
+	%16 = add i32 %15, %8
+	%17 = add i32 %16, %9
+	%18 = add i32 %17, %10
+	%19 = add i32 %18, %11
+	%20 = add i32 %19, %12
+	%21 = call i32 @sum5(i32 %20, i32 0, i32 0, i32 0, i32 %1)
+	ret i32 %21
+}
+`
+
+func TestEmitModuleRunPressure(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("cc is not found")
+	}
+	m, err := ir.Parse(pressure)
+	assert.NoError(t, err)
+	assert.Equal(t, "79\n", run(t, m))
+}
+
+func TestLiveIntervals(t *testing.T) {
+	m, err := ir.Parse(`
+func @f() i32 {
+entry:
+	%1 = alloca i32
+	%2 = call i32 @c()
+	jmp loop
+loop:
+	%3 = phi i32 [0, entry], [%4, loop]
+	%4 = add i32 %3, %2
+	%5 = call i32 @g(i32 %4)
+	br i32 %5, loop, done
+done:
+	ret i32 %4
+}`)
+	assert.NoError(t, err)
+
+	actual := map[int][3]int{}
+	for _, it := range liveIntervals(m.Funcs[0]) {
+		cross := 0
+		if it.crossCall {
+			cross = 1
+		}
+		actual[it.r.ID] = [3]int{it.start, it.end, cross}
+	}
+	assert.Equal(t, map[int][3]int{
+		// allocaの結果は割り当てない
+		2: {2, 12, 1}, // ループの中で使うので、ループの終わりまで生きている
+		3: {6, 8, 0},
+		4: {8, 14, 1},
+		5: {10, 12, 0},
+	}, actual)
+}
+
+func TestLinearScan(t *testing.T) {
+	m, err := ir.Parse(pressure)
+	assert.NoError(t, err)
+	intervals := liveIntervals(m.Funcs[0])
+	linearScan(intervals, amd64)
+
+	regs := map[int]Reg{}
+	spilled := 0
+	for _, it := range intervals {
+		if it.spilled {
+			spilled++
+			assert.Empty(t, it.reg)
+			continue
+		}
+		regs[it.r.ID] = it.reg
+		// 関数呼び出しをまたぐ値は呼び出し先が保存するレジスタに置く
+		if it.crossCall {
+			assert.Contains(t, amd64.calleeSaved, it.reg, "%%%d", it.r.ID)
+		}
+	}
+	assert.Equal(t, 3, spilled) // 2回目の呼び出しをまたぐ8個の値に、呼び出し先が保存するレジスタは5個
+
+	// 同時に生きている値は違うレジスタに置く
+	for _, a := range intervals {
+		for _, b := range intervals {
+			if a != b && !a.spilled && !b.spilled && a.start <= b.end && b.start <= a.end {
+				assert.NotEqual(t, a.reg, b.reg, "%%%d and %%%d", a.r.ID, b.r.ID)
+			}
+		}
+	}
+}
+
+// 1行に1つの命令を書いたテキストを読む
+func parseCode(src string) []*Instr {
+	code := []*Instr{}
+	for _, line := range strings.Split(strings.TrimSpace(src), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasSuffix(line, ":"):
+			code = append(code, &Instr{Kind: KindLabel, Op: strings.TrimSuffix(line, ":")})
+		default:
+			op, args, _ := strings.Cut(line, " ")
+			i := &Instr{Kind: KindInstr, Op: op}
+			if strings.HasPrefix(op, ".") {
+				i.Kind = KindDirective
+			}
+			if args != "" {
+				for _, a := range strings.Split(args, ", ") {
+					i.Args = append(i.Args, parseOperand(a))
+				}
+			}
+			code = append(code, i)
+		}
+	}
+	return code
+}
+
+func parseOperand(s string) Operand {
+	switch {
+	case strings.HasPrefix(s, "%"):
+		return Reg(s[1:])
+	case strings.HasPrefix(s, "$"):
+		v, _ := strconv.Atoi(s[1:])
+		return Imm(v)
+	case strings.HasSuffix(s, "(%rbp)"):
+		v, _ := strconv.Atoi(strings.TrimSuffix(s, "(%rbp)"))
+		return mem(v)
+	default:
+		return Sym(s)
+	}
+}
+
+func TestPeephole(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		expect string
+	}{
+		{
+			"同じレジスタへのmov",
+			"mov %rdi, %rdi\nmov %edi, %edi",
+			"mov %edi, %edi",
+		},
+		{
+			"pushしてすぐpop",
+			"push %rax\npop %rax\npush %rax\npop %rcx",
+			"mov %rax, %rcx",
+		},
+		{
+			"書き込んだ値をすぐ読み戻す",
+			"movl %edi, -16(%rbp)\nmov -16(%rbp), %edi\nmov %rsi, %rdi\nmov %rdi, %rsi",
+			"movl %edi, -16(%rbp)\nmov %rsi, %rdi",
+		},
+		{
+			"次の命令へのジャンプ",
+			"jmp .L1\n.L1:\nje .L2\n.L2:\nret",
+			".L1:\n.L2:\nret",
+		},
+		{
+			"条件を反転してジャンプを減らす",
+			"cmp $0, %edi\nje .L1\njmp .L2\n.L1:\nret",
+			"cmp $0, %edi\njne .L2\n.L1:\nret",
+		},
+		{
+			"2のべき乗の乗算はシフト",
+			"imul $8, %esi\nimul $1, %esi\nadd $0, %esi\nimul $6, %esi",
+			"shl $3, %esi\nimul $6, %esi",
+		},
+		{
+			"2のべき乗の除算はシフト",
+			"mov $4, %rcx\ncltd\nidivl %ecx\nmov $1, %rcx\ncltd\nidivl %ecx\nmov $3, %rcx\ncltd\nidivl %ecx",
+			"cltd\nand $3, %edx\nadd %edx, %eax\nsar $2, %eax\nmov $3, %rcx\ncltd\nidivl %ecx",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, format(parseCode(tt.expect)), format(Peephole(parseCode(tt.input))))
+		})
+	}
+}
+
+// 置き換えるたびに先頭から見直すと、命令の数の2乗に比例して遅くなる
+func TestPeepholeLarge(t *testing.T) {
+	var src strings.Builder
+	src.WriteString("func @mymain() i32 {\nentry:\n\t%1 = call i32 @sum2(i32 1, i32 2)\n")
+	for i := 2; i <= 20000; i++ {
+		fmt.Fprintf(&src, "\t%%%d = div i32 %%1, 8\n", i)
+	}
+	src.WriteString("\tret i32 %1\n}")
+	m, err := ir.Parse(src.String())
+	assert.NoError(t, err)
+
+	start := time.Now()
+	code := Compile(m)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	// 割り算はすべてシフトになる
+	for _, instr := range code {
+		assert.NotEqual(t, "idivl", instr.Op)
+	}
+}
+
+func format(code []*Instr) string {
+	var buf bytes.Buffer
+	_ = NewEmitter(&buf).Emit(code)
+	return buf.String()
+}
+
+// 2のべき乗で割った結果が、負の数でも0の方向に切り捨てられる
+func TestEmitModuleRunDivision(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("cc is not found")
+	}
+	m, err := ir.Parse(`
+func @mymain() i32 {
+entry:
+	%1 = call i32 @sum2(i32 -7, i32 0)
+	%2 = div i32 %1, 4
+	%3 = mul i32 %2, 1000
+	%4 = div i32 %1, 1
+	%5 = mul i32 %4, 8
+	%6 = add i32 %3, %5
+	ret i32 %6
+}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "-1056\n", run(t, m))
+}
+
+// 出力先ごとにEmitterを作れば、複数のモジュールを同時に出力できる
+func TestEmitterConcurrent(t *testing.T) {
+	srcs := []string{pressure, "func @mymain() i32 {\nentry:\n\tret i32 1\n}"}
+	expect := make([]string, len(srcs))
+	for i, src := range srcs {
+		m, err := ir.Parse(src)
+		assert.NoError(t, err)
+		var buf bytes.Buffer
+		assert.NoError(t, NewEmitter(&buf).EmitModule(m))
+		expect[i] = buf.String()
+	}
+
+	var wg sync.WaitGroup
+	actual := make([]string, 10)
+	for i := range actual {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m, _ := ir.Parse(srcs[i%len(srcs)])
+			var buf bytes.Buffer
+			_ = NewEmitter(&buf).EmitModule(m)
+			actual[i] = buf.String()
+		}(i)
+	}
+	wg.Wait()
+	for i, a := range actual {
+		assert.Equal(t, expect[i%len(srcs)], a)
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestEmitterError(t *testing.T) {
+	m, err := ir.Parse(pressure)
+	assert.NoError(t, err)
+	assert.EqualError(t, NewEmitter(errWriter{}).EmitModule(m), "disk full")
+}
+
+// 引数はスタックに積み、ラベルは絶対アドレスで指す
+func TestCompileI386(t *testing.T) {
+	m, err := ir.Parse(`data @.s0 = "%d"
+
+func @mymain() i32 {
+entry:
+	%1 = alloca i8
+	store i8 7, %1
+	%2 = load i8 %1
+	%3 = sext i8 %2 to i32
+	%4 = call i32 @printf(ptr @.s0, i32 %3)
+	ret i32 %4
+}`)
+	assert.NoError(t, err)
+	expect := `	.data
+.s0:
+	.string "%d"
+	.text
+	.global mymain
+mymain:
+	push %ebp
+	mov %esp, %ebp
+	sub $24, %esp
+	mov %ebx, -8(%ebp)
+	mov %esi, -12(%ebp)
+	movb $7, -4(%ebp)
+	movsbl -4(%ebp), %ebx
+	movsbl %bl, %esi
+	sub $8, %esp
+	mov %esi, %eax
+	push %eax
+	lea .s0, %eax
+	push %eax
+	call printf
+	add $16, %esp
+	mov %eax, %ebx
+	mov -8(%ebp), %ebx
+	mov -12(%ebp), %esi
+	leave
+	ret
+`
+	assert.Equal(t, expect, format(CompileI386(m)))
+}
+
+// cdeclで関数を呼ぶ。libcを使わずに、mymainの値を終了コードにする
+const start32 = `
+	.text
+	.global _start
+_start:
+	call mymain
+	mov %eax, %ebx
+	mov $1, %eax
+	int $0x80
+	.global sum2
+sum2:
+	mov 4(%esp), %eax
+	add 8(%esp), %eax
+	ret
+	.global sum5
+sum5:
+	mov 4(%esp), %eax
+	add 8(%esp), %eax
+	add 12(%esp), %eax
+	add 16(%esp), %eax
+	add 20(%esp), %eax
+	ret
+`
+
+// 32ビットのx86のコードをアセンブルして、Linuxの上で直接動かす
+func TestCompileI386Run(t *testing.T) {
+	for _, tool := range []string{"as", "ld"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " is not found")
+		}
+	}
+	dir := t.TempDir()
+	assemble := func(name string, code string) string {
+		s := filepath.Join(dir, name+".s")
+		o := filepath.Join(dir, name+".o")
+		assert.NoError(t, os.WriteFile(s, []byte(code), 0o644))
+		out, err := exec.Command("as", "--32", "-o", o, s).CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return o
+	}
+	start := assemble("start", start32)
+
+	// 結果は終了コードになるので、下位8ビットだけを比べる
+	tests := []struct {
+		src    string
+		expect int
+	}{
+		{pressure, 79},
+		{`
+func @mymain() i32 {
+entry:
+	%1 = call i32 @sum2(i32 -7, i32 0)
+	%2 = div i32 %1, 4
+	%3 = trunc i32 %1 to i8
+	%4 = sext i8 %3 to i32
+	%5 = mul i32 %4, %2
+	ret i32 %5
+}`, 7},
+		// %esiと%ediには8ビットの名前がない
+		{`
+func @mymain() i32 {
+entry:
+	%1 = alloca i8
+	%2 = alloca i8
+	%3 = alloca i8
+	%4 = call i32 @sum2(i32 1, i32 2)
+	%5 = trunc i32 %4 to i8
+	%6 = add i32 %4, 1
+	%7 = trunc i32 %6 to i8
+	%8 = add i32 %4, 2
+	%9 = trunc i32 %8 to i8
+	store i8 %5, %1
+	store i8 %7, %2
+	store i8 %9, %3
+	%10 = load i8 %1
+	%11 = load i8 %2
+	%12 = load i8 %3
+	%13 = sext i8 %10 to i32
+	%14 = sext i8 %11 to i32
+	%15 = sext i8 %12 to i32
+	%16 = call i32 @sum5(i32 %13, i32 %14, i32 %15, i32 0, i32 0)
+	ret i32 %16
+}`, 12},
+	}
+	for i, tt := range tests {
+		for level := 0; level <= 2; level++ {
+			m, err := ir.Parse(tt.src)
+			assert.NoError(t, err)
+			assert.NoError(t, opt.NewManager(level).Run(m))
+			name := "a" + strconv.Itoa(i)
+			obj := assemble(name, format(CompileI386(m)))
+			exe := filepath.Join(dir, name)
+			out, err := exec.Command("ld", "-m", "elf_i386", "-o", exe, start, obj).CombinedOutput()
+			assert.NoError(t, err, string(out))
+			err = exec.Command(exe).Run()
+			var exit *exec.ExitError
+			if errors.As(err, &exit) {
+				assert.Equal(t, tt.expect, exit.ExitCode(), "%d: -O%d", i, level)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expect, 0, "%d: -O%d", i, level)
+			}
+		}
+	}
+}
+
+func TestIntel(t *testing.T) {
+	tests := []struct {
+		instr  *Instr
+		expect string
+	}{
+		{instr("mov", Imm(1), eax), "\tmov eax, 1"},
+		{instr("movl", Imm(1), mem(-8)), "\tmov DWORD PTR [rbp-8], 1"},
+		{instr("movb", al, Mem{Base: rcx}), "\tmov BYTE PTR [rcx], al"},
+		{instr("movq", rax, Mem{Base: rbp, Offset: 16}), "\tmov QWORD PTR [rbp+16], rax"},
+		{instr("mov", mem(-8), eax), "\tmov eax, [rbp-8]"},
+		{instr("movsbl", mem(-8), eax), "\tmovsx eax, BYTE PTR [rbp-8]"},
+		{instr("movslq", mem(-8), rax), "\tmovsxd rax, DWORD PTR [rbp-8]"},
+		{instr("movzbl", al, eax), "\tmovzx eax, al"},
+		{instr("lea", Mem{Base: rip, Symbol: ".s0"}, rax), "\tlea rax, [rip+.s0]"},
+		{instr("lea", Mem{Symbol: ".s0"}, eax), "\tlea eax, [.s0]"},
+		{instr("idivl", mem(-8)), "\tidiv DWORD PTR [rbp-8]"},
+		{instr("cltd"), "\tcdq"},
+		{instr("call", Sym("printf")), "\tcall printf"},
+		{&Instr{Kind: KindLabel, Op: "mymain"}, "mymain:"},
+		{&Instr{Kind: KindDirective, Op: ".string", Args: []Operand{Str(`%d\n`)}}, "\t.string \"%d\\n\""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expect, tt.instr.Intel(), tt.instr.String())
+	}
+}
+
+// Intel記法でもAT&T記法でも、同じ機械語になる
+func TestEmitModuleIntel(t *testing.T) {
+	for _, tool := range []string{"as", "objcopy"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " is not found")
+		}
+	}
+	dir := t.TempDir()
+	text := func(name string, code []*Instr, syntax Syntax, flags ...string) []byte {
+		var buf bytes.Buffer
+		e := NewEmitter(&buf)
+		e.Syntax = syntax
+		assert.NoError(t, e.Emit(code))
+		s := filepath.Join(dir, name+".s")
+		o := filepath.Join(dir, name+".o")
+		bin := filepath.Join(dir, name+".bin")
+		assert.NoError(t, os.WriteFile(s, buf.Bytes(), 0o644))
+		out, err := exec.Command("as", append(flags, "-o", o, s)...).CombinedOutput()
+		assert.NoError(t, err, string(out))
+		out, err = exec.Command("objcopy", "-O", "binary", "-j", ".text", o, bin).CombinedOutput()
+		assert.NoError(t, err, string(out))
+		b, err := os.ReadFile(bin)
+		assert.NoError(t, err)
+		return b
+	}
+
+	srcs := []string{pressure, `data @.s0 = "%d"
+
+func @mymain() i32 {
+entry:
+	%1 = alloca i8
+	%2 = alloca ptr
+	store i8 7, %1
+	store ptr @.s0, %2
+	%3 = load i8 %1
+	%4 = sext i8 %3 to i32
+	%5 = sext i32 %4 to ptr
+	store ptr %5, %2
+	%6 = call i32 @sum2(i32 -7, i32 0)
+	%7 = div i32 %6, 4
+	%8 = div i32 %6, %4
+	%9 = lt i32 %7, %8
+	br i32 %9, a, b
+a:
+	%10 = call i32 @printf(ptr @.s0, i32 %9)
+	ret i32 %10
+b:
+	ret i32 %7
+}`}
+	for _, src := range srcs {
+		m, err := ir.Parse(src)
+		assert.NoError(t, err)
+		code := Compile(m)
+		assert.Equal(t, text("att", code, SyntaxATT), text("intel", code, SyntaxIntel))
+		code = CompileI386(m)
+		assert.Equal(t, text("att32", code, SyntaxATT, "--32"), text("intel32", code, SyntaxIntel, "--32"))
+	}
+}
+
+// asが出力するものと同じ機械語になる
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		instr  *Instr
+		expect string
+	}{
+		{instr("push", rbp), "55"},
+		{instr("push", Reg("r12")), "41 54"},
+		{instr("mov", rsp, rbp), "48 89 e5"},
+		{instr("sub", Imm(16), rsp), "48 83 ec 10"},
+		{instr("sub", Imm(1024), rsp), "48 81 ec 00 04 00 00"},
+		{instr("mov", Reg("rbx"), mem(-8)), "48 89 5d f8"},
+		{instr("mov", mem(-8), Reg("r12")), "4c 8b 65 f8"},
+		{instr("mov", Reg("r13d"), eax), "44 89 e8"},
+		{instr("movl", Imm(1), mem(-8)), "c7 45 f8 01 00 00 00"},
+		{instr("movl", Imm(3000000000), mem(-8)), "c7 45 f8 00 5e d0 b2"},
+		{instr("movq", Imm(-1), mem(-16)), "48 c7 45 f0 ff ff ff ff"},
+		{instr("movb", Imm(7), Mem{Base: rcx}), "c6 01 07"},
+		{instr("movb", Reg("sil"), Mem{Base: rcx}), "40 88 31"},
+		{instr("movb", al, mem(-300)), "88 85 d4 fe ff ff"},
+		{instr("mov", Mem{Base: rsp}, eax), "8b 04 24"},
+		{instr("mov", Mem{Base: "r12", Offset: 8}, eax), "41 8b 44 24 08"},
+		{instr("mov", Imm(5), eax), "b8 05 00 00 00"},
+		{instr("mov", Imm(5), Reg("r9d")), "41 b9 05 00 00 00"},
+		{instr("movsbl", mem(-8), eax), "0f be 45 f8"},
+		{instr("movsbl", Reg("dil"), Reg("esi")), "40 0f be f7"},
+		{instr("movzbl", al, eax), "0f b6 c0"},
+		{instr("movslq", eax, rax), "48 63 c0"},
+		{instr("lea", Mem{Base: rip, Symbol: ".s0"}, Reg("rdi")), "48 8d 3d 00 00 00 00"},
+		{instr("add", Imm(2), Reg("esi")), "83 c6 02"},
+		{instr("add", Reg("r8d"), Reg("esi")), "44 01 c6"},
+		{instr("add", mem(-8), eax), "03 45 f8"},
+		{instr("sub", ecx, eax), "29 c8"},
+		{instr("and", Imm(3), edx), "83 e2 03"},
+		{instr("cmp", Imm(0), eax), "83 f8 00"},
+		{instr("cmp", ecx, eax), "39 c8"},
+		{instr("imul", Imm(6), Reg("esi")), "6b f6 06"},
+		{instr("imul", Imm(1000), Reg("esi")), "69 f6 e8 03 00 00"},
+		{instr("imul", ecx, eax), "0f af c1"},
+		{instr("shl", Imm(3), eax), "c1 e0 03"},
+		{instr("sar", Imm(2), eax), "c1 f8 02"},
+		{instr("cltd"), "99"},
+		{instr("idivl", ecx), "f7 f9"},
+		{instr("idivl", mem(-8)), "f7 7d f8"},
+		{instr("sete", al), "0f 94 c0"},
+		{instr("setge", al), "0f 9d c0"},
+		{instr("push", Imm(4)), "6a 04"},
+		{instr("leave"), "c9"},
+		{instr("ret"), "c3"},
+		{instr("syscall"), "0f 05"},
+		{instr("pop", Reg("r13")), "41 5d"},
+		{instr("neg", rax), "48 f7 d8"},
+		{instr("div", rcx), "48 f7 f1"},
+		// 8ビットの演算はバイトのオペコードを使う
+		{instr("cmp", Reg("cl"), al), "38 c8"},
+		{instr("add", Reg("cl"), al), "00 c8"},
+		{instr("sub", Reg("sil"), Reg("dil")), "40 28 f7"},
+		{instr("add", mem(-8), Reg("r8b")), "44 02 45 f8"},
+		{instr("and", Imm(200), Reg("cl")), "80 e1 c8"},
+		{instr("cmp", Imm(-1), Reg("dl")), "80 fa ff"},
+		{instr("shl", Imm(3), al), "c0 e0 03"},
+		{instr("sar", Imm(2), Reg("sil")), "40 c0 fe 02"},
+		{instr("neg", al), "f6 d8"},
+		{instr("neg", Reg("dil")), "40 f6 df"},
+	}
+	for _, tt := range tests {
+		f, err := Assemble([]*Instr{tt.instr})
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expect, fmt.Sprintf("% x", f.Section(".text").Data), tt.instr.String())
+	}
+}
+
+// ジャンプ先はラベルから、データと関数は再配置で決める
+func TestAssembleRelocs(t *testing.T) {
+	code := []*Instr{
+		{Kind: KindDirective, Op: ".data"},
+		{Kind: KindLabel, Op: ".s0"},
+		{Kind: KindDirective, Op: ".string", Args: []Operand{Str(`a\n`)}},
+		{Kind: KindDirective, Op: ".text"},
+		{Kind: KindDirective, Op: ".global", Args: []Operand{Sym("f")}},
+		{Kind: KindLabel, Op: "f"},
+		instr("jmp", Sym(".L1")),
+		{Kind: KindLabel, Op: ".L1"},
+		instr("lea", Mem{Base: rip, Symbol: ".s0"}, Reg("rdi")),
+		instr("call", Sym("printf")),
+		instr("je", Sym(".L1")),
+		instr("call", Sym(".L1")),
+	}
+	f, err := Assemble(code)
+	assert.NoError(t, err)
+	assert.Equal(t, "a\n\x00", string(f.Section(".data").Data))
+	assert.Equal(t, "e9 00 00 00 00 48 8d 3d 00 00 00 00 e8 00 00 00 00 0f 84 ee ff ff ff e8 e9 ff ff ff", fmt.Sprintf("% x", f.Section(".text").Data))
+
+	text := f.Section(".text")
+	assert.Equal(t, []elf.Reloc{
+		{Offset: 8, Symbol: f.Symbol(".s0"), Type: elf.RelocPC32, Addend: -4},
+		{Offset: 13, Symbol: f.Symbol("printf"), Type: elf.RelocPLT32, Addend: -4},
+	}, text.Relocs)
+	assert.Equal(t, &elf.Symbol{Name: "f", Section: text, Global: true}, f.Symbol("f"))
+	assert.Nil(t, f.Symbol("printf").Section)
+	// .Lで始まるラベルはシンボルにしない
+	for _, s := range f.Symbols {
+		assert.NotEqual(t, ".L1", s.Name)
+	}
+}
+
+func TestAssembleError(t *testing.T) {
+	tests := []struct {
+		code   []*Instr
+		expect string
+	}{
+		{[]*Instr{instr("jmp", Sym(".L1"))}, "undefined label .L1"},
+		{[]*Instr{instr("cpuid")}, "cpuid: unknown instruction"},
+		{[]*Instr{instr("mov", eax, rax)}, "mov %eax, %rax: operand size mismatch"},
+		{[]*Instr{instr("add", Imm(1), mem(-8))}, "add $1, -8(%rbp): ambiguous operand size"},
+		{[]*Instr{instr("movl", Imm(1<<32), mem(-8))}, "movl $4294967296, -8(%rbp): immediate out of range"},
+		{[]*Instr{instr("movq", Imm(3000000000), mem(-8))}, "movq $3000000000, -8(%rbp): immediate out of range"},
+		{[]*Instr{instr("imul", Imm(3), al)}, "imul $3, %al: unsupported operand size"},
+		{[]*Instr{instr("add", Imm(256), al)}, "add $256, %al: immediate out of range"},
+		{[]*Instr{instr("lea", Mem{Symbol: ".s0"}, eax)}, "lea .s0, %eax: invalid operand"},
+		{[]*Instr{{Kind: KindLabel, Op: "f"}, {Kind: KindLabel, Op: "f"}}, "f:: label f is already defined"},
+		{[]*Instr{{Kind: KindDirective, Op: ".global", Args: []Operand{Sym("f")}}}, "undefined global symbol f"},
+	}
+	for _, tt := range tests {
+		_, err := Assemble(tt.code)
+		assert.EqualError(t, err, tt.expect)
+	}
+}
+
+// 32ビットに収まる範囲の端の即値も、asと同じ機械語にする
+func TestAssembleImmAS(t *testing.T) {
+	for _, tool := range []string{"as", "objcopy"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " is not found")
+		}
+	}
+	code := []*Instr{
+		instr("movl", Imm(3000000000), mem(-8)),
+		instr("movl", Imm(-1<<31), mem(-8)),
+		instr("movl", Imm(1<<32-1), mem(-8)),
+		instr("movq", Imm(-1<<31), mem(-16)),
+		instr("mov", Imm(3000000000), eax),
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, NewEmitter(&buf).Emit(code))
+	dir := t.TempDir()
+	s := filepath.Join(dir, "a.s")
+	o := filepath.Join(dir, "a.o")
+	bin := filepath.Join(dir, "a.bin")
+	assert.NoError(t, os.WriteFile(s, buf.Bytes(), 0o644))
+	out, err := exec.Command("as", "-o", o, s).CombinedOutput()
+	assert.NoError(t, err, string(out))
+	out, err = exec.Command("objcopy", "-O", "binary", "-j", ".text", o, bin).CombinedOutput()
+	assert.NoError(t, err, string(out))
+	expect, err := os.ReadFile(bin)
+	assert.NoError(t, err)
+
+	f, err := Assemble(code)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("% x", expect), fmt.Sprintf("% x", f.Section(".text").Data))
+}
+
+// 組み込みのアセンブラで作ったオブジェクトファイルをリンクして実行する
+func TestAssembleRun(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("cc is not found")
+	}
+	m, err := ir.Parse(pressure)
+	assert.NoError(t, err)
+	f, err := Assemble(Compile(m))
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	obj := filepath.Join(dir, "a.o")
+	exe := filepath.Join(dir, "a")
+	assert.NoError(t, os.WriteFile(obj, f.Bytes(), 0o644))
+	out, err := exec.Command("cc", "-o", exe, obj, "../c/driver.c").CombinedOutput()
+	assert.NoError(t, err, string(out))
+	out, err = exec.Command(exe).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "79\n", string(out))
+}
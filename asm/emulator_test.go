@@ -0,0 +1,591 @@
+package asm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/kijimaD/gogo/constant"
+	"github.com/kijimaD/gogo/ir"
+	"github.com/kijimaD/gogo/opt"
+	"github.com/stretchr/testify/assert"
+)
+
+// テストのためのx86-64のエミュレータ
+// Compileが出力する命令の列を、機械語にせずにそのまま実行する。ccがなくてもコード生成を確かめられる
+// printf、sum2、sum5はGoで書いたものを呼ぶ。呼んだあとは、呼び出し元が保存するレジスタを壊しておく
+type emulator struct {
+	code       []*Instr
+	labels     map[string]int    // 命令の列の中のラベルの位置
+	syms       map[string]uint64 // データのラベルのアドレス
+	regs       [16]uint64        // regInfosの番号の順
+	zf, sf, of bool
+	mem        []byte
+	pc         int
+	out        bytes.Buffer // printfの出力
+}
+
+const (
+	memSize  = 1 << 20
+	dataBase = 0x1000         // データを置き始めるアドレス。スタックはメモリの最後から使う
+	halt     = ^uint64(0)     // 最初の関数の戻り番地。ここに戻れば実行を終える
+	garbage  = 0xdeadbeefcafe // 呼び出しで壊れたレジスタの値
+	maxSteps = 1000000
+)
+
+func newEmulator(code []*Instr) *emulator {
+	e := &emulator{code: code, labels: map[string]int{}, syms: map[string]uint64{}, mem: make([]byte, memSize)}
+	text := true
+	next := uint64(dataBase)
+	for i, instr := range code {
+		switch instr.Kind {
+		case KindDirective:
+			switch instr.Op {
+			case ".text":
+				text = true
+			case ".data", ".section":
+				text = false
+			case ".string":
+				b, err := constant.Unquote(string(instr.Args[0].(Str)))
+				if err != nil {
+					panic(err)
+				}
+				next += uint64(copy(e.mem[next:], append(b, 0)))
+			}
+		case KindLabel:
+			if text {
+				e.labels[instr.Op] = i
+			} else {
+				e.syms[instr.Op] = next
+			}
+		}
+	}
+	return e
+}
+
+// 関数を呼んで、%eaxに返した値を返す
+func (e *emulator) call(name string) (int32, error) {
+	pc, ok := e.labels[name]
+	if !ok {
+		return 0, fmt.Errorf("undefined function %s", name)
+	}
+	e.regs[regInfos[rsp].num] = memSize
+	e.regs[regInfos[rbp].num] = garbage
+	if err := e.push(halt); err != nil {
+		return 0, err
+	}
+	e.pc = pc
+	for steps := 0; ; steps++ {
+		if steps == maxSteps {
+			return 0, fmt.Errorf("too many steps")
+		}
+		if e.pc >= len(e.code) {
+			return 0, fmt.Errorf("ran past the end of the code")
+		}
+		instr := e.code[e.pc]
+		e.pc++
+		if instr.Kind != KindInstr {
+			continue
+		}
+		done, err := e.step(instr)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", instr, err)
+		}
+		if done {
+			return int32(e.regs[regInfos[rax].num]), nil
+		}
+	}
+}
+
+// 1命令を実行する。最初の関数から戻ればtrueを返す
+func (e *emulator) step(i *Instr) (bool, error) {
+	args := i.Args
+	switch i.Op {
+	case "mov", "movb", "movl", "movq":
+		size, err := operandSize(0, args...)
+		if i.Op != "mov" {
+			size, err = operandSize(i.Op[len(i.Op)-1], args...)
+		}
+		if err != nil {
+			return false, err
+		}
+		v, err := e.read(args[0], size)
+		if err != nil {
+			return false, err
+		}
+		return false, e.write(args[1], size, v)
+	case "movsbl", "movzbl", "movslq":
+		from, to := 8, 32
+		if i.Op == "movslq" {
+			from, to = 32, 64
+		}
+		v, err := e.read(args[0], from)
+		if err != nil {
+			return false, err
+		}
+		if i.Op != "movzbl" {
+			v = uint64(signExtend(v, from))
+		}
+		return false, e.write(args[1], to, v)
+	case "lea":
+		m, ok := args[0].(Mem)
+		if !ok {
+			return false, fmt.Errorf("invalid operand")
+		}
+		a, err := e.addr(m)
+		if err != nil {
+			return false, err
+		}
+		return false, e.write(args[1], 64, a)
+	case "add", "sub", "cmp", "and", "imul", "shl", "sar":
+		return false, e.binary(i.Op, args[0], args[1])
+	case "neg":
+		size, err := operandSize(0, args[0])
+		if err != nil {
+			return false, err
+		}
+		v, err := e.read(args[0], size)
+		if err != nil {
+			return false, err
+		}
+		return false, e.write(args[0], size, -v)
+	case "cltd":
+		v := uint64(0)
+		if int32(e.regs[regInfos[eax].num]) < 0 {
+			v = 0xffffffff
+		}
+		return false, e.write(edx, 32, v)
+	case "idivl":
+		d, err := e.read(args[0], 32)
+		if err != nil {
+			return false, err
+		}
+		x := int64(e.regs[regInfos[edx].num]<<32 | e.regs[regInfos[eax].num]&0xffffffff)
+		y := int64(int32(d))
+		if y == 0 || x/y != int64(int32(x/y)) {
+			return false, fmt.Errorf("division error")
+		}
+		if err := e.write(eax, 32, uint64(x/y)); err != nil {
+			return false, err
+		}
+		return false, e.write(edx, 32, uint64(x%y))
+	case "sete", "setne", "setl", "setle", "setg", "setge":
+		v := uint64(0)
+		if e.cond(i.Op[3:]) {
+			v = 1
+		}
+		return false, e.write(args[0], 8, v)
+	case "jmp", "je", "jne", "jl", "jle", "jg", "jge":
+		if i.Op != "jmp" && !e.cond(i.Op[1:]) {
+			return false, nil
+		}
+		pc, ok := e.labels[string(args[0].(Sym))]
+		if !ok {
+			return false, fmt.Errorf("undefined label")
+		}
+		e.pc = pc
+		return false, nil
+	case "push":
+		v, err := e.read(args[0], 64)
+		if err != nil {
+			return false, err
+		}
+		return false, e.push(v)
+	case "pop":
+		v, err := e.pop()
+		if err != nil {
+			return false, err
+		}
+		return false, e.write(args[0], 64, v)
+	case "call":
+		// System V ABIでは、呼び出す時点で%rspが16バイト境界にそろっていなければならない
+		if e.regs[regInfos[rsp].num]%16 != 0 {
+			return false, fmt.Errorf("misaligned stack")
+		}
+		name := string(args[0].(Sym))
+		if pc, ok := e.labels[name]; ok {
+			if err := e.push(uint64(e.pc)); err != nil {
+				return false, err
+			}
+			e.pc = pc
+			return false, nil
+		}
+		return false, e.callStub(name)
+	case "leave":
+		e.regs[regInfos[rsp].num] = e.regs[regInfos[rbp].num]
+		v, err := e.pop()
+		e.regs[regInfos[rbp].num] = v
+		return false, err
+	case "ret":
+		v, err := e.pop()
+		if err != nil || v == halt {
+			return v == halt, err
+		}
+		e.pc = int(v)
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown instruction")
+}
+
+// 2オペランドの演算。フラグは比較とジャンプに使う分だけ更新する
+func (e *emulator) binary(op string, src Operand, dst Operand) error {
+	size, err := operandSize(0, src, dst)
+	if op == "shl" || op == "sar" {
+		size, err = operandSize(0, dst)
+	}
+	if err != nil {
+		return err
+	}
+	x, err := e.read(dst, size)
+	if err != nil {
+		return err
+	}
+	y, err := e.read(src, size)
+	if err != nil {
+		return err
+	}
+	var r uint64
+	switch op {
+	case "add":
+		r = x + y
+		e.of = sign(x, size) == sign(y, size) && sign(r, size) != sign(x, size)
+	case "sub", "cmp":
+		r = x - y
+		e.of = sign(x, size) != sign(y, size) && sign(r, size) != sign(x, size)
+	case "and":
+		r = x & y
+		e.of = false
+	case "imul":
+		r = uint64(signExtend(x, size) * signExtend(y, size))
+	case "shl":
+		r = x << (y % uint64(size))
+	case "sar":
+		r = uint64(signExtend(x, size) >> (y % uint64(size)))
+	}
+	r &= mask(size)
+	e.zf = r == 0
+	e.sf = sign(r, size)
+	if op == "cmp" {
+		return nil
+	}
+	return e.write(dst, size, r)
+}
+
+// 条件。jccとsetccの接尾辞
+func (e *emulator) cond(cc string) bool {
+	switch cc {
+	case "e":
+		return e.zf
+	case "ne":
+		return !e.zf
+	case "l":
+		return e.sf != e.of
+	case "ge":
+		return e.sf == e.of
+	case "le":
+		return e.zf || e.sf != e.of
+	default:
+		return !e.zf && e.sf == e.of
+	}
+}
+
+// Goで書いた関数を呼ぶ
+func (e *emulator) callStub(name string) error {
+	arg := func(i int) uint64 {
+		regs := amd64.argRegs
+		if i < len(regs) {
+			return e.regs[regInfos[regs[i]].num]
+		}
+		// 7個目からはスタックに積まれている。戻り番地は積んでいない
+		b, _ := e.load(e.regs[regInfos[rsp].num]+uint64(8*(i-len(regs))), 64)
+		return b
+	}
+	var ret int32
+	switch name {
+	case "sum2":
+		ret = int32(arg(0)) + int32(arg(1))
+	case "sum5":
+		ret = int32(arg(0)) + int32(arg(1)) + int32(arg(2)) + int32(arg(3)) + int32(arg(4))
+	case "printf":
+		s, err := e.printf(e.cstring(arg(0)), func(i int) uint64 { return arg(i + 1) })
+		if err != nil {
+			return err
+		}
+		n, _ := e.out.WriteString(s)
+		ret = int32(n)
+	default:
+		return fmt.Errorf("undefined function %s", name)
+	}
+	for _, r := range amd64.callerSaved {
+		e.regs[regInfos[r].num] = garbage
+	}
+	e.regs[regInfos[rax].num] = uint64(uint32(ret))
+	return nil
+}
+
+// %d、%s、%c、%%だけを扱う
+func (e *emulator) printf(format string, arg func(int) uint64) (string, error) {
+	var b bytes.Buffer
+	n := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'd':
+			fmt.Fprintf(&b, "%d", int32(arg(n)))
+		case 's':
+			b.WriteString(e.cstring(arg(n)))
+		case 'c':
+			b.WriteByte(byte(arg(n)))
+		case '%':
+			b.WriteByte('%')
+			continue
+		default:
+			return "", fmt.Errorf("unsupported conversion %%%c", format[i])
+		}
+		n++
+	}
+	return b.String(), nil
+}
+
+func (e *emulator) cstring(addr uint64) string {
+	end := addr
+	for end < memSize && e.mem[end] != 0 {
+		end++
+	}
+	if addr >= end {
+		return ""
+	}
+	return string(e.mem[addr:end])
+}
+
+func (e *emulator) addr(m Mem) (uint64, error) {
+	if m.Base == rip {
+		a, ok := e.syms[m.Symbol]
+		if !ok {
+			return 0, fmt.Errorf("undefined symbol %s", m.Symbol)
+		}
+		return a + uint64(m.Offset), nil
+	}
+	info, ok := reg(m.Base)
+	if !ok || info.size != 64 || m.Symbol != "" {
+		return 0, fmt.Errorf("invalid memory operand %s", m)
+	}
+	return e.regs[info.num] + uint64(int64(m.Offset)), nil
+}
+
+func (e *emulator) read(o Operand, size int) (uint64, error) {
+	switch o := o.(type) {
+	case Reg:
+		info, ok := reg(o)
+		if !ok || info.size != size {
+			return 0, fmt.Errorf("invalid register %s", o)
+		}
+		return e.regs[info.num] & mask(size), nil
+	case Imm:
+		return uint64(o) & mask(size), nil
+	case Mem:
+		a, err := e.addr(o)
+		if err != nil {
+			return 0, err
+		}
+		return e.load(a, size)
+	}
+	return 0, fmt.Errorf("invalid operand %s", o)
+}
+
+// 32ビットのレジスタへの書き込みは上位を0にし、8ビットは下位のバイトだけを書き換える
+func (e *emulator) write(o Operand, size int, v uint64) error {
+	switch o := o.(type) {
+	case Reg:
+		info, ok := reg(o)
+		if !ok || info.size != size {
+			return fmt.Errorf("invalid register %s", o)
+		}
+		switch size {
+		case 8:
+			v = e.regs[info.num]&^0xff | v&0xff
+		case 32:
+			v &= mask(32)
+		}
+		e.regs[info.num] = v
+		return nil
+	case Mem:
+		a, err := e.addr(o)
+		if err != nil {
+			return err
+		}
+		return e.store(a, size, v)
+	}
+	return fmt.Errorf("invalid operand %s", o)
+}
+
+func (e *emulator) load(a uint64, size int) (uint64, error) {
+	if a < dataBase || a+uint64(size/8) > memSize {
+		return 0, fmt.Errorf("invalid memory access at %#x", a)
+	}
+	b := make([]byte, 8)
+	copy(b, e.mem[a:a+uint64(size/8)])
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+func (e *emulator) store(a uint64, size int, v uint64) error {
+	if a < dataBase || a+uint64(size/8) > memSize {
+		return fmt.Errorf("invalid memory access at %#x", a)
+	}
+	b := binary.LittleEndian.AppendUint64(nil, v)
+	copy(e.mem[a:], b[:size/8])
+	return nil
+}
+
+func (e *emulator) push(v uint64) error {
+	e.regs[regInfos[rsp].num] -= 8
+	return e.store(e.regs[regInfos[rsp].num], 64, v)
+}
+
+func (e *emulator) pop() (uint64, error) {
+	v, err := e.load(e.regs[regInfos[rsp].num], 64)
+	e.regs[regInfos[rsp].num] += 8
+	return v, err
+}
+
+func mask(size int) uint64 {
+	if size == 64 {
+		return ^uint64(0)
+	}
+	return 1<<size - 1
+}
+
+func sign(v uint64, size int) bool {
+	return v>>(size-1)&1 == 1
+}
+
+func signExtend(v uint64, size int) int64 {
+	return int64(v<<(64-size)) >> (64 - size)
+}
+
+// 中間表現をコンパイルしてエミュレータで実行し、mymainの結果とprintfの出力を返す
+func emulate(t *testing.T, m *ir.Module) (int32, string) {
+	t.Helper()
+	e := newEmulator(Compile(m))
+	v, err := e.call("mymain")
+	assert.NoError(t, err)
+	return v, e.out.String()
+}
+
+func TestEmulate(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		expect int32
+		out    string
+	}{
+		{"pressure", pressure, 79, ""},
+		{
+			name: "branch",
+			src: `
+func @mymain() i32 {
+entry:
+	%1 = alloca i32
+	%2 = alloca i32
+	store i32 0, %1
+	store i32 1, %2
+	jmp loop
+loop:
+	%3 = load i32 %2
+	%4 = load i32 %1
+	%5 = add i32 %4, %3
+	store i32 %5, %1
+	%6 = add i32 %3, 1
+	store i32 %6, %2
+	%7 = le i32 %6, 10
+	br i32 %7, loop, done
+done:
+	%8 = load i32 %1
+	%9 = sub i32 0, %8
+	%10 = lt i32 %9, -54
+	%11 = ge i32 %9, -55
+	%12 = mul i32 %10, 10
+	%13 = add i32 %12, %11
+	ret i32 %13
+}`,
+			expect: 11,
+		},
+		{
+			name: "division",
+			src: `
+func @mymain() i32 {
+entry:
+	%1 = call i32 @sum2(i32 -7, i32 0)
+	%2 = div i32 %1, 4
+	%3 = mul i32 %2, 1000
+	%4 = div i32 %1, 2
+	%5 = mul i32 %4, 8
+	%6 = div i32 %1, 3
+	%7 = add i32 %3, %5
+	%8 = add i32 %7, %6
+	ret i32 %8
+}`,
+			expect: -1026,
+		},
+		{
+			name: "printf",
+			src: `
+data @.s0 = "hi"
+data @.s1 = "%s %c %d %d %d %d %d %d\n"
+
+func @mymain() i32 {
+entry:
+	%1 = alloca ptr
+	%2 = alloca i8
+	store ptr @.s0, %1
+	store i8 -97, %2
+	%3 = load ptr %1
+	%4 = load i8 %2
+	%5 = sext i8 %4 to i32
+	%6 = sub i32 0, %5
+	%7 = call i32 @printf(ptr @.s1, ptr %3, i32 %6, i32 1, i32 -2, i32 3, i32 4, i32 5, i32 6)
+	%8 = load i8 %2
+	%9 = sext i8 %8 to i32
+	%10 = add i32 %7, %9
+	ret i32 %10
+}`,
+			expect: 18 - 97,
+			out:    "hi a 1 -2 3 4 5 6\n",
+		},
+	}
+	for _, tt := range tests {
+		for level := 0; level <= 2; level++ {
+			m, err := ir.Parse(tt.src)
+			assert.NoError(t, err)
+			assert.NoError(t, opt.NewManager(level).Run(m))
+			v, out := emulate(t, m)
+			assert.Equal(t, tt.expect, v, "%s -O%d", tt.name, level)
+			assert.Equal(t, tt.out, out, "%s -O%d", tt.name, level)
+		}
+	}
+}
+
+// 間違ったコードは実行時のエラーになる
+func TestEmulateError(t *testing.T) {
+	tests := []struct {
+		code   []*Instr
+		expect string
+	}{
+		{[]*Instr{instr("call", Sym("puts"))}, "\tcall puts: undefined function puts"},
+		{[]*Instr{instr("push", rax), instr("call", Sym("sum2"))}, "\tcall sum2: misaligned stack"},
+		{[]*Instr{instr("mov", Imm(0), rcx), instr("cltd"), instr("idivl", ecx)}, "\tidivl %ecx: division error"},
+		{[]*Instr{instr("mov", Mem{Base: rax}, rcx)}, "\tmov (%rax), %rcx: invalid memory access at 0x0"},
+		{[]*Instr{instr("jmp", Sym(".L0"))}, "\tjmp .L0: undefined label"},
+		{[]*Instr{instr("ud2")}, "\tud2: unknown instruction"},
+	}
+	for _, tt := range tests {
+		code := append([]*Instr{{Kind: KindLabel, Op: "mymain"}, instr("sub", Imm(8), rsp), instr("mov", Imm(0), rax)}, tt.code...)
+		_, err := newEmulator(code).call("mymain")
+		assert.EqualError(t, err, tt.expect)
+	}
+}
@@ -0,0 +1,567 @@
+package asm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/kijimaD/gogo/constant"
+	"github.com/kijimaD/gogo/elf"
+)
+
+// 組み込みのアセンブラ
+// asmが出力するx86-64の命令だけを機械語にして、ELFのオブジェクトファイルにする
+// ジャンプはすべて32ビットの相対アドレスで書く。.Lで始まるラベルはasと同じくシンボルにしない
+func Assemble(code []*Instr) (*elf.File, error) {
+	a := &assembler{f: &elf.File{}, labels: map[string]label{}}
+	for _, name := range []string{".text", ".data", ".rodata"} {
+		a.f.Section(name)
+	}
+	a.sec = a.f.Section(".text")
+	for _, i := range code {
+		var err error
+		switch i.Kind {
+		case KindDirective:
+			err = a.directive(i)
+		case KindLabel:
+			err = a.label(i.Op)
+		default:
+			err = a.instr(i)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", strings.TrimSpace(i.String()), err)
+		}
+	}
+
+	for _, j := range a.jumps {
+		l, ok := a.labels[j.label]
+		if !ok || l.sec != j.sec {
+			return nil, fmt.Errorf("undefined label %s", j.label)
+		}
+		binary.LittleEndian.PutUint32(j.sec.Data[j.off:], uint32(int32(l.off-(j.off+4))))
+	}
+	for _, s := range a.f.Symbols {
+		if s.Global && s.Section == nil {
+			return nil, fmt.Errorf("undefined global symbol %s", s.Name)
+		}
+	}
+	return a.f, nil
+}
+
+type assembler struct {
+	f      *elf.File
+	sec    *elf.Section // 機械語やデータを書き込んでいるセクション
+	labels map[string]label
+	jumps  []jump // ラベルが決まってから書き込むジャンプ先
+}
+
+type label struct {
+	sec *elf.Section
+	off int
+}
+
+// 相対アドレスを書き込む位置
+type jump struct {
+	sec   *elf.Section
+	off   int
+	label string
+}
+
+func (a *assembler) emit(b ...byte) {
+	a.sec.Data = append(a.sec.Data, b...)
+}
+
+func (a *assembler) emit32(v int64) {
+	a.sec.Data = binary.LittleEndian.AppendUint32(a.sec.Data, uint32(v))
+}
+
+func (a *assembler) directive(i *Instr) error {
+	switch i.Op {
+	case ".text", ".data", ".rodata":
+		a.sec = a.f.Section(i.Op)
+	case ".section":
+		if len(i.Args) != 1 {
+			return fmt.Errorf("expected a section name")
+		}
+		switch name := i.Args[0].String(); name {
+		case ".text", ".data", ".rodata":
+			a.sec = a.f.Section(name)
+		default:
+			return fmt.Errorf("unknown section %s", name)
+		}
+	case ".global":
+		for _, arg := range i.Args {
+			a.f.Symbol(arg.String()).Global = true
+		}
+	case ".string":
+		for _, arg := range i.Args {
+			s, ok := arg.(Str)
+			if !ok {
+				return fmt.Errorf("expected a string")
+			}
+			b, err := constant.Unquote(string(s))
+			if err != nil {
+				return err
+			}
+			a.emit(b...)
+			a.emit(0)
+		}
+	default:
+		return fmt.Errorf("unknown directive")
+	}
+	return nil
+}
+
+func (a *assembler) label(name string) error {
+	if _, ok := a.labels[name]; ok {
+		return fmt.Errorf("label %s is already defined", name)
+	}
+	a.labels[name] = label{sec: a.sec, off: len(a.sec.Data)}
+	if !strings.HasPrefix(name, ".L") {
+		s := a.f.Symbol(name)
+		s.Section = a.sec
+		s.Value = uint64(len(a.sec.Data))
+	}
+	return nil
+}
+
+// レジスタの番号と幅
+type regInfo struct {
+	num  int
+	size int
+}
+
+var regInfos = map[Reg]regInfo{}
+
+func init() {
+	nums := []Reg{"rax", "rcx", "rdx", "rbx", "rsp", "rbp", "rsi", "rdi", "r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15"}
+	names := map[Reg][3]Reg{
+		"rsp": {"rsp", "esp", "spl"},
+		"rbp": {"rbp", "ebp", "bpl"},
+	}
+	for r, n := range regNames {
+		names[r] = n
+	}
+	for num, r := range nums {
+		n := names[r]
+		regInfos[n[0]] = regInfo{num, 64}
+		regInfos[n[1]] = regInfo{num, 32}
+		regInfos[n[2]] = regInfo{num, 8}
+	}
+}
+
+func reg(o Operand) (regInfo, bool) {
+	r, ok := o.(Reg)
+	if !ok {
+		return regInfo{}, false
+	}
+	info, ok := regInfos[r]
+	return info, ok
+}
+
+// 8ビットの%spl、%bpl、%sil、%dilは、REXプレフィックスがないと%ah、%ch、%dh、%bhになる
+func needsREX(o Operand) bool {
+	info, ok := reg(o)
+	return ok && info.size == 8 && 4 <= info.num && info.num < 8
+}
+
+// ModRMでオペランドを指定する命令を書く
+// regはModRMのregの欄に入れるレジスタの番号か、命令の種類を表す数。rmはレジスタかメモリ
+// immは命令の後ろに続く即値。%ripからの相対位置は、即値の分も考えて再配置する
+func (a *assembler) modrm(size int, opcode []byte, regField int, rm Operand, imm []byte, byteRegs ...Operand) error {
+	rex := byte(0)
+	if size == 64 {
+		rex |= 0x8
+	}
+	if regField&8 != 0 {
+		rex |= 0x4
+	}
+	forceREX := needsREX(rm)
+	for _, o := range byteRegs {
+		forceREX = forceREX || needsREX(o)
+	}
+
+	var tail []byte
+	var modrm byte
+	var sym string
+	switch rm := rm.(type) {
+	case Reg:
+		info, ok := reg(rm)
+		if !ok {
+			return fmt.Errorf("unknown register %s", rm)
+		}
+		if info.num&8 != 0 {
+			rex |= 0x1
+		}
+		modrm = 0xc0 | byte(regField&7)<<3 | byte(info.num&7)
+	case Mem:
+		switch {
+		case rm.Base == rip:
+			modrm = byte(regField&7)<<3 | 5
+			sym = rm.Symbol
+			tail = make([]byte, 4)
+		case rm.Base == "" || rm.Symbol != "":
+			return fmt.Errorf("cannot encode the memory operand %s", rm)
+		default:
+			info, ok := reg(rm.Base)
+			if !ok || info.size != 64 {
+				return fmt.Errorf("invalid base register %s", rm.Base)
+			}
+			if info.num&8 != 0 {
+				rex |= 0x1
+			}
+			base := byte(info.num & 7)
+			switch {
+			case rm.Offset == 0 && base != 5:
+				modrm = 0 << 6
+			case -128 <= rm.Offset && rm.Offset < 128:
+				modrm = 1 << 6
+			default:
+				modrm = 2 << 6
+			}
+			modrm |= byte(regField&7)<<3 | base
+			// %rspと%r12はSIBを使い、%rbpと%r13は0の変位でも書く
+			if base == 4 {
+				tail = append(tail, 0x24)
+			}
+			switch modrm >> 6 {
+			case 1:
+				tail = append(tail, byte(int8(rm.Offset)))
+			case 2:
+				tail = binary.LittleEndian.AppendUint32(tail, uint32(int32(rm.Offset)))
+			}
+		}
+	default:
+		return fmt.Errorf("invalid operand %s", rm)
+	}
+
+	if rex != 0 || forceREX {
+		a.emit(0x40 | rex)
+	}
+	a.emit(opcode...)
+	a.emit(modrm)
+	if sym != "" {
+		a.relocate(sym, elf.RelocPC32, -4-int64(len(imm)))
+	}
+	a.emit(tail...)
+	a.emit(imm...)
+	return nil
+}
+
+// 次の4バイトの位置に再配置を置く
+func (a *assembler) relocate(sym string, typ elf.RelocType, addend int64) {
+	a.sec.Relocs = append(a.sec.Relocs, elf.Reloc{
+		Offset: uint64(len(a.sec.Data)),
+		Symbol: a.f.Symbol(sym),
+		Type:   typ,
+		Addend: addend,
+	})
+}
+
+func imm8(v int64) []byte  { return []byte{byte(int8(v))} }
+func imm32(v int64) []byte { return binary.LittleEndian.AppendUint32(nil, uint32(int32(v))) }
+
+func isInt8(v int64) bool  { return -128 <= v && v < 128 }
+func isInt32(v int64) bool { return -1<<31 <= v && v < 1<<31 }
+
+// オペランドの幅。接尾辞がなければレジスタの幅にする
+func operandSize(suffix byte, args ...Operand) (int, error) {
+	switch suffix {
+	case 'b':
+		return 8, nil
+	case 'l':
+		return 32, nil
+	case 'q':
+		return 64, nil
+	}
+	size := 0
+	for _, o := range args {
+		if info, ok := reg(o); ok {
+			if size != 0 && size != info.size {
+				return 0, fmt.Errorf("operand size mismatch")
+			}
+			size = info.size
+		}
+	}
+	if size == 0 {
+		return 0, fmt.Errorf("ambiguous operand size")
+	}
+	return size, nil
+}
+
+// 加算などの2オペランドの命令の、オペコードの基準とModRMのregの欄に入れる数
+var alu = map[string]struct {
+	base  byte
+	digit int
+}{
+	"add": {0x00, 0},
+	"and": {0x20, 4},
+	"sub": {0x28, 5},
+	"cmp": {0x38, 7},
+}
+
+var shift = map[string]int{
+	"shl": 4,
+	"sar": 7,
+}
+
+var jcc = map[string]byte{
+	"je":  0x84,
+	"jne": 0x85,
+	"jl":  0x8c,
+	"jge": 0x8d,
+	"jle": 0x8e,
+	"jg":  0x8f,
+}
+
+// オペランドが1つで、0xf7のModRMのregの欄で種類を表す命令
+var unary = map[string]int{
+	"neg": 3,
+	"div": 6,
+}
+
+var setccCodes = map[string]byte{
+	"sete":  0x94,
+	"setne": 0x95,
+	"setl":  0x9c,
+	"setge": 0x9d,
+	"setle": 0x9e,
+	"setg":  0x9f,
+}
+
+// 命令を機械語にする。オペランドはAT&T記法の順に、入力、出力と並んでいる
+func (a *assembler) instr(i *Instr) error {
+	args := i.Args
+	switch op := i.Op; {
+	case len(args) == 0:
+		switch op {
+		case "leave":
+			a.emit(0xc9)
+		case "ret":
+			a.emit(0xc3)
+		case "cltd":
+			a.emit(0x99)
+		case "syscall":
+			a.emit(0x0f, 0x05)
+		default:
+			return fmt.Errorf("unknown instruction")
+		}
+		return nil
+	case op == "call":
+		sym, ok := args[0].(Sym)
+		if !ok {
+			return fmt.Errorf("indirect call is not supported")
+		}
+		a.emit(0xe8)
+		if strings.HasPrefix(string(sym), ".L") {
+			// シンボルにならないラベルは、ジャンプと同じく位置を決めてから書き込む
+			a.jumps = append(a.jumps, jump{sec: a.sec, off: len(a.sec.Data), label: string(sym)})
+		} else {
+			a.relocate(string(sym), elf.RelocPLT32, -4)
+		}
+		a.emit32(0)
+		return nil
+	case op == "jmp" || jcc[op] != 0:
+		sym, ok := args[0].(Sym)
+		if !ok {
+			return fmt.Errorf("indirect jump is not supported")
+		}
+		if op == "jmp" {
+			a.emit(0xe9)
+		} else {
+			a.emit(0x0f, jcc[op])
+		}
+		a.jumps = append(a.jumps, jump{sec: a.sec, off: len(a.sec.Data), label: string(sym)})
+		a.emit32(0)
+		return nil
+	case op == "push" || op == "pop":
+		if v, ok := args[0].(Imm); ok && op == "push" {
+			if isInt8(int64(v)) {
+				a.emit(0x6a, byte(int8(v)))
+			} else {
+				a.emit(0x68)
+				a.emit32(int64(v))
+			}
+			return nil
+		}
+		info, ok := reg(args[0])
+		if !ok || info.size != 64 {
+			return fmt.Errorf("invalid operand")
+		}
+		if info.num&8 != 0 {
+			a.emit(0x41)
+		}
+		if op == "pop" {
+			a.emit(0x58 + byte(info.num&7))
+		} else {
+			a.emit(0x50 + byte(info.num&7))
+		}
+		return nil
+	case setccCodes[op] != 0:
+		return a.modrm(8, []byte{0x0f, setccCodes[op]}, 0, args[0], nil)
+	case op == "idivl":
+		return a.modrm(32, []byte{0xf7}, 7, args[0], nil)
+	case unary[op] != 0:
+		size, err := operandSize(0, args[0])
+		if err != nil {
+			return err
+		}
+		if size == 8 {
+			return a.modrm(size, []byte{0xf6}, unary[op], args[0], nil, args[0])
+		}
+		return a.modrm(size, []byte{0xf7}, unary[op], args[0], nil)
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf("unknown instruction")
+	}
+	src, dst := args[0], args[1]
+	op := i.Op
+	switch op {
+	case "lea":
+		info, ok := reg(dst)
+		if !ok || info.size != 64 {
+			return fmt.Errorf("invalid operand")
+		}
+		return a.modrm(64, []byte{0x8d}, info.num, src, nil)
+	case "movsbl", "movzbl", "movslq":
+		info, ok := reg(dst)
+		if !ok {
+			return fmt.Errorf("invalid operand")
+		}
+		switch op {
+		case "movsbl":
+			return a.modrm(32, []byte{0x0f, 0xbe}, info.num, src, nil, src)
+		case "movzbl":
+			return a.modrm(32, []byte{0x0f, 0xb6}, info.num, src, nil, src)
+		default:
+			return a.modrm(64, []byte{0x63}, info.num, src, nil)
+		}
+	case "mov", "movb", "movl", "movq":
+		size, err := operandSize(op[len(op)-1], src, dst)
+		if op == "mov" {
+			size, err = operandSize(0, src, dst)
+		}
+		if err != nil {
+			return err
+		}
+		return a.mov(size, src, dst)
+	case "imul":
+		info, ok := reg(dst)
+		if !ok {
+			return fmt.Errorf("invalid operand")
+		}
+		// 8ビットには2オペランドのimulがない
+		if info.size == 8 {
+			return fmt.Errorf("unsupported operand size")
+		}
+		if v, ok := src.(Imm); ok {
+			if isInt8(int64(v)) {
+				return a.modrm(info.size, []byte{0x6b}, info.num, dst, imm8(int64(v)))
+			}
+			return a.modrm(info.size, []byte{0x69}, info.num, dst, imm32(int64(v)))
+		}
+		if _, err := operandSize(0, src, dst); err != nil {
+			return err
+		}
+		return a.modrm(info.size, []byte{0x0f, 0xaf}, info.num, src, nil)
+	}
+
+	if digit, ok := shift[op]; ok {
+		v, ok := src.(Imm)
+		if !ok {
+			return fmt.Errorf("invalid operand")
+		}
+		size, err := operandSize(0, dst)
+		if err != nil {
+			return err
+		}
+		if size == 8 {
+			return a.modrm(size, []byte{0xc0}, digit, dst, imm8(int64(v)), dst)
+		}
+		return a.modrm(size, []byte{0xc1}, digit, dst, imm8(int64(v)))
+	}
+	if code, ok := alu[op]; ok {
+		size, err := operandSize(0, src, dst)
+		if err != nil {
+			return err
+		}
+		if size == 8 {
+			return a.alu8(code.base, code.digit, src, dst)
+		}
+		if v, ok := src.(Imm); ok {
+			if isInt8(int64(v)) {
+				return a.modrm(size, []byte{0x83}, code.digit, dst, imm8(int64(v)))
+			}
+			return a.modrm(size, []byte{0x81}, code.digit, dst, imm32(int64(v)))
+		}
+		if info, ok := reg(src); ok {
+			return a.modrm(size, []byte{code.base + 1}, info.num, dst, nil)
+		}
+		info, ok := reg(dst)
+		if !ok {
+			return fmt.Errorf("invalid operand")
+		}
+		return a.modrm(size, []byte{code.base + 3}, info.num, src, nil)
+	}
+	return fmt.Errorf("unknown instruction")
+}
+
+// 8ビットの加算など。32ビットのものとは別のオペコードを使う
+func (a *assembler) alu8(base byte, digit int, src Operand, dst Operand) error {
+	if v, ok := src.(Imm); ok {
+		if !isInt8(int64(v)) && !(0 <= v && v < 1<<8) {
+			return fmt.Errorf("immediate out of range")
+		}
+		return a.modrm(8, []byte{0x80}, digit, dst, imm8(int64(v)), dst)
+	}
+	if info, ok := reg(src); ok {
+		return a.modrm(8, []byte{base}, info.num, dst, nil, src, dst)
+	}
+	info, ok := reg(dst)
+	if !ok {
+		return fmt.Errorf("invalid operand")
+	}
+	return a.modrm(8, []byte{base + 2}, info.num, src, nil, dst)
+}
+
+func (a *assembler) mov(size int, src Operand, dst Operand) error {
+	opcode := byte(0x89)
+	if size == 8 {
+		opcode = 0x88
+	}
+	if v, ok := src.(Imm); ok {
+		if info, ok := reg(dst); ok && size != 8 {
+			// 32ビットのレジスタへの転送は上位を0にするので、64ビットでも即値が32ビットで表せる正の数なら使える
+			switch {
+			case size == 32 || (0 <= v && v < 1<<31):
+				if info.num&8 != 0 {
+					a.emit(0x41)
+				}
+				a.emit(0xb8 + byte(info.num&7))
+				a.emit32(int64(v))
+				return nil
+			case !isInt32(int64(v)):
+				a.emit(0x48|byte(info.num>>3), 0xb8+byte(info.num&7))
+				a.sec.Data = binary.LittleEndian.AppendUint64(a.sec.Data, uint64(v))
+				return nil
+			}
+		}
+		if size == 8 {
+			return a.modrm(size, []byte{0xc6}, 0, dst, imm8(int64(v)), dst)
+		}
+		// 32ビットの転送は下位32ビットだけを書くので、asと同じく符号なしの値も受け付ける
+		if !isInt32(int64(v)) && !(size == 32 && 0 <= v && v < 1<<32) {
+			return fmt.Errorf("immediate out of range")
+		}
+		return a.modrm(size, []byte{0xc7}, 0, dst, imm32(int64(v)))
+	}
+	if info, ok := reg(src); ok {
+		return a.modrm(size, []byte{opcode}, info.num, dst, nil, src, dst)
+	}
+	info, ok := reg(dst)
+	if !ok {
+		return fmt.Errorf("invalid operand")
+	}
+	return a.modrm(size, []byte{opcode + 2}, info.num, src, nil, dst)
+}
@@ -0,0 +1,207 @@
+package asm
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type Kind int
+
+const (
+	KindInstr     Kind = iota // 機械語の命令
+	KindLabel                 // ラベル
+	KindDirective             // .textや.stringのような疑似命令
+)
+
+// アセンブリの1行
+// オペランドはAT&T記法の順に、入力、出力と並べる
+type Instr struct {
+	Kind Kind
+	Op   string // 命令や疑似命令の名前。ラベルならラベルの名前
+	Args []Operand
+}
+
+func (i *Instr) String() string {
+	switch i.Kind {
+	case KindLabel:
+		return i.Op + ":"
+	default:
+		if len(i.Args) == 0 {
+			return "\t" + i.Op
+		}
+		args := make([]string, len(i.Args))
+		for j, a := range i.Args {
+			args[j] = a.String()
+		}
+		return "\t" + i.Op + " " + strings.Join(args, ", ")
+	}
+}
+
+// Intel記法で書く。オペランドは出力、入力の順に並べ替え、命令の名前の幅の接尾辞はメモリのオペランドの幅にする
+func (i *Instr) Intel() string {
+	if i.Kind != KindInstr {
+		return i.String()
+	}
+	op, ok := intelOps[i.Op]
+	if !ok {
+		op = intelOp{name: i.Op}
+	}
+	if len(i.Args) == 0 {
+		return "\t" + op.name
+	}
+	args := make([]string, len(i.Args))
+	for j, a := range i.Args {
+		x := a.Intel()
+		if _, ok := a.(Mem); ok && j < len(op.sizes) && op.sizes[j] != "" {
+			x = op.sizes[j] + " PTR " + x
+		}
+		args[len(i.Args)-1-j] = x
+	}
+	return "\t" + op.name + " " + strings.Join(args, ", ")
+}
+
+// AT&T記法とIntel記法で名前が違う命令
+// sizesはAT&T記法の順に並べたオペランドの幅。メモリのオペランドはレジスタから幅がわからないので明示する
+type intelOp struct {
+	name  string
+	sizes []string
+}
+
+var intelOps = map[string]intelOp{
+	"movb":   {"mov", []string{"BYTE", "BYTE"}},
+	"movl":   {"mov", []string{"DWORD", "DWORD"}},
+	"movq":   {"mov", []string{"QWORD", "QWORD"}},
+	"movsbl": {"movsx", []string{"BYTE"}},
+	"movslq": {"movsxd", []string{"DWORD"}},
+	"movzbl": {"movzx", []string{"BYTE"}},
+	"idivl":  {"idiv", []string{"DWORD"}},
+	"cltd":   {"cdq", nil},
+}
+
+// 命令のオペランド
+type Operand interface {
+	String() string
+	Intel() string
+	operand()
+}
+
+// レジスタ。名前に%はつけない
+type Reg string
+
+// 即値
+type Imm int64
+
+// メモリ上の値。Baseのレジスタが指すアドレスにOffsetを足した位置にある
+// Symbolがあれば、Baseからの相対位置にあるラベルを指す。Baseがなければラベルの絶対アドレスを指す
+type Mem struct {
+	Base   Reg
+	Offset int
+	Symbol string
+}
+
+// ジャンプ先や呼び出す関数のラベル
+type Sym string
+
+// 文字列の定数
+type Str string
+
+func (r Reg) String() string { return "%" + string(r) }
+func (i Imm) String() string { return "$" + strconv.FormatInt(int64(i), 10) }
+func (s Sym) String() string { return string(s) }
+func (s Str) String() string { return `"` + string(s) + `"` }
+
+func (r Reg) Intel() string { return string(r) }
+func (i Imm) Intel() string { return strconv.FormatInt(int64(i), 10) }
+func (s Sym) Intel() string { return string(s) }
+func (s Str) Intel() string { return s.String() }
+
+func (m Mem) Intel() string {
+	switch {
+	case m.Symbol != "" && m.Base == "":
+		return "[" + m.Symbol + "]"
+	case m.Symbol != "":
+		return fmt.Sprintf("[%s+%s]", m.Base.Intel(), m.Symbol)
+	case m.Offset != 0:
+		return fmt.Sprintf("[%s%+d]", m.Base.Intel(), m.Offset)
+	default:
+		return fmt.Sprintf("[%s]", m.Base.Intel())
+	}
+}
+
+func (m Mem) String() string {
+	switch {
+	case m.Symbol != "" && m.Base == "":
+		return m.Symbol
+	case m.Symbol != "":
+		return fmt.Sprintf("%s(%s)", m.Symbol, m.Base)
+	case m.Offset != 0:
+		return fmt.Sprintf("%d(%s)", m.Offset, m.Base)
+	default:
+		return fmt.Sprintf("(%s)", m.Base)
+	}
+}
+
+func (Reg) operand() {}
+func (Imm) operand() {}
+func (Mem) operand() {}
+func (Sym) operand() {}
+func (Str) operand() {}
+
+// 命令の組み立てに使うレジスタ
+const (
+	rax Reg = "rax"
+	rcx Reg = "rcx"
+	rdx Reg = "rdx"
+	rbp Reg = "rbp"
+	rsp Reg = "rsp"
+	rip Reg = "rip"
+	r11 Reg = "r11"
+	eax Reg = "eax"
+	ecx Reg = "ecx"
+	edx Reg = "edx"
+	al  Reg = "al"
+)
+
+// %rbpからのオフセットで表すスタック上のオペランド
+func mem(off int) Mem {
+	return Mem{Base: rbp, Offset: off}
+}
+
+// アセンブリの記法
+type Syntax int
+
+const (
+	SyntaxATT   Syntax = iota // AT&T記法。gccと同じく、指定がなければこちら
+	SyntaxIntel               // Intel記法。.intel_syntax noprefixで始める
+)
+
+// アセンブリを書き出す
+type Emitter struct {
+	w      io.Writer
+	Syntax Syntax
+}
+
+func NewEmitter(w io.Writer) *Emitter {
+	return &Emitter{w: w}
+}
+
+// 命令の列を1行ずつ書き出す
+func (e *Emitter) Emit(code []*Instr) error {
+	if e.Syntax == SyntaxIntel {
+		if _, err := fmt.Fprintln(e.w, "\t.intel_syntax noprefix"); err != nil {
+			return err
+		}
+	}
+	for _, i := range code {
+		line := i.String()
+		if e.Syntax == SyntaxIntel {
+			line = i.Intel()
+		}
+		if _, err := fmt.Fprintln(e.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package asm
+
+// のぞき穴最適化
+// 隣り合う数命令だけを見て、意味を変えずに短い命令の列に置き換える
+// 前から1回だけ見ていき、置き換えたら直前の2命令まで戻って見直す。一番長い並びは3命令なので、それより前は変わらない
+func Peephole(code []*Instr) []*Instr {
+	// まだ見ていない命令を逆順に積む。置き換えた命令や戻って見直す命令は上に積み直すので、列をずらさずにすむ
+	rest := make([]*Instr, len(code))
+	for i, c := range code {
+		rest[len(code)-1-i] = c
+	}
+	out := make([]*Instr, 0, len(code))
+	window := make([]*Instr, 0, 3)
+	for len(rest) > 0 {
+		window = window[:0]
+		for i := len(rest) - 1; i >= 0 && len(window) < cap(window); i-- {
+			window = append(window, rest[i])
+		}
+		n, repl, ok := peephole(window)
+		if !ok {
+			out = append(out, rest[len(rest)-1])
+			rest = rest[:len(rest)-1]
+			continue
+		}
+		rest = rest[:len(rest)-n]
+		for i := len(repl) - 1; i >= 0; i-- {
+			rest = append(rest, repl[i])
+		}
+		for k := 0; k < 2 && len(out) > 0; k++ {
+			rest = append(rest, out[len(out)-1])
+			out = out[:len(out)-1]
+		}
+	}
+	return out
+}
+
+// 条件を反対にしたジャンプ命令
+var inverse = map[string]string{
+	"je":  "jne",
+	"jne": "je",
+	"jl":  "jge",
+	"jge": "jl",
+	"jle": "jg",
+	"jg":  "jle",
+}
+
+// 先頭のn個の命令をreplに置き換えられるか
+func peephole(code []*Instr) (n int, repl []*Instr, ok bool) {
+	a := code[0]
+	if a.Kind != KindInstr {
+		return 0, nil, false
+	}
+
+	// mov %rax, %rax
+	// 32ビットのレジスタへのmovは上位を0にするので残す
+	if a.Op == "mov" && a.Args[0] == a.Args[1] && is64(a.Args[0]) {
+		return 1, nil, true
+	}
+	// imul $1, %eax / add $0, %eax / sub $0, %eax
+	if (a.Op == "imul" && a.Args[0] == Imm(1)) || ((a.Op == "add" || a.Op == "sub") && a.Args[0] == Imm(0)) {
+		return 1, nil, true
+	}
+	// imul $8, %eax -> shl $3, %eax
+	if a.Op == "imul" && len(a.Args) == 2 {
+		if k, ok := log2(a.Args[0]); ok && k > 0 {
+			return 1, []*Instr{instr("shl", Imm(k), a.Args[1])}, true
+		}
+	}
+
+	if len(code) < 2 {
+		return 0, nil, false
+	}
+	b := code[1]
+
+	// jmp .L1
+	// .L1:
+	if isJump(a) && b.Kind == KindLabel && a.Args[0] == Sym(b.Op) {
+		return 1, nil, true
+	}
+	if b.Kind != KindInstr {
+		return 0, nil, false
+	}
+
+	// push %rax
+	// pop %rcx
+	if a.Op == "push" && b.Op == "pop" {
+		if a.Args[0] == b.Args[0] {
+			return 2, nil, true
+		}
+		if isReg(a.Args[0]) || isReg(b.Args[0]) {
+			return 2, []*Instr{instr("mov", a.Args[0], b.Args[0])}, true
+		}
+	}
+	// mov %rdi, -8(%rbp)
+	// mov -8(%rbp), %rdi
+	if movs[a.Op] && b.Op == "mov" && a.Args[0] == b.Args[1] && a.Args[1] == b.Args[0] {
+		return 2, []*Instr{a}, true
+	}
+
+	if len(code) < 3 {
+		return 0, nil, false
+	}
+	c := code[2]
+
+	// je .L1
+	// jmp .L2
+	// .L1:
+	if inv, ok := inverse[a.Op]; ok && b.Op == "jmp" && c.Kind == KindLabel && a.Args[0] == Sym(c.Op) {
+		return 2, []*Instr{instr(inv, b.Args[0])}, true
+	}
+	// mov $8, %rcx
+	// cltd
+	// idivl %ecx
+	// 負の数は0の方向に切り捨てるので、符号に応じて2^k-1を足してから右にシフトする
+	if a.Op == "mov" && a.Args[1] == rcx && b.Op == "cltd" && c.Kind == KindInstr && c.Op == "idivl" && c.Args[0] == ecx {
+		if k, ok := log2(a.Args[0]); ok {
+			if k == 0 {
+				return 3, nil, true
+			}
+			return 3, []*Instr{
+				instr("cltd"),
+				instr("and", Imm(1<<k-1), edx),
+				instr("add", edx, eax),
+				instr("sar", Imm(k), eax),
+			}, true
+		}
+	}
+
+	return 0, nil, false
+}
+
+// 値をそのまま書き込む命令。オペランドの幅はレジスタの名前で決まる
+var movs = map[string]bool{"mov": true, "movb": true, "movl": true, "movq": true}
+
+func instr(op string, args ...Operand) *Instr {
+	return &Instr{Kind: KindInstr, Op: op, Args: args}
+}
+
+func isJump(i *Instr) bool {
+	_, cond := inverse[i.Op]
+	return i.Kind == KindInstr && (i.Op == "jmp" || cond)
+}
+
+func isReg(o Operand) bool {
+	_, ok := o.(Reg)
+	return ok
+}
+
+// 64ビットのレジスタか
+func is64(o Operand) bool {
+	r, ok := o.(Reg)
+	if !ok {
+		return false
+	}
+	_, ok = regNames[r]
+	return ok
+}
+
+// 即値が2のk乗ならkを返す
+func log2(o Operand) (int, bool) {
+	v, ok := o.(Imm)
+	if !ok || v <= 0 || v&(v-1) != 0 || v > 1<<30 {
+		return 0, false
+	}
+	k := 0
+	for v > 1 {
+		v >>= 1
+		k++
+	}
+	return k, true
+}
@@ -0,0 +1,245 @@
+package asm
+
+import (
+	"sort"
+
+	"github.com/kijimaD/gogo/ir"
+)
+
+// 仮想レジスタの値を置く場所。regが空ならスタック上の%rbpからのオフセットoff
+type loc struct {
+	reg Reg
+	off int
+}
+
+func (l loc) inReg() bool { return l.reg != "" }
+
+// 仮想レジスタが生きている範囲。命令の番号で表す
+// 範囲に穴があっても埋めて、1つの区間として扱う
+type interval struct {
+	r          *ir.Reg
+	start, end int
+	crossCall  bool // 途中で関数を呼ぶ。呼び出し元が保存するレジスタには置けない
+	reg        Reg
+	spilled    bool
+}
+
+// 関数のすべての仮想レジスタの生存区間を計算する
+// allocaの結果はスタック上のアドレスなので、割り当ての対象にしない
+func liveIntervals(f *ir.Func) []*interval {
+	allocas := map[*ir.Reg]bool{}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Op == ir.OpAlloca {
+				allocas[instr.Dst] = true
+			}
+		}
+	}
+	skip := func(v ir.Value) (*ir.Reg, bool) {
+		r, ok := v.(*ir.Reg)
+		return r, ok && !allocas[r]
+	}
+
+	// 1. 命令に番号をつける
+	start := map[*ir.Block]int{}
+	end := map[*ir.Block]int{}
+	pos := 0
+	calls := []int{}
+	for _, b := range f.Blocks {
+		start[b] = pos
+		for _, instr := range b.Instrs {
+			if instr.Op == ir.OpCall {
+				calls = append(calls, pos)
+			}
+			end[b] = pos
+			pos += 2
+		}
+	}
+
+	// 2. ブロックの入口と出口で生きている仮想レジスタを、変わらなくなるまで計算する
+	// phiの引数は、前のブロックの出口で使うものとする
+	uses := map[*ir.Block]map[*ir.Reg]bool{}
+	defs := map[*ir.Block]map[*ir.Reg]bool{}
+	for _, b := range f.Blocks {
+		uses[b] = map[*ir.Reg]bool{}
+		defs[b] = map[*ir.Reg]bool{}
+		for _, instr := range b.Instrs {
+			if instr.Op != ir.OpPhi {
+				for _, a := range instr.Args {
+					if r, ok := skip(a); ok && !defs[b][r] {
+						uses[b][r] = true
+					}
+				}
+			}
+			if instr.Dst != nil {
+				defs[b][instr.Dst] = true
+			}
+		}
+	}
+	liveIn := map[*ir.Block]map[*ir.Reg]bool{}
+	liveOut := map[*ir.Block]map[*ir.Reg]bool{}
+	for _, b := range f.Blocks {
+		liveIn[b] = map[*ir.Reg]bool{}
+		liveOut[b] = map[*ir.Reg]bool{}
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(f.Blocks) - 1; i >= 0; i-- {
+			b := f.Blocks[i]
+			out := liveOut[b]
+			for _, s := range b.Succs() {
+				for r := range liveIn[s] {
+					if !out[r] {
+						out[r] = true
+						changed = true
+					}
+				}
+				for _, phi := range s.Phis() {
+					for j, p := range phi.Preds {
+						if r, ok := skip(phi.Args[j]); ok && p == b && !out[r] {
+							out[r] = true
+							changed = true
+						}
+					}
+				}
+			}
+			in := liveIn[b]
+			for r := range uses[b] {
+				if !in[r] {
+					in[r] = true
+					changed = true
+				}
+			}
+			for r := range out {
+				if !defs[b][r] && !in[r] {
+					in[r] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	// 3. 定義、使用、ブロックの入口と出口を区間に含める
+	intervals := map[*ir.Reg]*interval{}
+	extend := func(r *ir.Reg, p int) {
+		it, ok := intervals[r]
+		if !ok {
+			intervals[r] = &interval{r: r, start: p, end: p}
+			return
+		}
+		if p < it.start {
+			it.start = p
+		}
+		if p > it.end {
+			it.end = p
+		}
+	}
+	for _, b := range f.Blocks {
+		for r := range liveIn[b] {
+			extend(r, start[b])
+		}
+		for r := range liveOut[b] {
+			extend(r, end[b])
+		}
+		p := start[b]
+		for _, instr := range b.Instrs {
+			if instr.Op != ir.OpPhi {
+				for _, a := range instr.Args {
+					if r, ok := skip(a); ok {
+						extend(r, p)
+					}
+				}
+			}
+			if instr.Dst != nil && instr.Op != ir.OpAlloca {
+				// phiはブロックの入口で同時に値が決まる
+				if instr.Op == ir.OpPhi {
+					extend(instr.Dst, start[b])
+				} else {
+					extend(instr.Dst, p)
+				}
+			}
+			p += 2
+		}
+	}
+
+	result := []*interval{}
+	for _, it := range intervals {
+		for _, c := range calls {
+			if it.start < c && c < it.end {
+				it.crossCall = true
+			}
+		}
+		result = append(result, it)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].start != result[j].start {
+			return result[i].start < result[j].start
+		}
+		return result[i].r.ID < result[j].r.ID
+	})
+	return result
+}
+
+// 線形走査でレジスタを割り当てる
+// 関数呼び出しをまたぐ区間には呼び出し先が保存するレジスタだけを使い、足りなければ終わりが最も遠い区間をスタックに追い出す
+func linearScan(intervals []*interval, a *arch) {
+	used := map[Reg]bool{}
+	active := []*interval{}
+
+	for _, cur := range intervals {
+		// 終わった区間のレジスタを空ける
+		kept := active[:0]
+		for _, it := range active {
+			if it.end < cur.start {
+				used[it.reg] = false
+			} else {
+				kept = append(kept, it)
+			}
+		}
+		active = kept
+
+		pool := a.calleeSaved
+		if !cur.crossCall {
+			pool = append(append([]Reg{}, a.callerSaved...), a.calleeSaved...)
+		}
+		for _, reg := range pool {
+			if !used[reg] {
+				cur.reg = reg
+				break
+			}
+		}
+		if cur.reg != "" {
+			used[cur.reg] = true
+			active = append(active, cur)
+			continue
+		}
+
+		var victim *interval
+		for _, it := range active {
+			if contains(pool, it.reg) && (victim == nil || it.end > victim.end) {
+				victim = it
+			}
+		}
+		if victim == nil || victim.end <= cur.end {
+			cur.spilled = true
+			continue
+		}
+		cur.reg = victim.reg
+		victim.reg = ""
+		victim.spilled = true
+		for i, it := range active {
+			if it == victim {
+				active[i] = cur
+			}
+		}
+	}
+}
+
+func contains(regs []Reg, reg Reg) bool {
+	for _, r := range regs {
+		if r == reg {
+			return true
+		}
+	}
+	return false
+}
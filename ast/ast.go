@@ -10,6 +10,8 @@ import (
 type Node interface {
 	TokenLiteral() string
 	String() string
+	Start() token.Position // ノードの開始位置
+	End() token.Position   // ノードの直後の位置
 }
 
 type Statement interface {
@@ -40,6 +42,27 @@ func (p *Program) String() string {
 	return out.String()
 }
 
+func (p *Program) TokenLiteral() string {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].TokenLiteral()
+	}
+	return ""
+}
+
+func (p *Program) Start() token.Position {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Start()
+	}
+	return token.Position{}
+}
+
+func (p *Program) End() token.Position {
+	if n := len(p.Statements); n > 0 {
+		return p.Statements[n-1].End()
+	}
+	return token.Position{}
+}
+
 type Var struct {
 	Token token.Token
 	Pos   int
@@ -50,6 +73,8 @@ func (v *Var) ExpressionNode()       {}
 func (v *Var) TokenLiteral() string  { return v.Token.Literal }
 func (v *Var) String() string        { return v.Token.Literal }
 func (v *Var) GetCtype() token.Ctype { return v.Ctype }
+func (v *Var) Start() token.Position { return v.Token.Pos }
+func (v *Var) End() token.Position   { return v.Token.End }
 
 type ExpressionStatement struct {
 	Token      token.Token // 式の最初のトークン
@@ -64,6 +89,13 @@ func (es *ExpressionStatement) String() string {
 	}
 	return ""
 }
+func (es *ExpressionStatement) Start() token.Position { return es.Token.Pos }
+func (es *ExpressionStatement) End() token.Position {
+	if es.Expression != nil {
+		return es.Expression.End()
+	}
+	return es.Token.End
+}
 
 type StringLiteral struct {
 	Token token.Token
@@ -75,6 +107,8 @@ func (sl *StringLiteral) ExpressionNode()       {}
 func (sl *StringLiteral) TokenLiteral() string  { return sl.Token.Literal }
 func (sl *StringLiteral) String() string        { return "\"" + sl.Token.Literal + "\"" }
 func (sl *StringLiteral) GetCtype() token.Ctype { return token.CTYPE_STR }
+func (sl *StringLiteral) Start() token.Position { return sl.Token.Pos }
+func (sl *StringLiteral) End() token.Position   { return sl.Token.End }
 
 type CharLiteral struct {
 	Token token.Token
@@ -85,6 +119,8 @@ func (cl *CharLiteral) ExpressionNode()       {}
 func (cl *CharLiteral) TokenLiteral() string  { return cl.Token.Literal }
 func (cl *CharLiteral) String() string        { return `'` + cl.Token.Literal + `'` }
 func (cl *CharLiteral) GetCtype() token.Ctype { return token.CTYPE_CHAR }
+func (cl *CharLiteral) Start() token.Position { return cl.Token.Pos }
+func (cl *CharLiteral) End() token.Position   { return cl.Token.End }
 
 type IntegerLiteral struct {
 	Token token.Token
@@ -95,6 +131,8 @@ func (il *IntegerLiteral) ExpressionNode()       {}
 func (il *IntegerLiteral) TokenLiteral() string  { return il.Token.Literal }
 func (il *IntegerLiteral) String() string        { return il.Token.Literal }
 func (il *IntegerLiteral) GetCtype() token.Ctype { return token.CTYPE_INT }
+func (il *IntegerLiteral) Start() token.Position { return il.Token.Pos }
+func (il *IntegerLiteral) End() token.Position   { return il.Token.End }
 
 type InfixExpression struct {
 	Token    token.Token
@@ -117,6 +155,18 @@ func (ie *InfixExpression) String() string {
 	return out.String()
 }
 func (ie *InfixExpression) GetCtype() token.Ctype { return ie.Ctype }
+func (ie *InfixExpression) Start() token.Position {
+	if ie.Left != nil {
+		return ie.Left.Start()
+	}
+	return ie.Token.Pos
+}
+func (ie *InfixExpression) End() token.Position {
+	if ie.Right != nil {
+		return ie.Right.End()
+	}
+	return ie.Token.End
+}
 
 // int a = 1;
 type DeclStatement struct {
@@ -139,12 +189,23 @@ func (de *DeclStatement) String() string {
 
 	return out.String()
 }
+func (de *DeclStatement) Start() token.Position { return de.Token.Pos }
+func (de *DeclStatement) End() token.Position {
+	if de.Value != nil {
+		return de.Value.End()
+	}
+	if de.Name != nil {
+		return de.Name.End()
+	}
+	return de.Token.End
+}
 
 // f(20, 5)
 type FuncallExpression struct {
 	Token    token.Token // "("
 	Function Expression
 	Args     []Expression
+	Rparen   token.Position // ")"の位置
 }
 
 func (fe *FuncallExpression) ExpressionNode()      {}
@@ -163,3 +224,53 @@ func (fe *FuncallExpression) String() string {
 	return out.String()
 }
 func (fe *FuncallExpression) GetCtype() token.Ctype { return token.CTYPE_INT } // TODO: とりあえず返り値がintしかないのでハードコーディング
+func (fe *FuncallExpression) Start() token.Position {
+	if fe.Function != nil {
+		return fe.Function.Start()
+	}
+	return fe.Token.Pos
+}
+func (fe *FuncallExpression) End() token.Position {
+	if fe.Rparen.IsValid() {
+		return token.Position{Line: fe.Rparen.Line, Column: fe.Rparen.Column + 1}
+	}
+	return fe.Token.End
+}
+
+// 構文エラーで正しく読めなかった式の代わりに置かれる
+type BadExpr struct {
+	Token token.Token // エラーになったトークン
+}
+
+func (be *BadExpr) ExpressionNode()       {}
+func (be *BadExpr) TokenLiteral() string  { return be.Token.Literal }
+func (be *BadExpr) String() string        { return "<bad expr>" }
+func (be *BadExpr) GetCtype() token.Ctype { return token.CTYPE_VOID }
+func (be *BadExpr) Start() token.Position { return be.Token.Pos }
+func (be *BadExpr) End() token.Position   { return be.Token.End }
+
+// 構文エラーで正しく読めなかった文の代わりに置かれる
+type BadStmt struct {
+	Token  token.Token    // 文の最初のトークン
+	EndPos token.Position // 読み飛ばした範囲の直後
+}
+
+func (bs *BadStmt) statementNode()        {}
+func (bs *BadStmt) TokenLiteral() string  { return bs.Token.Literal }
+func (bs *BadStmt) String() string        { return "<bad stmt>" }
+func (bs *BadStmt) Start() token.Position { return bs.Token.Pos }
+func (bs *BadStmt) End() token.Position   { return bs.EndPos }
+
+// 暗黙の型変換。意味解析(sema)が挿入する
+// ソースコードには現れないので、String()は変換される式そのものを返す
+type ConvExpression struct {
+	Expression Expression
+	Ctype      token.Ctype // 変換後の型
+}
+
+func (ce *ConvExpression) ExpressionNode()       {}
+func (ce *ConvExpression) TokenLiteral() string  { return ce.Expression.TokenLiteral() }
+func (ce *ConvExpression) String() string        { return ce.Expression.String() }
+func (ce *ConvExpression) GetCtype() token.Ctype { return ce.Ctype }
+func (ce *ConvExpression) Start() token.Position { return ce.Expression.Start() }
+func (ce *ConvExpression) End() token.Position   { return ce.Expression.End() }
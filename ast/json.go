@@ -0,0 +1,310 @@
+package ast
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/kijimaD/gogo/token"
+)
+
+// ASTのJSON表現。ほかの言語で書かれたツールから読めるようにする
+// すべてのノードは"kind"で種類を表し、"start"と"end"に位置を持つ
+// 式は解決済みの型を"type"に持つ。"start"、"end"は読み込むときには使わない
+// "type"は、変数、二項演算、型変換のように型をノードに持つ式のときだけ読み込む
+type jsonNode struct {
+	Kind  string         `json:"kind"`
+	Start token.Position `json:"start"`
+	End   token.Position `json:"end"`
+	Type  *token.Ctype   `json:"type,omitempty"`
+	Token *token.Token   `json:"token,omitempty"`
+
+	Statements []*jsonNode     `json:"statements,omitempty"`
+	Expression *jsonNode       `json:"expression,omitempty"`
+	Name       *jsonNode       `json:"name,omitempty"`
+	Ctype      *token.Ctype    `json:"ctype,omitempty"`  // 宣言された型
+	VarPos     *int            `json:"varPos,omitempty"` // スタックの何番目にあるか
+	Value      json.RawMessage `json:"value,omitempty"`  // リテラルの値
+	Init       *jsonNode       `json:"init,omitempty"`   // 宣言の初期値
+	ID         *int            `json:"id,omitempty"`
+	Operator   string          `json:"operator,omitempty"`
+	Left       *jsonNode       `json:"left,omitempty"`
+	Right      *jsonNode       `json:"right,omitempty"`
+	Function   *jsonNode       `json:"function,omitempty"`
+	Args       *[]*jsonNode    `json:"args,omitempty"` // 引数リストが読めなかったときはnull
+	Rparen     *token.Position `json:"rparen,omitempty"`
+	EndPos     *token.Position `json:"endPos,omitempty"`
+}
+
+// ノードをJSONにして書き出す
+func EncodeJSON(w io.Writer, node Node) error {
+	n, err := toJSON(node)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(n)
+}
+
+// EncodeJSONで書き出したJSONからノードを復元する
+func DecodeJSON(r io.Reader) (Node, error) {
+	var n jsonNode
+	if err := json.NewDecoder(r).Decode(&n); err != nil {
+		return nil, err
+	}
+	return fromJSON(&n)
+}
+
+func toJSON(node Node) (*jsonNode, error) {
+	if node == nil {
+		return nil, nil
+	}
+	n := &jsonNode{Start: node.Start(), End: node.End()}
+	if e, ok := node.(Expression); ok {
+		ctype := e.GetCtype()
+		n.Type = &ctype
+	}
+
+	var err error
+	switch v := node.(type) {
+	case *Program:
+		n.Kind = "Program"
+		n.Statements = []*jsonNode{}
+		for _, s := range v.Statements {
+			js, err := toJSON(s)
+			if err != nil {
+				return nil, err
+			}
+			n.Statements = append(n.Statements, js)
+		}
+	case *ExpressionStatement:
+		n.Kind = "ExpressionStatement"
+		n.Token = &v.Token
+		n.Expression, err = toJSON(v.Expression)
+	case *DeclStatement:
+		n.Kind = "DeclStatement"
+		n.Token = &v.Token
+		n.Ctype = &v.Ctype
+		n.VarPos = &v.Pos
+		if v.Name != nil {
+			n.Name, err = toJSON(v.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		n.Init, err = toJSON(v.Value)
+	case *BadStmt:
+		n.Kind = "BadStmt"
+		n.Token = &v.Token
+		n.EndPos = &v.EndPos
+	case *Var:
+		n.Kind = "Var"
+		n.Token = &v.Token
+		n.VarPos = &v.Pos
+	case *StringLiteral:
+		n.Kind = "StringLiteral"
+		n.Token = &v.Token
+		n.ID = &v.ID
+		n.Value, err = json.Marshal(v.Value)
+	case *CharLiteral:
+		n.Kind = "CharLiteral"
+		n.Token = &v.Token
+		n.Value, err = json.Marshal(v.Value)
+	case *IntegerLiteral:
+		n.Kind = "IntegerLiteral"
+		n.Token = &v.Token
+		n.Value, err = json.Marshal(v.Value)
+	case *InfixExpression:
+		n.Kind = "InfixExpression"
+		n.Token = &v.Token
+		n.Operator = v.Operator
+		if n.Left, err = toJSON(v.Left); err == nil {
+			n.Right, err = toJSON(v.Right)
+		}
+	case *FuncallExpression:
+		n.Kind = "FuncallExpression"
+		n.Token = &v.Token
+		n.Rparen = &v.Rparen
+		if n.Function, err = toJSON(v.Function); err != nil {
+			return nil, err
+		}
+		var args []*jsonNode
+		if v.Args != nil {
+			args = []*jsonNode{}
+		}
+		for _, a := range v.Args {
+			ja, err := toJSON(a)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, ja)
+		}
+		n.Args = &args
+	case *ConvExpression:
+		n.Kind = "ConvExpression"
+		n.Expression, err = toJSON(v.Expression)
+	case *BadExpr:
+		n.Kind = "BadExpr"
+		n.Token = &v.Token
+	default:
+		return nil, fmt.Errorf("cannot encode node: %T", node)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func fromJSON(n *jsonNode) (Node, error) {
+	if n == nil {
+		return nil, nil
+	}
+	tok := token.Token{}
+	if n.Token != nil {
+		tok = *n.Token
+	}
+
+	switch n.Kind {
+	case "Program":
+		prog := &Program{Statements: []Statement{}}
+		for _, js := range n.Statements {
+			s, err := statementFromJSON(js)
+			if err != nil {
+				return nil, err
+			}
+			prog.Statements = append(prog.Statements, s)
+		}
+		return prog, nil
+	case "ExpressionStatement":
+		e, err := expressionFromJSON(n.Expression)
+		if err != nil {
+			return nil, err
+		}
+		return &ExpressionStatement{Token: tok, Expression: e}, nil
+	case "DeclStatement":
+		decl := &DeclStatement{Token: tok, Ctype: ctypeOf(n.Ctype), Pos: intOf(n.VarPos)}
+		if n.Name != nil {
+			name, err := fromJSON(n.Name)
+			if err != nil {
+				return nil, err
+			}
+			v, ok := name.(*Var)
+			if !ok {
+				return nil, fmt.Errorf("DeclStatement name must be Var, got %s", n.Name.Kind)
+			}
+			decl.Name = v
+		}
+		e, err := expressionFromJSON(n.Init)
+		if err != nil {
+			return nil, err
+		}
+		decl.Value = e
+		return decl, nil
+	case "BadStmt":
+		bs := &BadStmt{Token: tok}
+		if n.EndPos != nil {
+			bs.EndPos = *n.EndPos
+		}
+		return bs, nil
+	case "Var":
+		return &Var{Token: tok, Ctype: ctypeOf(n.Type), Pos: intOf(n.VarPos)}, nil
+	case "StringLiteral":
+		sl := &StringLiteral{Token: tok, ID: intOf(n.ID)}
+		return sl, unmarshalValue(n, &sl.Value)
+	case "CharLiteral":
+		cl := &CharLiteral{Token: tok}
+		return cl, unmarshalValue(n, &cl.Value)
+	case "IntegerLiteral":
+		il := &IntegerLiteral{Token: tok}
+		return il, unmarshalValue(n, &il.Value)
+	case "InfixExpression":
+		left, err := expressionFromJSON(n.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := expressionFromJSON(n.Right)
+		if err != nil {
+			return nil, err
+		}
+		return &InfixExpression{Token: tok, Left: left, Operator: n.Operator, Right: right, Ctype: ctypeOf(n.Type)}, nil
+	case "FuncallExpression":
+		fn, err := expressionFromJSON(n.Function)
+		if err != nil {
+			return nil, err
+		}
+		fe := &FuncallExpression{Token: tok, Function: fn}
+		if n.Rparen != nil {
+			fe.Rparen = *n.Rparen
+		}
+		if n.Args != nil && *n.Args != nil {
+			fe.Args = []Expression{}
+			for _, ja := range *n.Args {
+				a, err := expressionFromJSON(ja)
+				if err != nil {
+					return nil, err
+				}
+				fe.Args = append(fe.Args, a)
+			}
+		}
+		return fe, nil
+	case "ConvExpression":
+		e, err := expressionFromJSON(n.Expression)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			return nil, fmt.Errorf("ConvExpression has no expression")
+		}
+		return &ConvExpression{Expression: e, Ctype: ctypeOf(n.Type)}, nil
+	case "BadExpr":
+		return &BadExpr{Token: tok}, nil
+	default:
+		return nil, fmt.Errorf("unknown node kind: %q", n.Kind)
+	}
+}
+
+func statementFromJSON(n *jsonNode) (Statement, error) {
+	node, err := fromJSON(n)
+	if err != nil || node == nil {
+		return nil, err
+	}
+	s, ok := node.(Statement)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a statement", n.Kind)
+	}
+	return s, nil
+}
+
+func expressionFromJSON(n *jsonNode) (Expression, error) {
+	node, err := fromJSON(n)
+	if err != nil || node == nil {
+		return nil, err
+	}
+	e, ok := node.(Expression)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an expression", n.Kind)
+	}
+	return e, nil
+}
+
+func unmarshalValue(n *jsonNode, v interface{}) error {
+	if len(n.Value) == 0 {
+		return fmt.Errorf("%s has no value", n.Kind)
+	}
+	return json.Unmarshal(n.Value, v)
+}
+
+func ctypeOf(c *token.Ctype) token.Ctype {
+	if c == nil {
+		return token.CTYPE_VOID
+	}
+	return *c
+}
+
+func intOf(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
@@ -0,0 +1,110 @@
+package ast_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/diag"
+	"github.com/kijimaD/gogo/lexer"
+	"github.com/kijimaD/gogo/parser"
+	"github.com/kijimaD/gogo/sema"
+	"github.com/stretchr/testify/assert"
+)
+
+// JSONにしてから戻すと同じASTになる
+func TestJSONRoundTrip(t *testing.T) {
+	tests := []string{
+		`int a = 1+'b'; string s = "x"; sum2(a, 2*3)`,
+		`f()`,
+		`int a 1; 1 +; 2`, // エラーを含む
+	}
+
+	for _, input := range tests {
+		p := parser.New(lexer.New(input))
+		prog := p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			sema.Check("", prog, diag.NewEngine())
+		}
+
+		var buf bytes.Buffer
+		assert.NoError(t, ast.EncodeJSON(&buf, prog))
+		actual, err := ast.DecodeJSON(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, prog, actual)
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	p := parser.New(lexer.New(`int a = 1; a+'a'`))
+	prog := p.ParseProgram()
+	sema.Check("", prog, diag.NewEngine())
+
+	var buf bytes.Buffer
+	assert.NoError(t, ast.EncodeJSON(&buf, prog))
+
+	var actual map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &actual))
+	// 宣言の初期値は"init"に置き、"value"はリテラルの値だけに使う
+	decl := actual["statements"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "DeclStatement", decl["kind"])
+	assert.Equal(t, "int", decl["ctype"])
+	assert.NotContains(t, decl, "value")
+	init := decl["init"].(map[string]interface{})
+	assert.Equal(t, "IntegerLiteral", init["kind"])
+	assert.Equal(t, 1.0, init["value"])
+
+	// 式の型は"type"だけに持つ
+	name := decl["name"].(map[string]interface{})
+	assert.Equal(t, "Var", name["kind"])
+	assert.Equal(t, "int", name["type"])
+	assert.NotContains(t, name, "ctype")
+
+	stmt := actual["statements"].([]interface{})[1].(map[string]interface{})
+	assert.Equal(t, "ExpressionStatement", stmt["kind"])
+
+	infix := stmt["expression"].(map[string]interface{})
+	assert.Equal(t, "InfixExpression", infix["kind"])
+	assert.Equal(t, "+", infix["operator"])
+	assert.Equal(t, "int", infix["type"])
+	assert.Equal(t, map[string]interface{}{"line": 1.0, "column": 12.0}, infix["start"])
+	assert.Equal(t, map[string]interface{}{"line": 1.0, "column": 17.0}, infix["end"])
+
+	right := infix["right"].(map[string]interface{})
+	// 意味解析で挿入された型変換
+	assert.Equal(t, "ConvExpression", right["kind"])
+	assert.Equal(t, "int", right["type"])
+
+	char := right["expression"].(map[string]interface{})
+	assert.Equal(t, "CharLiteral", char["kind"])
+	assert.Equal(t, "char", char["type"])
+	assert.Equal(t, 97.0, char["value"])
+
+	// 意味解析で計算した定数式も、書かれたとおりの式のまま出力する
+	p = parser.New(lexer.New(`1+'a'`))
+	prog = p.ParseProgram()
+	sema.Check("", prog, diag.NewEngine())
+	buf.Reset()
+	assert.NoError(t, ast.EncodeJSON(&buf, prog))
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &actual))
+	infix = actual["statements"].([]interface{})[0].(map[string]interface{})["expression"].(map[string]interface{})
+	assert.Equal(t, "InfixExpression", infix["kind"])
+	assert.Equal(t, "+", infix["operator"])
+	assert.Equal(t, 1.0, infix["left"].(map[string]interface{})["value"])
+}
+
+func TestDecodeJSONError(t *testing.T) {
+	tests := []string{
+		`{"kind": "Unknown"}`,
+		`{"kind": "Program", "statements": [{"kind": "IntegerLiteral", "value": 1}]}`,
+		`{"kind": "ExpressionStatement", "expression": {"kind": "BadStmt"}}`,
+		`{"kind": "IntegerLiteral"}`,
+		`not json`,
+	}
+
+	for _, input := range tests {
+		_, err := ast.DecodeJSON(bytes.NewBufferString(input))
+		assert.Error(t, err, input)
+	}
+}
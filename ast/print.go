@@ -0,0 +1,93 @@
+package ast
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kijimaD/gogo/token"
+)
+
+// ノードを字下げした木の形で出力する。String()と違って型や位置も表示する
+//
+//	Program
+//	  DeclStatement int a [1:1-1:10]
+//	    IntegerLiteral 1 (int) [1:9-1:10]
+func Fprint(w io.Writer, node Node) error {
+	p := &printer{w: w}
+	p.print(node, 0, "")
+	return p.err
+}
+
+type printer struct {
+	w   io.Writer
+	err error
+}
+
+func (p *printer) printf(depth int, label string, format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	if label != "" {
+		label += ": "
+	}
+	_, p.err = fmt.Fprintf(p.w, "%s%s%s\n", strings.Repeat("  ", depth), label, fmt.Sprintf(format, args...))
+}
+
+func (p *printer) print(node Node, depth int, label string) {
+	switch n := node.(type) {
+	case nil:
+		p.printf(depth, label, "nil")
+	case *Program:
+		p.printf(depth, label, "Program")
+		for _, s := range n.Statements {
+			p.print(s, depth+1, "")
+		}
+	case *ExpressionStatement:
+		p.printf(depth, label, "ExpressionStatement %s", span(n))
+		p.print(n.Expression, depth+1, "")
+	case *DeclStatement:
+		name := ""
+		if n.Name != nil {
+			name = n.Name.Token.Literal
+		}
+		p.printf(depth, label, "DeclStatement %s %s (pos %d) %s", n.Ctype, name, n.Pos, span(n))
+		p.print(n.Value, depth+1, "")
+	case *BadStmt:
+		p.printf(depth, label, "BadStmt %s", span(n))
+	case *IntegerLiteral:
+		p.printf(depth, label, "IntegerLiteral %d (%s) %s", n.Value, n.GetCtype(), span(n))
+	case *CharLiteral:
+		p.printf(depth, label, "CharLiteral %q (%s) %s", n.Value, n.GetCtype(), span(n))
+	case *StringLiteral:
+		p.printf(depth, label, "StringLiteral %q .s%d (%s) %s", n.Value, n.ID, n.GetCtype(), span(n))
+	case *Var:
+		p.printf(depth, label, "Var %s (pos %d) (%s) %s", n.Token.Literal, n.Pos, n.GetCtype(), span(n))
+	case *InfixExpression:
+		p.printf(depth, label, "InfixExpression %s (%s) %s", n.Operator, n.GetCtype(), span(n))
+		p.print(n.Left, depth+1, "left")
+		p.print(n.Right, depth+1, "right")
+	case *FuncallExpression:
+		p.printf(depth, label, "FuncallExpression (%s) %s", n.GetCtype(), span(n))
+		p.print(n.Function, depth+1, "function")
+		for i, a := range n.Args {
+			p.print(a, depth+1, fmt.Sprintf("arg%d", i))
+		}
+	case *ConvExpression:
+		p.printf(depth, label, "ConvExpression (%s) %s", n.GetCtype(), span(n))
+		p.print(n.Expression, depth+1, "")
+	case *BadExpr:
+		p.printf(depth, label, "BadExpr %s", span(n))
+	default:
+		p.printf(depth, label, "%T", n)
+	}
+}
+
+// [開始行:開始列-終了行:終了列]
+func span(n Node) string {
+	return fmt.Sprintf("[%s-%s]", posString(n.Start()), posString(n.End()))
+}
+
+func posString(p token.Position) string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
@@ -0,0 +1,35 @@
+package ast
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kijimaD/gogo/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFprint(t *testing.T) {
+	pos := func(col int) token.Position { return token.Position{Line: 1, Column: col} }
+	prog := &Program{Statements: []Statement{
+		&ExpressionStatement{
+			Token: token.Token{Type: token.INT, Literal: "1", Pos: pos(1), End: pos(2)},
+			Expression: &InfixExpression{
+				Token:    token.Token{Type: token.PLUS, Literal: "+", Pos: pos(3), End: pos(4)},
+				Left:     &IntegerLiteral{Token: token.Token{Type: token.INT, Literal: "1", Pos: pos(1), End: pos(2)}, Value: 1},
+				Operator: "+",
+				Right:    &CharLiteral{Token: token.Token{Type: token.CHAR, Literal: "a", Pos: pos(5), End: pos(8)}, Value: 'a'},
+				Ctype:    token.CTYPE_INT,
+			},
+		},
+	}}
+
+	var buf bytes.Buffer
+	assert.NoError(t, Fprint(&buf, prog))
+	expect := `Program
+  ExpressionStatement [1:1-1:8]
+    InfixExpression + (int) [1:1-1:8]
+      left: IntegerLiteral 1 (int) [1:1-1:2]
+      right: CharLiteral 'a' (char) [1:5-1:8]
+`
+	assert.Equal(t, expect, buf.String())
+}
@@ -0,0 +1,133 @@
+package ast
+
+import "fmt"
+
+// go/ast と同じ形の走査API
+// 新しいノードを追加したら、walkChildrenとRewriteに子ノードを追加する
+
+// Walkがノードを訪れるたびにVisitを呼ぶ
+// 返り値のwがnilでなければ、wで子ノードを訪れたあとにw.Visit(nil)を呼ぶ
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// 深さ優先でノードを走査する
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	walkChildren(node, func(child Node) { Walk(v, child) })
+	v.Visit(nil)
+}
+
+func walkChildren(node Node, f func(Node)) {
+	switch n := node.(type) {
+	case *Program:
+		for _, s := range n.Statements {
+			f(s)
+		}
+	case *ExpressionStatement:
+		if n.Expression != nil {
+			f(n.Expression)
+		}
+	case *DeclStatement:
+		if n.Name != nil {
+			f(n.Name)
+		}
+		if n.Value != nil {
+			f(n.Value)
+		}
+	case *InfixExpression:
+		if n.Left != nil {
+			f(n.Left)
+		}
+		if n.Right != nil {
+			f(n.Right)
+		}
+	case *FuncallExpression:
+		if n.Function != nil {
+			f(n.Function)
+		}
+		for _, a := range n.Args {
+			f(a)
+		}
+	case *ConvExpression:
+		if n.Expression != nil {
+			f(n.Expression)
+		}
+	case *Var, *StringLiteral, *CharLiteral, *IntegerLiteral, *BadExpr, *BadStmt:
+		// 子ノードはない
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// 深さ優先でノードを走査してfを呼ぶ。fがfalseを返すと、そのノードの子は訪れない
+// 子ノードを訪れたあとにf(nil)を呼ぶ
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
+
+// 子ノードから順にfを呼び、返り値でノードを置き換える。置き換えない場合は引数をそのまま返す
+// 式の位置に式でないノードを返すなど、置き換えられない場合はパニックする
+func Rewrite(node Node, f func(Node) Node) Node {
+	switch n := node.(type) {
+	case *Program:
+		for i, s := range n.Statements {
+			n.Statements[i] = rewriteStatement(s, f)
+		}
+	case *ExpressionStatement:
+		n.Expression = rewriteExpression(n.Expression, f)
+	case *DeclStatement:
+		if n.Name != nil {
+			v, ok := Rewrite(n.Name, f).(*Var)
+			if !ok {
+				panic("ast.Rewrite: DeclStatement.Name must be *Var")
+			}
+			n.Name = v
+		}
+		n.Value = rewriteExpression(n.Value, f)
+	case *InfixExpression:
+		n.Left = rewriteExpression(n.Left, f)
+		n.Right = rewriteExpression(n.Right, f)
+	case *FuncallExpression:
+		n.Function = rewriteExpression(n.Function, f)
+		for i, a := range n.Args {
+			n.Args[i] = rewriteExpression(a, f)
+		}
+	case *ConvExpression:
+		n.Expression = rewriteExpression(n.Expression, f)
+	}
+	return f(node)
+}
+
+func rewriteStatement(s Statement, f func(Node) Node) Statement {
+	if s == nil {
+		return nil
+	}
+	r, ok := Rewrite(s, f).(Statement)
+	if !ok {
+		panic(fmt.Sprintf("ast.Rewrite: %T cannot be replaced with a non-statement", s))
+	}
+	return r
+}
+
+func rewriteExpression(e Expression, f func(Node) Node) Expression {
+	if e == nil {
+		return nil
+	}
+	r, ok := Rewrite(e, f).(Expression)
+	if !ok {
+		panic(fmt.Sprintf("ast.Rewrite: %T cannot be replaced with a non-expression", e))
+	}
+	return r
+}
@@ -0,0 +1,103 @@
+package ast_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/lexer"
+	"github.com/kijimaD/gogo/parser"
+	"github.com/kijimaD/gogo/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	prog := p.ParseProgram()
+	assert.Empty(t, p.Errors())
+	return prog
+}
+
+// 訪れた順に記録する
+type recorder struct {
+	visited []string
+	depth   int
+}
+
+func (r *recorder) Visit(node ast.Node) ast.Visitor {
+	if node == nil {
+		r.depth--
+		return nil
+	}
+	r.visited = append(r.visited, fmt.Sprintf("%s%T", strings.Repeat(" ", r.depth), node))
+	r.depth++
+	return r
+}
+
+func TestWalk(t *testing.T) {
+	prog := parse(t, `int a = 1 + 2; f(a, "s")`)
+
+	r := &recorder{}
+	ast.Walk(r, prog)
+	expect := []string{
+		"*ast.Program",
+		" *ast.DeclStatement",
+		"  *ast.Var",
+		"  *ast.InfixExpression",
+		"   *ast.IntegerLiteral",
+		"   *ast.IntegerLiteral",
+		" *ast.ExpressionStatement",
+		"  *ast.FuncallExpression",
+		"   *ast.Var",
+		"   *ast.Var",
+		"   *ast.StringLiteral",
+	}
+	assert.Equal(t, expect, r.visited)
+	assert.Equal(t, 0, r.depth)
+}
+
+func TestInspect(t *testing.T) {
+	prog := parse(t, `1 + 2 * 3; f(4, 5)`)
+
+	// 関数呼び出しの中には入らない
+	literals := []string{}
+	ast.Inspect(prog, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.IntegerLiteral:
+			literals = append(literals, n.String())
+		case *ast.FuncallExpression:
+			return false
+		}
+		return true
+	})
+	assert.Equal(t, []string{"1", "2", "3"}, literals)
+}
+
+func TestRewrite(t *testing.T) {
+	prog := parse(t, `int a = 1 + 2; f(a, 3)`)
+
+	// 整数リテラルを2倍にする
+	result := ast.Rewrite(prog, func(n ast.Node) ast.Node {
+		if il, ok := n.(*ast.IntegerLiteral); ok {
+			v := il.Value * 2
+			return &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: fmt.Sprint(v)}, Value: v}
+		}
+		return n
+	})
+	assert.Equal(t, `(int a = (2 + 4))f(a, 6)`, result.String())
+}
+
+func TestRewritePanic(t *testing.T) {
+	prog := parse(t, `1 + 2`)
+
+	assert.Panics(t, func() {
+		ast.Rewrite(prog, func(n ast.Node) ast.Node {
+			if _, ok := n.(*ast.IntegerLiteral); ok {
+				return &ast.BadStmt{}
+			}
+			return n
+		})
+	})
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+
+	"github.com/kijimaD/gogo"
+	"github.com/kijimaD/gogo/driver"
+)
+
+func main() {
+	d := driver.New(os.Stdin, os.Stdout, os.Stderr)
+	d.Runtime = gogo.Runtime
+	os.Exit(d.Run(os.Args[1:]))
+}
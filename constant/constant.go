@@ -0,0 +1,153 @@
+// 整数定数式の評価
+// Cと同じく、演算は型の幅で行う。charの演算はintに拡張してから行う
+// 意味解析で、intとcharの定数式を畳み込み、0での除算やオーバーフローを診断するのに使う
+
+package constant
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/token"
+)
+
+var (
+	// 変数や関数呼び出しを含んでいて、コンパイル時には値が決まらない
+	ErrNotConstant = errors.New("not a constant expression")
+	// 0で割った。結果は未定義なので値はない
+	ErrDivisionByZero = errors.New("division by zero is undefined")
+)
+
+// 型の範囲に収まらない結果を、型の幅で折り返した
+type OverflowError struct {
+	Op     string
+	X, Y   Value
+	Result Value
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("overflow in expression %d %s %d; result is %d with type %s", e.X.Int, e.Op, e.Y.Int, e.Result.Int, e.Result.Ctype)
+}
+
+// 定数の値と型
+type Value struct {
+	Int   int64
+	Ctype token.Ctype
+}
+
+func (v Value) String() string {
+	return fmt.Sprintf("%d (%s)", v.Int, v.Ctype)
+}
+
+// 型のビット数
+func width(ctype token.Ctype) int {
+	switch ctype {
+	case token.CTYPE_CHAR:
+		return 8
+	default:
+		return 32
+	}
+}
+
+// 値を型の幅に切り詰めて、符号拡張する
+func wrap(v int64, ctype token.Ctype) int64 {
+	switch width(ctype) {
+	case 8:
+		return int64(int8(v))
+	default:
+		return int64(int32(v))
+	}
+}
+
+// 型を変換する。幅の狭い型へは切り詰める
+func Convert(v Value, ctype token.Ctype) Value {
+	return Value{Int: wrap(v.Int, ctype), Ctype: ctype}
+}
+
+// 二項演算。オペランドは通常の算術変換でintにそろえる
+// 結果が型の範囲を超えれば、折り返した値と*OverflowErrorを返す
+func BinaryOp(op string, x Value, y Value) (Value, error) {
+	x = Convert(x, token.CTYPE_INT)
+	y = Convert(y, token.CTYPE_INT)
+
+	var r int64
+	switch op {
+	case token.PLUS:
+		r = x.Int + y.Int
+	case token.MINUS:
+		r = x.Int - y.Int
+	case token.ASTERISK:
+		r = x.Int * y.Int
+	case token.SLASH:
+		if y.Int == 0 {
+			return Value{}, ErrDivisionByZero
+		}
+		// Cの除算は0の方向に切り捨てる。Goと同じ
+		r = x.Int / y.Int
+	default:
+		return Value{}, fmt.Errorf("unknown operator: %s", op)
+	}
+
+	result := Value{Int: wrap(r, token.CTYPE_INT), Ctype: token.CTYPE_INT}
+	if result.Int != r {
+		return result, &OverflowError{Op: op, X: x, Y: y, Result: result}
+	}
+	return result, nil
+}
+
+// リテラルの値。リテラルでなければfalse
+func Literal(e ast.Expression) (Value, bool) {
+	switch n := e.(type) {
+	case *ast.IntegerLiteral:
+		return Value{Int: wrap(n.Value, token.CTYPE_INT), Ctype: token.CTYPE_INT}, true
+	case *ast.CharLiteral:
+		return Value{Int: wrap(int64(n.Value), token.CTYPE_CHAR), Ctype: token.CTYPE_CHAR}, true
+	default:
+		return Value{}, false
+	}
+}
+
+// 整数定数式を評価する
+// 定数でなければErrNotConstant、0で割ればErrDivisionByZeroを返す
+// オーバーフローは値を折り返して続け、最初に起きたものを*OverflowErrorで返す
+func Eval(e ast.Expression) (Value, error) {
+	if v, ok := Literal(e); ok {
+		return v, nil
+	}
+
+	switch n := e.(type) {
+	case *ast.ConvExpression:
+		v, err := Eval(n.Expression)
+		if err != nil && !isOverflow(err) {
+			return Value{}, err
+		}
+		return Convert(v, n.Ctype), err
+	case *ast.InfixExpression:
+		x, errx := Eval(n.Left)
+		if errx != nil && !isOverflow(errx) {
+			return Value{}, errx
+		}
+		y, erry := Eval(n.Right)
+		if erry != nil && !isOverflow(erry) {
+			return Value{}, erry
+		}
+		v, err := BinaryOp(n.Operator, x, y)
+		if err != nil && !isOverflow(err) {
+			return Value{}, err
+		}
+		for _, e := range []error{errx, erry} {
+			if e != nil {
+				return v, e
+			}
+		}
+		return v, err
+	default:
+		return Value{}, ErrNotConstant
+	}
+}
+
+func isOverflow(err error) bool {
+	var o *OverflowError
+	return errors.As(err, &o)
+}
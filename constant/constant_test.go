@@ -0,0 +1,129 @@
+package constant
+
+import (
+	"testing"
+
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/lexer"
+	"github.com/kijimaD/gogo/parser"
+	"github.com/kijimaD/gogo/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseExpr(t *testing.T, input string) ast.Expression {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	prog := p.ParseProgram()
+	assert.Empty(t, p.Errors())
+	return prog.Statements[0].(*ast.ExpressionStatement).Expression
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect Value
+	}{
+		{`1`, Value{1, token.CTYPE_INT}},
+		{`'a'`, Value{97, token.CTYPE_CHAR}},
+		{`1 + 2 * 3`, Value{7, token.CTYPE_INT}},
+		{`'a' + 'b'`, Value{195, token.CTYPE_INT}},
+		{`7 / 2`, Value{3, token.CTYPE_INT}},
+		{`1 - 7 / 2`, Value{-2, token.CTYPE_INT}},
+	}
+
+	for _, tt := range tests {
+		v, err := Eval(parseExpr(t, tt.input))
+		assert.NoError(t, err, tt.input)
+		assert.Equal(t, tt.expect, v, tt.input)
+	}
+}
+
+func TestEvalError(t *testing.T) {
+	_, err := Eval(parseExpr(t, `a + 1`))
+	assert.ErrorIs(t, err, ErrNotConstant)
+	_, err = Eval(parseExpr(t, `f()`))
+	assert.ErrorIs(t, err, ErrNotConstant)
+	_, err = Eval(parseExpr(t, `1 + 2 / 0`))
+	assert.ErrorIs(t, err, ErrDivisionByZero)
+
+	// オーバーフローしても、折り返した値で計算を続ける
+	v, err := Eval(parseExpr(t, `2147483647 + 1 - 1`))
+	var overflow *OverflowError
+	assert.ErrorAs(t, err, &overflow)
+	assert.Equal(t, int64(-2147483648), overflow.Result.Int)
+	assert.Equal(t, Value{2147483647, token.CTYPE_INT}, v)
+}
+
+func TestBinaryOp(t *testing.T) {
+	intMin := Value{-2147483648, token.CTYPE_INT}
+	tests := []struct {
+		op       string
+		x, y     Value
+		expect   Value
+		overflow bool
+	}{
+		{token.PLUS, Value{1, token.CTYPE_INT}, Value{2, token.CTYPE_INT}, Value{3, token.CTYPE_INT}, false},
+		// charはintに拡張してから計算する
+		{token.PLUS, Value{127, token.CTYPE_CHAR}, Value{1, token.CTYPE_CHAR}, Value{128, token.CTYPE_INT}, false},
+		{token.MINUS, intMin, Value{1, token.CTYPE_INT}, Value{2147483647, token.CTYPE_INT}, true},
+		{token.ASTERISK, Value{65536, token.CTYPE_INT}, Value{65536, token.CTYPE_INT}, Value{0, token.CTYPE_INT}, true},
+		{token.SLASH, Value{-7, token.CTYPE_INT}, Value{2, token.CTYPE_INT}, Value{-3, token.CTYPE_INT}, false},
+		{token.SLASH, intMin, Value{-1, token.CTYPE_INT}, intMin, true},
+	}
+
+	for _, tt := range tests {
+		v, err := BinaryOp(tt.op, tt.x, tt.y)
+		assert.Equal(t, tt.expect, v)
+		if tt.overflow {
+			var overflow *OverflowError
+			assert.ErrorAs(t, err, &overflow)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	_, err := BinaryOp(token.SLASH, Value{1, token.CTYPE_INT}, Value{0, token.CTYPE_INT})
+	assert.ErrorIs(t, err, ErrDivisionByZero)
+}
+
+func TestConvert(t *testing.T) {
+	assert.Equal(t, Value{44, token.CTYPE_CHAR}, Convert(Value{300, token.CTYPE_INT}, token.CTYPE_CHAR))
+	assert.Equal(t, Value{-1, token.CTYPE_CHAR}, Convert(Value{255, token.CTYPE_INT}, token.CTYPE_CHAR))
+	assert.Equal(t, Value{-56, token.CTYPE_INT}, Convert(Value{-56, token.CTYPE_CHAR}, token.CTYPE_INT))
+}
+
+func TestUnquote(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect string
+	}{
+		{`abc`, "abc"},
+		{`%d\n`, "%d\n"},
+		{`\t\\\"`, "\t\\\""},
+		{`\x41\x4a\x414`, "AJA4"},
+		{`\101\0\377`, "A\x00\xff"},
+		{`\'`, "'"},
+	}
+	for _, tt := range tests {
+		b, err := Unquote(tt.value)
+		assert.NoError(t, err, tt.value)
+		assert.Equal(t, []byte(tt.expect), b, tt.value)
+	}
+}
+
+func TestUnquoteError(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect string
+	}{
+		{`\x`, `\x used with no following hex digits`},
+		{`a\xg`, `\x used with no following hex digits`},
+		{`\777`, `octal escape sequence \777 out of range`},
+		{`\400`, `octal escape sequence \400 out of range`},
+		{`ab\`, `incomplete escape sequence at the end of "ab\"`},
+	}
+	for _, tt := range tests {
+		_, err := Unquote(tt.value)
+		assert.EqualError(t, err, tt.expect, tt.value)
+	}
+}
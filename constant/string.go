@@ -0,0 +1,64 @@
+package constant
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 文字列リテラルの中身の、エスケープシーケンスを解釈したバイト列。終端のヌル文字は含まない
+// \xは2桁まで、8進数は3桁までを読む。数字のない\xと、1バイトに収まらない8進数はエラーにする
+func Unquote(s string) ([]byte, error) {
+	b := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+1 == len(s) {
+			return nil, fmt.Errorf("incomplete escape sequence at the end of \"%s\"", s)
+		}
+		i++
+		switch c := s[i]; c {
+		case 'n':
+			b = append(b, '\n')
+		case 't':
+			b = append(b, '\t')
+		case 'r':
+			b = append(b, '\r')
+		case 'a':
+			b = append(b, '\a')
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'v':
+			b = append(b, '\v')
+		case 'x':
+			j := i + 1
+			for j < len(s) && j < i+3 && strings.IndexByte("0123456789abcdefABCDEF", s[j]) >= 0 {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("\\x used with no following hex digits")
+			}
+			v, _ := strconv.ParseUint(s[i+1:j], 16, 8)
+			b = append(b, byte(v))
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(s) && j < i+3 && '0' <= s[j] && s[j] <= '7' {
+				j++
+			}
+			v, err := strconv.ParseUint(s[i:j], 8, 8)
+			if err != nil {
+				return nil, fmt.Errorf("octal escape sequence \\%s out of range", s[i:j])
+			}
+			b = append(b, byte(v))
+			i = j - 1
+		default:
+			b = append(b, c)
+		}
+	}
+	return b, nil
+}
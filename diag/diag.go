@@ -0,0 +1,194 @@
+// コンパイラの各段階が報告する診断(エラーや警告)を表す
+// 文字列ではなく構造をもたせることで、テキスト・JSON・SARIFのどれでも出力できる
+
+package diag
+
+import (
+	"fmt"
+
+	"github.com/kijimaD/gogo/token"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+	SeverityNote
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	case SeverityNote:
+		return "note"
+	default:
+		return "unknown"
+	}
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Severity) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "error":
+		*s = SeverityError
+	case "warning":
+		*s = SeverityWarning
+	case "note":
+		*s = SeverityNote
+	default:
+		return fmt.Errorf("unknown severity: %s", b)
+	}
+	return nil
+}
+
+// 診断の種類。SARIFのruleIdにもなる
+type Code string
+
+const (
+	IllegalToken         Code = "illegal-token"
+	UnexpectedToken      Code = "unexpected-token"
+	ExpectedExpression   Code = "expected-expression"
+	InvalidInteger       Code = "invalid-integer"
+	UnknownType          Code = "unknown-type"
+	UndeclaredVariable   Code = "undeclared-variable"
+	IncompatibleOperands Code = "incompatible-operands"
+	IncompatibleInit     Code = "incompatible-init"
+	Redefinition         Code = "redefinition"
+	DivisionByZero       Code = "division-by-zero"
+	IntegerOverflow      Code = "integer-overflow"
+	InvalidDirective     Code = "invalid-directive"
+	IncludeNotFound      Code = "include-not-found"
+	UnsupportedCall      Code = "unsupported-call"
+	InvalidEscape        Code = "invalid-escape"
+)
+
+// 診断の種類ごとの説明
+var descriptions = map[Code]string{
+	IllegalToken:         "The lexer found a character sequence that is not a valid token.",
+	UnexpectedToken:      "The parser expected a different token.",
+	ExpectedExpression:   "An expression was expected but none was found.",
+	InvalidInteger:       "An integer literal could not be represented.",
+	UnknownType:          "A declaration used an unknown type name.",
+	UndeclaredVariable:   "A variable was used without being declared.",
+	IncompatibleOperands: "The operand types of a binary expression are incompatible.",
+	IncompatibleInit:     "A variable was initialized with a value of an incompatible type.",
+	Redefinition:         "A variable was declared twice.",
+	DivisionByZero:       "An integer was divided by a constant zero.",
+	IntegerOverflow:      "The result of a constant expression does not fit in its type.",
+	InvalidDirective:     "A preprocessor directive is malformed or not supported.",
+	IncludeNotFound:      "A file named by #include was not found in the include paths.",
+	UnsupportedCall:      "A function call cannot be translated into the chosen output language.",
+	InvalidEscape:        "A string literal contains a malformed or out-of-range escape sequence.",
+}
+
+func (c Code) Description() string {
+	if d, ok := descriptions[c]; ok {
+		return d
+	}
+	return string(c)
+}
+
+// ソースコード上の範囲。Endは範囲の直後を指す
+type Range struct {
+	File  string         `json:"file"`
+	Start token.Position `json:"start"`
+	End   token.Position `json:"end"`
+}
+
+// トークンが占める範囲
+func TokenRange(file string, tok token.Token) Range {
+	return Range{File: file, Start: tok.Pos, End: tok.End}
+}
+
+func (r Range) String() string {
+	file := r.File
+	if file == "" {
+		file = "<stdin>"
+	}
+	return fmt.Sprintf("%s:%d:%d", file, r.Start.Line, r.Start.Column)
+}
+
+// 診断に付随する補足情報
+type Note struct {
+	Message string `json:"message"`
+	Range   Range  `json:"range"`
+}
+
+// 修正候補。Rangeの範囲をReplacementで置き換える。挿入ならStartとEndが同じになる
+type FixIt struct {
+	Message     string `json:"message"`
+	Range       Range  `json:"range"`
+	Replacement string `json:"replacement"`
+}
+
+type Diagnostic struct {
+	Code     Code     `json:"code"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+	Range    Range    `json:"range"`
+	Notes    []Note   `json:"notes,omitempty"`
+	FixIts   []FixIt  `json:"fixits,omitempty"`
+}
+
+// file:line:col: error: message [code]
+func (d *Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s [%s]", d.Range, d.Severity, d.Message, d.Code)
+}
+
+func (d *Diagnostic) AddNote(r Range, format string, args ...interface{}) *Diagnostic {
+	d.Notes = append(d.Notes, Note{Message: fmt.Sprintf(format, args...), Range: r})
+	return d
+}
+
+func (d *Diagnostic) AddFixIt(r Range, replacement string, message string) *Diagnostic {
+	d.FixIts = append(d.FixIts, FixIt{Message: message, Range: r, Replacement: replacement})
+	return d
+}
+
+// 診断を集める。字句解析・構文解析など、すべての段階で同じものを使う
+type Engine struct {
+	diags []*Diagnostic
+}
+
+func NewEngine() *Engine {
+	return &Engine{diags: []*Diagnostic{}}
+}
+
+func (e *Engine) Report(sev Severity, code Code, r Range, format string, args ...interface{}) *Diagnostic {
+	d := &Diagnostic{
+		Code:     code,
+		Severity: sev,
+		Message:  fmt.Sprintf(format, args...),
+		Range:    r,
+	}
+	e.diags = append(e.diags, d)
+	return d
+}
+
+func (e *Engine) Errorf(code Code, r Range, format string, args ...interface{}) *Diagnostic {
+	return e.Report(SeverityError, code, r, format, args...)
+}
+
+func (e *Engine) Warningf(code Code, r Range, format string, args ...interface{}) *Diagnostic {
+	return e.Report(SeverityWarning, code, r, format, args...)
+}
+
+func (e *Engine) Diagnostics() []*Diagnostic {
+	return e.diags
+}
+
+func (e *Engine) HasErrors() bool {
+	for _, d := range e.diags {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
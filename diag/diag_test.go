@@ -0,0 +1,89 @@
+package diag
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/kijimaD/gogo/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func testDiagnostics() []*Diagnostic {
+	e := NewEngine()
+	r := Range{
+		File:  "a.c",
+		Start: token.Position{Line: 1, Column: 3},
+		End:   token.Position{Line: 1, Column: 4},
+	}
+	e.Errorf(IncompatibleOperands, r, "incompatible operands").
+		AddNote(Range{File: "a.c", Start: token.Position{Line: 1, Column: 1}}, "operand has type int").
+		AddFixIt(Range{File: "a.c", Start: r.End, End: r.End}, ";", "insert ';'")
+	e.Warningf(UnexpectedToken, r, "warn")
+	return e.Diagnostics()
+}
+
+func TestEngineHasErrors(t *testing.T) {
+	e := NewEngine()
+	assert.False(t, e.HasErrors())
+	e.Warningf(UnexpectedToken, Range{}, "warn")
+	assert.False(t, e.HasErrors())
+	e.Errorf(UnexpectedToken, Range{}, "error")
+	assert.True(t, e.HasErrors())
+}
+
+func TestWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteText(&buf, testDiagnostics()))
+	expect := `a.c:1:3: error: incompatible operands [incompatible-operands]
+a.c:1:1: note: operand has type int
+a.c:1:4: fix-it: insert ';': ";"
+a.c:1:3: warning: warn [unexpected-token]
+`
+	assert.Equal(t, expect, buf.String())
+}
+
+// JSONから元の診断に戻せる
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	ds := testDiagnostics()
+	assert.NoError(t, WriteJSON(&buf, ds))
+
+	var actual []*Diagnostic
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &actual))
+	assert.Equal(t, ds, actual)
+}
+
+func TestWriteSARIF(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteSARIF(&buf, testDiagnostics()))
+
+	var log sarifLog
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &log))
+	assert.Equal(t, "2.1.0", log.Version)
+	assert.Equal(t, 1, len(log.Runs))
+
+	run := log.Runs[0]
+	assert.Equal(t, []sarifRule{
+		{ID: "incompatible-operands", ShortDescription: sarifMessage{Text: IncompatibleOperands.Description()}},
+		{ID: "unexpected-token", ShortDescription: sarifMessage{Text: UnexpectedToken.Description()}},
+	}, run.Tool.Driver.Rules)
+	assert.Equal(t, 2, len(run.Results))
+
+	result := run.Results[0]
+	assert.Equal(t, "error", result.Level)
+	assert.Equal(t, "a.c", result.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	assert.Equal(t, sarifRegion{StartLine: 1, StartColumn: 3, EndLine: 1, EndColumn: 4}, result.Locations[0].PhysicalLocation.Region)
+	assert.Equal(t, "operand has type int", result.RelatedLocations[0].Message.Text)
+	assert.Equal(t, ";", result.Fixes[0].ArtifactChanges[0].Replacements[0].InsertedContent.Text)
+	assert.Equal(t, "warning", run.Results[1].Level)
+}
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("sarif")
+	assert.NoError(t, err)
+	assert.Equal(t, FormatSARIF, f)
+
+	_, err = ParseFormat("xml")
+	assert.Error(t, err)
+}
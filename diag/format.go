@@ -0,0 +1,71 @@
+package diag
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// 診断の出力形式
+type Format string
+
+const (
+	FormatText  Format = "text"
+	FormatJSON  Format = "json"
+	FormatSARIF Format = "sarif"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatText, FormatJSON, FormatSARIF:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown diagnostics format: %s", s)
+	}
+}
+
+// 指定した形式で診断を書き出す
+func Write(w io.Writer, f Format, ds []*Diagnostic) error {
+	switch f {
+	case FormatText:
+		return WriteText(w, ds)
+	case FormatJSON:
+		return WriteJSON(w, ds)
+	case FormatSARIF:
+		return WriteSARIF(w, ds)
+	default:
+		return fmt.Errorf("unknown diagnostics format: %s", f)
+	}
+}
+
+// 人が読むための形式
+//
+//	<stdin>:1:3: error: message [code]
+//	<stdin>:1:1: note: message
+func WriteText(w io.Writer, ds []*Diagnostic) error {
+	for _, d := range ds {
+		if _, err := fmt.Fprintln(w, d); err != nil {
+			return err
+		}
+		for _, n := range d.Notes {
+			if _, err := fmt.Fprintf(w, "%s: note: %s\n", n.Range, n.Message); err != nil {
+				return err
+			}
+		}
+		for _, f := range d.FixIts {
+			if _, err := fmt.Fprintf(w, "%s: fix-it: %s: %q\n", f.Range, f.Message, f.Replacement); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func WriteJSON(w io.Writer, ds []*Diagnostic) error {
+	if ds == nil {
+		ds = []*Diagnostic{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ds)
+}
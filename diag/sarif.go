@@ -0,0 +1,183 @@
+package diag
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// SARIF 2.1.0 の必要な部分だけを表す
+// https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+
+const (
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifVersion = "2.1.0"
+	toolName     = "gogo"
+	toolURI      = "https://github.com/kijimaD/gogo"
+)
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID           string          `json:"ruleId"`
+	Level            string          `json:"level"`
+	Message          sarifMessage    `json:"message"`
+	Locations        []sarifLocation `json:"locations"`
+	RelatedLocations []sarifLocation `json:"relatedLocations,omitempty"`
+	Fixes            []sarifFix      `json:"fixes,omitempty"`
+}
+
+type sarifLocation struct {
+	ID               *int                  `json:"id,omitempty"`
+	Message          *sarifMessage         `json:"message,omitempty"`
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+}
+
+type sarifFix struct {
+	Description     sarifMessage          `json:"description"`
+	ArtifactChanges []sarifArtifactChange `json:"artifactChanges"`
+}
+
+type sarifArtifactChange struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Replacements     []sarifReplacement    `json:"replacements"`
+}
+
+type sarifReplacement struct {
+	DeletedRegion   sarifRegion  `json:"deletedRegion"`
+	InsertedContent sarifMessage `json:"insertedContent"`
+}
+
+func WriteSARIF(w io.Writer, ds []*Diagnostic) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           toolName,
+			InformationURI: toolURI,
+			Rules:          sarifRules(ds),
+		}},
+		Results: []sarifResult{},
+	}
+	for _, d := range ds {
+		run.Results = append(run.Results, sarifResultOf(d))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{Schema: sarifSchema, Version: sarifVersion, Runs: []sarifRun{run}})
+}
+
+// 出現した診断の種類だけをルールとして並べる
+func sarifRules(ds []*Diagnostic) []sarifRule {
+	seen := map[Code]bool{}
+	rules := []sarifRule{}
+	for _, d := range ds {
+		if seen[d.Code] {
+			continue
+		}
+		seen[d.Code] = true
+		rules = append(rules, sarifRule{ID: string(d.Code), ShortDescription: sarifMessage{Text: d.Code.Description()}})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	return rules
+}
+
+func sarifResultOf(d *Diagnostic) sarifResult {
+	r := sarifResult{
+		RuleID:    string(d.Code),
+		Level:     d.Severity.String(),
+		Message:   sarifMessage{Text: d.Message},
+		Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocationOf(d.Range)}},
+	}
+	for i, n := range d.Notes {
+		id := i
+		r.RelatedLocations = append(r.RelatedLocations, sarifLocation{
+			ID:               &id,
+			Message:          &sarifMessage{Text: n.Message},
+			PhysicalLocation: sarifPhysicalLocationOf(n.Range),
+		})
+	}
+	for _, f := range d.FixIts {
+		r.Fixes = append(r.Fixes, sarifFix{
+			Description: sarifMessage{Text: f.Message},
+			ArtifactChanges: []sarifArtifactChange{{
+				ArtifactLocation: sarifArtifactLocation{URI: sarifURI(f.Range.File)},
+				Replacements: []sarifReplacement{{
+					DeletedRegion:   sarifRegionOf(f.Range),
+					InsertedContent: sarifMessage{Text: f.Replacement},
+				}},
+			}},
+		})
+	}
+	return r
+}
+
+func sarifPhysicalLocationOf(r Range) sarifPhysicalLocation {
+	return sarifPhysicalLocation{
+		ArtifactLocation: sarifArtifactLocation{URI: sarifURI(r.File)},
+		Region:           sarifRegionOf(r),
+	}
+}
+
+func sarifRegionOf(r Range) sarifRegion {
+	end := r.End
+	if !end.IsValid() {
+		end = r.Start
+	}
+	return sarifRegion{
+		StartLine:   r.Start.Line,
+		StartColumn: r.Start.Column,
+		EndLine:     end.Line,
+		EndColumn:   end.Column,
+	}
+}
+
+func sarifURI(file string) string {
+	if file == "" || file == "<stdin>" {
+		return "stdin"
+	}
+	return file
+}
@@ -0,0 +1,620 @@
+// gccのように使えるコマンドラインのドライバ
+// Cのソースをコンパイルして、アセンブル・リンクまでを外部のツールを呼び出して行う
+// --linker=builtinなら、外部のツールを使わずに組み込みのアセンブラとリンカで実行ファイルを作る
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/kijimaD/gogo"
+	"github.com/kijimaD/gogo/diag"
+	"github.com/kijimaD/gogo/elf"
+	"github.com/kijimaD/gogo/link"
+	"github.com/kijimaD/gogo/preprocess"
+)
+
+// どの段階で止めるか
+type mode int
+
+const (
+	modeLink     mode = iota // 実行ファイルまで作る
+	modeAssemble             // -c: オブジェクトファイルで止める
+	modeCompile              // -S: アセンブリで止める
+)
+
+// コンパイル段階で何を出力するか
+type emitKind string
+
+const (
+	emitAsm     emitKind = "asm"
+	emitASTJSON emitKind = "ast-json"
+	emitLLVM    emitKind = "llvm"
+	emitGo      emitKind = "go"
+)
+
+// 出力するファイルの拡張子
+func (e emitKind) ext(target gogo.Target) string {
+	switch {
+	case e == emitASTJSON:
+		return ".json"
+	case e == emitLLVM:
+		return ".ll"
+	case e == emitGo:
+		return ".go"
+	case target == gogo.TargetWasm32:
+		return ".wat"
+	default:
+		return ".s"
+	}
+}
+
+// 標準入力を表すファイル名
+const stdinName = "-"
+
+type options struct {
+	inputs            []string
+	output            string
+	mode              mode
+	emit              emitKind
+	diagnosticsFormat diag.Format
+	dump              gogo.Dump
+	optLevel          int
+	includePaths      []string
+	defines           map[string]string
+	jobs              int // 並行にコンパイルするファイルの数。0ならCPUの数
+	target            gogo.Target
+	intel             bool // -masm=intel
+	builtinLinker     bool // --linker=builtin
+}
+
+// -O0、-O1、-O2。gccと同じく最後に指定したものを使う
+type optLevelFlag struct {
+	level *int
+	value int
+}
+
+func (f optLevelFlag) String() string   { return "" }
+func (f optLevelFlag) IsBoolFlag() bool { return true }
+func (f optLevelFlag) Set(string) error {
+	*f.level = f.value
+	return nil
+}
+
+// -I dir。何度でも指定できる
+type includeFlag struct {
+	paths *[]string
+}
+
+func (f includeFlag) String() string { return "" }
+func (f includeFlag) Set(dir string) error {
+	*f.paths = append(*f.paths, dir)
+	return nil
+}
+
+// -D NAME[=VALUE]。何度でも指定できる
+type defineFlag struct {
+	defines *map[string]string
+}
+
+func (f defineFlag) String() string { return "" }
+func (f defineFlag) Set(arg string) error {
+	name, value, err := preprocess.ParseDefine(arg)
+	if err != nil {
+		return err
+	}
+	if *f.defines == nil {
+		*f.defines = map[string]string{}
+	}
+	(*f.defines)[name] = value
+	return nil
+}
+
+type Driver struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// リンクするときに一緒にコンパイルするCのソース。mainを定義している。--linker=builtinでは使わない
+	Runtime []byte
+	// 使う外部ツール。空ならCCやAS環境変数か、ccやasを使う
+	CC string
+	AS string
+}
+
+func New(stdin io.Reader, stdout io.Writer, stderr io.Writer) *Driver {
+	return &Driver{Stdin: stdin, Stdout: stdout, Stderr: stderr}
+}
+
+// コマンドライン引数を解析する。gccと同じようにフラグとファイルを混ぜて書ける
+func parseArgs(args []string, stderr io.Writer) (*options, error) {
+	opts := &options{}
+
+	fs := flag.NewFlagSet("gogo", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.output, "o", "", "place the output into `file`")
+	compileOnly := fs.Bool("S", false, "compile only; do not assemble or link")
+	assembleOnly := fs.Bool("c", false, "compile and assemble, but do not link")
+	format := fs.String("diagnostics-format", "text", "diagnostics output format: text, json or sarif")
+	emit := fs.String("emit", string(emitAsm), "output `kind` of the compile stage: asm, ast-json, llvm or go. other than asm stops after compiling")
+	target := fs.String("target", string(gogo.TargetX86_64), "generate code for `target`: x86_64-linux, aarch64-linux, riscv64-linux, i386-linux or wasm32. set CC and the assembler for other than x86_64-linux. wasm32 supports only -S")
+	masm := fs.String("masm", "att", "assembly `dialect` for x86_64-linux and i386-linux: att or intel")
+	linker := fs.String("linker", "cc", "`linker` for executables: cc or builtin. builtin needs no external tools, links a minimal runtime instead of libc and supports only x86_64-linux")
+	fs.Var(includeFlag{&opts.includePaths}, "I", "add `dir` to the include search path")
+	fs.Var(defineFlag{&opts.defines}, "D", "define macro `name[=value]`")
+	fs.IntVar(&opts.jobs, "j", 0, "compile up to `n` files in parallel (default: number of CPUs)")
+	fs.BoolVar(&opts.dump.Tokens, "dump-tokens", false, "dump tokens to standard error")
+	fs.BoolVar(&opts.dump.AST, "dump-ast", false, "dump the syntax tree to standard error")
+	fs.BoolVar(&opts.dump.Symbols, "dump-symbols", false, "dump the symbol table to standard error")
+	fs.BoolVar(&opts.dump.IR, "dump-ir", false, "dump the intermediate representation to standard error")
+	fs.BoolVar(&opts.dump.Passes, "print-after-all", false, "dump the intermediate representation after each optimization pass to standard error")
+	for level := 0; level <= 2; level++ {
+		fs.Var(optLevelFlag{&opts.optLevel, level}, fmt.Sprintf("O%d", level), fmt.Sprintf("optimization level %d", level))
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: gogo [options] file...\n")
+		fmt.Fprintf(stderr, "reads standard input and writes assembly to standard output when no file is given\n\n")
+		fs.PrintDefaults()
+	}
+
+	args = splitJoinedArgs(args)
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		opts.inputs = append(opts.inputs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if opts.jobs < 0 {
+		return nil, fmt.Errorf("invalid number of jobs: %d", opts.jobs)
+	}
+
+	f, err := diag.ParseFormat(*format)
+	if err != nil {
+		return nil, err
+	}
+	opts.diagnosticsFormat = f
+	if opts.target, err = gogo.ParseTarget(*target); err != nil {
+		return nil, err
+	}
+
+	switch *masm {
+	case "att":
+	case "intel":
+		if opts.target != gogo.TargetX86_64 && opts.target != gogo.TargetI386 {
+			return nil, fmt.Errorf("-masm=intel is not supported for --target=%s", opts.target)
+		}
+		opts.intel = true
+	default:
+		return nil, fmt.Errorf("unknown assembly dialect: %s", *masm)
+	}
+
+	switch *linker {
+	case "cc":
+	case "builtin":
+		if opts.target != gogo.TargetX86_64 {
+			return nil, fmt.Errorf("--linker=builtin is not supported for --target=%s", opts.target)
+		}
+		opts.builtinLinker = true
+	default:
+		return nil, fmt.Errorf("unknown linker: %s", *linker)
+	}
+
+	switch {
+	case *compileOnly:
+		opts.mode = modeCompile
+	case *assembleOnly:
+		opts.mode = modeAssemble
+	}
+
+	switch e := emitKind(*emit); e {
+	case emitAsm:
+		opts.emit = e
+	case emitASTJSON, emitLLVM, emitGo:
+		// アセンブルもリンクもできないので、コンパイル段階で止める
+		opts.emit = e
+		opts.mode = modeCompile
+	default:
+		return nil, fmt.Errorf("unknown emit kind: %s", *emit)
+	}
+
+	// ファイルの指定がなければ、標準入力をコンパイルして標準出力にアセンブリを書く
+	if len(opts.inputs) == 0 {
+		opts.inputs = []string{stdinName}
+		if !*assembleOnly && opts.output == "" {
+			opts.mode = modeCompile
+		}
+	}
+
+	// WebAssemblyはテキスト形式を出力するだけで、アセンブルもリンクもしない
+	if opts.target == gogo.TargetWasm32 && opts.mode != modeCompile {
+		return nil, errors.New("--target=wasm32 supports only -S")
+	}
+
+	if opts.output != "" && opts.mode != modeLink && len(opts.inputs) > 1 {
+		return nil, errors.New("cannot specify -o with -c or -S with multiple files")
+	}
+
+	return opts, nil
+}
+
+// 終了コードを返す
+func (d *Driver) Run(args []string) int {
+	opts, err := parseArgs(args, d.Stderr)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(d.Stderr, "gogo: %s\n", err)
+		return 2
+	}
+
+	if err := d.run(opts); err != nil {
+		if !errors.Is(err, errCompile) {
+			fmt.Fprintf(d.Stderr, "gogo: %s\n", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// 診断はすでに出力済みであることを表す
+var errCompile = errors.New("compilation failed")
+
+func (d *Driver) run(opts *options) error {
+	tmpdir, err := os.MkdirTemp("", "gogo")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// 1. コンパイル。ファイルごとに独立しているので並行に行い、結果は入力の順に扱う
+	// エラーがあってもすべてのファイルの診断を出す
+	type unit struct {
+		input string
+		asm   string // アセンブリのパス
+	}
+	results := d.compileAll(opts)
+	units := []unit{}
+	linkInputs := []string{}
+	objs := []*elf.File{} // 組み込みのリンカに渡すオブジェクトファイル
+	diags := []*diag.Diagnostic{}
+	failed := false
+	var firstErr error // 診断のないエラー。すべてのファイルの診断を出してから返す
+	for i, input := range opts.inputs {
+		switch filepath.Ext(input) {
+		case ".o", ".a":
+			if opts.mode != modeLink {
+				fmt.Fprintf(d.Stderr, "gogo: warning: %s: linker input file unused because linking not done\n", input)
+			}
+			if opts.mode == modeLink && opts.builtinLinker {
+				obj, err := readObject(input)
+				if err != nil {
+					return err
+				}
+				objs = append(objs, obj)
+				continue
+			}
+			linkInputs = append(linkInputs, input)
+			continue
+		case ".s":
+			if opts.mode == modeLink && opts.builtinLinker {
+				return fmt.Errorf("%s: cannot link assembly with --linker=builtin", input)
+			}
+			units = append(units, unit{input: input, asm: input})
+			continue
+		}
+
+		r := results[i]
+		if _, err := d.Stderr.Write(r.dump); err != nil {
+			return err
+		}
+		diags = append(diags, r.diags...)
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		if r.text == "" {
+			failed = true
+			continue
+		}
+
+		if opts.mode == modeCompile {
+			if err := d.writeOutput(outputPath(opts, input, opts.emit.ext(opts.target)), r.text); err != nil {
+				return err
+			}
+			continue
+		}
+		if opts.mode == modeAssemble && d.builtinAS(opts) {
+			// 組み込みのアセンブラで、コンパイルと同時にオブジェクトファイルになっている
+			if err := os.WriteFile(outputPath(opts, input, ".o"), []byte(r.text), 0o644); err != nil {
+				return err
+			}
+			continue
+		}
+		if opts.mode == modeLink && opts.builtinLinker {
+			obj, err := elf.Read([]byte(r.text))
+			if err != nil {
+				return fmt.Errorf("%s: %w", displayName(input), err)
+			}
+			objs = append(objs, obj)
+			continue
+		}
+		path := filepath.Join(tmpdir, fmt.Sprintf("%d-%s.s", i, baseName(input)))
+		if err := os.WriteFile(path, []byte(r.text), 0o644); err != nil {
+			return err
+		}
+		units = append(units, unit{input: input, asm: path})
+	}
+
+	if len(diags) != 0 {
+		if err := diag.Write(d.Stderr, opts.diagnosticsFormat, diags); err != nil {
+			return err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if failed {
+		return errCompile
+	}
+	if opts.mode == modeCompile {
+		return nil
+	}
+
+	if opts.builtinLinker {
+		b, err := link.Link(append(objs, link.Runtime()))
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(outputPath(opts, "", ""), b, 0o755)
+	}
+
+	// 2. アセンブル
+	if opts.mode == modeAssemble {
+		for _, u := range units {
+			args := append(opts.target.ASFlags(), "-o", outputPath(opts, u.input, ".o"), u.asm)
+			if err := d.command(d.as(), args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// 3. リンク。アセンブルもccにまかせる
+	args := append(opts.target.CCFlags(), "-o", outputPath(opts, "", ""))
+	for _, u := range units {
+		args = append(args, u.asm)
+	}
+	args = append(args, linkInputs...)
+	if d.Runtime != nil {
+		runtime := filepath.Join(tmpdir, "runtime.c")
+		if err := os.WriteFile(runtime, d.Runtime, 0o644); err != nil {
+			return err
+		}
+		args = append(args, runtime)
+	}
+	return d.command(d.cc(), args...)
+}
+
+// 1つのファイルをコンパイルした結果
+type compiled struct {
+	text  string
+	diags []*diag.Diagnostic
+	dump  []byte // --dump-*の出力。ほかのファイルと混ざらないように、あとで入力の順に書く
+	err   error
+}
+
+// Cのソースを最大-jの数だけ並行にコンパイルする。結果はopts.inputsと同じ位置に入る
+func (d *Driver) compileAll(opts *options) []compiled {
+	jobs := opts.jobs
+	if jobs == 0 {
+		jobs = runtime.NumCPU()
+	}
+	results := make([]compiled, len(opts.inputs))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, input := range opts.inputs {
+		switch filepath.Ext(input) {
+		case ".o", ".a", ".s":
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, input string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			src, err := d.readInput(input)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			var dump bytes.Buffer
+			text, diags, err := d.compile(opts, displayName(input), src, &dump)
+			results[i] = compiled{text: text, diags: diags, dump: dump.Bytes(), err: err}
+		}(i, input)
+	}
+	wg.Wait()
+	return results
+}
+
+// ソースコードを--emitで指定したものに変換する。エラーの診断があれば空文字列を返す
+// 組み込みのアセンブラが失敗したときのように、診断のないエラーはそのまま返す
+func (d *Driver) compile(opts *options, file string, src string, dumpW io.Writer) (string, []*diag.Diagnostic, error) {
+	output := gogo.OutputAsm
+	as := ""
+	switch {
+	case opts.mode == modeAssemble && d.builtinAS(opts):
+		output = gogo.OutputObject
+	case opts.mode == modeLink && opts.builtinLinker:
+		// アセンブラを指定したときは、それでオブジェクトファイルを作る
+		output = gogo.OutputObject
+		if !d.builtinAS(opts) {
+			as = d.as()
+		}
+	}
+	switch opts.emit {
+	case emitASTJSON:
+		output = gogo.OutputASTJSON
+	case emitLLVM:
+		output = gogo.OutputLLVM
+	case emitGo:
+		output = gogo.OutputGo
+	}
+	dump := opts.dump
+	dump.W = dumpW
+	res, err := gogo.Compile(context.Background(), src, gogo.Options{
+		Filename:     file,
+		Output:       output,
+		Target:       opts.target,
+		OptLevel:     opts.optLevel,
+		IncludePaths: opts.includePaths,
+		Defines:      opts.defines,
+		Dump:         dump,
+		Intel:        opts.intel,
+		AS:           as,
+	})
+	if errors.Is(err, gogo.ErrCompile) {
+		return "", res.Diagnostics, nil
+	}
+	if err != nil {
+		return "", res.Diagnostics, err
+	}
+	return string(res.Output), res.Diagnostics, nil
+}
+
+// 組み込みのリンカに渡すオブジェクトファイルを読む。アーカイブは扱わない
+func readObject(input string) (*elf.File, error) {
+	if filepath.Ext(input) == ".a" {
+		return nil, fmt.Errorf("%s: cannot link archives with --linker=builtin", input)
+	}
+	b, err := os.ReadFile(input)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := elf.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", input, err)
+	}
+	return obj, nil
+}
+
+func (d *Driver) readInput(input string) (string, error) {
+	if input == stdinName {
+		b, err := io.ReadAll(d.Stdin)
+		return string(b), err
+	}
+	b, err := os.ReadFile(input)
+	return string(b), err
+}
+
+func (d *Driver) writeOutput(path string, text string) error {
+	if path == stdinName {
+		_, err := io.WriteString(d.Stdout, text)
+		return err
+	}
+	return os.WriteFile(path, []byte(text), 0o644)
+}
+
+// 外部コマンドを実行する。出力はすべて標準エラーに流す
+func (d *Driver) command(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = d.Stderr
+	cmd.Stderr = d.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return nil
+}
+
+func (d *Driver) cc() string {
+	if d.CC != "" {
+		return d.CC
+	}
+	if cc := os.Getenv("CC"); cc != "" {
+		return cc
+	}
+	return "cc"
+}
+
+// -cで組み込みのアセンブラを使うか。アセンブラを指定したときは、x86-64でもそれを使う
+func (d *Driver) builtinAS(opts *options) bool {
+	return opts.target == gogo.TargetX86_64 && d.AS == "" && os.Getenv("AS") == ""
+}
+
+func (d *Driver) as() string {
+	if d.AS != "" {
+		return d.AS
+	}
+	if as := os.Getenv("AS"); as != "" {
+		return as
+	}
+	return "as"
+}
+
+// 出力先のパス。gccと同じく、-oがなければカレントディレクトリに拡張子を変えて置く
+// 標準入力をコンパイルした結果は標準出力に書く
+func outputPath(opts *options, input string, ext string) string {
+	if opts.output != "" {
+		return opts.output
+	}
+	if ext == "" {
+		return "a.out"
+	}
+	if input == stdinName {
+		if ext == ".o" {
+			return "stdin" + ext
+		}
+		return stdinName
+	}
+	return baseName(input) + ext
+}
+
+// 拡張子を除いたファイル名
+func baseName(input string) string {
+	if input == stdinName {
+		return "stdin"
+	}
+	base := filepath.Base(input)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// gccやmakeと同じく-Idir、-DNAME、-j4のように値をつなげて書けるようにする
+func splitJoinedArgs(args []string) []string {
+	out := []string{}
+	for _, arg := range args {
+		if len(arg) > 2 && (strings.HasPrefix(arg, "-I") || strings.HasPrefix(arg, "-D") || strings.HasPrefix(arg, "-j")) {
+			out = append(out, arg[:2], arg[2:])
+			continue
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// 診断に表示するファイル名
+func displayName(input string) string {
+	if input == stdinName {
+		return "<stdin>"
+	}
+	return input
+}
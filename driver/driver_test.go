@@ -0,0 +1,544 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/gogo"
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/diag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		expect options
+	}{
+		{
+			name: "ファイルがなければ標準入力をアセンブリにする",
+			args: []string{},
+			expect: options{
+				inputs:            []string{"-"},
+				mode:              modeCompile,
+				emit:              emitAsm,
+				diagnosticsFormat: diag.FormatText,
+				target:            gogo.TargetX86_64,
+			},
+		},
+		{
+			name: "フラグとファイルを混ぜて書ける",
+			args: []string{"a.c", "-o", "prog", "b.c", "--diagnostics-format=json"},
+			expect: options{
+				inputs:            []string{"a.c", "b.c"},
+				output:            "prog",
+				mode:              modeLink,
+				emit:              emitAsm,
+				diagnosticsFormat: diag.FormatJSON,
+				target:            gogo.TargetX86_64,
+			},
+		},
+		{
+			name: "-S",
+			args: []string{"-S", "a.c", "b.c"},
+			expect: options{
+				inputs:            []string{"a.c", "b.c"},
+				mode:              modeCompile,
+				emit:              emitAsm,
+				diagnosticsFormat: diag.FormatText,
+				target:            gogo.TargetX86_64,
+			},
+		},
+		{
+			name: "-c",
+			args: []string{"-c", "a.c"},
+			expect: options{
+				inputs:            []string{"a.c"},
+				mode:              modeAssemble,
+				emit:              emitAsm,
+				diagnosticsFormat: diag.FormatText,
+				target:            gogo.TargetX86_64,
+			},
+		},
+		{
+			name: "--emit=ast-json はコンパイル段階で止める",
+			args: []string{"--emit=ast-json", "a.c"},
+			expect: options{
+				inputs:            []string{"a.c"},
+				mode:              modeCompile,
+				emit:              emitASTJSON,
+				diagnosticsFormat: diag.FormatText,
+				target:            gogo.TargetX86_64,
+			},
+		},
+		{
+			name: "--emit=llvm もコンパイル段階で止める",
+			args: []string{"--emit=llvm", "-O2", "a.c"},
+			expect: options{
+				inputs:            []string{"a.c"},
+				mode:              modeCompile,
+				emit:              emitLLVM,
+				diagnosticsFormat: diag.FormatText,
+				target:            gogo.TargetX86_64,
+				optLevel:          2,
+			},
+		},
+		{
+			name: "最適化レベルは最後に指定したものを使う",
+			args: []string{"-O2", "a.c", "-O1", "--print-after-all"},
+			expect: options{
+				inputs:            []string{"a.c"},
+				mode:              modeLink,
+				emit:              emitAsm,
+				diagnosticsFormat: diag.FormatText,
+				target:            gogo.TargetX86_64,
+				dump:              gogo.Dump{Passes: true},
+				optLevel:          1,
+			},
+		},
+		{
+			name: "-Iと-Dは何度でも指定できて、値をつなげても書ける",
+			args: []string{"-I", "inc", "-Ilib", "-D", "A=1", "-DB", "a.c"},
+			expect: options{
+				inputs:            []string{"a.c"},
+				mode:              modeLink,
+				emit:              emitAsm,
+				diagnosticsFormat: diag.FormatText,
+				target:            gogo.TargetX86_64,
+				includePaths:      []string{"inc", "lib"},
+				defines:           map[string]string{"A": "1", "B": "1"},
+			},
+		},
+		{
+			name: "--target",
+			args: []string{"--target=aarch64-linux", "-S", "a.c"},
+			expect: options{
+				inputs:            []string{"a.c"},
+				mode:              modeCompile,
+				emit:              emitAsm,
+				diagnosticsFormat: diag.FormatText,
+				target:            gogo.TargetAArch64,
+			},
+		},
+		{
+			name: "--target=wasm32",
+			args: []string{"--target=wasm32"},
+			expect: options{
+				inputs:            []string{"-"},
+				mode:              modeCompile,
+				emit:              emitAsm,
+				diagnosticsFormat: diag.FormatText,
+				target:            gogo.TargetWasm32,
+			},
+		},
+		{
+			name: "-masm=intel",
+			args: []string{"-masm=intel", "--target=i386-linux"},
+			expect: options{
+				inputs:            []string{"-"},
+				mode:              modeCompile,
+				emit:              emitAsm,
+				diagnosticsFormat: diag.FormatText,
+				target:            gogo.TargetI386,
+				intel:             true,
+			},
+		},
+		{
+			name: "--linker=builtin",
+			args: []string{"--linker=builtin", "a.c"},
+			expect: options{
+				inputs:            []string{"a.c"},
+				mode:              modeLink,
+				emit:              emitAsm,
+				diagnosticsFormat: diag.FormatText,
+				target:            gogo.TargetX86_64,
+				builtinLinker:     true,
+			},
+		},
+		{
+			name: "-j",
+			args: []string{"-j4", "a.c", "-j", "2"},
+			expect: options{
+				inputs:            []string{"a.c"},
+				mode:              modeLink,
+				emit:              emitAsm,
+				diagnosticsFormat: diag.FormatText,
+				target:            gogo.TargetX86_64,
+				jobs:              2,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseArgs(tt.args, io.Discard)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expect, *opts)
+		})
+	}
+}
+
+func TestParseArgsError(t *testing.T) {
+	tests := [][]string{
+		{"-S", "-o", "out.s", "a.c", "b.c"},
+		{"--diagnostics-format=xml"},
+		{"-unknown"},
+		{"--emit=exe"},
+		{"-D1A"},
+		{"-j", "-1"},
+		{"--target=sparc-linux"},
+		{"--target=wasm32", "a.c"},
+		{"--target=wasm32", "-c", "a.c"},
+		{"-masm=nasm"},
+		{"-masm=intel", "--target=aarch64-linux"},
+		{"--linker=ld"},
+		{"--linker=builtin", "--target=i386-linux", "a.c"},
+	}
+
+	for _, args := range tests {
+		_, err := parseArgs(args, io.Discard)
+		assert.Error(t, err)
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	tests := []struct {
+		opts   options
+		input  string
+		ext    string
+		expect string
+	}{
+		{options{}, "dir/a.c", ".s", "a.s"},
+		{options{}, "a.c", ".o", "a.o"},
+		{options{}, "-", ".s", "-"},
+		{options{}, "-", ".json", "-"},
+		{options{}, "-", ".o", "stdin.o"},
+		{options{}, "", "", "a.out"},
+		{options{output: "out"}, "a.c", ".s", "out"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expect, outputPath(&tt.opts, tt.input, tt.ext))
+	}
+}
+
+// 複数行の入力をすべて読む
+func TestRunStdin(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	d := New(strings.NewReader("int a = 1;\na+2\n"), &stdout, &stderr)
+
+	assert.Equal(t, 0, d.Run([]string{}))
+	assert.Equal(t, "", stderr.String())
+	assert.Contains(t, stdout.String(), "movl $1, -8(%rbp)")
+	assert.Contains(t, stdout.String(), "add $2, %esi")
+
+	stdout.Reset()
+	d = New(strings.NewReader("int a = 1;\na+2\n"), &stdout, &stderr)
+	assert.Equal(t, 0, d.Run([]string{"-masm=intel"}))
+	assert.Contains(t, stdout.String(), "\t.intel_syntax noprefix\n")
+	assert.Contains(t, stdout.String(), "mov DWORD PTR [rbp-8], 1")
+}
+
+func TestRunCompileError(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.c")
+	assert.NoError(t, os.WriteFile(bad, []byte("1 +"), 0o644))
+
+	var stdout, stderr bytes.Buffer
+	d := New(nil, &stdout, &stderr)
+
+	assert.Equal(t, 1, d.Run([]string{"-S", "-o", filepath.Join(dir, "bad.s"), bad}))
+	assert.Contains(t, stderr.String(), bad+":1:4: error:")
+	assert.NoFileExists(t, filepath.Join(dir, "bad.s"))
+}
+
+func TestRunLink(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("cc is not found")
+	}
+	runtime, err := os.ReadFile("../c/driver.c")
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.c")
+	assert.NoError(t, os.WriteFile(src, []byte("sum2(1,\n 2)\n"), 0o644))
+	exe := filepath.Join(dir, "a")
+
+	var stdout, stderr bytes.Buffer
+	d := New(nil, &stdout, &stderr)
+	d.Runtime = runtime
+
+	assert.Equal(t, 0, d.Run([]string{src, "-o", exe}), stderr.String())
+	out, err := exec.Command(exe).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "3\n", string(out))
+}
+
+func TestRunDump(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	d := New(strings.NewReader("int a = 1; a"), &stdout, &stderr)
+
+	assert.Equal(t, 0, d.Run([]string{"--dump-tokens", "--dump-ast", "--dump-symbols", "--dump-ir"}))
+	dump := stderr.String()
+	assert.Contains(t, dump, "== tokens: <stdin> ==\n")
+	assert.Contains(t, dump, `1:5-1:6   IDENT "a"`)
+	assert.Contains(t, dump, "== ast: <stdin> ==\nProgram\n  DeclStatement int a (pos 1) [1:1-1:10]\n")
+	assert.Contains(t, dump, "== symbols: <stdin> ==\nNAME TYPE POS OFFSET\na    int  1   -8(%rbp)\n")
+	assert.Contains(t, dump, "== ir: <stdin> ==\nfunc @mymain() i32 {\nentry:\n\t%1 = alloca i32\n")
+	// ダンプしてもコンパイル結果は変わらない
+	assert.Contains(t, stdout.String(), "mymain:")
+
+	// 最適化すると変数はスタックに置かれないので、位置は出さない
+	stderr.Reset()
+	d = New(strings.NewReader("int a = 1; a"), &stdout, &stderr)
+	assert.Equal(t, 0, d.Run([]string{"-O1", "--dump-symbols"}))
+	assert.Contains(t, stderr.String(), "== symbols: <stdin> ==\nNAME TYPE POS OFFSET\na    int  1   -\n")
+}
+
+func TestRunPrintAfterAll(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	d := New(strings.NewReader("int a = 1; a + 2"), &stdout, &stderr)
+
+	assert.Equal(t, 0, d.Run([]string{"-O1", "--print-after-all"}))
+	dump := stderr.String()
+	assert.Contains(t, dump, "== ir after mem2reg: <stdin> ==\nfunc @mymain() i32 {\nentry:\n\t%3 = add i32 1, 2\n")
+	assert.Contains(t, dump, "== ir after dce: <stdin> ==\nfunc @mymain() i32 {\nentry:\n\tret i32 3\n}\n")
+	assert.Contains(t, stdout.String(), "\tmov $3, %rax\n")
+}
+
+func TestRunEmitASTJSON(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.c")
+	assert.NoError(t, os.WriteFile(src, []byte("int a = 1; a"), 0o644))
+	out := filepath.Join(dir, "a.json")
+
+	var stdout, stderr bytes.Buffer
+	d := New(nil, &stdout, &stderr)
+	assert.Equal(t, 0, d.Run([]string{"--emit=ast-json", "-o", out, src}), stderr.String())
+
+	f, err := os.Open(out)
+	assert.NoError(t, err)
+	defer f.Close()
+	node, err := ast.DecodeJSON(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "(int a = 1)a", node.String())
+}
+
+func TestRunEmitLLVM(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	d := New(strings.NewReader("int a = 1; sum2(a, 2)"), &stdout, &stderr)
+	assert.Equal(t, 0, d.Run([]string{"--emit=llvm"}), stderr.String())
+	assert.Contains(t, stdout.String(), "declare i32 @sum2(...)\n")
+	assert.Contains(t, stdout.String(), "define i32 @mymain() {\n")
+}
+
+func TestRunEmitGo(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	src := filepath.Join(dir, "a.c")
+	assert.NoError(t, os.WriteFile(src, []byte("int a = 1; a + 2"), 0o644))
+	var stdout, stderr bytes.Buffer
+	d := New(nil, &stdout, &stderr)
+	assert.Equal(t, 0, d.Run([]string{"--emit=go", src}), stderr.String())
+	b, err := os.ReadFile(filepath.Join(dir, "a.go"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "func mymain() int32 {\n\tvar a int32 = 1\n\treturn a + 2\n}\n")
+}
+
+func TestRunIncludeDefine(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "inc"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "inc", "n.h"), []byte("int n = N;\n"), 0o644))
+
+	var stdout, stderr bytes.Buffer
+	d := New(strings.NewReader("#include <n.h>\nn + M"), &stdout, &stderr)
+	assert.Equal(t, 0, d.Run([]string{"-I" + filepath.Join(dir, "inc"), "-DN=2", "-D", "M", "--emit=ast-json"}), stderr.String())
+	node, err := ast.DecodeJSON(&stdout)
+	assert.NoError(t, err)
+	assert.Equal(t, "(int n = 2)(n + 1)", node.String())
+}
+
+// 並行にコンパイルしても、診断とダンプは入力の順に出る
+func TestRunParallel(t *testing.T) {
+	dir := t.TempDir()
+	args := []string{"-S", "-j", "4", "--dump-ir"}
+	expect := ""
+	for i := 0; i < 16; i++ {
+		src := filepath.Join(dir, fmt.Sprintf("f%d.c", i))
+		assert.NoError(t, os.WriteFile(src, []byte(fmt.Sprintf("int a = %d;\nb", i)), 0o644))
+		args = append(args, src)
+		expect += src + ":2:1: error: not exist variable: b [undeclared-variable]\n"
+	}
+
+	for n := 0; n < 5; n++ {
+		var stdout, stderr bytes.Buffer
+		d := New(nil, &stdout, &stderr)
+		assert.Equal(t, 1, d.Run(args))
+		assert.Equal(t, expect, stderr.String())
+	}
+
+	// 成功したファイルのダンプも入力の順に出る。アセンブリはカレントディレクトリに書かれる
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+	args = []string{"-S", "-j", "4", "--dump-ir"}
+	headers := []string{}
+	for i := 0; i < 16; i++ {
+		src := filepath.Join(dir, fmt.Sprintf("g%d.c", i))
+		assert.NoError(t, os.WriteFile(src, []byte(fmt.Sprintf("%d", i)), 0o644))
+		args = append(args, src)
+		headers = append(headers, "== ir: "+src+" ==")
+	}
+	var stdout, stderr bytes.Buffer
+	d := New(nil, &stdout, &stderr)
+	assert.Equal(t, 0, d.Run(args), stderr.String())
+	got := []string{}
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if strings.HasPrefix(line, "== ir:") {
+			got = append(got, line)
+		}
+	}
+	assert.Equal(t, headers, got)
+	_, err = os.Stat(filepath.Join(dir, "g15.s"))
+	assert.NoError(t, err)
+}
+
+// 読めないファイルがあっても、ほかのファイルの診断を入力の順にすべて出してからエラーにする
+func TestRunParallelError(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.c")
+	b := filepath.Join(dir, "b.c")
+	missing := filepath.Join(dir, "missing.c")
+	assert.NoError(t, os.WriteFile(a, []byte("2147483647 + 1"), 0o644))
+	assert.NoError(t, os.WriteFile(b, []byte("c"), 0o644))
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	var stdout, stderr bytes.Buffer
+	d := New(nil, &stdout, &stderr)
+	assert.Equal(t, 1, d.Run([]string{"-S", "-j", "4", a, missing, b}))
+	out := stderr.String()
+	warning := strings.Index(out, a+":1:1: warning: overflow")
+	undeclared := strings.Index(out, b+":1:1: error: not exist variable: c")
+	notFound := strings.Index(out, "gogo: open "+missing+": no such file or directory")
+	assert.True(t, 0 <= warning && warning < undeclared && undeclared < notFound, out)
+}
+
+// WebAssemblyのテキスト形式は.watに書く
+func TestRunWasm32(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	src := filepath.Join(dir, "a.c")
+	assert.NoError(t, os.WriteFile(src, []byte("1 + 2"), 0o644))
+	var stdout, stderr bytes.Buffer
+	d := New(nil, &stdout, &stderr)
+	assert.Equal(t, 0, d.Run([]string{"--target=wasm32", "-S", src}), stderr.String())
+	b, err := os.ReadFile(filepath.Join(dir, "a.wat"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `(func $mymain (export "mymain") (result i32)`)
+}
+
+// i386ではアセンブラに--32を、ccに-m32を渡す
+func TestRunI386(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not found")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.c")
+	assert.NoError(t, os.WriteFile(src, []byte("1 + 2"), 0o644))
+	// 受け取った引数を書き残すだけのccとas
+	log := filepath.Join(dir, "log")
+	fake := filepath.Join(dir, "fake")
+	assert.NoError(t, os.WriteFile(fake, []byte("#!/bin/sh\necho \"$@\" >> "+log+"\n"), 0o755))
+
+	var stdout, stderr bytes.Buffer
+	d := New(nil, &stdout, &stderr)
+	d.CC = fake
+	d.AS = fake
+	assert.Equal(t, 0, d.Run([]string{"--target=i386-linux", "-c", "-o", filepath.Join(dir, "a.o"), src}), stderr.String())
+	assert.Equal(t, 0, d.Run([]string{"--target=i386-linux", "-o", filepath.Join(dir, "a"), src}), stderr.String())
+
+	b, err := os.ReadFile(log)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "--32 -o "+filepath.Join(dir, "a.o")), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "-m32 -no-pie -o "+filepath.Join(dir, "a")), lines[1])
+}
+
+// x86-64の-cは組み込みのアセンブラを使うので、asがなくてもオブジェクトファイルを作れる
+func TestRunAssembleBuiltin(t *testing.T) {
+	t.Setenv("PATH", "")
+	t.Setenv("AS", "")
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.c")
+	assert.NoError(t, os.WriteFile(src, []byte("printf(\"%d\\n\", 3)"), 0o644))
+	obj := filepath.Join(dir, "a.o")
+
+	var stdout, stderr bytes.Buffer
+	d := New(nil, &stdout, &stderr)
+	assert.Equal(t, 0, d.Run([]string{"-c", "-o", obj, src}), stderr.String())
+	b, err := os.ReadFile(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x7fELF"), b[:4])
+
+	// アセンブラを指定すれば、それを使う
+	d.AS = "no-such-assembler"
+	assert.Equal(t, 1, d.Run([]string{"-c", "-o", obj, src}))
+	assert.Contains(t, stderr.String(), "no-such-assembler failed")
+}
+
+// 外部のツールを使わずに実行ファイルを作る
+func TestRunLinkBuiltin(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("the executable runs only on x86-64 Linux")
+	}
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.c")
+	b := filepath.Join(dir, "b.c")
+	exe := filepath.Join(dir, "a.out")
+	assert.NoError(t, os.WriteFile(a, []byte(`printf("%s %d\n", "sum", sum2(1, 2)); 4`), 0o644))
+	assert.NoError(t, os.WriteFile(b, []byte("1"), 0o644))
+
+	t.Setenv("PATH", "")
+	t.Setenv("AS", "")
+	var stdout, stderr bytes.Buffer
+	d := New(nil, &stdout, &stderr)
+	assert.Equal(t, 0, d.Run([]string{"--linker=builtin", "-o", exe, a}), stderr.String())
+	out, err := exec.Command(exe).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "sum 3\n4\n", string(out))
+
+	// -cで作ったオブジェクトファイルもリンクできる
+	obj := filepath.Join(dir, "a.o")
+	assert.Equal(t, 0, d.Run([]string{"-c", "-o", obj, a}), stderr.String())
+	assert.Equal(t, 0, d.Run([]string{"--linker=builtin", "-o", exe, obj}), stderr.String())
+	out, err = exec.Command(exe).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "sum 3\n4\n", string(out))
+
+	// mymainが2つある
+	assert.Equal(t, 1, d.Run([]string{"--linker=builtin", "-o", exe, a, b}))
+	assert.Contains(t, stderr.String(), "duplicate symbol: mymain")
+	assert.Equal(t, 1, d.Run([]string{"--linker=builtin", "-o", exe, filepath.Join(dir, "c.s")}))
+	assert.Contains(t, stderr.String(), "cannot link assembly with --linker=builtin")
+}
@@ -0,0 +1,70 @@
+package gogo
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/kijimaD/gogo/asm"
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/ir"
+	"github.com/kijimaD/gogo/lexer"
+	"github.com/kijimaD/gogo/object"
+	"github.com/kijimaD/gogo/token"
+)
+
+// コンパイラの各段階の中身をWに出力する。コンパイル結果には影響しない
+type Dump struct {
+	W       io.Writer
+	Tokens  bool
+	AST     bool
+	Symbols bool
+	IR      bool
+	Passes  bool // 最適化の各パスのあと
+}
+
+func (d *Dump) header(kind string, file string) {
+	fmt.Fprintf(d.W, "== %s: %s ==\n", kind, file)
+}
+
+// パーサーが字句解析器を消費するので、別の字句解析器で読み直す
+func (d *Dump) tokens(file string, src string) {
+	d.header("tokens", file)
+	w := tabwriter.NewWriter(d.W, 0, 8, 1, ' ', 0)
+	l := lexer.NewFile(file, src)
+	for {
+		tok := l.NextToken()
+		fmt.Fprintf(w, "%d:%d-%d:%d\t%s\t%q\n", tok.Pos.Line, tok.Pos.Column, tok.End.Line, tok.End.Column, tok.Type, tok.Literal)
+		if tok.Type == token.EOF {
+			break
+		}
+	}
+	w.Flush()
+}
+
+func (d *Dump) ast(file string, prog *ast.Program) {
+	d.header("ast", file)
+	ast.Fprint(d.W, prog)
+}
+
+// スタック上の位置は、最適化しないx86-64のフレームのものなので、frameがfalseなら-にする
+// 最適化するとmem2regやレジスタ割り当てで変数が移るので、位置は正しくない
+func (d *Dump) symbols(file string, env *object.Environment, frame bool) {
+	d.header("symbols", file)
+	w := tabwriter.NewWriter(d.W, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "NAME\tTYPE\tPOS\tOFFSET\n")
+	for _, name := range env.Names() {
+		obj, _ := env.Get(name)
+		offset := "-"
+		if frame {
+			offset = fmt.Sprintf("%d(%%rbp)", asm.VarOffset(obj.CurPos()))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", name, obj.GetCtype(), obj.CurPos(), offset)
+	}
+	w.Flush()
+}
+
+func (d *Dump) ir(file string, m *ir.Module) {
+	d.header("ir", file)
+	ir.Fprint(d.W, m)
+}
@@ -0,0 +1,291 @@
+// ELF64のリロケータブルなオブジェクトファイルの出力
+// x86-64のLinuxのldやccに、asが作ったものと同じように渡せるものを作る
+// .text、.data、.rodataのほかに、スタックを実行できなくてよいことを示す.note.GNU-stackを置く
+
+package elf
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// オブジェクトファイルの中身
+type File struct {
+	Sections []*Section
+	Symbols  []*Symbol
+}
+
+// 機械語やデータを置くセクション
+type Section struct {
+	Name   string // .text、.data、.rodataのどれか
+	Data   []byte
+	Relocs []Reloc
+}
+
+// シンボル。Sectionがnilなら、ほかのオブジェクトファイルで定義されている
+type Symbol struct {
+	Name    string
+	Section *Section
+	Value   uint64 // セクションの先頭からの位置
+	Global  bool
+}
+
+// 再配置。リンクするときに、Offsetの位置にSymbolのアドレスから計算した値を書き込む
+type Reloc struct {
+	Offset uint64
+	Symbol *Symbol
+	Type   RelocType
+	Addend int64
+}
+
+type RelocType uint32
+
+const (
+	RelocPC32  RelocType = 2 // R_X86_64_PC32。S + A - P
+	RelocPLT32 RelocType = 4 // R_X86_64_PLT32。関数の呼び出し。静的にリンクすればPC32と同じ
+)
+
+// セクションを取り出す。なければ作る
+func (f *File) Section(name string) *Section {
+	for _, s := range f.Sections {
+		if s.Name == name {
+			return s
+		}
+	}
+	s := &Section{Name: name}
+	f.Sections = append(f.Sections, s)
+	return s
+}
+
+// シンボルを取り出す。なければ未定義のシンボルとして作る
+func (f *File) Symbol(name string) *Symbol {
+	for _, s := range f.Symbols {
+		if s.Name == name {
+			return s
+		}
+	}
+	s := &Symbol{Name: name}
+	f.Symbols = append(f.Symbols, s)
+	return s
+}
+
+const (
+	ehdrSize = 64
+	shdrSize = 64
+	symSize  = 24
+	relaSize = 24
+
+	shtProgbits = 1
+	shtSymtab   = 2
+	shtStrtab   = 3
+	shtRela     = 4
+
+	shfWrite     = 0x1
+	shfAlloc     = 0x2
+	shfExecinstr = 0x4
+	shfInfoLink  = 0x40
+
+	stbLocal   = 0
+	stbGlobal  = 1
+	sttSection = 3
+)
+
+type shdr struct {
+	Name      uint32
+	Type      uint32
+	Flags     uint64
+	Addr      uint64
+	Offset    uint64
+	Size      uint64
+	Link      uint32
+	Info      uint32
+	Addralign uint64
+	Entsize   uint64
+}
+
+type sym struct {
+	Name  uint32
+	Info  uint8
+	Other uint8
+	Shndx uint16
+	Value uint64
+	Size  uint64
+}
+
+type rela struct {
+	Offset uint64
+	Info   uint64
+	Addend int64
+}
+
+// 名前を並べた文字列表。先頭は空文字列
+type strtab struct {
+	buf bytes.Buffer
+}
+
+func newStrtab() *strtab {
+	t := &strtab{}
+	t.buf.WriteByte(0)
+	return t
+}
+
+func (t *strtab) add(s string) uint32 {
+	if s == "" {
+		return 0
+	}
+	off := uint32(t.buf.Len())
+	t.buf.WriteString(s)
+	t.buf.WriteByte(0)
+	return off
+}
+
+func sectionFlags(name string) uint64 {
+	switch name {
+	case ".text":
+		return shfAlloc | shfExecinstr
+	case ".data":
+		return shfAlloc | shfWrite
+	default:
+		return shfAlloc
+	}
+}
+
+// ELFのバイト列にする
+// セクションヘッダは、空のもの、各セクション、再配置、.symtab、.strtab、.shstrtab、.note.GNU-stackの順に並べる
+func (f *File) Bytes() []byte {
+	shstr := newStrtab()
+	str := newStrtab()
+	headers := []shdr{{}}
+	var body bytes.Buffer
+	body.Write(make([]byte, ehdrSize))
+	place := func(h shdr, data []byte, align int) {
+		for body.Len()%align != 0 {
+			body.WriteByte(0)
+		}
+		h.Offset = uint64(body.Len())
+		h.Size = uint64(len(data))
+		h.Addralign = uint64(align)
+		body.Write(data)
+		headers = append(headers, h)
+	}
+
+	index := map[*Section]int{}
+	for _, s := range f.Sections {
+		index[s] = len(headers)
+		place(shdr{Name: shstr.add(s.Name), Type: shtProgbits, Flags: sectionFlags(s.Name)}, s.Data, 1)
+	}
+
+	// ローカルなシンボルを先に置く。セクションのシンボルもローカルに含める
+	syms := []sym{{}}
+	symIndex := map[*Symbol]int{}
+	for _, s := range f.Sections {
+		syms = append(syms, sym{Info: stbLocal<<4 | sttSection, Shndx: uint16(index[s])})
+	}
+	add := func(s *Symbol, bind uint8) {
+		symIndex[s] = len(syms)
+		e := sym{Name: str.add(s.Name), Info: bind << 4, Value: s.Value}
+		if s.Section != nil {
+			e.Shndx = uint16(index[s.Section])
+		}
+		syms = append(syms, e)
+	}
+	for _, s := range f.Symbols {
+		if !isGlobal(s) {
+			add(s, stbLocal)
+		}
+	}
+	firstGlobal := len(syms)
+	for _, s := range f.Symbols {
+		if isGlobal(s) {
+			add(s, stbGlobal)
+		}
+	}
+
+	symtab := len(headers) + countRelocs(f)
+	for _, s := range f.Sections {
+		if len(s.Relocs) == 0 {
+			continue
+		}
+		var data bytes.Buffer
+		for _, r := range s.Relocs {
+			write(&data, rela{Offset: r.Offset, Info: uint64(symIndex[r.Symbol])<<32 | uint64(r.Type), Addend: r.Addend})
+		}
+		h := shdr{Name: shstr.add(".rela" + s.Name), Type: shtRela, Flags: shfInfoLink, Link: uint32(symtab), Info: uint32(index[s]), Entsize: relaSize}
+		place(h, data.Bytes(), 8)
+	}
+
+	var data bytes.Buffer
+	for _, s := range syms {
+		write(&data, s)
+	}
+	place(shdr{Name: shstr.add(".symtab"), Type: shtSymtab, Link: uint32(symtab + 1), Info: uint32(firstGlobal), Entsize: symSize}, data.Bytes(), 8)
+	place(shdr{Name: shstr.add(".strtab"), Type: shtStrtab}, str.buf.Bytes(), 1)
+	shstrndx := len(headers)
+	name := shstr.add(".shstrtab")
+	gnuStack := shstr.add(".note.GNU-stack")
+	place(shdr{Name: name, Type: shtStrtab}, shstr.buf.Bytes(), 1)
+	place(shdr{Name: gnuStack, Type: shtProgbits}, nil, 1)
+
+	for body.Len()%8 != 0 {
+		body.WriteByte(0)
+	}
+	shoff := body.Len()
+	for _, h := range headers {
+		write(&body, h)
+	}
+
+	out := body.Bytes()
+	copy(out, header(uint64(shoff), uint16(len(headers)), uint16(shstrndx)))
+	return out
+}
+
+// 未定義のシンボルは、ほかのオブジェクトファイルから探せるようにグローバルにする
+func isGlobal(s *Symbol) bool {
+	return s.Global || s.Section == nil
+}
+
+func countRelocs(f *File) int {
+	n := 0
+	for _, s := range f.Sections {
+		if len(s.Relocs) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// ELFヘッダ
+func header(shoff uint64, shnum uint16, shstrndx uint16) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0x7f, 'E', 'L', 'F', 2, 1, 1, 0}) // 64ビット、リトルエンディアン、System V
+	b.Write(make([]byte, 8))
+	write(&b, struct {
+		Type      uint16
+		Machine   uint16
+		Version   uint32
+		Entry     uint64
+		Phoff     uint64
+		Shoff     uint64
+		Flags     uint32
+		Ehsize    uint16
+		Phentsize uint16
+		Phnum     uint16
+		Shentsize uint16
+		Shnum     uint16
+		Shstrndx  uint16
+	}{
+		Type:      1,  // ET_REL
+		Machine:   62, // EM_X86_64
+		Version:   1,
+		Shoff:     shoff,
+		Ehsize:    ehdrSize,
+		Shentsize: shdrSize,
+		Shnum:     shnum,
+		Shstrndx:  shstrndx,
+	})
+	return b.Bytes()
+}
+
+func write(b *bytes.Buffer, v interface{}) {
+	_ = binary.Write(b, binary.LittleEndian, v) // bytes.Bufferへの書き込みは失敗しない
+}
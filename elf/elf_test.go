@@ -0,0 +1,111 @@
+package elf
+
+import (
+	"bytes"
+	delf "debug/elf"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 書き出したものを標準ライブラリで読み直す
+func TestBytes(t *testing.T) {
+	f := &File{}
+	text := f.Section(".text")
+	data := f.Section(".data")
+	f.Section(".rodata")
+	text.Data = []byte{0x48, 0x8d, 0x3d, 0, 0, 0, 0, 0xe8, 0, 0, 0, 0, 0xc3}
+	data.Data = []byte("a\x00")
+	s0 := f.Symbol(".s0")
+	s0.Section = data
+	main := f.Symbol("mymain")
+	main.Section = text
+	main.Global = true
+	text.Relocs = []Reloc{
+		{Offset: 3, Symbol: s0, Type: RelocPC32, Addend: -4},
+		{Offset: 8, Symbol: f.Symbol("printf"), Type: RelocPLT32, Addend: -4},
+	}
+
+	ef, err := delf.NewFile(bytes.NewReader(f.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, delf.ELFCLASS64, ef.Class)
+	assert.Equal(t, delf.ET_REL, ef.Type)
+	assert.Equal(t, delf.EM_X86_64, ef.Machine)
+
+	names := []string{}
+	for _, s := range ef.Sections {
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{"", ".text", ".data", ".rodata", ".rela.text", ".symtab", ".strtab", ".shstrtab", ".note.GNU-stack"}, names)
+	assert.Equal(t, delf.SHF_ALLOC|delf.SHF_EXECINSTR, ef.Section(".text").Flags)
+	assert.Equal(t, delf.SHF_ALLOC|delf.SHF_WRITE, ef.Section(".data").Flags)
+	b, err := ef.Section(".data").Data()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a\x00"), b)
+
+	// ローカルなシンボルが先に並ぶ。セクションのシンボルは名前がない
+	syms, err := ef.Symbols()
+	assert.NoError(t, err)
+	got := []string{}
+	for _, s := range syms {
+		bind := "local"
+		if delf.ST_BIND(s.Info) == delf.STB_GLOBAL {
+			bind = "global"
+		}
+		got = append(got, s.Name+" "+bind)
+	}
+	assert.Equal(t, []string{" local", " local", " local", ".s0 local", "mymain global", "printf global"}, got)
+	assert.Equal(t, delf.SHN_UNDEF, syms[5].Section)
+	assert.Equal(t, uint32(5), ef.Section(".symtab").Info)
+
+	// 再配置のシンボルの番号は、.symtabの空の要素の分だけずれる
+	rb, err := ef.Section(".rela.text").Data()
+	assert.NoError(t, err)
+	var relocs []delf.Rela64
+	for i := 0; i < len(rb); i += relaSize {
+		r := delf.Rela64{}
+		assert.NoError(t, binary.Read(bytes.NewReader(rb[i:i+relaSize]), binary.LittleEndian, &r))
+		relocs = append(relocs, r)
+	}
+	assert.Equal(t, []delf.Rela64{
+		{Off: 3, Info: 4<<32 | uint64(delf.R_X86_64_PC32), Addend: -4},
+		{Off: 8, Info: 6<<32 | uint64(delf.R_X86_64_PLT32), Addend: -4},
+	}, relocs)
+}
+
+// 書き出したものを読み直すと、同じシンボルと再配置になる
+func TestRead(t *testing.T) {
+	f := &File{}
+	text := f.Section(".text")
+	f.Section(".data").Data = []byte("a\x00")
+	f.Section(".rodata")
+	text.Data = []byte{0xe8, 0, 0, 0, 0, 0xc3}
+	main := f.Symbol("mymain")
+	main.Section = text
+	main.Global = true
+	text.Relocs = []Reloc{{Offset: 1, Symbol: f.Symbol("printf"), Type: RelocPLT32, Addend: -4}}
+
+	got, err := Read(f.Bytes())
+	assert.NoError(t, err)
+	names := []string{}
+	for _, s := range got.Sections {
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{".text", ".data", ".rodata"}, names)
+	assert.Equal(t, text.Data, got.Section(".text").Data)
+	assert.Equal(t, []byte("a\x00"), got.Section(".data").Data)
+
+	m := got.Symbol("mymain")
+	assert.True(t, m.Global)
+	assert.Equal(t, got.Section(".text"), m.Section)
+	relocs := got.Section(".text").Relocs
+	assert.Len(t, relocs, 1)
+	assert.Equal(t, "printf", relocs[0].Symbol.Name)
+	assert.Nil(t, relocs[0].Symbol.Section)
+	assert.Equal(t, RelocPLT32, relocs[0].Type)
+	assert.Equal(t, int64(-4), relocs[0].Addend)
+
+	_, err = Read([]byte("not elf"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,96 @@
+package elf
+
+import (
+	"bytes"
+	delf "debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ELF64のリロケータブルなオブジェクトファイルを読む
+// .text、.data、.rodataと、それに対する再配置だけを読む。ほかのセクションは読み飛ばす
+// asが作るもののように、再配置がセクションのシンボルを指していれば、名前のないローカルなシンボルにする
+func Read(b []byte) (*File, error) {
+	ef, err := delf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if ef.Class != delf.ELFCLASS64 || ef.Machine != delf.EM_X86_64 || ef.Type != delf.ET_REL {
+		return nil, fmt.Errorf("not an x86-64 relocatable object file")
+	}
+
+	f := &File{}
+	sections := map[int]*Section{}
+	for i, s := range ef.Sections {
+		switch s.Name {
+		case ".text", ".data", ".rodata":
+		default:
+			if s.Type == delf.SHT_NOBITS && s.Size > 0 {
+				return nil, fmt.Errorf("section %s is not supported", s.Name)
+			}
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, err
+		}
+		sec := f.Section(s.Name)
+		sec.Data = data
+		sections[i] = sec
+	}
+
+	syms, err := ef.Symbols()
+	if err != nil && !errors.Is(err, delf.ErrNoSymbols) {
+		return nil, err
+	}
+	// .symtabの番号から。0番の空のシンボルはSymbolsに含まれない
+	table := make([]*Symbol, len(syms)+1)
+	for i, s := range syms {
+		sym := &Symbol{Name: s.Name, Value: s.Value, Global: delf.ST_BIND(s.Info) != delf.STB_LOCAL}
+		if s.Section != delf.SHN_UNDEF {
+			sec, ok := sections[int(s.Section)]
+			if !ok {
+				// 読み飛ばしたセクションのシンボルは使わない
+				continue
+			}
+			sym.Section = sec
+		}
+		if delf.ST_TYPE(s.Info) == delf.STT_SECTION {
+			sym.Name = ""
+		}
+		table[i+1] = sym
+		f.Symbols = append(f.Symbols, sym)
+	}
+
+	for _, s := range ef.Sections {
+		if s.Type != delf.SHT_RELA {
+			continue
+		}
+		sec, ok := sections[int(s.Info)]
+		if !ok {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, err
+		}
+		for off := 0; off+relaSize <= len(data); off += relaSize {
+			var r rela
+			if err := binary.Read(bytes.NewReader(data[off:off+relaSize]), binary.LittleEndian, &r); err != nil {
+				return nil, err
+			}
+			idx := int(r.Info >> 32)
+			if idx <= 0 || idx >= len(table) || table[idx] == nil {
+				return nil, fmt.Errorf("%s: invalid symbol index %d", s.Name, idx)
+			}
+			sec.Relocs = append(sec.Relocs, Reloc{
+				Offset: r.Offset,
+				Symbol: table[idx],
+				Type:   RelocType(r.Info & 0xffffffff),
+				Addend: r.Addend,
+			})
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,321 @@
+// Cのソースをコンパイルするライブラリ
+// 前処理・構文解析・意味解析・最適化・コード生成を1つの関数で行う
+// 状態を共有しないので、複数のgoroutineから同時に呼び出せる
+
+package gogo
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/kijimaD/gogo/aarch64"
+	"github.com/kijimaD/gogo/asm"
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/diag"
+	"github.com/kijimaD/gogo/golang"
+	"github.com/kijimaD/gogo/ir"
+	"github.com/kijimaD/gogo/lexer"
+	"github.com/kijimaD/gogo/llvm"
+	"github.com/kijimaD/gogo/opt"
+	"github.com/kijimaD/gogo/parser"
+	"github.com/kijimaD/gogo/preprocess"
+	"github.com/kijimaD/gogo/riscv64"
+	"github.com/kijimaD/gogo/sema"
+	"github.com/kijimaD/gogo/wasm"
+)
+
+// 実行ファイルを作るときにリンクするランタイム。mymainを呼んで結果を表示するmainを定義している
+//
+//go:embed c/driver.c
+var Runtime []byte
+
+// 何を出力するか
+type Output string
+
+const (
+	OutputAsm     Output = "asm"      // アセンブリ
+	OutputObject  Output = "obj"      // オブジェクトファイル。x86-64では組み込みのアセンブラ、ほかではasを使う
+	OutputASTJSON Output = "ast-json" // 構文木のJSON
+	OutputLLVM    Output = "llvm"     // LLVM IRのテキスト形式。対象によらない
+	OutputGo      Output = "go"       // Goのソース。対象によらない
+)
+
+// コードを生成する対象
+type Target string
+
+const (
+	TargetX86_64  Target = "x86_64-linux"
+	TargetAArch64 Target = "aarch64-linux"
+	TargetRISCV64 Target = "riscv64-linux"
+	TargetI386    Target = "i386-linux"
+	TargetWasm32  Target = "wasm32" // WebAssemblyのテキスト形式。オブジェクトファイルは作れない
+)
+
+var targets = []Target{TargetX86_64, TargetAArch64, TargetRISCV64, TargetI386, TargetWasm32}
+
+// --targetの値を対象にする
+func ParseTarget(s string) (Target, error) {
+	for _, t := range targets {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown target: %s", s)
+}
+
+// 外部のアセンブラに渡すフラグ
+func (t Target) ASFlags() []string {
+	if t == TargetI386 {
+		return []string{"--32"}
+	}
+	return nil
+}
+
+// リンクするときにccに渡すフラグ
+// i386はラベルを絶対アドレスで指すので、位置独立の実行ファイルにはしない
+func (t Target) CCFlags() []string {
+	if t == TargetI386 {
+		return []string{"-m32", "-no-pie"}
+	}
+	return nil
+}
+
+type Options struct {
+	Filename     string            // 診断に出すファイル名。#include "..."はそのディレクトリからも探す
+	Output       Output            // 空ならアセンブリ
+	Target       Target            // 空ならx86-64
+	OptLevel     int               // 0から2
+	IncludePaths []string          // #includeでファイルを探すディレクトリ
+	Defines      map[string]string // 最初から定義しておくマクロ
+	Dump         Dump              // 各段階の中身を出力する。Wがnilなら出力しない
+	AS           string            // オブジェクトファイルを作るアセンブラ。空なら、x86-64では組み込みのアセンブラ、ほかではasを使う
+	Intel        bool              // x86-64とi386のアセンブリをIntel記法で書く
+}
+
+type Result struct {
+	Output      []byte
+	Diagnostics []*diag.Diagnostic // 警告を含む。位置は#includeしたファイルの位置になっている
+}
+
+// エラーの診断があってコンパイルできなかったことを表す。診断はResultに入っている
+var ErrCompile = errors.New("compilation failed")
+
+// 標準入力などファイル名のないソースにつける名前
+const defaultFilename = "<input>"
+
+// srcをコンパイルする。ctxはそれぞれの段階の間と、外部のアセンブラの実行で調べる
+// コード生成などの内部のエラーもパニックせずに返すので、呼び出し元のプロセスは止まらない
+func Compile(ctx context.Context, src string, opts Options) (Result, error) {
+	file := opts.Filename
+	if file == "" {
+		file = defaultFilename
+	}
+	res := Result{}
+	if opts.Target == "" {
+		opts.Target = TargetX86_64
+	}
+	if _, err := ParseTarget(string(opts.Target)); err != nil {
+		return res, err
+	}
+	if opts.Intel && opts.Target != TargetX86_64 && opts.Target != TargetI386 {
+		return res, fmt.Errorf("cannot use Intel syntax for %s", opts.Target)
+	}
+	if opts.Target == TargetWasm32 && opts.Output == OutputObject {
+		return res, fmt.Errorf("cannot make an object file for %s", opts.Target)
+	}
+	// 構文木から直接作るものは中間表現を通らないので、ダンプするものがない
+	if (opts.Dump.IR || opts.Dump.Passes) && (opts.Output == OutputASTJSON || opts.Output == OutputGo) {
+		return res, fmt.Errorf("cannot dump the intermediate representation for %s output", opts.Output)
+	}
+
+	engine := diag.NewEngine()
+	pp := preprocess.Process(file, src, preprocess.Options{
+		IncludePaths: opts.IncludePaths,
+		Defines:      opts.Defines,
+	}, engine)
+	res.Diagnostics = engine.Diagnostics()
+	if engine.HasErrors() {
+		return res, ErrCompile
+	}
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	dump := opts.Dump
+	if dump.W == nil {
+		dump = Dump{}
+	}
+	if dump.Tokens {
+		dump.tokens(file, pp.Text)
+	}
+
+	p := parser.New(lexer.NewFile(file, pp.Text))
+	prog := p.ParseProgram()
+	diags := p.Diagnostics()
+
+	// 構文エラーがあると意味解析のエラーが連鎖するので、意味解析はしない
+	var info *sema.Info
+	if len(p.Errors()) == 0 {
+		engine := diag.NewEngine()
+		info = sema.Check(file, prog, engine)
+		diags = append(diags, engine.Diagnostics()...)
+	}
+	for _, d := range diags {
+		pp.Remap(d)
+	}
+	res.Diagnostics = append(res.Diagnostics, diags...)
+
+	if dump.AST {
+		dump.ast(file, prog)
+	}
+	if dump.Symbols && info != nil {
+		dump.symbols(file, info.Env, opts.OptLevel == 0 && opts.Target == TargetX86_64)
+	}
+	if hasErrors(diags) {
+		return res, ErrCompile
+	}
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	var buf bytes.Buffer
+	if opts.Output == OutputASTJSON {
+		if err := ast.EncodeJSON(&buf, prog); err != nil {
+			return res, fmt.Errorf("encoding the AST as JSON: %w", err)
+		}
+		res.Output = buf.Bytes()
+		return res, nil
+	}
+	if opts.Output == OutputGo {
+		engine := diag.NewEngine()
+		for _, u := range golang.UnsupportedCalls(prog, info) {
+			r := diag.Range{File: file, Start: u.Call.Start(), End: u.Call.End()}
+			d := engine.Errorf(diag.UnsupportedCall, r, "cannot call %s in Go output: %s", u.Call.Function.TokenLiteral(), u.Reason)
+			pp.Remap(d)
+		}
+		res.Diagnostics = append(res.Diagnostics, engine.Diagnostics()...)
+		if engine.HasErrors() {
+			return res, ErrCompile
+		}
+		src, err := golang.Translate(prog, info)
+		if err != nil {
+			return res, fmt.Errorf("translating to Go: %w", err)
+		}
+		res.Output = src
+		return res, nil
+	}
+
+	m := ir.Lower(prog, info)
+	pm := opt.NewManager(opts.OptLevel)
+	if dump.Passes {
+		pm.AfterPass = func(pass string, m *ir.Module) {
+			dump.header("ir after "+pass, file)
+			ir.Fprint(dump.W, m)
+		}
+	}
+	if err := pm.Run(m); err != nil {
+		return res, fmt.Errorf("optimizing: %w", err)
+	}
+	if dump.IR {
+		dump.ir(file, m)
+	}
+	if opts.Output == OutputLLVM {
+		if err := llvm.NewEmitter(&buf).EmitModule(m); err != nil {
+			return res, fmt.Errorf("emitting LLVM IR: %w", err)
+		}
+		res.Output = buf.Bytes()
+		return res, nil
+	}
+	if opts.Output == OutputObject && opts.Target == TargetX86_64 && opts.AS == "" {
+		// 組み込みのアセンブラを使うので、asはいらない
+		obj, err := asm.Assemble(asm.Compile(m))
+		if err != nil {
+			return res, fmt.Errorf("assembling: %w", err)
+		}
+		res.Output = obj.Bytes()
+		return res, nil
+	}
+	if err := emitAsm(&buf, opts.Target, opts.Intel, m); err != nil {
+		return res, fmt.Errorf("emitting assembly: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	switch opts.Output {
+	case "", OutputAsm:
+		res.Output = buf.Bytes()
+	case OutputObject:
+		obj, err := assemble(ctx, opts.AS, opts.Target.ASFlags(), buf.Bytes())
+		if err != nil {
+			return res, err
+		}
+		res.Output = obj
+	default:
+		return res, fmt.Errorf("unknown output kind: %s", opts.Output)
+	}
+	return res, nil
+}
+
+// 対象のアセンブリを書く
+func emitAsm(w io.Writer, target Target, intel bool, m *ir.Module) error {
+	e := asm.NewEmitter(w)
+	if intel {
+		e.Syntax = asm.SyntaxIntel
+	}
+	switch target {
+	case TargetAArch64:
+		return aarch64.NewEmitter(w).EmitModule(m)
+	case TargetRISCV64:
+		return riscv64.NewEmitter(w).EmitModule(m)
+	case TargetI386:
+		return e.EmitModuleI386(m)
+	case TargetWasm32:
+		return wasm.NewEmitter(w).EmitModule(m)
+	default:
+		return e.EmitModule(m)
+	}
+}
+
+// 外部のアセンブラでオブジェクトファイルを作る。同時に呼ばれてもぶつからないように、呼び出しごとに一時ディレクトリを作る
+func assemble(ctx context.Context, as string, flags []string, code []byte) ([]byte, error) {
+	if as == "" {
+		as = "as"
+	}
+	dir, err := os.MkdirTemp("", "gogo")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "a.s")
+	obj := filepath.Join(dir, "a.o")
+	if err := os.WriteFile(src, code, 0o644); err != nil {
+		return nil, err
+	}
+	args := append(append([]string{}, flags...), "-o", obj, src)
+	out, err := exec.CommandContext(ctx, as, args...).CombinedOutput()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("%s failed: %w: %s", as, err, out)
+	}
+	return os.ReadFile(obj)
+}
+
+func hasErrors(diags []*diag.Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == diag.SeverityError {
+			return true
+		}
+	}
+	return false
+}
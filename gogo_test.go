@@ -0,0 +1,159 @@
+package gogo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		opts   Options
+		expect string
+	}{
+		{"アセンブリ", "1 + 2", Options{}, "\tmov $3, %rax\n"},
+		{"最適化する", "int a = 1; a + 2", Options{OptLevel: 1}, "\tmov $3, %rax\n"},
+		{"マクロを定義する", "N", Options{Defines: map[string]string{"N": "5"}}, "\tmov $5, %rax\n"},
+		{"構文木のJSON", "1", Options{Output: OutputASTJSON}, `"kind": "IntegerLiteral"`},
+		{"AArch64", "1 + 2", Options{Target: TargetAArch64}, "\tmov x0, #3\n"},
+		{"RISC-V", "1 + 2", Options{Target: TargetRISCV64}, "\tli a0, 3\n"},
+		{"i386", "1 + 2", Options{Target: TargetI386}, "\tmov $3, %eax\n"},
+		{"Intel記法", "1 + 2", Options{Intel: true}, "\tmov rax, 3\n"},
+		{"LLVM IR", "1 + 2", Options{Output: OutputLLVM}, "  ret i32 3\n"},
+		{"Go", "int a = 1; a + 2", Options{Output: OutputGo}, "\treturn a + 2\n"},
+		{"WebAssembly", "1 + 2", Options{Target: TargetWasm32}, "    i32.const 3\n    return\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Compile(context.Background(), tt.src, tt.opts)
+			assert.NoError(t, err)
+			assert.Empty(t, res.Diagnostics)
+			assert.Contains(t, string(res.Output), tt.expect)
+		})
+	}
+}
+
+func TestCompileDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.h"), []byte("int a = 1;\nb;\n"), 0o644))
+
+	res, err := Compile(context.Background(), "#include \"a.h\"\na", Options{Filename: filepath.Join(dir, "main.c")})
+	assert.ErrorIs(t, err, ErrCompile)
+	assert.Nil(t, res.Output)
+	assert.Len(t, res.Diagnostics, 1)
+	// #includeしたファイルの位置になる
+	assert.Equal(t, filepath.Join(dir, "a.h")+":2:1: error: not exist variable: b [undeclared-variable]", res.Diagnostics[0].String())
+
+	res, err = Compile(context.Background(), "#include <none.h>", Options{})
+	assert.ErrorIs(t, err, ErrCompile)
+	assert.Equal(t, "<input>:1:1: error: none.h: file not found [include-not-found]", res.Diagnostics[0].String())
+
+	// Goには、c/driver.cにない関数の呼び出しを訳せない
+	res, err = Compile(context.Background(), "int a = 1;\nputs(a)", Options{Output: OutputGo})
+	assert.ErrorIs(t, err, ErrCompile)
+	assert.Equal(t, "<input>:2:1: error: cannot call puts in Go output: only printf, sum2 and sum5 are defined [unsupported-call]", res.Diagnostics[0].String())
+
+	// 警告だけならコンパイルできる
+	res, err = Compile(context.Background(), "2147483647 + 1", Options{})
+	assert.NoError(t, err)
+	assert.Len(t, res.Diagnostics, 1)
+	assert.NotEmpty(t, res.Output)
+}
+
+func TestCompileDump(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := Compile(context.Background(), "int a = 1; a", Options{Filename: "a.c", Dump: Dump{W: &buf, AST: true, IR: true}})
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "== ast: a.c ==\nProgram\n")
+	assert.Contains(t, buf.String(), "== ir: a.c ==\nfunc @mymain() i32 {\n")
+
+	// Wがなければ何も出力しない
+	_, err = Compile(context.Background(), "int a = 1; a", Options{Dump: Dump{AST: true}})
+	assert.NoError(t, err)
+}
+
+func TestCompileObject(t *testing.T) {
+	res, err := Compile(context.Background(), "1 + 2", Options{Output: OutputObject})
+	assert.NoError(t, err)
+	// ELFのマジックナンバー
+	assert.Equal(t, []byte("\x7fELF"), res.Output[:4])
+
+	// i386はアセンブラに--32を渡して、32ビットのELFにする
+	res, err = Compile(context.Background(), "1 + 2", Options{Output: OutputObject, Target: TargetI386})
+	assert.NoError(t, err)
+	assert.Equal(t, byte(1), res.Output[4])
+
+	// Intel記法でもasでアセンブルできる
+	res, err = Compile(context.Background(), "1 + 2", Options{Output: OutputObject, Target: TargetI386, Intel: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x7fELF"), res.Output[:4])
+
+	_, err = Compile(context.Background(), "1", Options{Output: OutputObject, AS: "no-such-assembler"})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrCompile)
+
+	// x86-64は組み込みのアセンブラを使うので、asがなくてもよい
+	t.Setenv("PATH", "")
+	res, err = Compile(context.Background(), "1 + 2", Options{Output: OutputObject})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x7fELF"), res.Output[:4])
+}
+
+func TestCompileUnknownTarget(t *testing.T) {
+	_, err := Compile(context.Background(), "1", Options{Target: "sparc-linux"})
+	assert.EqualError(t, err, "unknown target: sparc-linux")
+
+	_, err = Compile(context.Background(), "1", Options{Target: TargetWasm32, Output: OutputObject})
+	assert.EqualError(t, err, "cannot make an object file for wasm32")
+
+	_, err = Compile(context.Background(), "1", Options{Target: TargetRISCV64, Intel: true})
+	assert.EqualError(t, err, "cannot use Intel syntax for riscv64-linux")
+
+	_, err = Compile(context.Background(), "1", Options{Output: OutputGo, Dump: Dump{IR: true}})
+	assert.EqualError(t, err, "cannot dump the intermediate representation for go output")
+	_, err = Compile(context.Background(), "1", Options{Output: OutputASTJSON, Dump: Dump{Passes: true}})
+	assert.EqualError(t, err, "cannot dump the intermediate representation for ast-json output")
+}
+
+func TestCompileCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Compile(ctx, "1 + 2", Options{})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// 同時に呼び出しても、1つずつ呼び出したときと同じ結果になる
+func TestCompileConcurrent(t *testing.T) {
+	const n = 50
+	srcs := make([]string, n)
+	expects := make([]string, n)
+	for i := range srcs {
+		srcs[i] = fmt.Sprintf("int a = %d; int b = a * N; int c = b - a / 2; c + sum2(a, b) * 3", i)
+		res, err := Compile(context.Background(), srcs[i], Options{OptLevel: i % 3, Defines: map[string]string{"N": "3"}})
+		assert.NoError(t, err)
+		expects[i] = string(res.Output)
+	}
+
+	var wg sync.WaitGroup
+	outs := make([]string, n)
+	for i := range srcs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := Compile(context.Background(), srcs[i], Options{OptLevel: i % 3, Defines: map[string]string{"N": "3"}})
+			assert.NoError(t, err)
+			outs[i] = string(res.Output)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, expects, outs)
+}
@@ -0,0 +1,427 @@
+// Goのソースの出力
+// 意味解析が終わったASTを、そのままビルドできるGoのソースにする。Cのプログラムを手でGoに移すときの下書きに使う
+// プログラムはmymainという関数になり、mainがその値を表示する。c/driver.cと同じ動きになる
+//
+// intとcharはint32とint8にする。ポインタはCのメモリを模したバイト列memの中の位置で表し、文字列リテラルはmemに置く
+// printfはfmt.Printfにして、書式の変換指定はGoのfmtの書式に直す。sum2とsum5はc/driver.cと同じものをGoで定義する。ほかの関数は呼べない
+
+package golang
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/constant"
+	"github.com/kijimaD/gogo/sema"
+	ctoken "github.com/kijimaD/gogo/token"
+)
+
+// 出力するソースの中で使う名前。Cの変数とぶつかれば、変数の名前を変える
+var reserved = []string{
+	"main", "mymain", "fmt", "mem", "ptr", "cstring", "cchar", "printf", "div", "sum2", "sum5",
+	"int8", "int32", "string", "byte", "int", "len", "panic", "interface",
+}
+
+// プログラムをGoのソースにして書き出す
+func Fprint(w io.Writer, prog *ast.Program, info *sema.Info) error {
+	src, err := Translate(prog, info)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// c/driver.cで定義している関数と、その引数の数
+var helpers = map[string]int{"sum2": 2, "sum5": 5}
+
+// Goにできない関数呼び出しと、その理由
+type UnsupportedCall struct {
+	Call   *ast.FuncallExpression
+	Reason string
+}
+
+// Goにできない関数呼び出し。定義していない関数や引数の数が違う呼び出しと、Goのfmtで表せない書式のprintf
+func UnsupportedCalls(prog *ast.Program, info *sema.Info) []UnsupportedCall {
+	calls := []UnsupportedCall{}
+	ast.Inspect(prog, func(n ast.Node) bool {
+		call, ok := n.(*ast.FuncallExpression)
+		if !ok {
+			return true
+		}
+		name := call.Function.TokenLiteral()
+		reason := ""
+		if n, ok := helpers[name]; ok {
+			if len(call.Args) != n {
+				reason = fmt.Sprintf("%s takes %d arguments", name, n)
+			}
+		} else if name == "printf" {
+			if _, _, err := printfConversions(call, info); err != nil {
+				reason = err.Error()
+			}
+		} else {
+			reason = "only printf, sum2 and sum5 are defined"
+		}
+		if reason != "" {
+			calls = append(calls, UnsupportedCall{Call: call, Reason: reason})
+		}
+		return true
+	})
+	return calls
+}
+
+// プログラムをgofmtしたGoのソースにする
+func Translate(prog *ast.Program, info *sema.Info) ([]byte, error) {
+	if calls := UnsupportedCalls(prog, info); len(calls) > 0 {
+		return nil, fmt.Errorf("cannot call %s in Go: %s", calls[0].Call.Function.TokenLiteral(), calls[0].Reason)
+	}
+	t := newTranslator(prog, info)
+	t.program(prog)
+	return format.Source(t.file())
+}
+
+type translator struct {
+	info  *sema.Info           // 定数式の値を使う。オーバーフローした式は折り返した値になっている
+	strs  []*ast.StringLiteral // IDの順に並べた文字列リテラル
+	names map[int]string       // 変数のスタック上の位置から、Goの名前へ
+	used  map[int]bool         // 値を読まれる変数
+	body  bytes.Buffer
+
+	// 出力するときに必要になったもの
+	needPtr     bool
+	needPrintf  bool
+	needChar    bool
+	needDiv     bool
+	needHelpers map[string]bool
+}
+
+func newTranslator(prog *ast.Program, info *sema.Info) *translator {
+	t := &translator{info: info, names: map[int]string{}, used: map[int]bool{}, needHelpers: map[string]bool{}}
+	seen := map[int]bool{}
+	taken := map[string]bool{}
+	for _, name := range reserved {
+		taken[name] = true
+	}
+	ast.Inspect(prog, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.StringLiteral:
+			if !seen[n.ID] {
+				seen[n.ID] = true
+				t.strs = append(t.strs, n)
+			}
+		case *ast.DeclStatement:
+			if n.Name != nil {
+				taken[n.Name.Token.Literal] = true
+			}
+		}
+		return true
+	})
+	sort.Slice(t.strs, func(i, j int) bool { return t.strs[i].ID < t.strs[j].ID })
+	for _, s := range t.strs {
+		taken[strName(s)] = true
+	}
+
+	for _, stmt := range prog.Statements {
+		ds, ok := stmt.(*ast.DeclStatement)
+		if !ok || ds.Name == nil {
+			continue
+		}
+		name := ds.Name.Token.Literal
+		if token.IsKeyword(name) || isReserved(name) || name == "_" {
+			for taken[name] {
+				name += "_"
+			}
+			taken[name] = true
+		}
+		t.names[ds.Pos] = name
+	}
+	var use func(n ast.Node) bool
+	use = func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Var:
+			t.used[n.Pos] = true
+		case *ast.FuncallExpression:
+			// printfの書式はGoの書式の文字列に直して埋め込むので、書式の変数は読まない
+			if n.Function.TokenLiteral() == "printf" && len(n.Args) > 0 {
+				for _, a := range n.Args[1:] {
+					ast.Inspect(a, use)
+				}
+				return false
+			}
+		}
+		return true
+	}
+	for _, stmt := range prog.Statements {
+		var e ast.Expression
+		switch s := stmt.(type) {
+		case *ast.ExpressionStatement:
+			e = s.Expression
+		case *ast.DeclStatement:
+			e = s.Value
+		}
+		if e == nil {
+			continue
+		}
+		ast.Inspect(e, use)
+	}
+	return t
+}
+
+func isReserved(name string) bool {
+	for _, r := range reserved {
+		if r == name {
+			return true
+		}
+	}
+	if len(name) > 1 && name[0] == 's' {
+		_, err := strconv.Atoi(name[1:])
+		return err == nil
+	}
+	return false
+}
+
+// 文字列リテラルのmemの中の位置を表す定数の名前
+func strName(s *ast.StringLiteral) string {
+	return fmt.Sprintf("s%d", s.ID)
+}
+
+func (t *translator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&t.body, format, args...)
+}
+
+func (t *translator) typ(ctype ctoken.Ctype) string {
+	switch ctype {
+	case ctoken.CTYPE_CHAR:
+		return "int8"
+	case ctoken.CTYPE_STR:
+		t.needPtr = true
+		return "ptr"
+	default:
+		return "int32"
+	}
+}
+
+// プログラムをmymainの本体にする。最後の文の値を返す
+func (t *translator) program(prog *ast.Program) {
+	if len(prog.Statements) == 0 {
+		t.printf("return 0\n")
+		return
+	}
+	for i, stmt := range prog.Statements {
+		last := i == len(prog.Statements)-1
+		switch s := stmt.(type) {
+		case *ast.DeclStatement:
+			name := t.names[s.Pos]
+			if s.Value == nil {
+				t.printf("var %s %s\n", name, t.typ(s.Ctype))
+			} else {
+				t.printf("var %s %s = %s\n", name, t.typ(s.Ctype), t.expr(s.Value))
+			}
+			switch {
+			case last:
+				t.printf("return %s\n", t.toInt(name, s.Ctype))
+			case !t.used[s.Pos]:
+				// Goでは使わない変数はエラーになる
+				t.printf("_ = %s\n", name)
+			}
+		case *ast.ExpressionStatement:
+			e := s.Expression
+			switch call, ok := e.(*ast.FuncallExpression); {
+			case last:
+				t.printf("return %s\n", t.toInt(t.expr(e), e.GetCtype()))
+			case ok && call.Function.TokenLiteral() == "printf":
+				// 値を使わないprintfは、fmt.Printfを直接呼ぶ
+				t.printf("fmt.Printf(%s)\n", strings.Join(t.printfArgs(call), ", "))
+			case ok:
+				t.printf("%s\n", t.expr(e))
+			default:
+				t.printf("_ = %s\n", t.expr(e))
+			}
+		default:
+			panic(fmt.Sprintf("golang: unexpected statement %T", s))
+		}
+	}
+}
+
+// mymainの返り値にする
+func (t *translator) toInt(x string, ctype ctoken.Ctype) string {
+	if ctype == ctoken.CTYPE_INT {
+		return x
+	}
+	return "int32(" + x + ")"
+}
+
+// Cの文字列リテラルと同じ内容のGoの文字列リテラル
+func goString(s *ast.StringLiteral) string {
+	return strconv.Quote(string(cbytes(s)))
+}
+
+// エスケープシーケンスを解釈した文字列リテラルの中身
+// 解釈できないエスケープシーケンスは意味解析で報告している
+func cbytes(s *ast.StringLiteral) []byte {
+	return unquote(s.Value)
+}
+
+func unquote(s string) []byte {
+	b, err := constant.Unquote(s)
+	if err != nil {
+		panic(fmt.Sprintf("golang: %s", err))
+	}
+	return b
+}
+
+// 0で割る式か
+func (t *translator) divByZero(ie *ast.InfixExpression) bool {
+	v, ok := t.info.Value(ie.Right)
+	return ie.Operator == ctoken.SLASH && ok && v.Int == 0
+}
+
+// 演算子の優先順位
+var precedence = map[string]int{
+	ctoken.PLUS:     1,
+	ctoken.MINUS:    1,
+	ctoken.ASTERISK: 2,
+	ctoken.SLASH:    2,
+}
+
+func (t *translator) expr(e ast.Expression) string {
+	// 定数式は、Cと同じく型の幅で折り返した値にする。Goでは定数のオーバーフローはエラーになる
+	if _, ok := e.(*ast.CharLiteral); !ok {
+		if v, ok := t.info.Value(e); ok {
+			return strconv.FormatInt(v.Int, 10)
+		}
+	}
+
+	switch n := e.(type) {
+	case *ast.CharLiteral:
+		if 0x20 <= n.Value && n.Value < 0x7f {
+			return strconv.QuoteRune(n.Value)
+		}
+		return strconv.FormatInt(int64(int8(n.Value)), 10)
+	case *ast.StringLiteral:
+		t.needPtr = true
+		return strName(n)
+	case *ast.Var:
+		return t.names[n.Pos]
+	case *ast.InfixExpression:
+		// 0での除算はGoではコンパイルエラーになるので、実行時に割る
+		if t.divByZero(n) {
+			t.needDiv = true
+			return fmt.Sprintf("div(%s, %s)", t.expr(n.Left), t.expr(n.Right))
+		}
+		left := t.operand(n.Left, precedence[n.Operator], false)
+		right := t.operand(n.Right, precedence[n.Operator], true)
+		return fmt.Sprintf("%s %s %s", left, n.Operator, right)
+	case *ast.ConvExpression:
+		return fmt.Sprintf("%s(%s)", t.typ(n.Ctype), t.expr(n.Expression))
+	case *ast.FuncallExpression:
+		name := n.Function.TokenLiteral()
+		if name == "printf" {
+			t.needPrintf = true
+			return fmt.Sprintf("printf(%s)", strings.Join(t.printfArgs(n), ", "))
+		}
+		t.needHelpers[name] = true
+		args := make([]string, len(n.Args))
+		for i, a := range n.Args {
+			args[i] = t.expr(a)
+		}
+		return fmt.Sprintf("%s(%s)", name, strings.Join(args, ", "))
+	default:
+		panic(fmt.Sprintf("golang: unexpected expression %T", n))
+	}
+}
+
+// 二項演算のオペランド。優先順位が低ければ括弧で囲む
+// 右のオペランドは、同じ優先順位でも左から計算した順序を保つために囲む
+func (t *translator) operand(e ast.Expression, prec int, right bool) string {
+	x := t.expr(e)
+	ie, ok := e.(*ast.InfixExpression)
+	if _, constant := t.info.Value(e); !ok || constant || t.divByZero(ie) {
+		// 定数に置き換えた式と、関数呼び出しの形にした式は囲まなくてよい
+		return x
+	}
+	if p := precedence[ie.Operator]; p < prec || (right && p == prec) {
+		return "(" + x + ")"
+	}
+	return x
+}
+
+// パッケージ全体のソース
+func (t *translator) file() []byte {
+	var out bytes.Buffer
+	out.WriteString("package main\n\nimport \"fmt\"\n\n")
+	if t.needPtr {
+		var mem []byte
+		consts := []string{}
+		for _, s := range t.strs {
+			consts = append(consts, fmt.Sprintf("%s ptr = %d // %s", strName(s), len(mem), goString(s)))
+			mem = append(append(mem, cbytes(s)...), 0)
+		}
+		out.WriteString("// Cのポインタ。memの中の位置で表す\ntype ptr int32\n\n")
+		fmt.Fprintf(&out, "// Cのメモリ。文字列リテラルをヌル終端で置く\nvar mem = []byte(%s)\n\n", strconv.Quote(string(mem)))
+		if len(consts) > 0 {
+			fmt.Fprintf(&out, "const (\n%s\n)\n\n", strings.Join(consts, "\n"))
+		}
+		out.WriteString(`// pから始まるヌル終端の文字列
+func cstring(p ptr) string {
+	end := p
+	for mem[end] != 0 {
+		end++
+	}
+	return string(mem[p:end])
+}
+
+`)
+	}
+	if t.needPrintf {
+		out.WriteString(`// Cのprintf。書式はGoの書式に直してある。書いたバイト数を返す
+func printf(format string, args ...interface{}) int32 {
+	n, _ := fmt.Printf(format, args...)
+	return int32(n)
+}
+
+`)
+	}
+	if t.needChar {
+		out.WriteString(`// Cの%c。unsigned charにした1バイトを書く
+func cchar(c int32) string {
+	return string([]byte{byte(c)})
+}
+
+`)
+	}
+	if t.needDiv {
+		out.WriteString(`// 0で割ると、Cでは未定義になる。Goではpanicする
+func div(a, b int32) int32 {
+	return a / b
+}
+
+`)
+	}
+	if t.needHelpers["sum2"] {
+		out.WriteString(`// c/driver.cのsum2
+func sum2(a, b int32) int32 {
+	return a + b
+}
+
+`)
+	}
+	if t.needHelpers["sum5"] {
+		out.WriteString(`// c/driver.cのsum5
+func sum5(a, b, c, d, e int32) int32 {
+	return a + b + c + d + e
+}
+
+`)
+	}
+	fmt.Fprintf(&out, "func mymain() int32 {\n%s}\n\n", t.body.String())
+	out.WriteString("func main() {\n\tfmt.Printf(\"%d\\n\", mymain())\n}\n")
+	return out.Bytes()
+}
@@ -0,0 +1,171 @@
+package golang
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/diag"
+	"github.com/kijimaD/gogo/lexer"
+	"github.com/kijimaD/gogo/parser"
+	"github.com/kijimaD/gogo/sema"
+	"github.com/stretchr/testify/assert"
+)
+
+func check(t *testing.T, input string) (*ast.Program, *sema.Info) {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	prog := p.ParseProgram()
+	assert.Empty(t, p.Errors())
+	info := sema.Check("", prog, diag.NewEngine())
+	return prog, info
+}
+
+func translate(t *testing.T, input string) string {
+	t.Helper()
+	src, err := Translate(check(t, input))
+	assert.NoError(t, err)
+	return string(src)
+}
+
+func TestTranslate(t *testing.T) {
+	expect := `package main
+
+import "fmt"
+
+// Cのポインタ。memの中の位置で表す
+type ptr int32
+
+// Cのメモリ。文字列リテラルをヌル終端で置く
+var mem = []byte("x\x00%s%d\n\x00")
+
+const (
+	s0 ptr = 0 // "x"
+	s1 ptr = 2 // "%s%d\n"
+)
+
+// pから始まるヌル終端の文字列
+func cstring(p ptr) string {
+	end := p
+	for mem[end] != 0 {
+		end++
+	}
+	return string(mem[p:end])
+}
+
+func mymain() int32 {
+	var s ptr = s0
+	var a int32 = 2
+	fmt.Printf("%s%d\n", cstring(s), a)
+	return a + 1
+}
+
+func main() {
+	fmt.Printf("%d\n", mymain())
+}
+`
+	assert.Equal(t, expect, translate(t, `string s = "x"; int a = 2; printf("%s%d\n", s, a); a + 1`))
+}
+
+func TestTranslateBody(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{"", "return 0\n"},
+		{"1 + 2", "return 3\n"},
+		{"2147483647 + 1", "return -2147483648\n"},
+		{"char c = 200 + 100; c", "var c int8 = 44\n\treturn int32(c)\n"},
+		{"char c = 'b'; c - 'a' + 1", "var c int8 = 'b'\n\treturn int32(c) - 97 + 1\n"},
+		{"int a = 1; int b = 2; b * 3 + a", "var a int32 = 1\n\tvar b int32 = 2\n\treturn b*3 + a\n"},
+		{"int a = 1; a - a * a / a - a", "return a - a*a/a - a\n"},
+		{"int a = 2; int b = 1; 5", "var a int32 = 2\n\t_ = a\n\tvar b int32 = 1\n\t_ = b\n\treturn 5\n"},
+		{"int a = 2; a + 1; a", "_ = a + 1\n"},
+		{"int a = 2; sum2(a, 3)", "return sum2(a, 3)\n"},
+		{"sum2(1, 2)", "func sum2(a, b int32) int32 {\n\treturn a + b\n}\n"},
+		{"int sum5 = 1; sum5", "var sum5_ int32 = 1\n"},
+		{"int a = 2; a / 0", "return div(a, 0)\n"},
+		{"int len = 1; int s0 = len; s0", "var len_ int32 = 1\n\tvar s0_ int32 = len_\n\treturn s0_\n"},
+		{`printf("%d", 1)`, "return printf(\"%d\", 1)\n"},
+		{`printf("%i %lu %hhx\n", 1, 0-1, 300); 0`, "fmt.Printf(\"%d %d %x\\n\", 1, 4294967295, 44)\n"},
+		{`int a = 1; printf("%5hd%c", a, a); a`, "fmt.Printf(\"%5d%s\", int16(a), cchar(a))\n"},
+		{`string f = "%s%%"; printf(f, "a"); 1`, "fmt.Printf(\"%s%%\", cstring(s1))\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			assert.Contains(t, translate(t, tt.input), tt.expect)
+		})
+	}
+}
+
+// c/driver.cにない関数や、引数の数が違う呼び出しと、Goのfmtで表せない書式のprintfはGoにできない
+func TestTranslateUnsupportedCall(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{"puts(1)", "only printf, sum2 and sum5 are defined"},
+		{"sum2(1)", "sum2 takes 2 arguments"},
+		{"1 + sum5(1, 2, 3, 4, 5, 6)", "sum5 takes 5 arguments"},
+		{"printf()", "printf needs a format"},
+		{`printf("%f", 1)`, "%f is not supported"},
+		{`printf("%*d", 1, 2)`, "%* is not supported"},
+		{`printf("%Ld", 1)`, "%L is not supported"},
+		{`printf("%lc", 1)`, "%lc is not supported"},
+		{`printf("%5%")`, "%5% is not supported"},
+		{`printf("%l")`, "%l is not a complete conversion"},
+		{`printf("%d %d", 1)`, "the format has 2 conversions but 1 arguments are given"},
+		{`printf("%s", 1)`, "argument 2 does not match %s"},
+		{`printf("%d", "a")`, "argument 2 does not match %d"},
+		{`int a = 1; printf(a)`, "the format of printf must be a string literal or a string variable"},
+	}
+
+	for _, tt := range tests {
+		prog, info := check(t, tt.input)
+		calls := UnsupportedCalls(prog, info)
+		if assert.Len(t, calls, 1, tt.input) {
+			assert.Equal(t, tt.expect, calls[0].Reason, tt.input)
+		}
+		_, err := Translate(prog, info)
+		assert.Error(t, err, tt.input)
+	}
+}
+
+// 出力したソースをビルドして、c/driver.cとリンクしたときと同じ結果になることを確かめる
+func TestTranslateRun(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not found")
+	}
+
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{"int a = 2; sum2(a, 3)", "5\n"},
+		{"sum5(1, 2, 3, 4, sum2(5, 6))", "21\n"},
+		{"char c = 'b'; c - 'a' + 1", "2\n"},
+		{"int a = 2147483647; a + 1", "-2147483648\n"},
+		{`string s = "x"; printf("%s", s); 2`, "x2\n"},
+		{`printf("%s", "abc");`, "abc3\n"},
+		{`printf("%i %u\n", 3, 4)`, "3 4\n4\n"},
+		{`int a = 0-1; printf("%d %u %x %X %o|", a, a, a, a, 8); 0`, "-1 4294967295 ffffffff FFFFFFFF 10|0\n"},
+		{`int a = 300; printf("%ld %hhd %hd %hhu %lld|", a, a, 70000, a, a); 0`, "300 44 4464 44 300|0\n"},
+		{`int a = 42; printf("[%5d][%-5d][%05d][%+d][%.3d][%#x]", a, a, a, a, a, a); 0`, "[   42][42   ][00042][+42][042][0x2a]0\n"},
+		{`string f = "%c%c%.2s%%\n"; char c = 'a'; printf(f, c, 98, "xyz")`, "abxy%\n6\n"},
+		{"int a = 0-7; char c = a; a / 2 + c", "-10\n"},
+	}
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module a\n\ngo 1.20\n"), 0o644))
+	for _, tt := range tests {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte(translate(t, tt.input)), 0o644))
+		cmd := exec.Command("go", "run", ".")
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+		assert.Equal(t, tt.expect, string(out), tt.input)
+	}
+}
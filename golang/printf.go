@@ -0,0 +1,191 @@
+package golang
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/object"
+	"github.com/kijimaD/gogo/sema"
+	ctoken "github.com/kijimaD/gogo/token"
+)
+
+// printfの変換指定をGoのfmtで表したもの
+type conversion struct {
+	spec string // Cの変換指定。%ldなど
+	wrap string // 引数を包むGoの関数。空なら包まない
+}
+
+// 文字列を受け取る変換か
+func (c conversion) str() bool {
+	return c.wrap == "cstring"
+}
+
+// Cのprintfの書式を、Goのfmtの書式にする
+// Goのfmtは引数の型で表示を決めるので、長さ修飾子と符号なしの変換は、引数を包む型変換に移す
+func goFormat(format []byte) (string, []conversion, error) {
+	var out strings.Builder
+	convs := []conversion{}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			out.WriteByte(format[i])
+			continue
+		}
+		start := i
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		i = skipDigits(format, i)
+		if i < len(format) && format[i] == '.' {
+			i = skipDigits(format, i+1)
+		}
+		flags := string(format[start:i])
+		j := i
+		for i < len(format) && strings.IndexByte("hlzjt", format[i]) >= 0 {
+			i++
+		}
+		length := string(format[j:i])
+		if i == len(format) {
+			return "", nil, fmt.Errorf("%s is not a complete conversion", format[start:])
+		}
+		spec := string(format[start : i+1])
+		unsupported := fmt.Errorf("%s is not supported", spec)
+		switch length {
+		case "", "hh", "h", "l", "ll", "z", "j", "t":
+		default:
+			return "", nil, unsupported
+		}
+
+		switch c := format[i]; c {
+		case '%':
+			if spec != "%%" {
+				return "", nil, unsupported
+			}
+			out.WriteString("%%")
+		case 'd', 'i':
+			out.WriteString(flags + "d")
+			convs = append(convs, conversion{spec: spec, wrap: map[string]string{"hh": "int8", "h": "int16"}[length]})
+		case 'u', 'o', 'x', 'X':
+			if c == 'u' {
+				c = 'd'
+			}
+			out.WriteString(flags + string(c))
+			wrap := "uint32"
+			switch length {
+			case "hh":
+				wrap = "uint8"
+			case "h":
+				wrap = "uint16"
+			}
+			convs = append(convs, conversion{spec: spec, wrap: wrap})
+		case 'c', 's':
+			// Goの%cはUTF-8で書くので、1バイトの文字列にして渡す
+			if length != "" {
+				return "", nil, unsupported
+			}
+			out.WriteString(flags + "s")
+			wrap := "cstring"
+			if c == 'c' {
+				wrap = "cchar"
+			}
+			convs = append(convs, conversion{spec: spec, wrap: wrap})
+		default:
+			return "", nil, unsupported
+		}
+	}
+	return out.String(), convs, nil
+}
+
+func skipDigits(s []byte, i int) int {
+	for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+		i++
+	}
+	return i
+}
+
+// printfの書式の中身。文字列リテラルか、文字列の変数でなければfalse
+// 文字列の変数には代入できないので、値は初期値のリテラルで決まる
+func formatBytes(e ast.Expression, info *sema.Info) ([]byte, bool) {
+	switch n := e.(type) {
+	case *ast.StringLiteral:
+		return cbytes(n), true
+	case *ast.Var:
+		if s, ok := info.Uses[n].(*object.String); ok {
+			return unquote(s.Value), true
+		}
+	}
+	return nil, false
+}
+
+// printfの呼び出しをGoのfmtに渡す書式と変換にする。Goにできなければ理由を返す
+func printfConversions(call *ast.FuncallExpression, info *sema.Info) (string, []conversion, error) {
+	if len(call.Args) == 0 {
+		return "", nil, fmt.Errorf("printf needs a format")
+	}
+	format, ok := formatBytes(call.Args[0], info)
+	if !ok {
+		return "", nil, fmt.Errorf("the format of printf must be a string literal or a string variable")
+	}
+	f, convs, err := goFormat(format)
+	if err != nil {
+		return "", nil, err
+	}
+	args := call.Args[1:]
+	if len(args) != len(convs) {
+		return "", nil, fmt.Errorf("the format has %d conversions but %d arguments are given", len(convs), len(args))
+	}
+	for i, c := range convs {
+		if c.str() != (args[i].GetCtype() == ctoken.CTYPE_STR) {
+			return "", nil, fmt.Errorf("argument %d does not match %s", i+2, c.spec)
+		}
+	}
+	return f, convs, nil
+}
+
+// printfの引数をGoのソースにする。先頭は書式の文字列になる
+func (t *translator) printfArgs(call *ast.FuncallExpression) []string {
+	f, convs, err := printfConversions(call, t.info)
+	if err != nil {
+		panic(fmt.Sprintf("golang: %s", err))
+	}
+	args := []string{strconv.Quote(f)}
+	for i, a := range call.Args[1:] {
+		args = append(args, t.wrap(convs[i].wrap, a))
+	}
+	return args
+}
+
+// 引数を型変換で包む。定数はGoでは範囲外の変換がエラーになるので、変換した値にする
+func (t *translator) wrap(wrap string, e ast.Expression) string {
+	switch wrap {
+	case "":
+		return t.expr(e)
+	case "cstring":
+		t.needPtr = true
+	case "cchar":
+		t.needChar = true
+	default:
+		if v, ok := t.info.Value(e); ok {
+			return strconv.FormatInt(convertInt(wrap, v.Int), 10)
+		}
+	}
+	return wrap + "(" + t.expr(e) + ")"
+}
+
+// 整数をGoの型に変換した値
+func convertInt(typ string, v int64) int64 {
+	switch typ {
+	case "int8":
+		return int64(int8(v))
+	case "int16":
+		return int64(int16(v))
+	case "uint8":
+		return int64(uint8(v))
+	case "uint16":
+		return int64(uint16(v))
+	default:
+		return int64(uint32(v))
+	}
+}
@@ -0,0 +1,62 @@
+package ir
+
+// 値をすべてスタックに置くバックエンドのための、関数のスタック上の配置
+// スタックポインタの直上に、レジスタで渡しきれない引数を置く領域を取る。その上に、allocaの領域と仮想レジスタの値の領域を命令の順に並べる
+// phiには、飛んでくる前のブロックで値を書いておく領域を別に取る。phiどうしで値を入れ替えるときに、まだ読んでいない値を壊さない
+type StackLayout struct {
+	Slots    map[*Reg]int // 仮想レジスタの値を置く、スタックポインタからのオフセット
+	Allocas  map[*Reg]int // allocaで確保した領域
+	Incoming map[*Reg]int // phiの値を、飛んでくる前のブロックで書いておく領域
+	Size     int          // 16バイトの倍数にそろえた大きさ
+}
+
+// 領域をslotWidthバイトずつ並べる。引数のうちargRegs個まではレジスタで渡す
+func LayoutStack(f *Func, slotWidth int, argRegs int) *StackLayout {
+	l := &StackLayout{Slots: map[*Reg]int{}, Allocas: map[*Reg]int{}, Incoming: map[*Reg]int{}}
+	pos := 0
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if n := (len(instr.Args) - argRegs) * slotWidth; instr.Op == OpCall && n > pos {
+				pos = n
+			}
+		}
+	}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			switch {
+			case instr.Op == OpAlloca:
+				l.Allocas[instr.Dst] = pos
+				pos += slotWidth
+			case instr.Dst != nil:
+				l.Slots[instr.Dst] = pos
+				pos += slotWidth
+			}
+			if instr.Op == OpPhi {
+				l.Incoming[instr.Dst] = pos
+				pos += slotWidth
+			}
+		}
+	}
+	l.Size = (pos + 15) / 16 * 16
+	return l
+}
+
+// phiに入る値
+type PhiMove struct {
+	Phi *Reg
+	Src Value
+}
+
+// fromからtoに進むときに、toのphiに入る値。phiの順に並べる
+func PhiMoves(from *Block, to *Block) []PhiMove {
+	moves := []PhiMove{}
+	for _, phi := range to.Phis() {
+		for i, p := range phi.Preds {
+			if p == from {
+				moves = append(moves, PhiMove{Phi: phi.Dst, Src: phi.Args[i]})
+				break
+			}
+		}
+	}
+	return moves
+}
@@ -0,0 +1,300 @@
+// 中間表現
+// ASTとアセンブリの間に置く3番地コード。関数は基本ブロックの列で、ブロックの最後の命令は分岐かretになる
+// 値は数に制限のない仮想レジスタに入れる。ローカル変数はallocaで確保したスタック上の領域にload/storeする
+//
+//	data @.s0 = "a"
+//
+//	func @mymain() i32 {
+//	entry:
+//		%1 = alloca i32
+//		store i32 2, %1
+//		%2 = load i32 %1
+//		%3 = call i32 @printf(ptr @.s0, i32 %2)
+//		ret i32 %3
+//	}
+
+package ir
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/kijimaD/gogo/constant"
+)
+
+// 値の型
+type Type int
+
+const (
+	Void Type = iota
+	I8
+	I32
+	Ptr
+)
+
+var typeNames = map[Type]string{
+	Void: "void",
+	I8:   "i8",
+	I32:  "i32",
+	Ptr:  "ptr",
+}
+
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
+// 型のバイト数
+func (t Type) Size() int {
+	switch t {
+	case I8:
+		return 1
+	case I32:
+		return 4
+	case Ptr:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// 命令のオペランドになるもの
+type Value interface {
+	String() string
+	Type() Type
+}
+
+// 仮想レジスタ。命令の結果は必ず新しいレジスタに入れる
+type Reg struct {
+	ID int
+	Ty Type
+}
+
+func (r *Reg) String() string { return "%" + strconv.Itoa(r.ID) }
+func (r *Reg) Type() Type     { return r.Ty }
+
+// 即値
+type Const struct {
+	Value int64
+	Ty    Type
+}
+
+func (c *Const) String() string { return strconv.FormatInt(c.Value, 10) }
+func (c *Const) Type() Type     { return c.Ty }
+
+// データやリンク先の関数のアドレス
+type Global struct {
+	Name string
+}
+
+func (g *Global) String() string { return "@" + g.Name }
+func (g *Global) Type() Type     { return Ptr }
+
+type Op int
+
+const (
+	OpAlloca Op = iota // %1 = alloca i32
+	OpLoad             // %2 = load i32 %1
+	OpStore            // store i32 %2, %1
+	OpAdd              // %3 = add i32 %1, %2
+	OpSub
+	OpMul
+	OpDiv
+	OpEq // %3 = eq i32 %1, %2。真なら1、偽なら0
+	OpNe
+	OpLt
+	OpLe
+	OpGt
+	OpGe
+	OpSext  // %2 = sext i8 %1 to i32
+	OpTrunc // %2 = trunc i32 %1 to i8
+	OpCall  // %2 = call i32 @f(i32 %1)
+	OpJmp   // jmp L1
+	OpBr    // br i32 %1, L1, L2。0でなければL1に進む
+	OpRet   // ret i32 %1
+	OpPhi   // %3 = phi i32 [%1, L1], [%2, L2]。直前にいたブロックに対応する値を選ぶ
+	OpCopy  // %2 = copy i32 %1
+)
+
+var opNames = map[Op]string{
+	OpAlloca: "alloca",
+	OpLoad:   "load",
+	OpStore:  "store",
+	OpAdd:    "add",
+	OpSub:    "sub",
+	OpMul:    "mul",
+	OpDiv:    "div",
+	OpEq:     "eq",
+	OpNe:     "ne",
+	OpLt:     "lt",
+	OpLe:     "le",
+	OpGt:     "gt",
+	OpGe:     "ge",
+	OpSext:   "sext",
+	OpTrunc:  "trunc",
+	OpCall:   "call",
+	OpJmp:    "jmp",
+	OpBr:     "br",
+	OpRet:    "ret",
+	OpPhi:    "phi",
+	OpCopy:   "copy",
+}
+
+func (op Op) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// 2つのオペランドをとる算術演算か比較
+func (op Op) IsBinary() bool {
+	return OpAdd <= op && op <= OpGe
+}
+
+// 比較の結果は0か1のi32になる
+func (op Op) IsCompare() bool {
+	return OpEq <= op && op <= OpGe
+}
+
+// 基本ブロックの最後に置く命令
+func (op Op) IsTerminator() bool {
+	return op == OpJmp || op == OpBr || op == OpRet
+}
+
+type Instr struct {
+	Op      Op
+	Dst     *Reg     // 結果を入れるレジスタ。結果がない命令ではnil
+	Type    Type     // 演算の型。allocaでは確保する型、sextとtruncでは変換元の型
+	To      Type     // sextとtruncの変換先の型
+	Args    []Value  // オペランド。storeは値、アドレスの順
+	Callee  string   // callで呼ぶ関数
+	Targets []*Block // jmpとbrの飛び先
+	Preds   []*Block // phiの各オペランドがどのブロックから来るか
+}
+
+// 値を計算するだけで、ほかに影響を与えない命令か。使われなければ消してよい
+func (i *Instr) IsPure() bool {
+	switch {
+	case i.Op.IsBinary(), i.Op == OpSext, i.Op == OpTrunc, i.Op == OpPhi, i.Op == OpCopy, i.Op == OpLoad, i.Op == OpAlloca:
+		return true
+	default:
+		return false
+	}
+}
+
+// 分岐を含まない命令の列。最後の命令だけが分岐かretになる
+type Block struct {
+	Name   string
+	Instrs []*Instr
+}
+
+// 先頭に並んだphi
+func (b *Block) Phis() []*Instr {
+	n := 0
+	for n < len(b.Instrs) && b.Instrs[n].Op == OpPhi {
+		n++
+	}
+	return b.Instrs[:n]
+}
+
+// 最後の命令。まだ分岐かretで終わっていなければnil
+func (b *Block) Terminator() *Instr {
+	if n := len(b.Instrs); n > 0 && b.Instrs[n-1].Op.IsTerminator() {
+		return b.Instrs[n-1]
+	}
+	return nil
+}
+
+// 後続のブロック
+func (b *Block) Succs() []*Block {
+	if t := b.Terminator(); t != nil {
+		return t.Targets
+	}
+	return nil
+}
+
+type Func struct {
+	Name    string
+	Ret     Type
+	Blocks  []*Block // 先頭が入口のブロック
+	NumRegs int      // 使ったレジスタの数。レジスタの番号は1から始まる
+}
+
+func NewFunc(name string, ret Type) *Func {
+	return &Func{Name: name, Ret: ret}
+}
+
+// 新しい仮想レジスタを作る
+func (f *Func) NewReg(t Type) *Reg {
+	f.NumRegs++
+	return &Reg{ID: f.NumRegs, Ty: t}
+}
+
+// 新しいブロックを関数の最後に追加する
+func (f *Func) NewBlock(name string) *Block {
+	b := &Block{Name: name}
+	f.Blocks = append(f.Blocks, b)
+	return b
+}
+
+// 各ブロックの先行ブロック。分岐の両方が同じブロックなら2回数える
+func (f *Func) Preds() map[*Block][]*Block {
+	preds := map[*Block][]*Block{}
+	for _, b := range f.Blocks {
+		for _, s := range b.Succs() {
+			preds[s] = append(preds[s], b)
+		}
+	}
+	return preds
+}
+
+// oldを使っているオペランドを、すべてvに置き換える
+func (f *Func) ReplaceUses(old *Reg, v Value) {
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			for i, a := range instr.Args {
+				if a == Value(old) {
+					instr.Args[i] = v
+				}
+			}
+		}
+	}
+}
+
+// 値をtの幅に切り詰めて、符号拡張した値
+func Truncate(v int64, t Type) int64 {
+	switch t {
+	case I8:
+		return int64(int8(v))
+	case I32:
+		return int64(int32(v))
+	default:
+		return v
+	}
+}
+
+// 文字列リテラルなどの読み取り専用のデータ
+// 値はアセンブラに渡す文字列そのままで、エスケープシーケンスはアセンブラが解釈する
+type Data struct {
+	Name  string
+	Value string
+}
+
+// エスケープシーケンスを解釈したバイト列。終端のヌル文字は含まない
+// アセンブラに頼らずにデータを置くバックエンドが使う。解釈できないエスケープシーケンスはエラーにする
+func (d *Data) Bytes() ([]byte, error) {
+	b, err := constant.Unquote(d.Value)
+	if err != nil {
+		return nil, fmt.Errorf("@%s: %w", d.Name, err)
+	}
+	return b, nil
+}
+
+// 1つの翻訳単位
+type Module struct {
+	Data  []*Data
+	Funcs []*Func
+}
@@ -0,0 +1,314 @@
+package ir
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/gogo/diag"
+	"github.com/kijimaD/gogo/lexer"
+	"github.com/kijimaD/gogo/parser"
+	"github.com/kijimaD/gogo/sema"
+	"github.com/stretchr/testify/assert"
+)
+
+func lower(t *testing.T, input string) *Module {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	prog := p.ParseProgram()
+	assert.Empty(t, p.Errors())
+	engine := diag.NewEngine()
+	info := sema.Check("", prog, engine)
+	assert.Empty(t, engine.Diagnostics())
+	return Lower(prog, info)
+}
+
+func TestLower(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{
+			``,
+			`
+func @mymain() i32 {
+entry:
+	ret i32 0
+}`,
+		},
+		{
+			// 定数式は意味解析で計算済み
+			`1 + 2 * 3`,
+			`
+func @mymain() i32 {
+entry:
+	ret i32 7
+}`,
+		},
+		{
+			`int a = 2; a - 1`,
+			`
+func @mymain() i32 {
+entry:
+	%1 = alloca i32
+	store i32 2, %1
+	%2 = load i32 %1
+	%3 = sub i32 %2, 1
+	ret i32 %3
+}`,
+		},
+		{
+			// charは読むときに符号拡張する
+			`char c = 'a'; c + 1`,
+			`
+func @mymain() i32 {
+entry:
+	%1 = alloca i8
+	store i8 97, %1
+	%2 = load i8 %1
+	%3 = sext i8 %2 to i32
+	%4 = add i32 %3, 1
+	ret i32 %4
+}`,
+		},
+		{
+			// 最後の文が宣言なら、初期値を返す
+			`int a = 1; char c = a`,
+			`
+func @mymain() i32 {
+entry:
+	%1 = alloca i32
+	%2 = alloca i8
+	store i32 1, %1
+	%3 = load i32 %1
+	%4 = trunc i32 %3 to i8
+	store i8 %4, %2
+	%5 = sext i8 %4 to i32
+	ret i32 %5
+}`,
+		},
+		{
+			// intに収まらないリテラルは、どのバックエンドにもintの範囲の値を渡す
+			`int a = 3000000000; a`,
+			`
+func @mymain() i32 {
+entry:
+	%1 = alloca i32
+	store i32 -1294967296, %1
+	%2 = load i32 %1
+	ret i32 %2
+}`,
+		},
+		{
+			`printf("%s", "a"); sum2(1, 'b')`,
+			`data @.s0 = "%s"
+data @.s1 = "a"
+
+func @mymain() i32 {
+entry:
+	%1 = call i32 @printf(ptr @.s0, ptr @.s1)
+	%2 = call i32 @sum2(i32 1, i32 98)
+	ret i32 %2
+}`,
+		},
+	}
+
+	for _, tt := range tests {
+		m := lower(t, tt.input)
+		assert.Equal(t, strings.TrimPrefix(tt.expect, "\n")+"\n", m.String(), tt.input)
+	}
+}
+
+// 印字したものを読み込むと同じものに戻る
+func TestParseRoundTrip(t *testing.T) {
+	tests := []string{
+		`data @.s0 = "a b; c"
+
+func @mymain() i32 {
+entry:
+	%1 = alloca i32
+	store i32 -1, %1
+	%2 = load i32 %1
+	%3 = lt i32 %2, 10
+	br i32 %3, loop, done
+loop:
+	%4 = load i32 %1
+	%5 = add i32 %4, 1
+	store i32 %5, %1
+	%6 = call i32 @printf(ptr @.s0)
+	call void @exit(i32 0)
+	jmp entry
+done:
+	%7 = trunc i32 %2 to i8
+	%8 = sext i8 %7 to i32
+	ret i32 %8
+}
+`,
+		`func @f() i32 {
+entry:
+	%1 = call i32 @c()
+	br i32 %1, loop, done
+loop:
+	%2 = phi i32 [0, entry], [%3, loop]
+	%3 = copy i32 %2
+	br i32 %3, loop, done
+done:
+	%4 = phi i32 [%1, entry], [%3, loop]
+	ret i32 %4
+}
+`,
+		`func @f() void {
+entry:
+	ret void
+}
+
+func @g() i32 {
+entry:
+	%1 = call i32 @f()
+	ret i32 %1
+}
+`,
+	}
+
+	for _, input := range tests {
+		m, err := Parse(input)
+		assert.NoError(t, err)
+		assert.Equal(t, input, m.String())
+	}
+}
+
+func TestParse(t *testing.T) {
+	m, err := Parse(`
+; コメントは読み飛ばす
+func @mymain() i32 {
+entry:          ; 入口
+	br i32 %2, a, b
+a:
+	%2 = add i32 1, 2
+	ret i32 %2
+b:
+	%9 = load i8 %2
+	ret i32 0
+}`)
+	assert.NoError(t, err)
+
+	f := m.Funcs[0]
+	assert.Equal(t, 9, f.NumRegs)
+	assert.Equal(t, []string{"entry", "a", "b"}, []string{f.Blocks[0].Name, f.Blocks[1].Name, f.Blocks[2].Name})
+	assert.Equal(t, []*Block{f.Blocks[1], f.Blocks[2]}, f.Blocks[0].Succs())
+
+	// 前方参照したレジスタも同じもの
+	br := f.Blocks[0].Instrs[0]
+	add := f.Blocks[1].Instrs[0]
+	assert.Same(t, add.Dst, br.Args[0])
+	assert.Equal(t, I32, add.Dst.Type())
+	assert.Equal(t, I8, f.Blocks[2].Instrs[0].Dst.Type())
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{`func @f() i32 {`, `line 1: missing } at the end of @f`},
+		{`ret i32 0`, `line 1: expected data or func, got "ret"`},
+		{"func @f() i32 {\n\tret i32 0\n}", `line 2: instruction outside of a block`},
+		{"func @f() i32 {\nentry:\n\tmov i32 0\n}", `line 3: unknown instruction "mov"`},
+		{"func @f() i32 {\nentry:\n\tret i64 0\n}", `line 3: unknown type "i64"`},
+		{"func @f() i32 {\nentry:\n\tjmp nowhere\n}", `line 4: undefined block nowhere`},
+		{"func @f() i32 {\nentry:\n\tret i32 %1\n}", `line 4: undefined register %1`},
+		{"func @f() i32 {\nentry:\n\t%1 = add i32 1, 2\n\t%1 = add i32 1, 2\n}", `line 4: register %1 is already defined`},
+		{"func @f() i32 {\nentry:\n\tadd i32 1, 2\n}", `line 3: add needs a result register`},
+		{"func @f() i32 {\nentry:\n\t%1 = store i32 1, %2\n}", `line 3: store has no result`},
+		{"func @f() i32 {\nentry:\n\tret i32 0 0\n}", `line 3: unexpected "0"`},
+		{`data @s = "abc`, `line 1: unterminated string`},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.input)
+		assert.EqualError(t, err, tt.expect, tt.input)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{
+			"func @f() i32 {\nentry:\n\t%1 = add i32 1, 2\n}",
+			"@f: block entry does not end with a terminator",
+		},
+		{
+			"func @f() i32 {\nentry:\n\tjmp a\n\tjmp a\na:\n\tret i32 0\n}",
+			"@f: entry: terminator in the middle of the block: jmp a",
+		},
+		{
+			"func @f() i32 {\nentry:\n\tjmp a\na:\n\t%1 = add i32 1, 2\n\t%2 = phi i32 [1, entry]\n\tret i32 0\n}",
+			"@f: a: phi after other instructions: %2 = phi i32 [1, entry]",
+		},
+		{
+			"func @f() i32 {\nentry:\n\tjmp a\nb:\n\tjmp a\na:\n\t%1 = phi i32 [1, entry]\n\tret i32 0\n}",
+			"@f: a: %1 = phi i32 [1, entry]: no value for predecessor b",
+		},
+		{
+			"func @f() i32 {\nentry:\n\tjmp a\na:\n\t%1 = phi i32 [1, entry], [2, a]\n\tret i32 0\n}",
+			"@f: a: %1 = phi i32 [1, entry], [2, a]: a is not a predecessor",
+		},
+	}
+
+	for _, tt := range tests {
+		m, err := Parse(tt.input)
+		assert.NoError(t, err)
+		assert.EqualError(t, Verify(m.Funcs[0]), tt.expect)
+	}
+
+	m := lower(t, `int a = 1; printf("%d", a)`)
+	assert.NoError(t, Verify(m.Funcs[0]))
+}
+
+func TestDataBytes(t *testing.T) {
+	b, err := (&Data{Name: ".s0", Value: `%d\n`}).Bytes()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("%d\n"), b)
+
+	_, err = (&Data{Name: ".s0", Value: `\777`}).Bytes()
+	assert.EqualError(t, err, `@.s0: octal escape sequence \777 out of range`)
+}
+
+func TestLayoutStack(t *testing.T) {
+	m, err := Parse(`
+func @f() i32 {
+entry:
+	%1 = alloca i32
+	%2 = call i32 @sum5(i32 1, i32 2, i32 3, i32 4, i32 5)
+	jmp a
+a:
+	%3 = phi i32 [%2, entry], [%4, a]
+	%4 = add i32 %3, 1
+	br i32 %4, a, b
+b:
+	ret i32 %3
+}`)
+	assert.NoError(t, err)
+	f := m.Funcs[0]
+	regs := map[string]*Reg{}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Dst != nil {
+				regs[instr.Dst.String()] = instr.Dst
+			}
+		}
+	}
+
+	// 渡しきれない引数2つの領域の上に、命令の順に並べる
+	l := LayoutStack(f, 8, 3)
+	assert.Equal(t, map[*Reg]int{regs["%1"]: 16}, l.Allocas)
+	assert.Equal(t, map[*Reg]int{regs["%2"]: 24, regs["%3"]: 32, regs["%4"]: 48}, l.Slots)
+	assert.Equal(t, map[*Reg]int{regs["%3"]: 40}, l.Incoming)
+	assert.Equal(t, 64, l.Size)
+
+	a := f.Blocks[1]
+	assert.Equal(t, []PhiMove{{Phi: regs["%3"], Src: regs["%2"]}}, PhiMoves(f.Blocks[0], a))
+	assert.Equal(t, []PhiMove{{Phi: regs["%3"], Src: regs["%4"]}}, PhiMoves(a, a))
+	assert.Empty(t, PhiMoves(a, f.Blocks[2]))
+}
@@ -0,0 +1,57 @@
+// バックエンドのテストで共有する中間表現のプログラム
+// プログラムはir/testdataに、名前.irとして置く。実行したときの出力は名前.outに書いておく
+
+package irtest
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/kijimaD/gogo/ir"
+	"github.com/kijimaD/gogo/opt"
+)
+
+// testdataにあるプログラムの名前
+var Programs = []string{"loop", "call"}
+
+// ir/testdataの場所。テストを実行するディレクトリによらないように、このファイルの位置から決める
+func dir() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "testdata")
+}
+
+func read(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir(), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// 中間表現を読み込み、levelの最適化をかける
+func Parse(t *testing.T, src string, level int) *ir.Module {
+	t.Helper()
+	m, err := ir.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := opt.NewManager(level).Run(m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// testdataのプログラムを読み込み、levelの最適化をかける
+func Load(t *testing.T, name string, level int) *ir.Module {
+	t.Helper()
+	return Parse(t, read(t, name+".ir"), level)
+}
+
+// testdataのプログラムを、c/driver.cと一緒に実行したときの出力
+func Output(t *testing.T, name string) string {
+	t.Helper()
+	return read(t, name+".out")
+}
@@ -0,0 +1,174 @@
+package ir
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/sema"
+	"github.com/kijimaD/gogo/token"
+)
+
+// プログラム全体が入る関数の名前。ランタイムのmainから呼ばれる
+const EntryFunc = "mymain"
+
+// 文字列リテラルのデータの名前
+func StringName(id int) string {
+	return fmt.Sprintf(".s%d", id)
+}
+
+// 意味解析が終わったASTを中間表現に変換する
+// プログラムはmymainという1つの関数になり、最後の文の値を返す。定数式はinfoに記録した値にする
+func Lower(prog *ast.Program, info *sema.Info) *Module {
+	m := &Module{Data: lowerStrings(prog)}
+
+	l := &lowerer{f: NewFunc(EntryFunc, I32), info: info, slots: map[int]*Reg{}}
+	l.b = l.f.NewBlock("entry")
+
+	// 変数の領域は入口でまとめて確保する。スタック上の位置の順に並べる
+	for _, stmt := range prog.Statements {
+		if ds, ok := stmt.(*ast.DeclStatement); ok {
+			slot := l.emit(&Instr{Op: OpAlloca, Type: typeOf(ds.Ctype)}, Ptr)
+			l.slots[ds.Pos] = slot
+		}
+	}
+
+	var last Value = &Const{Value: 0, Ty: I32}
+	for _, stmt := range prog.Statements {
+		if v := l.stmt(stmt); v != nil {
+			last = v
+		}
+	}
+	l.b.Instrs = append(l.b.Instrs, &Instr{Op: OpRet, Type: I32, Args: []Value{l.conv(last, I32)}})
+
+	m.Funcs = append(m.Funcs, l.f)
+	return m
+}
+
+// 文字列リテラルをIDの順に集める
+func lowerStrings(prog *ast.Program) []*Data {
+	strs := map[int]string{}
+	ast.Inspect(prog, func(n ast.Node) bool {
+		if sl, ok := n.(*ast.StringLiteral); ok {
+			strs[sl.ID] = sl.Value
+		}
+		return true
+	})
+
+	ids := make([]int, 0, len(strs))
+	for id := range strs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	data := make([]*Data, 0, len(ids))
+	for _, id := range ids {
+		data = append(data, &Data{Name: StringName(id), Value: strs[id]})
+	}
+	return data
+}
+
+type lowerer struct {
+	f     *Func
+	b     *Block
+	info  *sema.Info
+	slots map[int]*Reg // スタック上の位置から、変数の領域のアドレスを入れたレジスタへ
+}
+
+// 命令を追加して、結果を入れるレジスタを返す
+func (l *lowerer) emit(instr *Instr, t Type) *Reg {
+	instr.Dst = l.f.NewReg(t)
+	l.b.Instrs = append(l.b.Instrs, instr)
+	return instr.Dst
+}
+
+// 文を変換して、文の値を返す
+func (l *lowerer) stmt(stmt ast.Statement) Value {
+	switch s := stmt.(type) {
+	case *ast.ExpressionStatement:
+		return l.expr(s.Expression)
+	case *ast.DeclStatement:
+		if s.Value == nil {
+			return nil
+		}
+		v := l.expr(s.Value)
+		l.b.Instrs = append(l.b.Instrs, &Instr{Op: OpStore, Type: typeOf(s.Ctype), Args: []Value{v, l.slots[s.Pos]}})
+		return v
+	default:
+		panic(fmt.Sprintf("ir: unexpected statement %T", s))
+	}
+}
+
+var binops = map[string]Op{
+	token.PLUS:     OpAdd,
+	token.MINUS:    OpSub,
+	token.ASTERISK: OpMul,
+	token.SLASH:    OpDiv,
+}
+
+func (l *lowerer) expr(e ast.Expression) Value {
+	switch n := e.(type) {
+	case *ast.IntegerLiteral:
+		return &Const{Value: Truncate(n.Value, I32), Ty: I32}
+	case *ast.CharLiteral:
+		return &Const{Value: int64(n.Value), Ty: I8}
+	case *ast.StringLiteral:
+		return &Global{Name: StringName(n.ID)}
+	case *ast.Var:
+		t := typeOf(n.Ctype)
+		return l.emit(&Instr{Op: OpLoad, Type: t, Args: []Value{l.slots[n.Pos]}}, t)
+	case *ast.InfixExpression:
+		if v, ok := l.info.Consts[n]; ok {
+			return &Const{Value: Truncate(v.Int, I32), Ty: I32}
+		}
+		op, ok := binops[n.Operator]
+		if !ok {
+			panic(fmt.Sprintf("ir: unexpected operator %s", n.Operator))
+		}
+		left := l.expr(n.Left)
+		right := l.expr(n.Right)
+		t := typeOf(n.Ctype)
+		return l.emit(&Instr{Op: op, Type: t, Args: []Value{left, right}}, t)
+	case *ast.ConvExpression:
+		return l.conv(l.expr(n.Expression), typeOf(n.Ctype))
+	case *ast.FuncallExpression:
+		args := make([]Value, len(n.Args))
+		for i, a := range n.Args {
+			args[i] = l.expr(a)
+		}
+		t := typeOf(n.GetCtype())
+		return l.emit(&Instr{Op: OpCall, Type: t, Callee: n.Function.TokenLiteral(), Args: args}, t)
+	default:
+		panic(fmt.Sprintf("ir: unexpected expression %T", n))
+	}
+}
+
+// 整数の幅を変える。広げるときは符号拡張する
+func (l *lowerer) conv(v Value, to Type) Value {
+	from := v.Type()
+	if from == to {
+		return v
+	}
+	// 即値はそのまま変換する
+	if c, ok := v.(*Const); ok {
+		return &Const{Value: Truncate(c.Value, to), Ty: to}
+	}
+	op := OpSext
+	if from.Size() > to.Size() {
+		op = OpTrunc
+	}
+	return l.emit(&Instr{Op: op, Type: from, To: to, Args: []Value{v}}, to)
+}
+
+func typeOf(ctype token.Ctype) Type {
+	switch ctype {
+	case token.CTYPE_INT:
+		return I32
+	case token.CTYPE_CHAR:
+		return I8
+	case token.CTYPE_STR:
+		return Ptr
+	default:
+		return Void
+	}
+}
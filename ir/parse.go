@@ -0,0 +1,494 @@
+package ir
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 読み込めなかった行と理由
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+var opsByName = func() map[string]Op {
+	m := map[string]Op{}
+	for op, name := range opNames {
+		m[name] = op
+	}
+	return m
+}()
+
+var typesByName = func() map[string]Type {
+	m := map[string]Type{}
+	for t, name := range typeNames {
+		m[name] = t
+	}
+	return m
+}()
+
+// テキスト形式のモジュールを読み込む。主にテストで期待する中間表現を書くのに使う
+// ;から行末まではコメント
+func Parse(src string) (*Module, error) {
+	p := &irParser{m: &Module{}}
+	for i, line := range strings.Split(src, "\n") {
+		toks, err := tokenize(line)
+		if err != nil {
+			return nil, &ParseError{Line: i + 1, Msg: err.Error()}
+		}
+		if len(toks) == 0 {
+			continue
+		}
+		p.line = &lineScanner{toks: toks}
+		if err := p.parseLine(); err != nil {
+			return nil, &ParseError{Line: i + 1, Msg: err.Error()}
+		}
+	}
+	if p.f != nil {
+		return nil, &ParseError{Line: strings.Count(src, "\n") + 1, Msg: fmt.Sprintf("missing } at the end of @%s", p.f.Name)}
+	}
+	return p.m, nil
+}
+
+// 1行を単語と記号に分ける
+func tokenize(line string) ([]string, error) {
+	toks := []string{}
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ';':
+			return toks, nil
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.IndexByte(",()=:{}[]", c) >= 0:
+			toks = append(toks, string(c))
+			i++
+		case c == '"':
+			end := strings.IndexByte(line[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			toks = append(toks, line[i:i+end+2])
+			i += end + 2
+		default:
+			start := i
+			for i < len(line) && strings.IndexByte(" \t\r;,()=:{}[]\"", line[i]) < 0 {
+				i++
+			}
+			toks = append(toks, line[start:i])
+		}
+	}
+	return toks, nil
+}
+
+type lineScanner struct {
+	toks []string
+	pos  int
+}
+
+func (s *lineScanner) peek() string {
+	if s.pos < len(s.toks) {
+		return s.toks[s.pos]
+	}
+	return ""
+}
+
+func (s *lineScanner) next() string {
+	tok := s.peek()
+	s.pos++
+	return tok
+}
+
+func (s *lineScanner) expect(tok string) error {
+	if got := s.next(); got != tok {
+		return fmt.Errorf("expected %q, got %q", tok, got)
+	}
+	return nil
+}
+
+func (s *lineScanner) done() error {
+	if s.pos < len(s.toks) {
+		return fmt.Errorf("unexpected %q", s.toks[s.pos])
+	}
+	return nil
+}
+
+type irParser struct {
+	m    *Module
+	line *lineScanner
+
+	// 読んでいる関数
+	f       *Func
+	b       *Block
+	regs    map[int]*Reg
+	defined map[*Reg]bool
+	blocks  map[string]*Block
+	labeled map[*Block]bool
+}
+
+func (p *irParser) parseLine() error {
+	s := p.line
+	if p.f == nil {
+		switch s.peek() {
+		case "data":
+			return p.parseData()
+		case "func":
+			return p.parseFuncHeader()
+		default:
+			return fmt.Errorf("expected data or func, got %q", s.peek())
+		}
+	}
+
+	if s.peek() == "}" {
+		s.next()
+		if err := s.done(); err != nil {
+			return err
+		}
+		return p.endFunc()
+	}
+	if len(s.toks) == 2 && s.toks[1] == ":" {
+		return p.parseLabel(s.toks[0])
+	}
+	if p.b == nil {
+		return fmt.Errorf("instruction outside of a block")
+	}
+	instr, err := p.parseInstr()
+	if err != nil {
+		return err
+	}
+	if err := s.done(); err != nil {
+		return err
+	}
+	p.b.Instrs = append(p.b.Instrs, instr)
+	return nil
+}
+
+// data @.s0 = "abc"
+func (p *irParser) parseData() error {
+	s := p.line
+	s.next()
+	name, err := parseGlobalName(s.next())
+	if err != nil {
+		return err
+	}
+	if err := s.expect("="); err != nil {
+		return err
+	}
+	str := s.next()
+	if len(str) < 2 || str[0] != '"' {
+		return fmt.Errorf("expected string, got %q", str)
+	}
+	p.m.Data = append(p.m.Data, &Data{Name: name, Value: str[1 : len(str)-1]})
+	return s.done()
+}
+
+// func @mymain() i32 {
+func (p *irParser) parseFuncHeader() error {
+	s := p.line
+	s.next()
+	name, err := parseGlobalName(s.next())
+	if err != nil {
+		return err
+	}
+	for _, tok := range []string{"(", ")"} {
+		if err := s.expect(tok); err != nil {
+			return err
+		}
+	}
+	ret, err := parseType(s.next())
+	if err != nil {
+		return err
+	}
+	if err := s.expect("{"); err != nil {
+		return err
+	}
+	p.f = NewFunc(name, ret)
+	p.b = nil
+	p.regs = map[int]*Reg{}
+	p.defined = map[*Reg]bool{}
+	p.blocks = map[string]*Block{}
+	p.labeled = map[*Block]bool{}
+	return s.done()
+}
+
+func (p *irParser) endFunc() error {
+	if len(p.f.Blocks) == 0 {
+		return fmt.Errorf("@%s has no blocks", p.f.Name)
+	}
+	for name, b := range p.blocks {
+		if !p.labeled[b] {
+			return fmt.Errorf("undefined block %s", name)
+		}
+	}
+	ids := []int{}
+	for id, r := range p.regs {
+		if !p.defined[r] {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 {
+		sort.Ints(ids)
+		return fmt.Errorf("undefined register %%%d", ids[0])
+	}
+	p.m.Funcs = append(p.m.Funcs, p.f)
+	p.f = nil
+	return nil
+}
+
+func (p *irParser) parseLabel(name string) error {
+	b := p.block(name)
+	if p.labeled[b] {
+		return fmt.Errorf("block %s is already defined", name)
+	}
+	p.labeled[b] = true
+	p.f.Blocks = append(p.f.Blocks, b)
+	p.b = b
+	return nil
+}
+
+// 前方参照できるように、ラベルより前に参照されたブロックも作っておく
+func (p *irParser) block(name string) *Block {
+	if b, ok := p.blocks[name]; ok {
+		return b
+	}
+	b := &Block{Name: name}
+	p.blocks[name] = b
+	return b
+}
+
+func (p *irParser) reg(id int) *Reg {
+	if r, ok := p.regs[id]; ok {
+		return r
+	}
+	r := &Reg{ID: id}
+	p.regs[id] = r
+	if id > p.f.NumRegs {
+		p.f.NumRegs = id
+	}
+	return r
+}
+
+func (p *irParser) parseInstr() (*Instr, error) {
+	s := p.line
+	var dst *Reg
+	if strings.HasPrefix(s.peek(), "%") {
+		r, err := p.parseReg(s.next())
+		if err != nil {
+			return nil, err
+		}
+		if p.defined[r] {
+			return nil, fmt.Errorf("register %s is already defined", r)
+		}
+		if err := s.expect("="); err != nil {
+			return nil, err
+		}
+		dst = r
+	}
+
+	name := s.next()
+	op, ok := opsByName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown instruction %q", name)
+	}
+	instr := &Instr{Op: op}
+	if op != OpJmp {
+		t, err := parseType(s.next())
+		if err != nil {
+			return nil, err
+		}
+		instr.Type = t
+	}
+
+	var err error
+	switch {
+	case op == OpAlloca:
+	case op == OpLoad:
+		err = p.parseArgs(instr, Ptr)
+	case op == OpCopy:
+		err = p.parseArgs(instr, instr.Type)
+	case op == OpPhi:
+		err = p.parsePhi(instr)
+	case op == OpStore:
+		err = p.parseArgs(instr, instr.Type, Ptr)
+	case op.IsBinary():
+		err = p.parseArgs(instr, instr.Type, instr.Type)
+	case op == OpSext, op == OpTrunc:
+		if err = p.parseArgs(instr, instr.Type); err == nil {
+			if err = s.expect("to"); err == nil {
+				instr.To, err = parseType(s.next())
+			}
+		}
+	case op == OpCall:
+		err = p.parseCall(instr)
+	case op == OpJmp:
+		instr.Targets = []*Block{p.block(s.next())}
+	case op == OpBr:
+		if err = p.parseArgs(instr, instr.Type); err == nil {
+			for i := 0; i < 2 && err == nil; i++ {
+				if err = s.expect(","); err == nil {
+					instr.Targets = append(instr.Targets, p.block(s.next()))
+				}
+			}
+		}
+	case op == OpRet:
+		if instr.Type != Void {
+			err = p.parseArgs(instr, instr.Type)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if t, ok := resultType(instr); ok {
+		if dst == nil && op != OpCall {
+			return nil, fmt.Errorf("%s needs a result register", op)
+		}
+		if dst != nil {
+			dst.Ty = t
+		}
+	} else if dst != nil {
+		return nil, fmt.Errorf("%s has no result", op)
+	}
+	if dst != nil {
+		p.defined[dst] = true
+		instr.Dst = dst
+	}
+	return instr, nil
+}
+
+// 命令の結果の型。結果がなければfalse
+func resultType(i *Instr) (Type, bool) {
+	switch {
+	case i.Op == OpAlloca:
+		return Ptr, true
+	case i.Op == OpLoad, i.Op == OpPhi, i.Op == OpCopy:
+		return i.Type, true
+	case i.Op.IsCompare():
+		return I32, true
+	case i.Op.IsBinary():
+		return i.Type, true
+	case i.Op == OpSext, i.Op == OpTrunc:
+		return i.To, true
+	case i.Op == OpCall:
+		return i.Type, i.Type != Void
+	default:
+		return Void, false
+	}
+}
+
+// カンマで区切ったオペランドを、それぞれの型で読む
+func (p *irParser) parseArgs(instr *Instr, types ...Type) error {
+	for i, t := range types {
+		if i > 0 {
+			if err := p.line.expect(","); err != nil {
+				return err
+			}
+		}
+		v, err := p.parseValue(p.line.next(), t)
+		if err != nil {
+			return err
+		}
+		instr.Args = append(instr.Args, v)
+	}
+	return nil
+}
+
+// call i32 @f(i32 %1, ptr @.s0)
+func (p *irParser) parseCall(instr *Instr) error {
+	s := p.line
+	callee, err := parseGlobalName(s.next())
+	if err != nil {
+		return err
+	}
+	instr.Callee = callee
+	if err := s.expect("("); err != nil {
+		return err
+	}
+	for s.peek() != ")" {
+		if len(instr.Args) > 0 {
+			if err := s.expect(","); err != nil {
+				return err
+			}
+		}
+		t, err := parseType(s.next())
+		if err != nil {
+			return err
+		}
+		if err := p.parseArgs(instr, t); err != nil {
+			return err
+		}
+	}
+	return s.expect(")")
+}
+
+// phi i32 [%1, L1], [%2, L2]
+func (p *irParser) parsePhi(instr *Instr) error {
+	s := p.line
+	for {
+		if err := s.expect("["); err != nil {
+			return err
+		}
+		if err := p.parseArgs(instr, instr.Type); err != nil {
+			return err
+		}
+		if err := s.expect(","); err != nil {
+			return err
+		}
+		instr.Preds = append(instr.Preds, p.block(s.next()))
+		if err := s.expect("]"); err != nil {
+			return err
+		}
+		if s.peek() != "," {
+			return nil
+		}
+		s.next()
+	}
+}
+
+func (p *irParser) parseValue(tok string, t Type) (Value, error) {
+	switch {
+	case strings.HasPrefix(tok, "%"):
+		return p.parseReg(tok)
+	case strings.HasPrefix(tok, "@"):
+		name, err := parseGlobalName(tok)
+		if err != nil {
+			return nil, err
+		}
+		return &Global{Name: name}, nil
+	default:
+		v, err := strconv.ParseInt(tok, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected value, got %q", tok)
+		}
+		return &Const{Value: v, Ty: t}, nil
+	}
+}
+
+func (p *irParser) parseReg(tok string) (*Reg, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(tok, "%"))
+	if err != nil || id <= 0 {
+		return nil, fmt.Errorf("invalid register %q", tok)
+	}
+	return p.reg(id), nil
+}
+
+func parseGlobalName(tok string) (string, error) {
+	if len(tok) < 2 || tok[0] != '@' {
+		return "", fmt.Errorf("expected global name, got %q", tok)
+	}
+	return tok[1:], nil
+}
+
+func parseType(tok string) (Type, error) {
+	t, ok := typesByName[tok]
+	if !ok {
+		return Void, fmt.Errorf("unknown type %q", tok)
+	}
+	return t, nil
+}
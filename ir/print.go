@@ -0,0 +1,80 @@
+package ir
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// モジュールをテキスト形式で書き出す。Parseで読み戻せる
+func Fprint(w io.Writer, m *Module) error {
+	_, err := io.WriteString(w, m.String())
+	return err
+}
+
+func (m *Module) String() string {
+	var out bytes.Buffer
+	for _, d := range m.Data {
+		fmt.Fprintf(&out, "data @%s = \"%s\"\n", d.Name, d.Value)
+	}
+	for i, f := range m.Funcs {
+		if i > 0 || len(m.Data) > 0 {
+			out.WriteString("\n")
+		}
+		out.WriteString(f.String())
+	}
+	return out.String()
+}
+
+func (f *Func) String() string {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "func @%s() %s {\n", f.Name, f.Ret)
+	for _, b := range f.Blocks {
+		fmt.Fprintf(&out, "%s:\n", b.Name)
+		for _, instr := range b.Instrs {
+			fmt.Fprintf(&out, "\t%s\n", instr)
+		}
+	}
+	out.WriteString("}\n")
+	return out.String()
+}
+
+func (i *Instr) String() string {
+	var out strings.Builder
+	if i.Dst != nil {
+		fmt.Fprintf(&out, "%s = ", i.Dst)
+	}
+	out.WriteString(i.Op.String())
+
+	switch {
+	case i.Op == OpAlloca:
+		fmt.Fprintf(&out, " %s", i.Type)
+	case i.Op == OpLoad, i.Op == OpRet, i.Op == OpCopy:
+		fmt.Fprintf(&out, " %s", i.Type)
+		if len(i.Args) > 0 {
+			fmt.Fprintf(&out, " %s", i.Args[0])
+		}
+	case i.Op == OpStore || i.Op.IsBinary():
+		fmt.Fprintf(&out, " %s %s, %s", i.Type, i.Args[0], i.Args[1])
+	case i.Op == OpSext, i.Op == OpTrunc:
+		fmt.Fprintf(&out, " %s %s to %s", i.Type, i.Args[0], i.To)
+	case i.Op == OpCall:
+		args := make([]string, len(i.Args))
+		for n, a := range i.Args {
+			args[n] = fmt.Sprintf("%s %s", a.Type(), a)
+		}
+		fmt.Fprintf(&out, " %s @%s(%s)", i.Type, i.Callee, strings.Join(args, ", "))
+	case i.Op == OpJmp:
+		fmt.Fprintf(&out, " %s", i.Targets[0].Name)
+	case i.Op == OpPhi:
+		incoming := make([]string, len(i.Args))
+		for n, a := range i.Args {
+			incoming[n] = fmt.Sprintf("[%s, %s]", a, i.Preds[n].Name)
+		}
+		fmt.Fprintf(&out, " %s %s", i.Type, strings.Join(incoming, ", "))
+	case i.Op == OpBr:
+		fmt.Fprintf(&out, " %s %s, %s, %s", i.Type, i.Args[0], i.Targets[0].Name, i.Targets[1].Name)
+	}
+	return out.String()
+}
@@ -0,0 +1,91 @@
+package ir
+
+import "fmt"
+
+// 関数の形が正しいかを調べる。最適化のパスを書くときの確認に使う
+//   - すべてのブロックは分岐かretで終わり、途中に分岐はない
+//   - phiはブロックの先頭にあり、先行ブロックごとに1つずつ値を持つ
+//   - レジスタは1回だけ定義され、使うレジスタはどこかで定義されている
+func Verify(f *Func) error {
+	if len(f.Blocks) == 0 {
+		return fmt.Errorf("@%s: no blocks", f.Name)
+	}
+
+	blocks := map[*Block]bool{}
+	for _, b := range f.Blocks {
+		if blocks[b] {
+			return fmt.Errorf("@%s: block %s appears twice", f.Name, b.Name)
+		}
+		blocks[b] = true
+	}
+
+	defs := map[*Reg]*Instr{}
+	for _, b := range f.Blocks {
+		if b.Terminator() == nil {
+			return fmt.Errorf("@%s: block %s does not end with a terminator", f.Name, b.Name)
+		}
+		phis := true
+		for i, instr := range b.Instrs {
+			if instr.Op.IsTerminator() && i != len(b.Instrs)-1 {
+				return fmt.Errorf("@%s: %s: terminator in the middle of the block: %s", f.Name, b.Name, instr)
+			}
+			if instr.Op == OpPhi && !phis {
+				return fmt.Errorf("@%s: %s: phi after other instructions: %s", f.Name, b.Name, instr)
+			}
+			phis = instr.Op == OpPhi
+			for _, t := range instr.Targets {
+				if !blocks[t] {
+					return fmt.Errorf("@%s: %s: jump to unknown block %s", f.Name, b.Name, t.Name)
+				}
+			}
+			if instr.Dst != nil {
+				if _, ok := defs[instr.Dst]; ok {
+					return fmt.Errorf("@%s: %s is defined twice", f.Name, instr.Dst)
+				}
+				defs[instr.Dst] = instr
+			}
+		}
+	}
+
+	preds := f.Preds()
+	for _, b := range f.Blocks {
+		for _, phi := range b.Phis() {
+			if err := verifyPhi(phi, preds[b]); err != nil {
+				return fmt.Errorf("@%s: %s: %s: %w", f.Name, b.Name, phi, err)
+			}
+		}
+		for _, instr := range b.Instrs {
+			for _, a := range instr.Args {
+				if r, ok := a.(*Reg); ok {
+					if _, ok := defs[r]; !ok {
+						return fmt.Errorf("@%s: %s: %s uses undefined %s", f.Name, b.Name, instr, r)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// phiの値の元になるブロックと、先行ブロックが一致するか
+func verifyPhi(phi *Instr, preds []*Block) error {
+	if len(phi.Args) != len(phi.Preds) {
+		return fmt.Errorf("%d values for %d blocks", len(phi.Args), len(phi.Preds))
+	}
+	count := map[*Block]int{}
+	for _, p := range preds {
+		count[p]++
+	}
+	for _, p := range phi.Preds {
+		count[p]--
+	}
+	for p, n := range count {
+		if n > 0 {
+			return fmt.Errorf("no value for predecessor %s", p.Name)
+		}
+		if n < 0 {
+			return fmt.Errorf("%s is not a predecessor", p.Name)
+		}
+	}
+	return nil
+}
@@ -1,7 +1,14 @@
 package lexer
 
+import "github.com/kijimaD/gogo/token"
+
 // 次の1文字を読んでinput文字列の現在位置を進める
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+	l.column++
 	if l.readPosition >= len(l.input) {
 		l.ch = 0 // ASCIIコードの"NUL"文字に対応している
 	} else {
@@ -21,11 +28,16 @@ func (l *Lexer) peekChar() byte {
 }
 
 func (l *Lexer) skipSpace() {
-	for l.ch == ' ' || l.ch == '\n' || l.ch == '\t' {
+	for l.ch == ' ' || l.ch == '\n' || l.ch == '\t' || l.ch == '\r' {
 		l.readChar()
 	}
 }
 
+// chの位置
+func (l *Lexer) curPos() token.Position {
+	return token.Position{Line: l.line, Column: l.column}
+}
+
 // 数字か判定する
 func isDigit(ch byte) bool {
 	return '0' <= ch && ch <= '9'
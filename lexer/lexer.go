@@ -7,23 +7,46 @@ import (
 )
 
 type Lexer struct {
+	file         string // 診断メッセージに使うファイル名
 	input        string
 	position     int // 現在検査中のバイトchの位置
 	readPosition int // 入力における次の位置
 	ch           byte
+	line         int // chの行
+	column       int // chの列
 }
 
 // ソースコード文字列を引数に取り、初期化する
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewFile("", input)
+}
+
+// ファイル名つきで初期化する
+func NewFile(file string, input string) *Lexer {
+	l := &Lexer{file: file, input: input, line: 1}
 	l.readChar()
 	return l
 }
 
+func (l *Lexer) File() string {
+	return l.file
+}
+
 // 現在位置の文字を読み込む
 func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
 	l.skipSpace()
+	start := l.curPos()
+	tok := l.nextToken()
+	tok.Pos = start
+	tok.End = l.curPos()
+	if tok.Type == token.EOF {
+		tok.End = start
+	}
+	return tok
+}
+
+func (l *Lexer) nextToken() token.Token {
+	var tok token.Token
 
 	switch l.ch {
 	case '"':
@@ -58,6 +81,10 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.LPAREN, l.ch)
 	case ')':
 		tok = newToken(token.RPAREN, l.ch)
+	case '{':
+		tok = newToken(token.LBRACE, l.ch)
+	case '}':
+		tok = newToken(token.RBRACE, l.ch)
 	case 0:
 		// 終端文字
 		tok.Literal = ""
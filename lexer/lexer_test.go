@@ -116,6 +116,7 @@ a + b;
 42a;
 a42;
 f(1);
+{ }
 `
 
 	tests := []struct {
@@ -178,6 +179,9 @@ f(1);
 		{token.INT, "1"},
 		{token.RPAREN, ")"},
 		{token.SEMICOLON, ";"},
+
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
 	}
 
 	l := New(input)
@@ -193,3 +197,29 @@ func TestIsLetter(t *testing.T) {
 	assert.True(t, isLetter('B'))
 	assert.False(t, isLetter('1'))
 }
+
+func TestTokenPosition(t *testing.T) {
+	l := New(`1 + 2;
+  "ab" x`)
+
+	tests := []struct {
+		expectedLiteral string
+		expectedPos     token.Position
+		expectedEnd     token.Position
+	}{
+		{"1", token.Position{Line: 1, Column: 1}, token.Position{Line: 1, Column: 2}},
+		{"+", token.Position{Line: 1, Column: 3}, token.Position{Line: 1, Column: 4}},
+		{"2", token.Position{Line: 1, Column: 5}, token.Position{Line: 1, Column: 6}},
+		{";", token.Position{Line: 1, Column: 6}, token.Position{Line: 1, Column: 7}},
+		{"ab", token.Position{Line: 2, Column: 3}, token.Position{Line: 2, Column: 7}},
+		{"x", token.Position{Line: 2, Column: 8}, token.Position{Line: 2, Column: 9}},
+		{"", token.Position{Line: 2, Column: 9}, token.Position{Line: 2, Column: 9}},
+	}
+
+	for _, tt := range tests {
+		tok := l.NextToken()
+		assert.Equal(t, tt.expectedLiteral, tok.Literal)
+		assert.Equal(t, tt.expectedPos, tok.Pos)
+		assert.Equal(t, tt.expectedEnd, tok.End)
+	}
+}
@@ -0,0 +1,196 @@
+// 静的リンカ
+// gogoが作ったx86-64のオブジェクトファイルと組み込みのランタイムをまとめて、libcを使わない静的な実行ファイルにする
+// 実行ファイルは0x400000から置き、ELFヘッダ、.text、.rodataを読み込みと実行ができるセグメントに、
+// .dataを書き込みのできるセグメントにする。セクションヘッダは書かない
+
+package link
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/kijimaD/gogo/elf"
+)
+
+const (
+	base     = 0x400000 // 実行ファイルを置くアドレス
+	pageSize = 0x1000
+
+	ehdrSize = 64
+	phdrSize = 56
+
+	ptLoad     = 1
+	ptGNUStack = 0x6474e551
+
+	pfX = 0x1
+	pfW = 0x2
+	pfR = 0x4
+)
+
+// 実行を始めるシンボル
+const Entry = "_start"
+
+// オブジェクトファイルをリンクして、実行ファイルのバイト列にする
+// 同じ名前のグローバルなシンボルが2つあるか、どこにも定義されていないシンボルがあればエラーにする
+func Link(objs []*elf.File) ([]byte, error) {
+	l := &linker{addrs: map[*elf.Section]uint64{}, globals: map[string]*elf.Symbol{}}
+	for _, f := range objs {
+		for _, s := range f.Symbols {
+			if !s.Global || s.Section == nil {
+				continue
+			}
+			if _, ok := l.globals[s.Name]; ok {
+				return nil, fmt.Errorf("duplicate symbol: %s", s.Name)
+			}
+			l.globals[s.Name] = s
+		}
+	}
+
+	// 読み込みと実行ができるセグメント。ELFヘッダとプログラムヘッダも含める
+	text := make([]byte, ehdrSize+3*phdrSize)
+	for _, name := range []string{".text", ".rodata"} {
+		for _, f := range objs {
+			for _, s := range f.Sections {
+				if s.Name == name {
+					text = l.place(text, s, 0, 16)
+				}
+			}
+		}
+	}
+	// 書き込みのできるセグメントは、ファイルの中の位置とアドレスがページの中で同じ位置になるように置く
+	dataOff := (len(text) + pageSize - 1) / pageSize * pageSize
+	data := []byte{}
+	for _, f := range objs {
+		for _, s := range f.Sections {
+			if s.Name == ".data" {
+				data = l.place(data, s, uint64(dataOff), 8)
+			}
+		}
+	}
+
+	for _, f := range objs {
+		for _, s := range f.Sections {
+			buf, off := text, l.addrs[s]-base
+			if s.Name == ".data" {
+				buf, off = data, l.addrs[s]-base-uint64(dataOff)
+			}
+			for _, r := range s.Relocs {
+				if err := l.relocate(buf[off:], s, r); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	entry, ok := l.globals[Entry]
+	if !ok {
+		return nil, fmt.Errorf("undefined symbol: %s", Entry)
+	}
+
+	var out bytes.Buffer
+	out.Write(text)
+	out.Write(make([]byte, dataOff-len(text)))
+	out.Write(data)
+	b := out.Bytes()
+	copy(b, header(l.addr(entry)))
+	copy(b[ehdrSize:], programHeaders(uint64(len(text)), uint64(dataOff), uint64(len(data))))
+	return b, nil
+}
+
+type linker struct {
+	addrs   map[*elf.Section]uint64 // セクションを置いたアドレス
+	globals map[string]*elf.Symbol
+}
+
+// セクションの中身をbufの後ろに置く。bufの先頭はファイルのoffの位置になる
+func (l *linker) place(buf []byte, s *elf.Section, off uint64, align int) []byte {
+	for len(buf)%align != 0 {
+		buf = append(buf, 0)
+	}
+	l.addrs[s] = base + off + uint64(len(buf))
+	return append(buf, s.Data...)
+}
+
+func (l *linker) addr(s *elf.Symbol) uint64 {
+	return l.addrs[s.Section] + s.Value
+}
+
+// 再配置する。bufはセクションを置いた位置から始まる
+func (l *linker) relocate(buf []byte, s *elf.Section, r elf.Reloc) error {
+	sym := r.Symbol
+	if sym.Section == nil {
+		def, ok := l.globals[sym.Name]
+		if !ok {
+			return fmt.Errorf("undefined symbol: %s", sym.Name)
+		}
+		sym = def
+	}
+	switch r.Type {
+	case elf.RelocPC32, elf.RelocPLT32:
+		v := int64(l.addr(sym)) + r.Addend - int64(l.addrs[s]+r.Offset)
+		if v < -1<<31 || v >= 1<<31 {
+			return fmt.Errorf("relocation overflow: %s", sym.Name)
+		}
+		binary.LittleEndian.PutUint32(buf[r.Offset:], uint32(int32(v)))
+		return nil
+	default:
+		return fmt.Errorf("unsupported relocation type %d for %s", r.Type, sym.Name)
+	}
+}
+
+// ELFヘッダ
+func header(entry uint64) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0x7f, 'E', 'L', 'F', 2, 1, 1, 0}) // 64ビット、リトルエンディアン、System V
+	b.Write(make([]byte, 8))
+	write(&b, struct {
+		Type      uint16
+		Machine   uint16
+		Version   uint32
+		Entry     uint64
+		Phoff     uint64
+		Shoff     uint64
+		Flags     uint32
+		Ehsize    uint16
+		Phentsize uint16
+		Phnum     uint16
+		Shentsize uint16
+		Shnum     uint16
+		Shstrndx  uint16
+	}{
+		Type:      2,  // ET_EXEC
+		Machine:   62, // EM_X86_64
+		Version:   1,
+		Entry:     entry,
+		Phoff:     ehdrSize,
+		Ehsize:    ehdrSize,
+		Phentsize: phdrSize,
+		Phnum:     3,
+	})
+	return b.Bytes()
+}
+
+type phdr struct {
+	Type   uint32
+	Flags  uint32
+	Offset uint64
+	Vaddr  uint64
+	Paddr  uint64
+	Filesz uint64
+	Memsz  uint64
+	Align  uint64
+}
+
+// 2つのセグメントと、スタックを実行できなくてよいことを示すPT_GNU_STACK
+func programHeaders(textSize uint64, dataOff uint64, dataSize uint64) []byte {
+	var b bytes.Buffer
+	write(&b, phdr{Type: ptLoad, Flags: pfR | pfX, Vaddr: base, Paddr: base, Filesz: textSize, Memsz: textSize, Align: pageSize})
+	write(&b, phdr{Type: ptLoad, Flags: pfR | pfW, Offset: dataOff, Vaddr: base + dataOff, Paddr: base + dataOff, Filesz: dataSize, Memsz: dataSize, Align: pageSize})
+	write(&b, phdr{Type: ptGNUStack, Flags: pfR | pfW, Align: 16})
+	return b.Bytes()
+}
+
+func write(b *bytes.Buffer, v interface{}) {
+	_ = binary.Write(b, binary.LittleEndian, v) // bytes.Bufferへの書き込みは失敗しない
+}
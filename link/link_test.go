@@ -0,0 +1,90 @@
+package link
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	goruntime "runtime"
+	"testing"
+
+	"github.com/kijimaD/gogo"
+	"github.com/kijimaD/gogo/asm"
+	"github.com/kijimaD/gogo/elf"
+	"github.com/stretchr/testify/assert"
+)
+
+// コンパイルしたオブジェクトファイルを組み込みのランタイムとリンクして実行する
+func TestLinkRun(t *testing.T) {
+	if goruntime.GOOS != "linux" || goruntime.GOARCH != "amd64" {
+		t.Skip("the executable runs only on x86-64 Linux")
+	}
+	tests := []struct {
+		src    string
+		expect string
+	}{
+		{"42", "42\n"},
+		{"0-2147483647-1", "-2147483648\n"},
+		{"int a = 3000000000; a", "-1294967296\n"},
+		{"sum5(1, 2, 3, 4, sum2(5, 6))", "21\n"},
+		{`printf("a%db%sc%cd%%e%q\n", 0-12, "str", 65)`, "a-12bstrcAd%e%q\n16\n"},
+		{`printf("%d %d %d %d %d %d %d\n", 1, 2, 3, 4, 5, 6, 7); printf("")`, "1 2 3 4 5 6 7\n0\n"},
+		{`string s = "x"; char c = 'y'; printf("%s%c", s, c)`, "xy2\n"},
+	}
+	for _, tt := range tests {
+		for level := 0; level <= 2; level++ {
+			res, err := gogo.Compile(context.Background(), tt.src, gogo.Options{Output: gogo.OutputObject, OptLevel: level})
+			assert.NoError(t, err)
+			obj, err := elf.Read(res.Output)
+			assert.NoError(t, err)
+			b, err := Link([]*elf.File{obj, Runtime()})
+			assert.NoError(t, err)
+
+			exe := filepath.Join(t.TempDir(), "a")
+			assert.NoError(t, os.WriteFile(exe, b, 0o755))
+			out, err := exec.Command(exe).Output()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expect, string(out), "%s -O%d", tt.src, level)
+		}
+	}
+}
+
+// asが作ったオブジェクトファイルもリンクできる
+func TestLinkAS(t *testing.T) {
+	if goruntime.GOOS != "linux" || goruntime.GOARCH != "amd64" {
+		t.Skip("the executable runs only on x86-64 Linux")
+	}
+	if _, err := exec.LookPath("as"); err != nil {
+		t.Skip("as is not found")
+	}
+	res, err := gogo.Compile(context.Background(), `printf("%s\n", "hello"); 3`, gogo.Options{Output: gogo.OutputObject, AS: "as"})
+	assert.NoError(t, err)
+	obj, err := elf.Read(res.Output)
+	assert.NoError(t, err)
+	b, err := Link([]*elf.File{obj, Runtime()})
+	assert.NoError(t, err)
+
+	exe := filepath.Join(t.TempDir(), "a")
+	assert.NoError(t, os.WriteFile(exe, b, 0o755))
+	out, err := exec.Command(exe).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n3\n", string(out))
+}
+
+func TestLinkError(t *testing.T) {
+	object := func(code ...*asm.Instr) *elf.File {
+		f, err := asm.Assemble(code)
+		assert.NoError(t, err)
+		return f
+	}
+	mymain := object(directive(".global", asm.Sym("mymain")), label("mymain"), ins("call", asm.Sym("puts")), ins("ret"))
+
+	_, err := Link([]*elf.File{mymain, Runtime()})
+	assert.EqualError(t, err, "undefined symbol: puts")
+
+	_, err = Link([]*elf.File{object(directive(".global", asm.Sym("sum2")), label("sum2"), ins("ret")), Runtime()})
+	assert.EqualError(t, err, "duplicate symbol: sum2")
+
+	_, err = Link([]*elf.File{object(directive(".global", asm.Sym("f")), label("f"), ins("ret"))})
+	assert.EqualError(t, err, "undefined symbol: _start")
+}
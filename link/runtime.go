@@ -0,0 +1,235 @@
+package link
+
+import (
+	"github.com/kijimaD/gogo/asm"
+	"github.com/kijimaD/gogo/elf"
+)
+
+// 組み込みのランタイム
+// c/driver.cと同じく、mymainの結果を"%d\n"で書き出して終了する。libcの代わりに、writeとexitはシステムコールを呼ぶ
+// printfは%d、%s、%c、%%だけを扱い、ほかの変換はそのまま書き出す。書き出したバイト数を返す
+func Runtime() *elf.File {
+	f, err := asm.Assemble(runtimeCode)
+	if err != nil {
+		panic(err) // 決まった命令の列なので、失敗するのはバグ
+	}
+	return f
+}
+
+func ins(op string, args ...asm.Operand) *asm.Instr {
+	return &asm.Instr{Kind: asm.KindInstr, Op: op, Args: args}
+}
+
+func label(name string) *asm.Instr {
+	return &asm.Instr{Kind: asm.KindLabel, Op: name}
+}
+
+func directive(op string, args ...asm.Operand) *asm.Instr {
+	return &asm.Instr{Kind: asm.KindDirective, Op: op, Args: args}
+}
+
+func mem(base asm.Reg, off int) asm.Mem {
+	return asm.Mem{Base: base, Offset: off}
+}
+
+const (
+	rax asm.Reg = "rax"
+	rbx asm.Reg = "rbx"
+	rcx asm.Reg = "rcx"
+	rdx asm.Reg = "rdx"
+	rsi asm.Reg = "rsi"
+	rdi asm.Reg = "rdi"
+	rbp asm.Reg = "rbp"
+	rsp asm.Reg = "rsp"
+	r8  asm.Reg = "r8"
+	r9  asm.Reg = "r9"
+	r12 asm.Reg = "r12"
+	r13 asm.Reg = "r13"
+	eax asm.Reg = "eax"
+	ecx asm.Reg = "ecx"
+	edx asm.Reg = "edx"
+	esi asm.Reg = "esi"
+	edi asm.Reg = "edi"
+	ebp asm.Reg = "ebp"
+	r8d asm.Reg = "r8d"
+	al  asm.Reg = "al"
+	dl  asm.Reg = "dl"
+)
+
+// printfのスタック
+// %rbp-8から%rbp-40に、レジスタで渡された2番目から6番目の引数を置く。7番目からは%rbp+16から並んでいる
+// %rbx、%r12、%r13を退避したあと、%rbp-96から%rbp-64を数字を組み立てるバッファにする
+// %rbxは書式の文字列の今の位置、%r12は次の引数の位置、%r13は書き出したバイト数
+const printfBuf = -64
+
+var runtimeCode = []*asm.Instr{
+	directive(".section", asm.Sym(".rodata")),
+	label(".fmt"),
+	directive(".string", asm.Str(`%d\n`)),
+	directive(".text"),
+	directive(".global", asm.Sym(Entry), asm.Sym("printf"), asm.Sym("write"), asm.Sym("exit"), asm.Sym("sum2"), asm.Sym("sum5")),
+
+	// カーネルから呼ばれるので、戻り先はない。%rspは16バイトに揃っている
+	label(Entry),
+	ins("mov", asm.Imm(0), ebp),
+	ins("call", asm.Sym("mymain")),
+	ins("mov", eax, esi),
+	ins("lea", asm.Mem{Base: "rip", Symbol: ".fmt"}, rdi),
+	ins("mov", asm.Imm(0), eax),
+	ins("call", asm.Sym("printf")),
+	ins("mov", asm.Imm(0), edi),
+	ins("call", asm.Sym("exit")),
+
+	label("sum2"),
+	ins("mov", edi, eax),
+	ins("add", esi, eax),
+	ins("ret"),
+
+	label("sum5"),
+	ins("mov", edi, eax),
+	ins("add", esi, eax),
+	ins("add", edx, eax),
+	ins("add", ecx, eax),
+	ins("add", r8d, eax),
+	ins("ret"),
+
+	// write(fd, buf, len)
+	label("write"),
+	ins("mov", asm.Imm(1), eax),
+	ins("syscall"),
+	ins("ret"),
+
+	// exit(status)。exit_groupですべてのスレッドを終える
+	label("exit"),
+	ins("mov", asm.Imm(231), eax),
+	ins("syscall"),
+
+	label("printf"),
+	ins("push", rbp),
+	ins("mov", rsp, rbp),
+	ins("push", r9),
+	ins("push", r8),
+	ins("push", rcx),
+	ins("push", rdx),
+	ins("push", rsi),
+	ins("push", rbx),
+	ins("push", r12),
+	ins("push", r13),
+	ins("sub", asm.Imm(32), rsp),
+	ins("mov", rdi, rbx),
+	ins("lea", mem(rbp, -40), r12),
+	ins("mov", asm.Imm(0), r13),
+	label(".Lprintf_loop"),
+	ins("movzbl", mem(rbx, 0), eax),
+	ins("cmp", asm.Imm(0), eax),
+	ins("je", asm.Sym(".Lprintf_end")),
+	ins("cmp", asm.Imm('%'), eax),
+	ins("je", asm.Sym(".Lprintf_conv")),
+	// %rbxの1文字をそのまま書き出す
+	label(".Lprintf_lit"),
+	ins("mov", rbx, rsi),
+	ins("mov", asm.Imm(1), edx),
+	ins("call", asm.Sym(".Lprintf_write")),
+	ins("add", asm.Imm(1), rbx),
+	ins("jmp", asm.Sym(".Lprintf_loop")),
+
+	label(".Lprintf_conv"),
+	ins("add", asm.Imm(1), rbx),
+	ins("movzbl", mem(rbx, 0), eax),
+	ins("cmp", asm.Imm('d'), eax),
+	ins("je", asm.Sym(".Lprintf_d")),
+	ins("cmp", asm.Imm('s'), eax),
+	ins("je", asm.Sym(".Lprintf_s")),
+	ins("cmp", asm.Imm('c'), eax),
+	ins("je", asm.Sym(".Lprintf_c")),
+	ins("cmp", asm.Imm('%'), eax),
+	ins("je", asm.Sym(".Lprintf_lit")),
+	ins("cmp", asm.Imm(0), eax),
+	ins("je", asm.Sym(".Lprintf_end")),
+	// 知らない変換は%から書き出す
+	ins("lea", mem(rbx, -1), rsi),
+	ins("mov", asm.Imm(2), edx),
+	ins("call", asm.Sym(".Lprintf_write")),
+	ins("add", asm.Imm(1), rbx),
+	ins("jmp", asm.Sym(".Lprintf_loop")),
+
+	label(".Lprintf_c"),
+	ins("call", asm.Sym(".Lprintf_arg")),
+	ins("mov", al, mem(rbp, printfBuf-32)),
+	ins("lea", mem(rbp, printfBuf-32), rsi),
+	ins("mov", asm.Imm(1), edx),
+	ins("jmp", asm.Sym(".Lprintf_next")),
+
+	label(".Lprintf_s"),
+	ins("call", asm.Sym(".Lprintf_arg")),
+	ins("mov", rax, rsi),
+	ins("mov", rax, rcx),
+	label(".Lprintf_strlen"),
+	ins("movzbl", mem(rcx, 0), edx),
+	ins("cmp", asm.Imm(0), edx),
+	ins("je", asm.Sym(".Lprintf_strlen_end")),
+	ins("add", asm.Imm(1), rcx),
+	ins("jmp", asm.Sym(".Lprintf_strlen")),
+	label(".Lprintf_strlen_end"),
+	ins("mov", rcx, rdx),
+	ins("sub", rsi, rdx),
+	ins("jmp", asm.Sym(".Lprintf_next")),
+
+	// 10で割った余りを、バッファの後ろから前へ並べる。符号は%r8に残しておく
+	label(".Lprintf_d"),
+	ins("call", asm.Sym(".Lprintf_arg")),
+	ins("movslq", eax, rax),
+	ins("mov", rax, r8),
+	ins("lea", mem(rbp, printfBuf), rsi),
+	ins("cmp", asm.Imm(0), rax),
+	ins("jge", asm.Sym(".Lprintf_digit")),
+	ins("neg", rax),
+	label(".Lprintf_digit"),
+	ins("mov", asm.Imm(0), edx),
+	ins("mov", asm.Imm(10), ecx),
+	ins("div", rcx),
+	ins("add", asm.Imm('0'), edx),
+	ins("sub", asm.Imm(1), rsi),
+	ins("movb", dl, mem(rsi, 0)),
+	ins("cmp", asm.Imm(0), rax),
+	ins("jne", asm.Sym(".Lprintf_digit")),
+	ins("cmp", asm.Imm(0), r8),
+	ins("jge", asm.Sym(".Lprintf_d_write")),
+	ins("sub", asm.Imm(1), rsi),
+	ins("movb", asm.Imm('-'), mem(rsi, 0)),
+	label(".Lprintf_d_write"),
+	ins("lea", mem(rbp, printfBuf), rdx),
+	ins("sub", rsi, rdx),
+
+	// %rsiから%rdxバイトを書き出して、変換の次の文字へ進む
+	label(".Lprintf_next"),
+	ins("call", asm.Sym(".Lprintf_write")),
+	ins("add", asm.Imm(1), rbx),
+	ins("jmp", asm.Sym(".Lprintf_loop")),
+
+	label(".Lprintf_end"),
+	ins("mov", r13, rax),
+	ins("lea", mem(rbp, -64), rsp),
+	ins("pop", r13),
+	ins("pop", r12),
+	ins("pop", rbx),
+	ins("leave"),
+	ins("ret"),
+
+	// 次の引数を%raxに取り出す。レジスタで渡された分を使い切ったら、スタックで渡された分へ移る
+	label(".Lprintf_arg"),
+	ins("mov", mem(r12, 0), rax),
+	ins("add", asm.Imm(8), r12),
+	ins("cmp", rbp, r12),
+	ins("jne", asm.Sym(".Lprintf_arg_end")),
+	ins("lea", mem(rbp, 16), r12),
+	label(".Lprintf_arg_end"),
+	ins("ret"),
+
+	// %rsiから%rdxバイトを標準出力に書き出し、書き出したバイト数に足す
+	label(".Lprintf_write"),
+	ins("add", rdx, r13),
+	ins("mov", asm.Imm(1), edi),
+	ins("call", asm.Sym("write")),
+	ins("ret"),
+}
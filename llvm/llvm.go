@@ -0,0 +1,261 @@
+// LLVM IRの出力
+// 中間表現を、LLVM IRのテキスト形式(.ll)にする。llcでコンパイルして、自前のバックエンドの結果と比べるのに使う
+// ポインタは型を持たないptrで書くので、LLVM 14のllcでは-opaque-pointersが要る
+// 仮想レジスタは%r1のように名前をつけ、allocaやphiはLLVM IRの同じ命令にそのまま移す
+
+package llvm
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/kijimaD/gogo/ir"
+)
+
+// LLVM IRを書き出す
+type Emitter struct {
+	w io.Writer
+}
+
+func NewEmitter(w io.Writer) *Emitter {
+	return &Emitter{w: w}
+}
+
+// 中間表現のモジュール全体を出力する
+func (e *Emitter) EmitModule(m *ir.Module) error {
+	code, err := Compile(m)
+	if err != nil {
+		return err
+	}
+	for _, line := range code {
+		if _, err := fmt.Fprintln(e.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 中間表現のモジュール全体をLLVM IRの行の列にする
+func Compile(m *ir.Module) ([]string, error) {
+	code := []string{}
+	for _, d := range m.Data {
+		b, err := d.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, 0)
+		code = append(code, fmt.Sprintf("@%s = private unnamed_addr constant [%d x i8] c\"%s\"", d.Name, len(b), escape(b)))
+	}
+
+	// 呼び出す関数はプロトタイプがわからないので、Cの引数を書かない宣言と同じく(...)で宣言する
+	declared := map[string]bool{}
+	for _, f := range m.Funcs {
+		declared[f.Name] = true
+	}
+	decls := []string{}
+	for _, f := range m.Funcs {
+		for _, b := range f.Blocks {
+			for _, instr := range b.Instrs {
+				if instr.Op == ir.OpCall && !declared[instr.Callee] {
+					declared[instr.Callee] = true
+					decls = append(decls, fmt.Sprintf("declare %s @%s(...)", typ(instr.Type), instr.Callee))
+				}
+			}
+		}
+	}
+	if len(code) > 0 && len(decls) > 0 {
+		code = append(code, "")
+	}
+	code = append(code, decls...)
+
+	for _, f := range m.Funcs {
+		if len(code) > 0 {
+			code = append(code, "")
+		}
+		code = append(code, emitFunc(f)...)
+	}
+	return code, nil
+}
+
+var types = map[ir.Type]string{
+	ir.Void: "void",
+	ir.I8:   "i8",
+	ir.I32:  "i32",
+	ir.Ptr:  "ptr",
+}
+
+func typ(t ir.Type) string {
+	return types[t]
+}
+
+type function struct {
+	f    *ir.Func
+	code []string
+}
+
+func (fn *function) emit(format string, args ...interface{}) {
+	fn.code = append(fn.code, "  "+fmt.Sprintf(format, args...))
+}
+
+func emitFunc(f *ir.Func) []string {
+	fn := &function{f: f}
+	fn.code = append(fn.code, fmt.Sprintf("define %s @%s() {", typ(f.Ret), f.Name))
+	preds := f.Preds()
+	for i, b := range f.Blocks {
+		// LLVM IRの入口のブロックには飛んでこられないので、入口に飛ぶだけのブロックを前に置く
+		if i == 0 && len(preds[b]) > 0 {
+			fn.code = append(fn.code, startBlock(f)+":")
+			fn.emit("br label %s", label(b))
+		}
+		fn.code = append(fn.code, b.Name+":")
+		for _, instr := range b.Instrs {
+			fn.emitInstr(b, instr)
+		}
+	}
+	fn.code = append(fn.code, "}")
+	return fn.code
+}
+
+// ほかのブロックと重ならない、入口の前に置くブロックの名前
+func startBlock(f *ir.Func) string {
+	name := "start"
+	for {
+		taken := false
+		for _, b := range f.Blocks {
+			taken = taken || b.Name == name
+		}
+		if !taken {
+			return name
+		}
+		name += "."
+	}
+}
+
+func label(b *ir.Block) string {
+	return "%" + b.Name
+}
+
+// オペランドとして書く値
+func value(v ir.Value) string {
+	switch v := v.(type) {
+	case *ir.Const:
+		if v.Ty == ir.Ptr {
+			if v.Value == 0 {
+				return "null"
+			}
+			return fmt.Sprintf("inttoptr (i64 %d to ptr)", v.Value)
+		}
+		return fmt.Sprint(ir.Truncate(v.Value, v.Ty))
+	case *ir.Global:
+		return "@" + v.Name
+	case *ir.Reg:
+		return fmt.Sprintf("%%r%d", v.ID)
+	default:
+		log.Fatal("invalid value:", v)
+		return ""
+	}
+}
+
+var arith = map[ir.Op]string{
+	ir.OpAdd: "add",
+	ir.OpSub: "sub",
+	ir.OpMul: "mul",
+	ir.OpDiv: "sdiv",
+}
+
+var cond = map[ir.Op]string{
+	ir.OpEq: "eq",
+	ir.OpNe: "ne",
+	ir.OpLt: "slt",
+	ir.OpLe: "sle",
+	ir.OpGt: "sgt",
+	ir.OpGe: "sge",
+}
+
+// 型の幅を変える命令
+func conv(op ir.Op, from ir.Type, to ir.Type) string {
+	switch {
+	case from == ir.Ptr:
+		return "ptrtoint"
+	case to == ir.Ptr:
+		return "inttoptr"
+	case op == ir.OpSext:
+		return "sext"
+	default:
+		return "trunc"
+	}
+}
+
+// 命令を出力する
+func (fn *function) emitInstr(b *ir.Block, instr *ir.Instr) {
+	switch op := instr.Op; {
+	case op == ir.OpAlloca:
+		fn.emit("%s = alloca %s", value(instr.Dst), typ(instr.Type))
+	case op == ir.OpLoad:
+		fn.emit("%s = load %s, ptr %s", value(instr.Dst), typ(instr.Type), value(instr.Args[0]))
+	case op == ir.OpStore:
+		fn.emit("store %s %s, ptr %s", typ(instr.Type), value(instr.Args[0]), value(instr.Args[1]))
+	case op.IsCompare():
+		// icmpの結果はi1なので、0か1のi32に広げる
+		fn.emit("%s.c = icmp %s %s %s, %s", value(instr.Dst), cond[op], typ(instr.Type), value(instr.Args[0]), value(instr.Args[1]))
+		fn.emit("%s = zext i1 %s.c to i32", value(instr.Dst), value(instr.Dst))
+	case op.IsBinary():
+		fn.emit("%s = %s %s %s, %s", value(instr.Dst), arith[op], typ(instr.Type), value(instr.Args[0]), value(instr.Args[1]))
+	case op == ir.OpSext, op == ir.OpTrunc:
+		fn.emit("%s = %s %s %s to %s", value(instr.Dst), conv(op, instr.Type, instr.To), typ(instr.Type), value(instr.Args[0]), typ(instr.To))
+	case op == ir.OpCopy:
+		// LLVM IRにはコピーの命令がないので、同じ型へのbitcastで表す
+		fn.emit("%s = bitcast %s %s to %s", value(instr.Dst), typ(instr.Type), value(instr.Args[0]), typ(instr.Type))
+	case op == ir.OpPhi:
+		incoming := make([]string, len(instr.Args))
+		for i, a := range instr.Args {
+			incoming[i] = fmt.Sprintf("[ %s, %s ]", value(a), label(instr.Preds[i]))
+		}
+		fn.emit("%s = phi %s %s", value(instr.Dst), typ(instr.Type), strings.Join(incoming, ", "))
+	case op == ir.OpCall:
+		args := make([]string, len(instr.Args))
+		for i, a := range instr.Args {
+			args[i] = fmt.Sprintf("%s %s", typ(a.Type()), value(a))
+		}
+		call := fmt.Sprintf("call %s (...) @%s(%s)", typ(instr.Type), instr.Callee, strings.Join(args, ", "))
+		if instr.Dst != nil {
+			call = value(instr.Dst) + " = " + call
+		}
+		fn.emit("%s", call)
+	case op == ir.OpJmp:
+		fn.emit("br label %s", label(instr.Targets[0]))
+	case op == ir.OpBr:
+		fn.emit("%%%s.br = icmp ne %s %s, %s", b.Name, typ(instr.Type), value(instr.Args[0]), zero(instr.Type))
+		fn.emit("br i1 %%%s.br, label %s, label %s", b.Name, label(instr.Targets[0]), label(instr.Targets[1]))
+	case op == ir.OpRet:
+		if len(instr.Args) == 0 {
+			fn.emit("ret void")
+			break
+		}
+		fn.emit("ret %s %s", typ(instr.Type), value(instr.Args[0]))
+	default:
+		log.Fatal("invalid instruction:", instr)
+	}
+}
+
+func zero(t ir.Type) string {
+	if t == ir.Ptr {
+		return "null"
+	}
+	return "0"
+}
+
+// LLVM IRの文字列に書けるようにする。表示できない文字と"と\は16進数で書く
+func escape(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			fmt.Fprintf(&sb, "\\%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
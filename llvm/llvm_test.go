@@ -0,0 +1,151 @@
+package llvm
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/kijimaD/gogo/ir"
+	"github.com/kijimaD/gogo/ir/irtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func emit(t *testing.T, m *ir.Module) string {
+	t.Helper()
+	var buf bytes.Buffer
+	assert.NoError(t, NewEmitter(&buf).EmitModule(m))
+	return buf.String()
+}
+
+func TestEmitModule(t *testing.T) {
+	expect := `@.s0 = private unnamed_addr constant [4 x i8] c"%d\0A\00"
+
+declare i32 @printf(...)
+declare i32 @sum5(...)
+
+define i32 @mymain() {
+entry:
+  %r1 = alloca i8
+  store i8 -56, ptr %r1
+  %r2 = load i8, ptr %r1
+  %r3 = sext i8 %r2 to i32
+  %r4 = sdiv i32 %r3, 7
+  %r5 = call i32 (...) @printf(ptr @.s0, i32 %r4)
+  %r6 = add i32 2147483647, 1
+  %r7 = call i32 (...) @printf(ptr @.s0, i32 %r6)
+  %r8 = call i32 (...) @sum5(i32 1, i32 2, i32 3, i32 4, i32 5)
+  %r9 = call i32 (...) @printf(ptr @.s0, i32 %r8, i32 0, i32 0, i32 0, i32 0, i32 0, i32 0, i32 0, i32 0)
+  %r10 = trunc i32 %r8 to i8
+  %r11 = sext i8 %r10 to i32
+  ret i32 %r11
+}
+`
+	assert.Equal(t, expect, emit(t, irtest.Load(t, "call", 0)))
+}
+
+// 比較の結果はi32に広げ、分岐の前にi1に戻す
+func TestEmitModuleBranch(t *testing.T) {
+	expect := `define i32 @mymain() {
+entry:
+  %r1.c = icmp slt i32 1, 2
+  %r1 = zext i1 %r1.c to i32
+  %entry.br = icmp ne i32 %r1, 0
+  br i1 %entry.br, label %a, label %b
+a:
+  br label %b
+b:
+  %r2 = phi i32 [ 2, %a ], [ 3, %entry ]
+  ret i32 %r2
+}
+`
+	assert.Equal(t, expect, emit(t, irtest.Parse(t, `
+func @mymain() i32 {
+entry:
+	%1 = lt i32 1, 2
+	br i32 %1, a, b
+a:
+	jmp b
+b:
+	%2 = phi i32 [2, a], [3, entry]
+	ret i32 %2
+}
+`, 0)))
+}
+
+// 入口のブロックに飛んでくるなら、その前にブロックを置く
+func TestEmitModuleEntryLoop(t *testing.T) {
+	expect := `declare i32 @next(...)
+
+define i32 @mymain() {
+start:
+  br label %entry
+entry:
+  %r1 = call i32 (...) @next()
+  %entry.br = icmp ne i32 %r1, 0
+  br i1 %entry.br, label %entry, label %done
+done:
+  ret i32 0
+}
+`
+	assert.Equal(t, expect, emit(t, irtest.Parse(t, `
+func @mymain() i32 {
+entry:
+	%1 = call i32 @next()
+	br i32 %1, entry, done
+done:
+	ret i32 0
+}
+`, 0)))
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, `abc`, escape([]byte("abc")))
+	assert.Equal(t, `%d\0A\09\5C\22\00\FF`, escape([]byte("%d\n\t\\\"\x00\xff")))
+}
+
+// llcの引数。LLVM 14ではptrを使うのに-opaque-pointersが要る
+func llc(t *testing.T) []string {
+	t.Helper()
+	path, err := exec.LookPath("llc")
+	if err != nil {
+		t.Skip("llc is not found")
+	}
+	out, err := exec.Command(path, "--version").Output()
+	assert.NoError(t, err)
+	args := []string{path}
+	if m := regexp.MustCompile(`LLVM version (\d+)`).FindSubmatch(out); m != nil {
+		if major, _ := strconv.Atoi(string(m[1])); major < 15 {
+			args = append(args, "-opaque-pointers")
+		}
+	}
+	return args
+}
+
+// llcでコンパイルして実行した結果を確かめる
+func TestEmitModuleRun(t *testing.T) {
+	args := llc(t)
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("cc is not found")
+	}
+
+	dir := t.TempDir()
+	for _, name := range irtest.Programs {
+		for level := 0; level <= 2; level++ {
+			ll := filepath.Join(dir, "a.ll")
+			s := filepath.Join(dir, "a.s")
+			exe := filepath.Join(dir, "a")
+			assert.NoError(t, os.WriteFile(ll, []byte(emit(t, irtest.Load(t, name, level))), 0o644))
+			out, err := exec.Command(args[0], append(args[1:], "-relocation-model=pic", "-o", s, ll)...).CombinedOutput()
+			assert.NoError(t, err, string(out))
+			out, err = exec.Command("cc", "-o", exe, s, "../c/driver.c").CombinedOutput()
+			assert.NoError(t, err, string(out))
+			out, err = exec.Command(exe).Output()
+			assert.NoError(t, err)
+			assert.Equal(t, irtest.Output(t, name), string(out), "%s -O%d", name, level)
+		}
+	}
+}
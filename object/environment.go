@@ -1,5 +1,7 @@
 package object
 
+import "sort"
+
 type Environment struct {
 	store  map[string]Object
 	VarPos int
@@ -18,3 +20,15 @@ func (e *Environment) Get(ident string) (Object, bool) {
 	obj, ok := e.store[ident]
 	return obj, ok
 }
+
+// 登録された名前を、スタックに置かれた順に返す
+func (e *Environment) Names() []string {
+	names := make([]string, 0, len(e.store))
+	for name := range e.store {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return e.store[names[i]].CurPos() < e.store[names[j]].CurPos()
+	})
+	return names
+}
@@ -9,9 +9,10 @@ import (
 )
 
 const (
-	INTEGER_OBJ = "INTEGER"
-	STRING_OBJ  = "STRING"
-	CHAR_OBJ    = "CHAR"
+	INTEGER_OBJ  = "INTEGER"
+	STRING_OBJ   = "STRING"
+	CHAR_OBJ     = "CHAR"
+	FUNCTION_OBJ = "FUNCTION"
 )
 
 type ObjectType string
@@ -52,3 +53,13 @@ func (c *Char) Type() ObjectType      { return CHAR_OBJ }
 func (c *Char) Inspect() string       { return fmt.Sprintf("%d", c.Value) }
 func (c *Char) CurPos() int           { return c.Pos }
 func (c *Char) GetCtype() token.Ctype { return token.CTYPE_CHAR }
+
+// 呼び出された関数。宣言がないので、C89の暗黙の宣言と同じくintを返すものとする
+type Function struct {
+	Name string
+}
+
+func (f *Function) Type() ObjectType      { return FUNCTION_OBJ }
+func (f *Function) Inspect() string       { return f.Name }
+func (f *Function) CurPos() int           { return 0 } // スタックには置かない
+func (f *Function) GetCtype() token.Ctype { return token.CTYPE_INT }
@@ -16,3 +16,12 @@ func TestEnvironment(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, "value", result.Inspect())
 }
+
+func TestEnvironmentNames(t *testing.T) {
+	e := NewEnvironment()
+	e.Set("b", &Integer{Value: 1, Pos: e.VarPos})
+	e.Set("a", &Char{Value: 2, Pos: e.VarPos})
+	e.Set("c", &String{Value: "s", Pos: e.VarPos})
+
+	assert.Equal(t, []string{"b", "a", "c"}, e.Names())
+}
@@ -0,0 +1,131 @@
+package opt
+
+import "github.com/kijimaD/gogo/ir"
+
+// 定数伝播
+// オペランドがすべて定数の命令を計算した値に置き換え、条件が定数の分岐をjmpにする
+// 置き換えた結果さらに計算できるようになった命令も、変わらなくなるまで繰り返し置き換える
+func constProp(f *ir.Func) bool {
+	changed := false
+	for progress := true; progress; {
+		progress = false
+		for _, b := range f.Blocks {
+			for _, instr := range b.Instrs {
+				if v, ok := fold(instr); ok {
+					replaceInstr(f, instr, v)
+					progress = true
+					break // 命令やブロックの列が変わったので、読み直す
+				}
+				if instr.Op == ir.OpBr {
+					if c, ok := instr.Args[0].(*ir.Const); ok {
+						foldBranch(b, instr, c.Value != 0)
+						// 到達できなくなったブロックから来る値をphiから除く
+						removeUnreachable(f)
+						progress = true
+						break
+					}
+				}
+			}
+			if progress {
+				break
+			}
+		}
+		changed = changed || progress
+	}
+	return changed
+}
+
+// 命令の結果が定数になるなら、その値を返す
+func fold(instr *ir.Instr) (ir.Value, bool) {
+	switch {
+	case instr.Op.IsBinary():
+		x, ok1 := instr.Args[0].(*ir.Const)
+		y, ok2 := instr.Args[1].(*ir.Const)
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		v, ok := foldBinary(instr.Op, instr.Type, x.Value, y.Value)
+		if !ok {
+			return nil, false
+		}
+		return &ir.Const{Value: v, Ty: instr.Dst.Type()}, true
+	case instr.Op == ir.OpSext, instr.Op == ir.OpTrunc, instr.Op == ir.OpCopy:
+		c, ok := instr.Args[0].(*ir.Const)
+		if !ok {
+			return nil, false
+		}
+		return &ir.Const{Value: ir.Truncate(c.Value, instr.Dst.Type()), Ty: instr.Dst.Type()}, true
+	case instr.Op == ir.OpPhi:
+		// すべての値が同じ定数。自分自身は無視する
+		var c *ir.Const
+		for _, a := range instr.Args {
+			if a == ir.Value(instr.Dst) {
+				continue
+			}
+			ac, ok := a.(*ir.Const)
+			if !ok || (c != nil && c.Value != ac.Value) {
+				return nil, false
+			}
+			c = ac
+		}
+		if c == nil {
+			return nil, false
+		}
+		return &ir.Const{Value: c.Value, Ty: instr.Dst.Type()}, true
+	}
+	return nil, false
+}
+
+// 2つの定数の演算。結果は型の幅で折り返す
+// 0での除算と、結果が表せない除算は実行時に任せる
+func foldBinary(op ir.Op, t ir.Type, x int64, y int64) (int64, bool) {
+	var v int64
+	switch op {
+	case ir.OpAdd:
+		v = x + y
+	case ir.OpSub:
+		v = x - y
+	case ir.OpMul:
+		v = x * y
+	case ir.OpDiv:
+		if y == 0 || (y == -1 && x == ir.Truncate(1<<(8*t.Size()-1), t)) {
+			return 0, false
+		}
+		v = x / y
+	case ir.OpEq:
+		return boolInt(x == y), true
+	case ir.OpNe:
+		return boolInt(x != y), true
+	case ir.OpLt:
+		return boolInt(x < y), true
+	case ir.OpLe:
+		return boolInt(x <= y), true
+	case ir.OpGt:
+		return boolInt(x > y), true
+	case ir.OpGe:
+		return boolInt(x >= y), true
+	default:
+		return 0, false
+	}
+	return ir.Truncate(v, t), true
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// 条件が定数の分岐を、進む方へのjmpにする
+func foldBranch(b *ir.Block, br *ir.Instr, cond bool) {
+	taken, other := br.Targets[0], br.Targets[1]
+	if !cond {
+		taken, other = other, taken
+	}
+	removePhiIncoming(other, b)
+	br.Op = ir.OpJmp
+	br.Type = ir.Void
+	br.Args = nil
+	br.Targets = []*ir.Block{taken}
+}
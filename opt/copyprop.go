@@ -0,0 +1,44 @@
+package opt
+
+import "github.com/kijimaD/gogo/ir"
+
+// コピー伝播
+// copyの結果を使っているところをコピー元に置き換える
+// すべての値が同じphiも、その値のコピーとして扱う
+func copyProp(f *ir.Func) bool {
+	changed := false
+	for progress := true; progress; {
+		progress = false
+		for _, b := range f.Blocks {
+			for _, instr := range b.Instrs {
+				if v, ok := copySource(instr); ok {
+					replaceInstr(f, instr, v)
+					progress = true
+					break
+				}
+			}
+		}
+		changed = changed || progress
+	}
+	return changed
+}
+
+func copySource(instr *ir.Instr) (ir.Value, bool) {
+	switch instr.Op {
+	case ir.OpCopy:
+		return instr.Args[0], true
+	case ir.OpPhi:
+		var src ir.Value
+		for _, a := range instr.Args {
+			if a == ir.Value(instr.Dst) || a == src {
+				continue
+			}
+			if src != nil {
+				return nil, false
+			}
+			src = a
+		}
+		return src, src != nil
+	}
+	return nil, false
+}
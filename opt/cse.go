@@ -0,0 +1,68 @@
+package opt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kijimaD/gogo/ir"
+)
+
+// 共通部分式削除
+// 支配木を上からたどり、支配するブロックで同じ計算をしていれば、その結果を使う
+// メモリを読むloadは、間にstoreや関数呼び出しがあると値が変わるので対象にしない
+func cse(f *ir.Func) bool {
+	dt := Dominators(f)
+	avail := map[string]*ir.Reg{}
+	dead := map[*ir.Instr]bool{}
+
+	var visit func(b *ir.Block)
+	visit = func(b *ir.Block) {
+		added := []string{}
+		for _, instr := range b.Instrs {
+			key, ok := exprKey(instr)
+			if !ok {
+				continue
+			}
+			if r, ok := avail[key]; ok {
+				f.ReplaceUses(instr.Dst, r)
+				dead[instr] = true
+				continue
+			}
+			avail[key] = instr.Dst
+			added = append(added, key)
+		}
+		for _, c := range dt.Children(b) {
+			visit(c)
+		}
+		for _, key := range added {
+			delete(avail, key)
+		}
+	}
+	visit(f.Blocks[0])
+
+	removeInstrs(f, dead)
+	return len(dead) > 0
+}
+
+// 可換な演算
+var commutative = map[ir.Op]bool{
+	ir.OpAdd: true,
+	ir.OpMul: true,
+	ir.OpEq:  true,
+	ir.OpNe:  true,
+}
+
+// 同じ値を計算する命令が同じになる文字列
+func exprKey(instr *ir.Instr) (string, bool) {
+	if !instr.Op.IsBinary() && instr.Op != ir.OpSext && instr.Op != ir.OpTrunc {
+		return "", false
+	}
+	args := make([]string, len(instr.Args))
+	for i, a := range instr.Args {
+		args[i] = a.String()
+	}
+	if commutative[instr.Op] && args[0] > args[1] {
+		args[0], args[1] = args[1], args[0]
+	}
+	return fmt.Sprintf("%s %s %s %s", instr.Op, instr.Type, instr.To, strings.Join(args, ",")), true
+}
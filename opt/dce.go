@@ -0,0 +1,51 @@
+package opt
+
+import "github.com/kijimaD/gogo/ir"
+
+// 不要コード削除
+// 副作用のある命令から使われている命令をたどり、たどれなかった命令を取り除く
+// 互いにしか使われていないphiの循環も取り除ける
+func dce(f *ir.Func) bool {
+	changed := removeUnreachable(f)
+
+	defs := map[*ir.Reg]*ir.Instr{}
+	live := map[*ir.Instr]bool{}
+	work := []*ir.Instr{}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Dst != nil {
+				defs[instr.Dst] = instr
+			}
+			if !instr.IsPure() {
+				live[instr] = true
+				work = append(work, instr)
+			}
+		}
+	}
+
+	for len(work) > 0 {
+		instr := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, a := range instr.Args {
+			r, ok := a.(*ir.Reg)
+			if !ok {
+				continue
+			}
+			if def := defs[r]; def != nil && !live[def] {
+				live[def] = true
+				work = append(work, def)
+			}
+		}
+	}
+
+	dead := map[*ir.Instr]bool{}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if !live[instr] {
+				dead[instr] = true
+			}
+		}
+	}
+	removeInstrs(f, dead)
+	return changed || len(dead) > 0
+}
@@ -0,0 +1,158 @@
+package opt
+
+import "github.com/kijimaD/gogo/ir"
+
+// 支配木
+// 入口からブロックbへのすべての経路がaを通るとき、aはbを支配する
+// 入口から到達できないブロックは含まない
+type DomTree struct {
+	order    []*ir.Block // 逆後順。先頭は入口
+	index    map[*ir.Block]int
+	idom     map[*ir.Block]*ir.Block
+	children map[*ir.Block][]*ir.Block
+	preds    map[*ir.Block][]*ir.Block
+}
+
+// Cooper, Harvey, Kennedyの反復アルゴリズムで支配木を作る
+func Dominators(f *ir.Func) *DomTree {
+	d := &DomTree{
+		index:    map[*ir.Block]int{},
+		idom:     map[*ir.Block]*ir.Block{},
+		children: map[*ir.Block][]*ir.Block{},
+		preds:    f.Preds(),
+	}
+	d.order = reversePostorder(f)
+	for i, b := range d.order {
+		d.index[b] = i
+	}
+
+	entry := d.order[0]
+	d.idom[entry] = entry
+	for changed := true; changed; {
+		changed = false
+		for _, b := range d.order[1:] {
+			var idom *ir.Block
+			for _, p := range d.preds[b] {
+				if _, ok := d.idom[p]; !ok {
+					continue // まだ処理していないか、到達できない
+				}
+				if idom == nil {
+					idom = p
+				} else {
+					idom = d.intersect(p, idom)
+				}
+			}
+			if d.idom[b] != idom {
+				d.idom[b] = idom
+				changed = true
+			}
+		}
+	}
+
+	for _, b := range d.order[1:] {
+		d.children[d.idom[b]] = append(d.children[d.idom[b]], b)
+	}
+	return d
+}
+
+func (d *DomTree) intersect(a *ir.Block, b *ir.Block) *ir.Block {
+	for a != b {
+		for d.index[a] > d.index[b] {
+			a = d.idom[a]
+		}
+		for d.index[b] > d.index[a] {
+			b = d.idom[b]
+		}
+	}
+	return a
+}
+
+// 入口から到達できるブロックを、逆後順に並べる
+func reversePostorder(f *ir.Func) []*ir.Block {
+	visited := map[*ir.Block]bool{}
+	post := []*ir.Block{}
+	var visit func(b *ir.Block)
+	visit = func(b *ir.Block) {
+		visited[b] = true
+		for _, s := range b.Succs() {
+			if !visited[s] {
+				visit(s)
+			}
+		}
+		post = append(post, b)
+	}
+	visit(f.Blocks[0])
+
+	for i, j := 0, len(post)-1; i < j; i, j = i+1, j-1 {
+		post[i], post[j] = post[j], post[i]
+	}
+	return post
+}
+
+// 到達できるブロックの逆後順
+func (d *DomTree) Order() []*ir.Block {
+	return d.order
+}
+
+// 直接の支配ブロック。入口ではnil
+func (d *DomTree) Idom(b *ir.Block) *ir.Block {
+	if b == d.order[0] {
+		return nil
+	}
+	return d.idom[b]
+}
+
+// 支配木の子
+func (d *DomTree) Children(b *ir.Block) []*ir.Block {
+	return d.children[b]
+}
+
+// 到達できるか
+func (d *DomTree) Reachable(b *ir.Block) bool {
+	_, ok := d.index[b]
+	return ok
+}
+
+// aがbを支配するか。ブロックは自分自身を支配する
+func (d *DomTree) Dominates(a *ir.Block, b *ir.Block) bool {
+	if !d.Reachable(a) || !d.Reachable(b) {
+		return false
+	}
+	for {
+		if a == b {
+			return true
+		}
+		if b == d.order[0] {
+			return false
+		}
+		b = d.idom[b]
+	}
+}
+
+// 支配辺境。bが支配するブロックから出る辺のうち、bが厳密には支配しない行き先
+// phiを置く場所になる
+func (d *DomTree) Frontier() map[*ir.Block][]*ir.Block {
+	df := map[*ir.Block][]*ir.Block{}
+	for _, b := range d.order {
+		preds := d.preds[b]
+		if len(preds) < 2 {
+			continue
+		}
+		seen := map[*ir.Block]bool{}
+		for _, p := range preds {
+			if !d.Reachable(p) {
+				continue
+			}
+			for runner := p; runner != d.idom[b]; runner = d.idom[runner] {
+				if !seen[runner] {
+					seen[runner] = true
+					df[runner] = append(df[runner], b)
+				}
+				if runner == d.order[0] {
+					break
+				}
+			}
+		}
+	}
+	return df
+}
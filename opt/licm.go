@@ -0,0 +1,178 @@
+package opt
+
+import (
+	"sort"
+
+	"github.com/kijimaD/gogo/ir"
+)
+
+// ループ
+type loop struct {
+	header *ir.Block
+	body   map[*ir.Block]bool // headerを含む
+}
+
+// ループ不変式の移動
+// ループの中で毎回同じ値になる計算を、ループに入る前のブロック(preheader)に移す
+// ループを1回も回らないときにも実行されるので、0で割るかもしれない除算は移さない
+func licm(f *ir.Func) bool {
+	changed := false
+	// ブロックを追加すると支配木が変わるので、1つのループを処理するたびに作り直す
+	for progress := true; progress; {
+		progress = false
+		dt := Dominators(f)
+		for _, l := range findLoops(f, dt) {
+			if hoist(f, l) {
+				progress = true
+				changed = true
+				break
+			}
+		}
+	}
+	return changed
+}
+
+// 自然ループを内側から順に返す
+// 行き先が出発点を支配する辺をループの戻り辺とし、戻り辺から逆にたどれるブロックをループの本体とする
+func findLoops(f *ir.Func, dt *DomTree) []*loop {
+	preds := f.Preds()
+	loops := map[*ir.Block]*loop{}
+	headers := []*ir.Block{}
+	for _, b := range dt.Order() {
+		for _, h := range b.Succs() {
+			if !dt.Dominates(h, b) {
+				continue
+			}
+			l, ok := loops[h]
+			if !ok {
+				l = &loop{header: h, body: map[*ir.Block]bool{h: true}}
+				loops[h] = l
+				headers = append(headers, h)
+			}
+			work := []*ir.Block{b}
+			for len(work) > 0 {
+				n := work[len(work)-1]
+				work = work[:len(work)-1]
+				if l.body[n] {
+					continue
+				}
+				l.body[n] = true
+				work = append(work, preds[n]...)
+			}
+		}
+	}
+
+	result := make([]*loop, len(headers))
+	for i, h := range headers {
+		result[i] = loops[h]
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return len(result[i].body) < len(result[j].body)
+	})
+	return result
+}
+
+func hoist(f *ir.Func, l *loop) bool {
+	defBlock := map[*ir.Reg]*ir.Block{}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Dst != nil {
+				defBlock[instr.Dst] = b
+			}
+		}
+	}
+
+	// ループの外で定義された値か、すでに移すと決めた値だけを使う命令を集める
+	invariant := []*ir.Instr{}
+	moved := map[*ir.Reg]bool{}
+	for _, b := range f.Blocks {
+		if !l.body[b] {
+			continue
+		}
+		for _, instr := range b.Instrs {
+			if !hoistable(instr) {
+				continue
+			}
+			ok := true
+			for _, a := range instr.Args {
+				if r, isReg := a.(*ir.Reg); isReg && l.body[defBlock[r]] && !moved[r] {
+					ok = false
+					break
+				}
+			}
+			if ok {
+				invariant = append(invariant, instr)
+				moved[instr.Dst] = true
+			}
+		}
+	}
+	if len(invariant) == 0 {
+		return false
+	}
+
+	pre := preheader(f, l)
+	dead := map[*ir.Instr]bool{}
+	for _, instr := range invariant {
+		dead[instr] = true
+	}
+	removeInstrs(f, dead)
+	n := len(pre.Instrs) - 1
+	pre.Instrs = append(pre.Instrs[:n], append(invariant, pre.Instrs[n])...)
+	return true
+}
+
+func hoistable(instr *ir.Instr) bool {
+	switch {
+	case instr.Op == ir.OpDiv:
+		return false
+	case instr.Op.IsBinary(), instr.Op == ir.OpSext, instr.Op == ir.OpTrunc, instr.Op == ir.OpCopy:
+		return true
+	default:
+		return false
+	}
+}
+
+// ループに入る前に必ず通り、ループにしか進まないブロック。なければ作る
+func preheader(f *ir.Func, l *loop) *ir.Block {
+	outside := []*ir.Block{}
+	for _, p := range f.Preds()[l.header] {
+		if !l.body[p] {
+			outside = append(outside, p)
+		}
+	}
+	if len(outside) == 1 && len(outside[0].Succs()) == 1 {
+		return outside[0]
+	}
+
+	pre := &ir.Block{Name: uniqueBlockName(f, l.header.Name+".preheader")}
+	for _, phi := range l.header.Phis() {
+		// ループの外から来る値は、preheaderのphiで1つにまとめる
+		merged := &ir.Instr{Op: ir.OpPhi, Dst: f.NewReg(phi.Type), Type: phi.Type}
+		args := []ir.Value{}
+		preds := []*ir.Block{}
+		for i, p := range phi.Preds {
+			if l.body[p] {
+				args = append(args, phi.Args[i])
+				preds = append(preds, p)
+			} else {
+				merged.Args = append(merged.Args, phi.Args[i])
+				merged.Preds = append(merged.Preds, p)
+			}
+		}
+		pre.Instrs = append(pre.Instrs, merged)
+		phi.Args = append(args, merged.Dst)
+		phi.Preds = append(preds, pre)
+	}
+	pre.Instrs = append(pre.Instrs, &ir.Instr{Op: ir.OpJmp, Targets: []*ir.Block{l.header}})
+
+	for _, p := range outside {
+		retarget(p, l.header, pre)
+	}
+	for i, b := range f.Blocks {
+		if b == l.header {
+			insertBlock(f, i, pre)
+			break
+		}
+	}
+	return pre
+}
@@ -0,0 +1,185 @@
+package opt
+
+import "github.com/kijimaD/gogo/ir"
+
+// allocaした変数をSSA形式の仮想レジスタにする
+// 変数へのstoreがあるブロックの反復支配辺境にphiを置き、支配木をたどって各loadを直前の値に置き換える
+// アドレスをload/store以外に使う変数はそのまま残す
+func mem2reg(f *ir.Func) bool {
+	allocas := promotable(f)
+	if len(allocas) == 0 {
+		return false
+	}
+	removeUnreachable(f)
+	ensureEntry(f)
+
+	dt := Dominators(f)
+	df := dt.Frontier()
+	preds := f.Preds()
+
+	// 1. phiを置く
+	phis := map[*ir.Instr]*ir.Instr{} // phiから、対応するalloca
+	for _, a := range allocas {
+		placed := map[*ir.Block]bool{}
+		work := []*ir.Block{}
+		for _, b := range f.Blocks {
+			for _, instr := range b.Instrs {
+				if instr.Op == ir.OpStore && instr.Args[1] == ir.Value(a.Dst) {
+					work = append(work, b)
+					break
+				}
+			}
+		}
+		for len(work) > 0 {
+			b := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, y := range df[b] {
+				if placed[y] {
+					continue
+				}
+				placed[y] = true
+				phi := &ir.Instr{
+					Op:    ir.OpPhi,
+					Dst:   f.NewReg(a.Type),
+					Type:  a.Type,
+					Args:  make([]ir.Value, len(preds[y])),
+					Preds: append([]*ir.Block{}, preds[y]...),
+				}
+				n := len(y.Phis())
+				y.Instrs = append(y.Instrs[:n], append([]*ir.Instr{phi}, y.Instrs[n:]...)...)
+				phis[phi] = a
+				work = append(work, y)
+			}
+		}
+	}
+
+	// 2. 支配木を上からたどって、loadを直前にstoreした値に置き換える
+	stacks := map[*ir.Instr][]ir.Value{}
+	for _, a := range allocas {
+		// 初期化する前に読んだ値は不定なので、0にしておく
+		stacks[a] = []ir.Value{&ir.Const{Value: 0, Ty: a.Type}}
+	}
+	slots := map[ir.Value]*ir.Instr{}
+	for _, a := range allocas {
+		slots[a.Dst] = a
+	}
+	replace := map[*ir.Reg]ir.Value{}
+	dead := map[*ir.Instr]bool{}
+	for _, a := range allocas {
+		dead[a] = true
+	}
+
+	var rename func(b *ir.Block)
+	rename = func(b *ir.Block) {
+		saved := map[*ir.Instr]int{}
+		for a, s := range stacks {
+			saved[a] = len(s)
+		}
+
+		for _, instr := range b.Instrs {
+			switch {
+			case instr.Op == ir.OpPhi && phis[instr] != nil:
+				a := phis[instr]
+				stacks[a] = append(stacks[a], instr.Dst)
+			case instr.Op == ir.OpLoad && slots[instr.Args[0]] != nil:
+				a := slots[instr.Args[0]]
+				replace[instr.Dst] = top(stacks[a])
+				dead[instr] = true
+			case instr.Op == ir.OpStore && slots[instr.Args[1]] != nil:
+				a := slots[instr.Args[1]]
+				stacks[a] = append(stacks[a], resolve(replace, instr.Args[0]))
+				dead[instr] = true
+			}
+		}
+
+		for _, s := range b.Succs() {
+			for _, phi := range s.Phis() {
+				a, ok := phis[phi]
+				if !ok {
+					continue
+				}
+				for i, p := range phi.Preds {
+					if p == b && phi.Args[i] == nil {
+						phi.Args[i] = top(stacks[a])
+						break
+					}
+				}
+			}
+		}
+
+		for _, c := range dt.Children(b) {
+			rename(c)
+		}
+		for a, n := range saved {
+			stacks[a] = stacks[a][:n]
+		}
+	}
+	rename(f.Blocks[0])
+
+	removeInstrs(f, dead)
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			for i, a := range instr.Args {
+				instr.Args[i] = resolve(replace, a)
+			}
+		}
+	}
+	return true
+}
+
+// アドレスをload/storeにしか使わないalloca
+func promotable(f *ir.Func) []*ir.Instr {
+	escaped := map[ir.Value]bool{}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			for i, a := range instr.Args {
+				if instr.Op == ir.OpLoad || (instr.Op == ir.OpStore && i == 1) {
+					continue
+				}
+				escaped[a] = true
+			}
+		}
+	}
+
+	allocas := []*ir.Instr{}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Op == ir.OpAlloca && !escaped[instr.Dst] {
+				allocas = append(allocas, instr)
+			}
+		}
+	}
+	return allocas
+}
+
+// 入口のブロックに戻ってくる辺があると、入口にphiを置けないので、新しい入口を作る
+func ensureEntry(f *ir.Func) {
+	entry := f.Blocks[0]
+	if len(f.Preds()[entry]) == 0 {
+		return
+	}
+	b := &ir.Block{
+		Name:   uniqueBlockName(f, "entry"),
+		Instrs: []*ir.Instr{{Op: ir.OpJmp, Targets: []*ir.Block{entry}}},
+	}
+	insertBlock(f, 0, b)
+}
+
+func top(s []ir.Value) ir.Value {
+	return s[len(s)-1]
+}
+
+// 置き換えたloadの結果を、置き換え先の値にする
+func resolve(replace map[*ir.Reg]ir.Value, v ir.Value) ir.Value {
+	for {
+		r, ok := v.(*ir.Reg)
+		if !ok {
+			return v
+		}
+		next, ok := replace[r]
+		if !ok {
+			return v
+		}
+		v = next
+	}
+}
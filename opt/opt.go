@@ -0,0 +1,160 @@
+// 中間表現の最適化
+// 変数をSSA形式にしてから、定数伝播・コピー伝播・共通部分式削除・ループ不変式の移動・不要コード削除を行う
+
+package opt
+
+import (
+	"fmt"
+
+	"github.com/kijimaD/gogo/ir"
+)
+
+// 関数を書き換えるパス。書き換えたらtrueを返す
+type Pass struct {
+	Name string
+	Run  func(f *ir.Func) bool
+}
+
+var (
+	Mem2Reg   = Pass{Name: "mem2reg", Run: mem2reg}
+	ConstProp = Pass{Name: "constprop", Run: constProp}
+	CopyProp  = Pass{Name: "copyprop", Run: copyProp}
+	DCE       = Pass{Name: "dce", Run: dce}
+	CSE       = Pass{Name: "cse", Run: cse}
+	LICM      = Pass{Name: "licm", Run: licm}
+)
+
+// 最適化レベルで使うパスの並び
+//
+//	-O0: 最適化しない
+//	-O1: SSA形式にして、定数とコピーを伝播し、不要なコードを消す
+//	-O2: さらに共通部分式とループ不変式を扱い、その結果をもう一度伝播する
+func Passes(level int) []Pass {
+	switch {
+	case level <= 0:
+		return nil
+	case level == 1:
+		return []Pass{Mem2Reg, ConstProp, CopyProp, DCE}
+	default:
+		return []Pass{Mem2Reg, ConstProp, CopyProp, CSE, LICM, ConstProp, CopyProp, DCE}
+	}
+}
+
+// パスを順に実行する
+type Manager struct {
+	Passes []Pass
+	// nilでなければ、各パスのあとに呼ぶ。中間表現を出力するのに使う
+	AfterPass func(pass string, m *ir.Module)
+	// パスのあとに中間表現の形を調べる。パスの不具合を見つけるのに使う
+	Verify bool
+}
+
+func NewManager(level int) *Manager {
+	return &Manager{Passes: Passes(level)}
+}
+
+func (pm *Manager) Run(m *ir.Module) error {
+	for _, p := range pm.Passes {
+		for _, f := range m.Funcs {
+			p.Run(f)
+			if pm.Verify {
+				if err := ir.Verify(f); err != nil {
+					return fmt.Errorf("after %s: %w", p.Name, err)
+				}
+			}
+		}
+		if pm.AfterPass != nil {
+			pm.AfterPass(p.Name, m)
+		}
+	}
+	return nil
+}
+
+// 命令を取り除く
+func removeInstrs(f *ir.Func, dead map[*ir.Instr]bool) {
+	if len(dead) == 0 {
+		return
+	}
+	for _, b := range f.Blocks {
+		instrs := b.Instrs[:0]
+		for _, instr := range b.Instrs {
+			if !dead[instr] {
+				instrs = append(instrs, instr)
+			}
+		}
+		b.Instrs = instrs
+	}
+}
+
+// 命令を取り除いて、結果を使っているところをvに置き換える
+func replaceInstr(f *ir.Func, instr *ir.Instr, v ir.Value) {
+	f.ReplaceUses(instr.Dst, v)
+	removeInstrs(f, map[*ir.Instr]bool{instr: true})
+}
+
+// bのphiから、predから来る値を取り除く
+func removePhiIncoming(b *ir.Block, pred *ir.Block) {
+	for _, phi := range b.Phis() {
+		for i := 0; i < len(phi.Preds); i++ {
+			if phi.Preds[i] == pred {
+				phi.Preds = append(phi.Preds[:i], phi.Preds[i+1:]...)
+				phi.Args = append(phi.Args[:i], phi.Args[i+1:]...)
+				break // 同じブロックから2本の辺があれば、1本ずつ取り除く
+			}
+		}
+	}
+}
+
+// 入口から到達できないブロックを取り除く
+func removeUnreachable(f *ir.Func) bool {
+	reachable := map[*ir.Block]bool{}
+	for _, b := range reversePostorder(f) {
+		reachable[b] = true
+	}
+	if len(reachable) == len(f.Blocks) {
+		return false
+	}
+
+	blocks := f.Blocks[:0]
+	for _, b := range f.Blocks {
+		if reachable[b] {
+			blocks = append(blocks, b)
+			continue
+		}
+		for _, s := range b.Succs() {
+			removePhiIncoming(s, b)
+		}
+	}
+	f.Blocks = blocks
+	return true
+}
+
+// 関数の中で使われていないブロック名
+func uniqueBlockName(f *ir.Func, base string) string {
+	names := map[string]bool{}
+	for _, b := range f.Blocks {
+		names[b.Name] = true
+	}
+	name := base
+	for i := 1; names[name]; i++ {
+		name = fmt.Sprintf("%s.%d", base, i)
+	}
+	return name
+}
+
+// ブロックを関数のi番目に挿入する
+func insertBlock(f *ir.Func, i int, b *ir.Block) {
+	f.Blocks = append(f.Blocks, nil)
+	copy(f.Blocks[i+1:], f.Blocks[i:])
+	f.Blocks[i] = b
+}
+
+// 終端命令の飛び先をfromからtoに変える
+func retarget(b *ir.Block, from *ir.Block, to *ir.Block) {
+	t := b.Terminator()
+	for i, target := range t.Targets {
+		if target == from {
+			t.Targets[i] = to
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package opt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/gogo/diag"
+	"github.com/kijimaD/gogo/ir"
+	"github.com/kijimaD/gogo/lexer"
+	"github.com/kijimaD/gogo/parser"
+	"github.com/kijimaD/gogo/sema"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseFunc(t *testing.T, src string) *ir.Func {
+	t.Helper()
+	m, err := ir.Parse(src)
+	assert.NoError(t, err)
+	return m.Funcs[0]
+}
+
+// パスを実行した結果を、期待するテキストと比べる
+func runPass(t *testing.T, pass Pass, input string, expect string) {
+	t.Helper()
+	f := parseFunc(t, input)
+	pass.Run(f)
+	assert.NoError(t, ir.Verify(f))
+	assert.Equal(t, strings.TrimPrefix(expect, "\n"), f.String())
+}
+
+const diamond = `
+func @f() i32 {
+entry:
+	%1 = call i32 @c()
+	br i32 %1, then, else
+then:
+	jmp done
+else:
+	jmp done
+done:
+	ret i32 0
+}
+`
+
+func TestDominators(t *testing.T) {
+	f := parseFunc(t, diamond)
+	entry, then, els, done := f.Blocks[0], f.Blocks[1], f.Blocks[2], f.Blocks[3]
+
+	dt := Dominators(f)
+	assert.Nil(t, dt.Idom(entry))
+	assert.Equal(t, entry, dt.Idom(then))
+	assert.Equal(t, entry, dt.Idom(els))
+	assert.Equal(t, entry, dt.Idom(done))
+	assert.True(t, dt.Dominates(entry, done))
+	assert.True(t, dt.Dominates(done, done))
+	assert.False(t, dt.Dominates(then, done))
+	assert.ElementsMatch(t, []*ir.Block{then, els, done}, dt.Children(entry))
+
+	df := dt.Frontier()
+	assert.Equal(t, []*ir.Block{done}, df[then])
+	assert.Equal(t, []*ir.Block{done}, df[els])
+	assert.Empty(t, df[entry])
+}
+
+func TestMem2Reg(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		expect string
+	}{
+		{
+			"合流点にphiを置く",
+			`
+func @f() i32 {
+entry:
+	%1 = alloca i32
+	store i32 1, %1
+	%2 = call i32 @c()
+	br i32 %2, then, else
+then:
+	store i32 2, %1
+	jmp done
+else:
+	jmp done
+done:
+	%3 = load i32 %1
+	ret i32 %3
+}`,
+			`
+func @f() i32 {
+entry:
+	%2 = call i32 @c()
+	br i32 %2, then, else
+then:
+	jmp done
+else:
+	jmp done
+done:
+	%4 = phi i32 [2, then], [1, else]
+	ret i32 %4
+}
+`,
+		},
+		{
+			"ループの先頭にphiを置く",
+			`
+func @f() i32 {
+entry:
+	%1 = alloca i32
+	store i32 0, %1
+	jmp loop
+loop:
+	%2 = load i32 %1
+	%3 = add i32 %2, 1
+	store i32 %3, %1
+	%4 = lt i32 %3, 10
+	br i32 %4, loop, done
+done:
+	%5 = load i32 %1
+	ret i32 %5
+}`,
+			`
+func @f() i32 {
+entry:
+	jmp loop
+loop:
+	%6 = phi i32 [0, entry], [%3, loop]
+	%3 = add i32 %6, 1
+	%4 = lt i32 %3, 10
+	br i32 %4, loop, done
+done:
+	ret i32 %3
+}
+`,
+		},
+		{
+			"アドレスを関数に渡す変数はそのまま",
+			`
+func @f() i32 {
+entry:
+	%1 = alloca i32
+	%2 = alloca i32
+	store i32 1, %1
+	store i32 2, %2
+	%3 = call i32 @g(ptr %2)
+	%4 = load i32 %1
+	ret i32 %4
+}`,
+			`
+func @f() i32 {
+entry:
+	%2 = alloca i32
+	store i32 2, %2
+	%3 = call i32 @g(ptr %2)
+	ret i32 1
+}
+`,
+		},
+		{
+			"入口に戻るループがあれば新しい入口を作る。使われないphiも置く",
+			`
+func @f() i32 {
+entry:
+	%1 = alloca i32
+	store i32 1, %1
+	%2 = call i32 @c()
+	br i32 %2, entry, done
+done:
+	%3 = load i32 %1
+	ret i32 %3
+}`,
+			`
+func @f() i32 {
+entry.1:
+	jmp entry
+entry:
+	%4 = phi i32 [0, entry.1], [1, entry]
+	%2 = call i32 @c()
+	br i32 %2, entry, done
+done:
+	ret i32 1
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runPass(t, Mem2Reg, tt.input, tt.expect)
+		})
+	}
+}
+
+func TestConstProp(t *testing.T) {
+	runPass(t, ConstProp, `
+func @f() i32 {
+entry:
+	%1 = add i32 2, 3
+	%2 = lt i32 %1, 4
+	br i32 %2, a, b
+a:
+	jmp c
+b:
+	jmp c
+c:
+	%3 = phi i32 [1, a], [%1, b]
+	%4 = add i32 2147483647, %3
+	%5 = trunc i32 300 to i8
+	%6 = sext i8 %5 to i32
+	%7 = div i32 %6, 0
+	%8 = call i32 @g(i32 %4, i32 %6, i32 %7)
+	ret i32 %8
+}`, `
+func @f() i32 {
+entry:
+	jmp b
+b:
+	jmp c
+c:
+	%7 = div i32 44, 0
+	%8 = call i32 @g(i32 -2147483644, i32 44, i32 %7)
+	ret i32 %8
+}
+`)
+}
+
+func TestCopyProp(t *testing.T) {
+	runPass(t, CopyProp, `
+func @f() i32 {
+entry:
+	%1 = call i32 @c()
+	%2 = copy i32 %1
+	%3 = copy i32 %2
+	br i32 %3, a, b
+a:
+	jmp b
+b:
+	%4 = phi i32 [%3, entry], [%1, a]
+	%5 = add i32 %4, %2
+	ret i32 %5
+}`, `
+func @f() i32 {
+entry:
+	%1 = call i32 @c()
+	br i32 %1, a, b
+a:
+	jmp b
+b:
+	%5 = add i32 %1, %1
+	ret i32 %5
+}
+`)
+}
+
+func TestDCE(t *testing.T) {
+	runPass(t, DCE, `
+func @f() i32 {
+entry:
+	%1 = add i32 1, 2
+	%2 = mul i32 %1, 3
+	%3 = call i32 @g()
+	%4 = alloca i32
+	jmp loop
+loop:
+	%5 = phi i32 [0, entry], [%6, loop]
+	%6 = add i32 %5, 1
+	%7 = call i32 @c()
+	br i32 %7, loop, done
+dead:
+	jmp done
+done:
+	ret i32 %1
+}`, `
+func @f() i32 {
+entry:
+	%1 = add i32 1, 2
+	%3 = call i32 @g()
+	jmp loop
+loop:
+	%7 = call i32 @c()
+	br i32 %7, loop, done
+done:
+	ret i32 %1
+}
+`)
+}
+
+func TestCSE(t *testing.T) {
+	runPass(t, CSE, `
+func @f() i32 {
+entry:
+	%1 = call i32 @c()
+	%2 = add i32 %1, 1
+	%3 = add i32 1, %1
+	%4 = sub i32 1, %1
+	br i32 %1, a, b
+a:
+	%5 = add i32 %1, 1
+	%6 = mul i32 %1, 2
+	jmp done
+b:
+	%7 = mul i32 %1, 2
+	jmp done
+done:
+	%8 = phi i32 [%6, a], [%7, b]
+	%9 = add i32 %2, %3
+	%10 = add i32 %9, %5
+	%11 = add i32 %10, %4
+	%12 = add i32 %11, %8
+	ret i32 %12
+}`, `
+func @f() i32 {
+entry:
+	%1 = call i32 @c()
+	%2 = add i32 %1, 1
+	%4 = sub i32 1, %1
+	br i32 %1, a, b
+a:
+	%6 = mul i32 %1, 2
+	jmp done
+b:
+	%7 = mul i32 %1, 2
+	jmp done
+done:
+	%8 = phi i32 [%6, a], [%7, b]
+	%9 = add i32 %2, %2
+	%10 = add i32 %9, %2
+	%11 = add i32 %10, %4
+	%12 = add i32 %11, %8
+	ret i32 %12
+}
+`)
+}
+
+func TestLICM(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		expect string
+	}{
+		{
+			"ループの前のブロックに移す",
+			`
+func @f() i32 {
+entry:
+	%1 = call i32 @c()
+	jmp loop
+loop:
+	%2 = phi i32 [0, entry], [%5, loop]
+	%3 = mul i32 %1, 2
+	%4 = add i32 %3, 1
+	%5 = add i32 %2, %4
+	%6 = div i32 %1, 3
+	%7 = lt i32 %5, %6
+	br i32 %7, loop, done
+done:
+	ret i32 %5
+}`,
+			`
+func @f() i32 {
+entry:
+	%1 = call i32 @c()
+	%3 = mul i32 %1, 2
+	%4 = add i32 %3, 1
+	jmp loop
+loop:
+	%2 = phi i32 [0, entry], [%5, loop]
+	%5 = add i32 %2, %4
+	%6 = div i32 %1, 3
+	%7 = lt i32 %5, %6
+	br i32 %7, loop, done
+done:
+	ret i32 %5
+}
+`,
+		},
+		{
+			"ループに入る前のブロックがなければ作る",
+			`
+func @f() i32 {
+entry:
+	%1 = call i32 @c()
+	br i32 %1, a, loop
+a:
+	jmp loop
+loop:
+	%2 = phi i32 [0, entry], [1, a], [%4, loop]
+	%3 = mul i32 %1, 2
+	%4 = add i32 %2, %3
+	br i32 %4, loop, done
+done:
+	ret i32 %4
+}`,
+			`
+func @f() i32 {
+entry:
+	%1 = call i32 @c()
+	br i32 %1, a, loop.preheader
+a:
+	jmp loop.preheader
+loop.preheader:
+	%5 = phi i32 [0, entry], [1, a]
+	%3 = mul i32 %1, 2
+	jmp loop
+loop:
+	%2 = phi i32 [%4, loop], [%5, loop.preheader]
+	%4 = add i32 %2, %3
+	br i32 %4, loop, done
+done:
+	ret i32 %4
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runPass(t, LICM, tt.input, tt.expect)
+		})
+	}
+}
+
+func lower(t *testing.T, input string) *ir.Module {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	prog := p.ParseProgram()
+	assert.Empty(t, p.Errors())
+	engine := diag.NewEngine()
+	info := sema.Check("", prog, engine)
+	assert.Empty(t, engine.Diagnostics())
+	return ir.Lower(prog, info)
+}
+
+func TestManager(t *testing.T) {
+	tests := []struct {
+		level  int
+		input  string
+		expect string
+	}{
+		{
+			0,
+			`int a = 1; a + 2`,
+			`
+func @mymain() i32 {
+entry:
+	%1 = alloca i32
+	store i32 1, %1
+	%2 = load i32 %1
+	%3 = add i32 %2, 2
+	ret i32 %3
+}
+`,
+		},
+		{
+			1,
+			`int a = 1; char c = 'a'; a + c * 2`,
+			`
+func @mymain() i32 {
+entry:
+	ret i32 195
+}
+`,
+		},
+		{
+			2,
+			`int a = sum2(1, 2); int b = a * 2 + a * 2; printf("%d", b)`,
+			`data @.s0 = "%d"
+
+func @mymain() i32 {
+entry:
+	%3 = call i32 @sum2(i32 1, i32 2)
+	%5 = mul i32 %3, 2
+	%8 = add i32 %5, %5
+	%10 = call i32 @printf(ptr @.s0, i32 %8)
+	ret i32 %10
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		m := lower(t, tt.input)
+		passes := []string{}
+		pm := NewManager(tt.level)
+		pm.Verify = true
+		pm.AfterPass = func(pass string, m *ir.Module) {
+			passes = append(passes, pass)
+		}
+		assert.NoError(t, pm.Run(m))
+		assert.Equal(t, strings.TrimPrefix(tt.expect, "\n"), m.String(), tt.input)
+
+		names := []string{}
+		for _, p := range Passes(tt.level) {
+			names = append(names, p.Name)
+		}
+		assert.Equal(t, names, passes)
+	}
+}
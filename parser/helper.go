@@ -5,3 +5,7 @@ import "github.com/kijimaD/gogo/token"
 func (p *Parser) peekTokenIs(expect token.TokenType) bool {
 	return p.peekToken.Type == expect
 }
+
+func (p *Parser) curTokenIs(expect token.TokenType) bool {
+	return p.curToken.Type == expect
+}
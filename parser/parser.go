@@ -5,8 +5,8 @@ import (
 	"strconv"
 
 	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/diag"
 	"github.com/kijimaD/gogo/lexer"
-	"github.com/kijimaD/gogo/object"
 	"github.com/kijimaD/gogo/token"
 )
 
@@ -20,13 +20,25 @@ type Parser struct {
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
 
-	Strs   []string // 定義済みの文字列一覧。ラベルの定義に使う。スタックに入っているので、位置が必要
-	errors []string
-	Env    *object.Environment // パーサーから移動させたほうがいいかもしれない
+	Strs      []string // 定義済みの文字列一覧。ラベルの定義に使う。スタックに入っているので、位置が必要
+	diags     *diag.Engine
+	panicking bool // 構文エラーから回復中か。回復するまで連鎖したエラーは報告しない
 }
 
+// エラーのメッセージ一覧
 func (p *Parser) Errors() []string {
-	return p.errors
+	errors := []string{}
+	for _, d := range p.diags.Diagnostics() {
+		if d.Severity == diag.SeverityError {
+			errors = append(errors, d.Message)
+		}
+	}
+	return errors
+}
+
+// 位置や修正候補を含む診断の一覧
+func (p *Parser) Diagnostics() []*diag.Diagnostic {
+	return p.diags.Diagnostics()
 }
 
 type (
@@ -59,10 +71,9 @@ var precedences = map[token.TokenType]int{
 
 func New(l *lexer.Lexer) *Parser {
 	p := &Parser{
-		l:      l,
-		Strs:   []string{},
-		errors: []string{},
-		Env:    object.NewEnvironment(),
+		l:     l,
+		Strs:  []string{},
+		diags: diag.NewEngine(),
 	}
 
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
@@ -103,11 +114,44 @@ func (p *Parser) expectPeek(t token.TokenType) bool {
 }
 
 func (p *Parser) peekError(t token.TokenType) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead",
+	d := p.syntaxErrorAt(p.peekToken, diag.UnexpectedToken, "expected next token to be %s, got %s instead",
 		t,
 		p.peekToken.Type,
 	)
-	p.errors = append(p.errors, msg)
+	// 記号が足りないだけなら、直前のトークンの後ろに挿入すれば直る
+	if len(t) == 1 {
+		at := p.curToken.End
+		d.AddFixIt(diag.Range{File: p.l.File(), Start: at, End: at}, string(t), fmt.Sprintf("insert '%s'", t))
+	}
+}
+
+// トークンの位置でエラーを報告する
+func (p *Parser) errorAt(tok token.Token, code diag.Code, format string, args ...interface{}) *diag.Diagnostic {
+	if p.panicking {
+		// 報告はしないが、呼び出し元が補足を追加できるように捨てる診断を返す
+		return &diag.Diagnostic{}
+	}
+	return p.diags.Errorf(code, diag.TokenRange(p.l.File(), tok), format, args...)
+}
+
+// 構文エラーを報告して、回復モードに入る
+func (p *Parser) syntaxErrorAt(tok token.Token, code diag.Code, format string, args ...interface{}) *diag.Diagnostic {
+	d := p.errorAt(tok, code, format, args...)
+	p.panicking = true
+	return d
+}
+
+// 構文エラーのあと、同期点までトークンを読み飛ばして回復する
+// 同期点は ; と } と宣言のキーワード。; と } は現在のトークンとして止まるので、次のnextTokenで読み飛ばされる
+// 宣言のキーワードは次の文の始まりなので、その直前で止まる
+func (p *Parser) synchronize() {
+	for !p.curTokenIs(token.SEMICOLON) && !p.curTokenIs(token.RBRACE) && !p.curTokenIs(token.EOF) {
+		if p.peekTokenIs(token.EOF) || (p.peekTokenIs(token.IDENT) && isCtypeName(p.peekToken.Literal)) {
+			break
+		}
+		p.nextToken()
+	}
+	p.panicking = false
 }
 
 func (p *Parser) peekPrecedence() int {
@@ -132,7 +176,9 @@ func (p *Parser) ParseProgram() *ast.Program {
 	for p.curToken.Type != token.EOF {
 		switch p.curToken.Type {
 		case token.ILLEGAL:
-			p.errors = append(p.errors, "illegal token is detected!")
+			p.syntaxErrorAt(p.curToken, diag.IllegalToken, "illegal token is detected!")
+		case token.RBRACE:
+			p.syntaxErrorAt(p.curToken, diag.UnexpectedToken, "unexpected %s", p.curToken.Type)
 		case token.SEMICOLON:
 		default:
 			stmt := p.parseStatement()
@@ -140,6 +186,9 @@ func (p *Parser) ParseProgram() *ast.Program {
 				program.Statements = append(program.Statements, stmt)
 			}
 		}
+		if p.panicking {
+			p.synchronize()
+		}
 		p.nextToken()
 	}
 
@@ -158,9 +207,7 @@ func (p *Parser) registerInfix(tokenType token.TokenType, fn infixParseFn) {
 // 文は代入とか、ifの実行文とか(条件部分は式)、返り値がないもの
 func (p *Parser) parseStatement() ast.Statement {
 	if p.curToken.Type == token.IDENT && p.isCtypeKeyword() {
-		if decl := p.parseDeclStatement(); decl != nil {
-			return decl
-		}
+		return p.parseDeclStatement()
 	}
 	return p.parseExpressionStatement()
 }
@@ -175,42 +222,31 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 }
 
 // int a = 1
-// TODO: 型宣言と値の型が一致しているかチェックする
-func (p *Parser) parseDeclStatement() *ast.DeclStatement {
+// 型のチェックと変数の登録は意味解析(sema)で行う
+func (p *Parser) parseDeclStatement() ast.Statement {
 	declstmt := &ast.DeclStatement{Token: p.curToken}
+	bad := func() ast.Statement {
+		return &ast.BadStmt{Token: declstmt.Token, EndPos: p.curToken.End}
+	}
 
 	ctype, err := p.getDeclCtype()
 	if err != nil {
-		p.errors = append(p.errors, "failed get ident type")
+		p.errorAt(p.curToken, diag.UnknownType, "failed get ident type")
 	}
 	declstmt.Ctype = ctype
 
 	if !p.expectPeek(token.IDENT) {
-		return nil
+		return bad()
 	}
 
 	declstmt.Name = &ast.Var{Token: p.curToken}
 
 	if !p.expectPeek(token.ASSIGN) {
-		return nil
+		return bad()
 	}
 
 	p.nextToken()
 	declstmt.Value = p.parseExpression(LOWEST)
-	declstmt.Pos = p.Env.VarPos
-
-	var obj object.Object
-	switch declstmt.Ctype {
-	case token.CTYPE_STR:
-		obj = &object.String{Value: p.curToken.Literal, Pos: p.Env.VarPos}
-	case token.CTYPE_CHAR:
-		parsed, _ := strconv.ParseInt(p.curToken.Literal, 10, 64)
-		obj = &object.Char{Value: parsed, Pos: p.Env.VarPos}
-	case token.CTYPE_INT:
-		parsed, _ := strconv.ParseInt(p.curToken.Literal, 10, 64)
-		obj = &object.Integer{Value: parsed, Pos: p.Env.VarPos}
-	}
-	p.Env.Set(declstmt.Name.Token.Literal, obj)
 
 	return declstmt
 }
@@ -220,9 +256,8 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 	// 前置構文
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
-		msg := fmt.Sprintf("no prefix parse function for %s found", p.curToken.Type)
-		p.errors = append(p.errors, msg)
-		return nil
+		p.syntaxErrorAt(p.curToken, diag.ExpectedExpression, "no prefix parse function for %s found", p.curToken.Type)
+		return &ast.BadExpr{Token: p.curToken}
 	}
 	leftExp := prefix()
 
@@ -248,6 +283,10 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 
 func (p *Parser) parseCharLiteral() ast.Expression {
 	runes := []rune(p.curToken.Literal)
+	if len(runes) == 0 {
+		p.syntaxErrorAt(p.curToken, diag.IllegalToken, "empty character literal")
+		return &ast.BadExpr{Token: p.curToken}
+	}
 	a := ast.CharLiteral{Token: p.curToken, Value: runes[0]}
 	return &a
 }
@@ -257,29 +296,18 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
-		return nil
+		p.errorAt(p.curToken, diag.InvalidInteger, "could not parse %q as integer", p.curToken.Literal)
+		return &ast.BadExpr{Token: p.curToken}
 	}
 
 	lit.Value = value
 	return lit
 }
 
-// token.identifierから、定義ずみ変数を探してvarにする
+// token.identifierをvarにする。どの変数を指すかは意味解析(sema)で解決する
 func (p *Parser) parseIdent() ast.Expression {
-	var varctype token.Ctype
-	if !p.peekTokenIs(token.LPAREN) {
-		obj, ok := p.Env.Get(p.curToken.Literal)
-		if ok {
-			varctype = obj.GetCtype()
-		} else {
-			msg := fmt.Sprintf("not exist variable: %s", p.curToken.Literal)
-			p.errors = append(p.errors, msg)
-		}
-	}
 	// 前置関数と中置関数の仕組みで、処理しているトークンが関数呼び出しの場合はここの返り値は使われることがない
-	a := &ast.Var{Token: p.curToken, Ctype: varctype}
+	a := &ast.Var{Token: p.curToken}
 	return a
 }
 
@@ -294,12 +322,6 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	p.nextToken()                                    // 中置演算子の右の引数に進む
 	expression.Right = p.parseExpression(precedence) // 右側を評価する
 
-	ctype, err := p.resultType(left, expression.Right)
-	if err != nil {
-		p.errors = append(p.errors, err.Error())
-	}
-	expression.Ctype = ctype
-
 	return expression
 }
 
@@ -309,6 +331,9 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.FuncallExpression{Token: p.curToken, Function: function}
 	exp.Args = p.parseExpressionList(token.RPAREN)
+	if p.curTokenIs(token.RPAREN) {
+		exp.Rparen = p.curToken.Pos
+	}
 	return exp
 }
 
@@ -344,18 +369,24 @@ func (p *Parser) getDeclCtype() (token.Ctype, error) {
 		return token.CTYPE_VOID, fmt.Errorf("%s is not ident", p.curToken.Type)
 	}
 
-	switch p.curToken.Literal {
-	case "void":
-		return token.CTYPE_VOID, nil
-	case "int":
-		return token.CTYPE_INT, nil
-	case "char":
-		return token.CTYPE_CHAR, nil
-	case "string":
-		return token.CTYPE_STR, nil
-	default:
+	ctype, ok := ctypeNames[p.curToken.Literal]
+	if !ok {
 		return token.CTYPE_VOID, fmt.Errorf("this is not type keyword: %s", p.curToken.Literal)
 	}
+	return ctype, nil
+}
+
+var ctypeNames = map[string]token.Ctype{
+	"void":   token.CTYPE_VOID,
+	"int":    token.CTYPE_INT,
+	"char":   token.CTYPE_CHAR,
+	"string": token.CTYPE_STR,
+}
+
+// 型名か判定する
+func isCtypeName(literal string) bool {
+	_, ok := ctypeNames[literal]
+	return ok
 }
 
 // 識別子が型か判定する
@@ -363,43 +394,3 @@ func (p *Parser) isCtypeKeyword() bool {
 	_, err := p.getDeclCtype()
 	return err == nil
 }
-
-func (p *Parser) resultType(a ast.Expression, b ast.Expression) (token.Ctype, error) {
-	small := a
-	big := b
-	incompatibleErr := fmt.Errorf("incompatible operands: %s and %s for %c", p.curToken, small, big)
-
-	if a == nil || b == nil {
-		return token.CTYPE_VOID, incompatibleErr
-	}
-
-	if a.GetCtype() > b.GetCtype() {
-		small = b
-		big = a
-	}
-
-	switch small.GetCtype() {
-	case token.CTYPE_VOID:
-		return token.CTYPE_VOID, incompatibleErr
-	case token.CTYPE_INT:
-		switch big.GetCtype() {
-		case token.CTYPE_INT:
-			return token.CTYPE_INT, nil
-		case token.CTYPE_CHAR:
-			return token.CTYPE_INT, nil
-		case token.CTYPE_STR:
-			return token.CTYPE_VOID, incompatibleErr
-		}
-	case token.CTYPE_CHAR:
-		switch big.GetCtype() {
-		case token.CTYPE_CHAR:
-			return token.CTYPE_INT, nil
-		case token.CTYPE_STR:
-			return token.CTYPE_VOID, incompatibleErr
-		}
-	case token.CTYPE_STR:
-		return token.CTYPE_VOID, incompatibleErr
-	}
-
-	return token.CTYPE_VOID, incompatibleErr
-}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/diag"
 	"github.com/kijimaD/gogo/lexer"
 	"github.com/kijimaD/gogo/token"
 	"github.com/stretchr/testify/assert"
@@ -123,7 +124,6 @@ func TestParseProgramIllegal(t *testing.T) {
 		{`42a`},        // 数値から始まる識別子
 		{`1+`},         // 中置演算子の右側がない
 		{`'MULTIPLE'`}, // charリテラルに複数の文字
-		{`1 + "a"`},    // 型エラー
 	}
 
 	for _, tt := range tests {
@@ -309,33 +309,23 @@ func TestParsePrecedence(t *testing.T) {
 	}
 }
 
-func TestParseTypeCheck(t *testing.T) {
-	tests := []struct {
-		input string
-	}{
-		{
-			`int a = 1; a + 1;`,
-		},
-		{
-			`char a = 'a'; a + 1;`,
-		},
-	}
-
-	for _, tt := range tests {
-		l := lexer.New(tt.input)
-		p := New(l)
-		p.ParseProgram()
-		checkParserErrors(t, p)
-	}
-}
-
 func TestNextToken(t *testing.T) {
 	l := lexer.New(`"hello world"`)
 	p := New(l)
 
-	expectCur := token.Token{Type: "STRING", Literal: "hello world"}
+	expectCur := token.Token{
+		Type:    "STRING",
+		Literal: "hello world",
+		Pos:     token.Position{Line: 1, Column: 1},
+		End:     token.Position{Line: 1, Column: 14},
+	}
 	assert.Equal(t, expectCur, p.curToken)
-	expectPeek := token.Token{Type: "EOF", Literal: ""}
+	expectPeek := token.Token{
+		Type:    "EOF",
+		Literal: "",
+		Pos:     token.Position{Line: 1, Column: 14},
+		End:     token.Position{Line: 1, Column: 14},
+	}
 	assert.Equal(t, expectPeek, p.peekToken)
 }
 
@@ -365,3 +355,136 @@ func TestParseExpressionList(t *testing.T) {
 		assert.Equal(t, tt.expect, strings.Join(results, ", "))
 	}
 }
+
+func TestParseDiagnostics(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		expect []string
+	}{
+		{
+			name:  "記号が足りないときは修正候補がつく",
+			input: `int a 1`,
+			expect: []string{
+				`a.c:1:7: error: expected next token to be =, got INT instead [unexpected-token]`,
+				`a.c:1:6: fix-it: insert '=': "="`,
+			},
+		},
+		{
+			name:  "不正なトークン",
+			input: `42a`,
+			expect: []string{
+				`a.c:1:1: error: illegal token is detected! [illegal-token]`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := lexer.NewFile("a.c", tt.input)
+			p := New(l)
+			p.ParseProgram()
+
+			var buf strings.Builder
+			assert.NoError(t, diag.WriteText(&buf, p.Diagnostics()))
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			assert.Equal(t, tt.expect, lines[:len(tt.expect)])
+		})
+	}
+}
+
+// 構文エラーのあとは同期点まで読み飛ばして、後続の文を読み続ける
+func TestParseRecovery(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expect    string
+		errorsLen int
+	}{
+		{
+			name:      "式の途中のエラーは;で回復する",
+			input:     `1 +; 2`,
+			expect:    `(1 + <bad expr>)2`,
+			errorsLen: 1,
+		},
+		{
+			name:      "宣言のエラーは;で回復する",
+			input:     `int a 1; int b = 2`,
+			expect:    `<bad stmt>(int b = 2)`,
+			errorsLen: 1,
+		},
+		{
+			name:      "宣言のキーワードで回復する",
+			input:     `int a 1 2 3 int b = 2`,
+			expect:    `<bad stmt>(int b = 2)`,
+			errorsLen: 1,
+		},
+		{
+			name:      "}で回復する",
+			input:     `f(1, { 2 } 3`,
+			expect:    `f()3`,
+			errorsLen: 1,
+		},
+		{
+			name:      "対応しない}",
+			input:     `} 1`,
+			expect:    `1`,
+			errorsLen: 1,
+		},
+		{
+			name:      "エラーは連鎖しない",
+			input:     `1 + + + 2; 3`,
+			expect:    `((1 + <bad expr>) + 2)3`,
+			errorsLen: 1,
+		},
+		{
+			name:      "文ごとにエラーを報告する",
+			input:     `1 +; 2 *; 3`,
+			expect:    `(1 + <bad expr>)(2 * <bad expr>)3`,
+			errorsLen: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := lexer.New(tt.input)
+			p := New(l)
+			pg := p.ParseProgram()
+
+			assert.Equal(t, tt.errorsLen, len(p.Errors()))
+			assert.Equal(t, tt.expect, pg.String())
+		})
+	}
+}
+
+// どんな入力でもパニックしない
+func FuzzParseProgram(f *testing.F) {
+	seeds := []string{
+		`int a = 1; a + 2`,
+		`f(1, 2`,
+		`int`,
+		`int a`,
+		`int a =`,
+		`'`,
+		`''`,
+		`"abc`,
+		`1 + "a"`,
+		`99999999999999999999`,
+		`}}}{{{`,
+		`f(,)`,
+		`((((`,
+		`= = =`,
+		`int a = b; char c = 'x' + a;`,
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		l := lexer.New(input)
+		p := New(l)
+		pg := p.ParseProgram()
+		_ = pg.String()
+		_ = p.Errors()
+	})
+}
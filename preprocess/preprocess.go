@@ -0,0 +1,311 @@
+// プリプロセッサ
+// #include、#define、#undef、#ifdef、#ifndef、#else、#endifを処理したテキストを作る
+// マクロは引数のないものだけに対応する。展開したテキストの各行が、どのファイルの何行目から来たかを記録しておく
+
+package preprocess
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kijimaD/gogo/diag"
+	"github.com/kijimaD/gogo/token"
+)
+
+// #includeが入れ子にできる深さ。自分自身を読み込むファイルで止まらなくなるのを防ぐ
+const maxIncludeDepth = 200
+
+type Options struct {
+	IncludePaths []string          // #includeでファイルを探すディレクトリ
+	Defines      map[string]string // 最初から定義しておくマクロ。-Dに当たる
+	// ファイルを読む関数。nilならos.ReadFileを使う
+	ReadFile func(name string) ([]byte, error)
+}
+
+// テキストの行の出どころ
+type Origin struct {
+	File string
+	Line int
+}
+
+// 前処理した結果
+type Result struct {
+	Text    string
+	origins []Origin // 出力した行ごとの出どころ
+}
+
+// 前処理したテキストの位置を、元のファイルの位置にする
+func (r *Result) Origin(pos token.Position) (string, token.Position) {
+	if pos.Line < 1 || pos.Line > len(r.origins) {
+		return "", pos
+	}
+	o := r.origins[pos.Line-1]
+	return o.File, token.Position{Line: o.Line, Column: pos.Column}
+}
+
+// 診断の範囲を元のファイルの位置にする
+func (r *Result) Remap(d *diag.Diagnostic) {
+	d.Range = r.remapRange(d.Range)
+	for i := range d.Notes {
+		d.Notes[i].Range = r.remapRange(d.Notes[i].Range)
+	}
+	for i := range d.FixIts {
+		d.FixIts[i].Range = r.remapRange(d.FixIts[i].Range)
+	}
+}
+
+func (r *Result) remapRange(rg diag.Range) diag.Range {
+	file, start := r.Origin(rg.Start)
+	if file == "" {
+		return rg
+	}
+	_, end := r.Origin(rg.End)
+	return diag.Range{File: file, Start: start, End: end}
+}
+
+type preprocessor struct {
+	opts    Options
+	diags   *diag.Engine
+	macros  map[string]string
+	out     []string
+	origins []Origin
+}
+
+// 条件付きコンパイルの入れ子1段
+type cond struct {
+	active   bool // この段の行を出力するか
+	parent   bool // 外側の段が有効か
+	seenElse bool
+	pos      diag.Range
+}
+
+// fileのsrcを前処理する。fileは診断に出す名前で、#include "..."はそのディレクトリからも探す
+func Process(file string, src string, opts Options, diags *diag.Engine) *Result {
+	p := &preprocessor{opts: opts, diags: diags, macros: map[string]string{}}
+	if p.opts.ReadFile == nil {
+		p.opts.ReadFile = os.ReadFile
+	}
+	for name, value := range opts.Defines {
+		p.macros[name] = value
+	}
+	p.file(file, src, 0)
+	return &Result{Text: strings.Join(p.out, "\n"), origins: p.origins}
+}
+
+func (p *preprocessor) emit(line string, file string, n int) {
+	p.out = append(p.out, line)
+	p.origins = append(p.origins, Origin{File: file, Line: n})
+}
+
+func (p *preprocessor) file(file string, src string, depth int) {
+	conds := []cond{}
+	active := func() bool {
+		return len(conds) == 0 || conds[len(conds)-1].active
+	}
+
+	lines := strings.Split(strings.TrimSuffix(src, "\n"), "\n")
+	for i, line := range lines {
+		n := i + 1
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "#") {
+			if active() {
+				p.emit(p.expand(line, map[string]bool{}), file, n)
+			} else {
+				p.emit("", file, n)
+			}
+			continue
+		}
+
+		// 指令の行は空行にして、行番号をそろえる
+		p.emit("", file, n)
+		name, rest := splitWord(strings.TrimSpace(trimmed[1:]))
+		col := strings.Index(line, "#") + 1
+		rg := diag.Range{File: file, Start: token.Position{Line: n, Column: col}, End: token.Position{Line: n, Column: len(line) + 1}}
+
+		switch name {
+		case "ifdef", "ifndef":
+			macro, _ := splitWord(rest)
+			_, defined := p.macros[macro]
+			c := cond{parent: active(), pos: rg}
+			c.active = c.parent && defined == (name == "ifdef")
+			conds = append(conds, c)
+			continue
+		case "else":
+			if len(conds) == 0 || conds[len(conds)-1].seenElse {
+				p.diags.Errorf(diag.InvalidDirective, rg, "#else without #ifdef")
+				continue
+			}
+			c := &conds[len(conds)-1]
+			c.active = c.parent && !c.active
+			c.seenElse = true
+			continue
+		case "endif":
+			if len(conds) == 0 {
+				p.diags.Errorf(diag.InvalidDirective, rg, "#endif without #ifdef")
+				continue
+			}
+			conds = conds[:len(conds)-1]
+			continue
+		}
+		if !active() {
+			continue
+		}
+
+		switch name {
+		case "":
+			// #だけの行は何もしない
+		case "define":
+			macro, body := splitWord(rest)
+			if !isIdent(macro) {
+				p.diags.Errorf(diag.InvalidDirective, rg, "macro name must be an identifier")
+				continue
+			}
+			if strings.HasPrefix(body, "(") && strings.HasPrefix(rest[len(macro):], "(") {
+				p.diags.Errorf(diag.InvalidDirective, rg, "function-like macros are not supported")
+				continue
+			}
+			p.macros[macro] = body
+		case "undef":
+			macro, _ := splitWord(rest)
+			delete(p.macros, macro)
+		case "include":
+			p.include(file, rest, rg, depth)
+		default:
+			p.diags.Errorf(diag.InvalidDirective, rg, "invalid preprocessing directive #%s", name)
+		}
+	}
+
+	for _, c := range conds {
+		p.diags.Errorf(diag.InvalidDirective, c.pos, "unterminated conditional directive")
+	}
+}
+
+// #include "file" または #include <file>
+func (p *preprocessor) include(from string, arg string, rg diag.Range, depth int) {
+	if len(arg) < 2 || !(arg[0] == '"' && strings.HasSuffix(arg, `"`) || arg[0] == '<' && strings.HasSuffix(arg, ">")) {
+		p.diags.Errorf(diag.InvalidDirective, rg, `#include expects "FILENAME" or <FILENAME>`)
+		return
+	}
+	if depth >= maxIncludeDepth {
+		p.diags.Errorf(diag.InvalidDirective, rg, "#include nested too deeply")
+		return
+	}
+	name := arg[1 : len(arg)-1]
+
+	// "..."は読み込むファイルのディレクトリから先に探す
+	dirs := []string{}
+	if arg[0] == '"' {
+		dirs = append(dirs, filepath.Dir(from))
+	}
+	dirs = append(dirs, p.opts.IncludePaths...)
+	if filepath.IsAbs(name) {
+		dirs = []string{""}
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		b, err := p.opts.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		p.file(path, string(b), depth+1)
+		return
+	}
+	p.diags.Errorf(diag.IncludeNotFound, rg, "%s: file not found", name)
+}
+
+// 行の中のマクロを展開する。文字列と文字のリテラルの中はそのまま
+// 展開中のマクロは、その展開結果の中では展開しない
+func (p *preprocessor) expand(line string, expanding map[string]bool) string {
+	var b strings.Builder
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(line) && line[j] != c {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			switch {
+			case j > len(line):
+				// 閉じていないリテラルが\で終わっている
+				j = len(line)
+			case j < len(line):
+				j++
+			}
+			b.WriteString(line[i:j])
+			i = j
+		case isIdentStart(c):
+			j := i
+			for j < len(line) && (isIdentStart(line[j]) || '0' <= line[j] && line[j] <= '9') {
+				j++
+			}
+			word := line[i:j]
+			if body, ok := p.macros[word]; ok && !expanding[word] {
+				expanding[word] = true
+				b.WriteString(p.expand(body, expanding))
+				delete(expanding, word)
+			} else {
+				b.WriteString(word)
+			}
+			i = j
+		case '0' <= c && c <= '9':
+			// 123abcのような数字の後ろを識別子として展開しない
+			j := i
+			for j < len(line) && (isIdentStart(line[j]) || '0' <= line[j] && line[j] <= '9') {
+				j++
+			}
+			b.WriteString(line[i:j])
+			i = j
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// 先頭の単語と、残りを返す
+func splitWord(s string) (string, string) {
+	i := strings.IndexAny(s, " \t(")
+	if i < 0 {
+		return s, ""
+	}
+	if s[i] == '(' {
+		// #define F(x) を見分けられるように、(は残りに含める
+		return s[:i], s[i:]
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isIdent(s string) bool {
+	if s == "" || !isIdentStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isIdentStart(s[i]) && !('0' <= s[i] && s[i] <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// -DNAME=VALUEの引数を、マクロの名前と値にする。値がなければ1
+func ParseDefine(arg string) (string, string, error) {
+	name, value, ok := strings.Cut(arg, "=")
+	if !isIdent(name) {
+		return "", "", fmt.Errorf("macro name must be an identifier: %s", arg)
+	}
+	if !ok {
+		value = "1"
+	}
+	return name, value, nil
+}
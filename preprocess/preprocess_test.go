@@ -0,0 +1,147 @@
+package preprocess
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/gogo/diag"
+	"github.com/kijimaD/gogo/token"
+	"github.com/stretchr/testify/assert"
+)
+
+// メモリ上のファイルを読む
+func files(fs map[string]string) func(string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		if s, ok := fs[name]; ok {
+			return []byte(s), nil
+		}
+		return nil, errors.New("not found")
+	}
+}
+
+func TestProcess(t *testing.T) {
+	fs := files(map[string]string{
+		"src/a.h":      "int a = N;\n",
+		"inc/b.h":      "#ifndef B_H\n#define B_H\nint b = 2;\n#endif\n",
+		"inc/nested.h": `#include "b.h"` + "\n",
+	})
+	tests := []struct {
+		name   string
+		input  string
+		expect string
+	}{
+		{"マクロを展開する", "#define N 3\nN + N", "\n3 + 3"},
+		{"展開した結果も展開する", "#define A B + 1\n#define B 2\nA", "\n\n2 + 1"},
+		{"自分自身は展開しない", "#define A A + 1\nA", "\nA + 1"},
+		{"文字列の中は展開しない", "#define N 3\nprintf(\"N\", N1, 1N)", "\nprintf(\"N\", N1, 1N)"},
+		{"-Dで定義したマクロ", "D", "4"},
+		{"#undef", "#undef D\nD", "\nD"},
+		{"#ifdef", "#ifdef D\n1\n#else\n2\n#endif", "\n1\n\n\n"},
+		{"#ifndef", "#ifndef D\n1\n#else\n2\n#endif", "\n\n\n2\n"},
+		{"入れ子の#ifdef", "#ifdef X\n#ifdef D\n1\n#endif\n#else\n2\n#endif", "\n\n\n\n\n2\n"},
+		{"ファイルのディレクトリから探す", "#define N 1\n#include \"a.h\"", "\n\nint a = 1;"},
+		{"インクルードパスから探す", "#include <b.h>\n#include <b.h>\nb", "\n\n\nint b = 2;\n\n\n\n\n\n\nb"},
+		{"インクルードしたファイルからさらに読む", "#include <nested.h>", "\n\n\n\nint b = 2;\n"},
+		{"閉じていないリテラルが\\で終わる", "#define N 3\nN \"\\\nN '\\", "\n3 \"\\\n3 '\\"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := diag.NewEngine()
+			r := Process("src/main.c", tt.input, Options{
+				IncludePaths: []string{"inc"},
+				Defines:      map[string]string{"D": "4"},
+				ReadFile:     fs,
+			}, engine)
+			assert.Empty(t, engine.Diagnostics())
+			assert.Equal(t, tt.expect, r.Text)
+		})
+	}
+}
+
+// どんな入力でもパニックしない
+func FuzzProcess(f *testing.F) {
+	seeds := []string{
+		"#define N 3\nN + N",
+		"#include \"a.h\"",
+		"#ifdef N\n#else\n#endif",
+		"#if",
+		"\"\\",
+		"'\\",
+		"\"N",
+		"#define A A\nA",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		engine := diag.NewEngine()
+		r := Process("main.c", input, Options{ReadFile: files(map[string]string{"a.h": "1"})}, engine)
+		_ = r.Text
+	})
+}
+
+// 前処理したテキストの位置から、元のファイルの位置がわかる
+func TestOrigin(t *testing.T) {
+	r := Process("main.c", "#include \"a.h\"\nx", Options{
+		ReadFile: files(map[string]string{"a.h": "1\n2"}),
+	}, diag.NewEngine())
+	assert.Equal(t, "\n1\n2\nx", r.Text)
+
+	file, pos := r.Origin(token.Position{Line: 3, Column: 1})
+	assert.Equal(t, "a.h", file)
+	assert.Equal(t, token.Position{Line: 2, Column: 1}, pos)
+	file, pos = r.Origin(token.Position{Line: 4, Column: 1})
+	assert.Equal(t, "main.c", file)
+	assert.Equal(t, token.Position{Line: 2, Column: 1}, pos)
+
+	d := &diag.Diagnostic{Range: diag.Range{File: "main.c", Start: token.Position{Line: 3, Column: 1}, End: token.Position{Line: 3, Column: 2}}}
+	r.Remap(d)
+	assert.Equal(t, "a.h:2:1", d.Range.String())
+}
+
+func TestProcessError(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{`#include "none.h"`, `a.c:1:1: error: none.h: file not found [include-not-found]`},
+		{`#include none.h`, `a.c:1:1: error: #include expects "FILENAME" or <FILENAME> [invalid-directive]`},
+		{`#include "a.c"`, `a.c:1:1: error: #include nested too deeply [invalid-directive]`},
+		{"#define F(x) x", `a.c:1:1: error: function-like macros are not supported [invalid-directive]`},
+		{"#define 1 2", `a.c:1:1: error: macro name must be an identifier [invalid-directive]`},
+		{"#pragma once", `a.c:1:1: error: invalid preprocessing directive #pragma [invalid-directive]`},
+		{"#endif", `a.c:1:1: error: #endif without #ifdef [invalid-directive]`},
+		{"#ifdef A\n#else\n#else\n#endif", `a.c:3:1: error: #else without #ifdef [invalid-directive]`},
+		{"1\n  #ifdef A", `a.c:2:3: error: unterminated conditional directive [invalid-directive]`},
+	}
+
+	for _, tt := range tests {
+		engine := diag.NewEngine()
+		Process("a.c", tt.input, Options{
+			ReadFile: files(map[string]string{"a.c": `#include "a.c"`}),
+		}, engine)
+		ds := []string{}
+		for _, d := range engine.Diagnostics() {
+			ds = append(ds, d.String())
+		}
+		// 入れ子が深すぎるときは、それぞれの段で報告しないように最初の1つだけを見る
+		assert.Equal(t, tt.expect, ds[0], tt.input)
+	}
+}
+
+func TestParseDefine(t *testing.T) {
+	name, value, err := ParseDefine("A=1+2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"A", "1+2"}, []string{name, value})
+
+	name, value, err = ParseDefine("DEBUG")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DEBUG", "1"}, []string{name, value})
+
+	_, _, err = ParseDefine("1A")
+	assert.Error(t, err)
+	assert.False(t, strings.Contains(err.Error(), "="))
+}
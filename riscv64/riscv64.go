@@ -0,0 +1,313 @@
+// RISC-V 64のコード生成
+// 中間表現を、GNUアセンブラの記法のRV64GCのアセンブリにする。呼び出し規約はLinuxのpsABI
+// レジスタ割り当てはせず、仮想レジスタはすべてスタック上の領域に置く。演算はt0とt1で行い、遠い領域のアドレスはt3で計算する
+// 32ビットの演算はwのついた命令で行う。truncした値は上位のビットが残っているので、比較と分岐の前に符号拡張しなおす
+
+package riscv64
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/kijimaD/gogo/ir"
+)
+
+// スタック上の領域1つの大きさ。ポインタも入るように8バイトにする
+const slotWidth = 8
+
+// 引数を渡すレジスタの数。a0からa7を使い、残りはスタックに置く
+const numArgRegs = 8
+
+// RV64のアセンブリを書き出す
+type Emitter struct {
+	w io.Writer
+}
+
+func NewEmitter(w io.Writer) *Emitter {
+	return &Emitter{w: w}
+}
+
+// モジュールをアセンブリにして、1行ずつ書き出す
+func (e *Emitter) EmitModule(m *ir.Module) error {
+	for _, line := range Compile(m) {
+		if _, err := fmt.Fprintln(e.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// モジュールをアセンブリの行にする。文字列は.dataに置き、llaでアドレスを取る
+func Compile(m *ir.Module) []string {
+	code := []string{}
+	if len(m.Data) > 0 {
+		code = append(code, "\t.data")
+		for _, d := range m.Data {
+			code = append(code, d.Name+":", fmt.Sprintf("\t.string \"%s\"", d.Value))
+		}
+	}
+	code = append(code, "\t.text")
+	for _, f := range m.Funcs {
+		code = append(code, emitFunc(f)...)
+	}
+	return code
+}
+
+// 関数のスタックフレーム。spからの位置はir.LayoutStackで決める
+// s0はraとs0を退避した領域の上を指すフレームポインタにして、retの前にspを戻すのに使う
+type frame struct {
+	*ir.StackLayout
+	f    *ir.Func
+	code []string
+}
+
+func newFrame(f *ir.Func) *frame {
+	return &frame{StackLayout: ir.LayoutStack(f, slotWidth, numArgRegs), f: f}
+}
+
+func (fr *frame) label(b *ir.Block) string {
+	return fmt.Sprintf(".L%s_%s", fr.f.Name, b.Name)
+}
+
+func (fr *frame) emit(format string, args ...interface{}) {
+	fr.code = append(fr.code, "\t"+fmt.Sprintf(format, args...))
+}
+
+func (fr *frame) emitLabel(name string) {
+	fr.code = append(fr.code, name+":")
+}
+
+// 12ビットの符号付き即値に収まるか
+func isImm12(v int) bool {
+	return -2048 <= v && v <= 2047
+}
+
+func emitFunc(f *ir.Func) []string {
+	fr := newFrame(f)
+	fr.code = append(fr.code, "\t.global "+f.Name)
+	fr.emitLabel(f.Name)
+	fr.emit("addi sp, sp, -16")
+	fr.emit("sd ra, 8(sp)")
+	fr.emit("sd s0, 0(sp)")
+	fr.emit("addi s0, sp, 16")
+	if fr.Size > 0 {
+		if isImm12(-fr.Size) {
+			fr.emit("addi sp, sp, %d", -fr.Size)
+		} else {
+			fr.emit("li t3, %d", fr.Size)
+			fr.emit("sub sp, sp, t3")
+		}
+	}
+	preds := f.Preds()
+	for i, b := range f.Blocks {
+		// 入口のブロックは関数のラベルで始まるので、戻ってくる分岐がなければ.Lのラベルは書かない
+		if i > 0 || len(preds[b]) > 0 {
+			fr.emitLabel(fr.label(b))
+		}
+		// 前のブロックがIncomingに書いた値を、phiの領域に移す
+		for _, phi := range b.Phis() {
+			fr.emit("ld t0, %s", fr.mem(fr.Incoming[phi.Dst]))
+			fr.emit("sd t0, %s", fr.mem(fr.Slots[phi.Dst]))
+		}
+		for _, instr := range b.Instrs {
+			fr.emitInstr(b, instr)
+		}
+	}
+	return fr.code
+}
+
+// spからoffの位置にあるメモリのオペランド
+// 即値に収まらないほど遠ければ、アドレスをt3に計算する
+func (fr *frame) mem(off int) string {
+	if isImm12(off) {
+		return fmt.Sprintf("%d(sp)", off)
+	}
+	fr.emit("li t3, %d", off)
+	fr.emit("add t3, sp, t3")
+	return "0(t3)"
+}
+
+// 値をレジスタに読み込む
+func (fr *frame) load(v ir.Value, r string) {
+	switch v := v.(type) {
+	case *ir.Const:
+		fr.emit("li %s, %d", r, v.Value)
+	case *ir.Global:
+		fr.emit("lla %s, %s", r, v.Name)
+	case *ir.Reg:
+		if off, ok := fr.Allocas[v]; ok {
+			if isImm12(off) {
+				fr.emit("addi %s, sp, %d", r, off)
+			} else {
+				fr.emit("li %s, %d", r, off)
+				fr.emit("add %s, sp, %s", r, r)
+			}
+			return
+		}
+		fr.emit("ld %s, %s", r, fr.mem(fr.Slots[v]))
+	default:
+		log.Fatal("invalid value:", v)
+	}
+}
+
+// レジスタの値を、仮想レジスタの領域に書き込む
+func (fr *frame) def(dst *ir.Reg, r string) {
+	fr.emit("sd %s, %s", r, fr.mem(fr.Slots[dst]))
+}
+
+// アドレスを表すオペランド。allocaした領域なら直接、それ以外はrを経由する
+func (fr *frame) addr(v ir.Value, r string) string {
+	if reg, ok := v.(*ir.Reg); ok {
+		if off, ok := fr.Allocas[reg]; ok {
+			return fr.mem(off)
+		}
+	}
+	fr.load(v, r)
+	return fmt.Sprintf("0(%s)", r)
+}
+
+// truncした値は上位のビットが残っているので、型の幅で符号拡張しなおす
+func (fr *frame) canon(r string, t ir.Type) {
+	switch t {
+	case ir.I8:
+		fr.emit("slli %s, %s, 56", r, r)
+		fr.emit("srai %s, %s, 56", r, r)
+	case ir.I32:
+		fr.emit("sext.w %s, %s", r, r)
+	}
+}
+
+// 32ビットの演算にはwのついた命令を使う
+var arith = map[ir.Op]string{
+	ir.OpAdd: "add",
+	ir.OpSub: "sub",
+	ir.OpMul: "mul",
+	ir.OpDiv: "div",
+}
+
+var loads = map[ir.Type]string{
+	ir.I8:  "lb",
+	ir.I32: "lw",
+	ir.Ptr: "ld",
+}
+
+var stores = map[ir.Type]string{
+	ir.I8:  "sb",
+	ir.I32: "sw",
+	ir.Ptr: "sd",
+}
+
+// 命令を出力する
+func (fr *frame) emitInstr(b *ir.Block, instr *ir.Instr) {
+	switch op := instr.Op; {
+	case op == ir.OpAlloca:
+		// 命令は出さない。アドレスはloadとaddrがspからの位置で作る
+	case op == ir.OpLoad:
+		src := fr.addr(instr.Args[0], "t1")
+		fr.emit("%s t0, %s", loads[instr.Type], src)
+		fr.def(instr.Dst, "t0")
+	case op == ir.OpStore:
+		fr.load(instr.Args[0], "t0")
+		dst := fr.addr(instr.Args[1], "t1")
+		fr.emit("%s t0, %s", stores[instr.Type], dst)
+	case op.IsCompare():
+		fr.load(instr.Args[0], "t0")
+		fr.load(instr.Args[1], "t1")
+		fr.canon("t0", instr.Type)
+		fr.canon("t1", instr.Type)
+		switch op {
+		case ir.OpEq:
+			fr.emit("sub t0, t0, t1")
+			fr.emit("seqz t0, t0")
+		case ir.OpNe:
+			fr.emit("sub t0, t0, t1")
+			fr.emit("snez t0, t0")
+		case ir.OpLt:
+			fr.emit("slt t0, t0, t1")
+		case ir.OpGt:
+			fr.emit("slt t0, t1, t0")
+		case ir.OpLe:
+			fr.emit("slt t0, t1, t0")
+			fr.emit("xori t0, t0, 1")
+		case ir.OpGe:
+			fr.emit("slt t0, t0, t1")
+			fr.emit("xori t0, t0, 1")
+		}
+		fr.def(instr.Dst, "t0")
+	case op.IsBinary():
+		fr.load(instr.Args[0], "t0")
+		fr.load(instr.Args[1], "t1")
+		name := arith[op]
+		if instr.Type != ir.Ptr {
+			name += "w"
+		}
+		fr.emit("%s t0, t0, t1", name)
+		fr.def(instr.Dst, "t0")
+	case op == ir.OpSext:
+		fr.load(instr.Args[0], "t0")
+		fr.canon("t0", instr.Type)
+		fr.def(instr.Dst, "t0")
+	case op == ir.OpTrunc, op == ir.OpCopy:
+		// 上位のビットは残したまま書く。wのつく演算とsb、swは下位だけを使い、比較と分岐とsextはcanonで符号拡張しなおす
+		fr.load(instr.Args[0], "t0")
+		fr.def(instr.Dst, "t0")
+	case op == ir.OpPhi:
+		// emitFuncがブロックの先頭でIncomingから移している
+	case op == ir.OpCall:
+		fr.emitCall(instr)
+	case op == ir.OpJmp:
+		fr.emitJump(b, instr.Targets[0])
+	case op == ir.OpBr:
+		fr.load(instr.Args[0], "t0")
+		fr.canon("t0", instr.Type)
+		els := fr.label(instr.Targets[1])
+		if len(instr.Targets[1].Phis()) > 0 {
+			// beqzの飛び先でphiの値を書いてから、jで進む
+			els = fr.label(b) + ".else"
+		}
+		fr.emit("beqz t0, %s", els)
+		fr.emitJump(b, instr.Targets[0])
+		if len(instr.Targets[1].Phis()) > 0 {
+			fr.emitLabel(els)
+			fr.emitJump(b, instr.Targets[1])
+		}
+	case op == ir.OpRet:
+		if len(instr.Args) > 0 {
+			fr.load(instr.Args[0], "a0")
+		}
+		fr.emit("addi sp, s0, -16")
+		fr.emit("ld ra, 8(sp)")
+		fr.emit("ld s0, 0(sp)")
+		fr.emit("addi sp, sp, 16")
+		fr.emit("ret")
+	default:
+		log.Fatal("invalid instruction:", instr)
+	}
+}
+
+// jでtoに進む。toのphiに入る値は、t0を通してIncomingの領域に書く
+func (fr *frame) emitJump(from *ir.Block, to *ir.Block) {
+	for _, m := range ir.PhiMoves(from, to) {
+		fr.load(m.Src, "t0")
+		fr.emit("sd t0, %s", fr.mem(fr.Incoming[m.Phi]))
+	}
+	fr.emit("j %s", fr.label(to))
+}
+
+// psABIの整数の呼び出し規約で呼ぶ。a0からa7に入らない引数は、8バイトずつspから並べる
+// printfのような可変長引数の関数でも、整数とポインタは名前のある引数と同じレジスタで渡す
+func (fr *frame) emitCall(instr *ir.Instr) {
+	for i := numArgRegs; i < len(instr.Args); i++ {
+		fr.load(instr.Args[i], "t0")
+		fr.emit("sd t0, %s", fr.mem((i-numArgRegs)*slotWidth))
+	}
+	// 作業にはtのレジスタしか使わないので、aのレジスタに順に読み込んでも先に入れた引数は壊れない
+	for i := 0; i < len(instr.Args) && i < numArgRegs; i++ {
+		fr.load(instr.Args[i], fmt.Sprintf("a%d", i))
+	}
+	fr.emit("call %s", instr.Callee)
+	if instr.Dst != nil {
+		fr.def(instr.Dst, "a0")
+	}
+}
@@ -0,0 +1,207 @@
+package riscv64
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/gogo/ir"
+	"github.com/kijimaD/gogo/ir/irtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func emit(t *testing.T, m *ir.Module) string {
+	t.Helper()
+	var buf bytes.Buffer
+	assert.NoError(t, NewEmitter(&buf).EmitModule(m))
+	return buf.String()
+}
+
+func TestEmitModule(t *testing.T) {
+	m, err := ir.Parse(`
+data @.s0 = "a"
+
+func @mymain() i32 {
+entry:
+	%1 = alloca i32
+	store i32 1, %1
+	%2 = load i32 %1
+	%3 = call i32 @printf(ptr @.s0, i32 %2)
+	%4 = add i32 %2, 70000
+	ret i32 %4
+}
+`)
+	assert.NoError(t, err)
+	expect := `	.data
+.s0:
+	.string "a"
+	.text
+	.global mymain
+mymain:
+	addi sp, sp, -16
+	sd ra, 8(sp)
+	sd s0, 0(sp)
+	addi s0, sp, 16
+	addi sp, sp, -32
+	li t0, 1
+	sw t0, 0(sp)
+	lw t0, 0(sp)
+	sd t0, 8(sp)
+	lla a0, .s0
+	ld a1, 8(sp)
+	call printf
+	sd a0, 16(sp)
+	ld t0, 8(sp)
+	li t1, 70000
+	addw t0, t0, t1
+	sd t0, 24(sp)
+	ld a0, 24(sp)
+	addi sp, s0, -16
+	ld ra, 8(sp)
+	ld s0, 0(sp)
+	addi sp, sp, 16
+	ret
+`
+	assert.Equal(t, expect, emit(t, m))
+}
+
+// phiの値は、飛んでくる前のブロックで別の領域に書いておく
+func TestEmitModulePhi(t *testing.T) {
+	m, err := ir.Parse(`
+func @mymain() i32 {
+entry:
+	br i32 1, a, b
+a:
+	jmp b
+b:
+	%1 = phi i32 [2, a], [3, entry]
+	ret i32 %1
+}
+`)
+	assert.NoError(t, err)
+	expect := `	.text
+	.global mymain
+mymain:
+	addi sp, sp, -16
+	sd ra, 8(sp)
+	sd s0, 0(sp)
+	addi s0, sp, 16
+	addi sp, sp, -16
+	li t0, 1
+	sext.w t0, t0
+	beqz t0, .Lmymain_entry.else
+	j .Lmymain_a
+.Lmymain_entry.else:
+	li t0, 3
+	sd t0, 8(sp)
+	j .Lmymain_b
+.Lmymain_a:
+	li t0, 2
+	sd t0, 8(sp)
+	j .Lmymain_b
+.Lmymain_b:
+	ld t0, 8(sp)
+	sd t0, 0(sp)
+	ld a0, 0(sp)
+	addi sp, s0, -16
+	ld ra, 8(sp)
+	ld s0, 0(sp)
+	addi sp, sp, 16
+	ret
+`
+	assert.Equal(t, expect, emit(t, m))
+}
+
+// 8個目より後ろの引数は、spの直上に置く
+func TestEmitModuleStackArgs(t *testing.T) {
+	code := emit(t, irtest.Load(t, "call", 0))
+	assert.Contains(t, code, "\tli t0, 0\n\tsd t0, 0(sp)\n\tli t0, 0\n\tsd t0, 8(sp)\n\tlla a0, .s0\n")
+	assert.Equal(t, 4, strings.Count(code, "\tcall "))
+}
+
+// RV64に特有の命令の選び方
+func TestEmitInstr(t *testing.T) {
+	tests := []struct {
+		instrs string
+		expect string
+	}{
+		// 32ビットの演算にはwのついた命令を使う。ポインタの演算は64ビットのまま
+		{"%1 = add i32 2147483647, 1", "\tli t0, 2147483647\n\tli t1, 1\n\taddw t0, t0, t1\n"},
+		{"%1 = div i32 7, 2", "\tdivw t0, t0, t1\n"},
+		{"%1 = add ptr @.s0, 1", "\tlla t0, .s0\n\tli t1, 1\n\tadd t0, t0, t1\n"},
+		// 比較の前に、型の幅で符号拡張しなおす。比較の命令はsltしかないので、ほかはxoriやseqzで作る
+		{"%1 = lt i32 1, 2", "\tsext.w t0, t0\n\tsext.w t1, t1\n\tslt t0, t0, t1\n"},
+		{"%1 = ge i32 1, 2", "\tslt t0, t0, t1\n\txori t0, t0, 1\n"},
+		{"%1 = eq i8 1, 2", "\tslli t0, t0, 56\n\tsrai t0, t0, 56\n\tslli t1, t1, 56\n\tsrai t1, t1, 56\n\tsub t0, t0, t1\n\tseqz t0, t0\n"},
+		// truncは上位のビットを残すので、分岐の前に符号拡張する
+		{"%1 = trunc i32 256 to i8\n\tbr i8 %1, a, a\na:", "\tld t0, 0(sp)\n\tslli t0, t0, 56\n\tsrai t0, t0, 56\n\tbeqz t0, .Lmymain_a\n"},
+		{"%1 = alloca i8\n\tstore i8 -56, %1\n\t%2 = load i8 %1", "\tli t0, -56\n\tsb t0, 0(sp)\n\tlb t0, 0(sp)\n"},
+	}
+	for _, tt := range tests {
+		m := irtest.Parse(t, "data @.s0 = \"a\"\nfunc @mymain() i32 {\nentry:\n\t"+tt.instrs+"\n\tret i32 0\n}\n", 0)
+		assert.Contains(t, emit(t, m), tt.expect, tt.instrs)
+	}
+}
+
+// 12ビットの即値に収まらない位置は、t3にアドレスを計算する
+func TestEmitModuleLargeFrame(t *testing.T) {
+	var src strings.Builder
+	src.WriteString("func @mymain() i32 {\nentry:\n")
+	for i := 1; i <= 300; i++ {
+		fmt.Fprintf(&src, "\t%%%d = add i32 %d, 1\n", i, i)
+	}
+	src.WriteString("\tret i32 %300\n}\n")
+	code := emit(t, irtest.Parse(t, src.String(), 0))
+	assert.Contains(t, code, "\tli t3, 2400\n\tsub sp, sp, t3\n")
+	assert.Contains(t, code, "\tsd t0, 2040(sp)\n")
+	assert.Contains(t, code, "\tli t3, 2048\n\tadd t3, sp, t3\n\tsd t0, 0(t3)\n")
+}
+
+// クロスアセンブラがあれば、アセンブルできることを確かめる
+func TestEmitModuleAssemble(t *testing.T) {
+	var args []string
+	if path, err := exec.LookPath("riscv64-linux-gnu-as"); err == nil {
+		args = []string{path}
+	} else if path, err := exec.LookPath("llvm-mc"); err == nil {
+		args = []string{path, "-triple=riscv64-linux-gnu", "-mattr=+m,+a,+f,+d,+c", "-filetype=obj"}
+	} else {
+		t.Skip("assembler for riscv64 is not found")
+	}
+
+	dir := t.TempDir()
+	for _, name := range irtest.Programs {
+		for level := 0; level <= 2; level++ {
+			s := filepath.Join(dir, "a.s")
+			assert.NoError(t, os.WriteFile(s, []byte(emit(t, irtest.Load(t, name, level))), 0o644))
+			out, err := exec.Command(args[0], append(args[1:], "-o", filepath.Join(dir, "a.o"), s)...).CombinedOutput()
+			assert.NoError(t, err, string(out))
+		}
+	}
+}
+
+// クロスコンパイラとqemuがあれば、実行して結果を確かめる
+func TestEmitModuleRun(t *testing.T) {
+	for _, tool := range []string{"riscv64-linux-gnu-gcc", "qemu-riscv64"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not found", tool)
+		}
+	}
+
+	dir := t.TempDir()
+	for _, name := range irtest.Programs {
+		for level := 0; level <= 2; level++ {
+			s := filepath.Join(dir, "a.s")
+			exe := filepath.Join(dir, "a")
+			assert.NoError(t, os.WriteFile(s, []byte(emit(t, irtest.Load(t, name, level))), 0o644))
+			out, err := exec.Command("riscv64-linux-gnu-gcc", "-static", "-o", exe, s, "../c/driver.c").CombinedOutput()
+			assert.NoError(t, err, string(out))
+			out, err = exec.Command("qemu-riscv64", exe).Output()
+			assert.NoError(t, err)
+			assert.Equal(t, irtest.Output(t, name), string(out), "%s -O%d", name, level)
+		}
+	}
+}
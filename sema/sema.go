@@ -0,0 +1,326 @@
+// 意味解析
+// 構文解析が終わったASTをたどって、識別子を変数や関数に結びつけ、式の型を計算する
+// 型が異なるオペランドには暗黙の型変換(ast.ConvExpression)を挿入する。定数式は計算した値をInfoに記録し、ASTは書き換えない
+
+package sema
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/constant"
+	"github.com/kijimaD/gogo/diag"
+	"github.com/kijimaD/gogo/object"
+	"github.com/kijimaD/gogo/token"
+)
+
+// 意味解析の結果
+type Info struct {
+	Env  *object.Environment        // スタックに置く変数
+	Defs map[*ast.Var]object.Object // 宣言した識別子と、それが表すもの
+	Uses map[*ast.Var]object.Object // 参照した識別子と、それが指すもの
+
+	Consts map[*ast.InfixExpression]constant.Value // 畳み込んだ定数式と、その値
+}
+
+// 定数ならその値。リテラルと、畳み込んだ定数式と、それらの型変換が定数になる
+func (info *Info) Value(e ast.Expression) (constant.Value, bool) {
+	switch n := e.(type) {
+	case *ast.ConvExpression:
+		v, ok := info.Value(n.Expression)
+		return constant.Convert(v, n.Ctype), ok
+	case *ast.InfixExpression:
+		v, ok := info.Consts[n]
+		return v, ok
+	default:
+		return constant.Literal(e)
+	}
+}
+
+type checker struct {
+	file  string
+	diags *diag.Engine
+	info  *Info
+	decls map[string]*ast.DeclStatement // プログラム中のすべての宣言。宣言より前での参照を報告するのに使う
+}
+
+// プログラムを検査する。エラーはdiagsに報告する
+// 変数のスタック上の位置と式の型は、ASTのノードにも書き込む
+func Check(file string, prog *ast.Program, diags *diag.Engine) *Info {
+	c := &checker{
+		file:  file,
+		diags: diags,
+		info: &Info{
+			Env:  object.NewEnvironment(),
+			Defs: map[*ast.Var]object.Object{},
+			Uses: map[*ast.Var]object.Object{},
+
+			Consts: map[*ast.InfixExpression]constant.Value{},
+		},
+		decls: map[string]*ast.DeclStatement{},
+	}
+
+	// 1. 宣言を集める
+	for _, stmt := range prog.Statements {
+		if decl, ok := stmt.(*ast.DeclStatement); ok && decl.Name != nil {
+			if _, exists := c.decls[decl.Name.Token.Literal]; !exists {
+				c.decls[decl.Name.Token.Literal] = decl
+			}
+		}
+	}
+
+	// 2. 先頭から順に検査する
+	for _, stmt := range prog.Statements {
+		c.stmt(stmt)
+	}
+
+	return c.info
+}
+
+func (c *checker) nodeRange(n ast.Node) diag.Range {
+	return diag.Range{File: c.file, Start: n.Start(), End: n.End()}
+}
+
+func (c *checker) stmt(stmt ast.Statement) {
+	switch s := stmt.(type) {
+	case *ast.ExpressionStatement:
+		s.Expression = c.expr(s.Expression)
+	case *ast.DeclStatement:
+		c.decl(s)
+	case *ast.BadStmt:
+	default:
+		panic(fmt.Sprintf("sema: unexpected statement %T", s))
+	}
+}
+
+// int a = 1
+func (c *checker) decl(ds *ast.DeclStatement) {
+	// 初期値は宣言する変数より先に評価する
+	ds.Value = c.expr(ds.Value)
+	if ds.Name == nil {
+		return
+	}
+
+	name := ds.Name.Token.Literal
+	if prev, ok := c.info.Env.Get(name); ok {
+		d := c.diags.Errorf(diag.Redefinition, c.nodeRange(ds.Name), "redefinition of %s", name)
+		for v, obj := range c.info.Defs {
+			if obj == prev {
+				d.AddNote(c.nodeRange(v), "previous definition is here")
+			}
+		}
+		return
+	}
+
+	if ds.Value != nil && !isBad(ds.Value) {
+		if !assignable(ds.Ctype, ds.Value.GetCtype()) {
+			c.diags.Errorf(diag.IncompatibleInit, c.nodeRange(ds.Value), "cannot initialize %s %s with a value of type %s", ds.Ctype, name, ds.Value.GetCtype()).
+				AddNote(c.nodeRange(ds.Name), "%s is declared here", name)
+		} else {
+			ds.Value = convert(ds.Value, ds.Ctype)
+		}
+	}
+
+	pos := c.info.Env.VarPos
+	obj := c.newObject(ds.Ctype, ds.Value, pos)
+	c.info.Env.Set(name, obj)
+	c.info.Defs[ds.Name] = obj
+	ds.Pos = pos
+	ds.Name.Pos = pos
+	ds.Name.Ctype = ds.Ctype
+}
+
+// 変数の型に対応するオブジェクトを作る。初期値が定数ならその値を持たせる
+func (c *checker) newObject(ctype token.Ctype, value ast.Expression, pos int) object.Object {
+	v, _ := c.info.Value(value)
+
+	switch ctype {
+	case token.CTYPE_STR:
+		s := ""
+		if lit, ok := value.(*ast.StringLiteral); ok {
+			s = lit.Value
+		}
+		return &object.String{Value: s, Pos: pos}
+	case token.CTYPE_CHAR:
+		return &object.Char{Value: v.Int, Pos: pos}
+	default:
+		return &object.Integer{Value: v.Int, Pos: pos}
+	}
+}
+
+// 式を検査して、型変換を挿入した式を返す
+func (c *checker) expr(e ast.Expression) ast.Expression {
+	switch n := e.(type) {
+	case nil:
+		return nil
+	case *ast.IntegerLiteral, *ast.CharLiteral, *ast.BadExpr:
+	case *ast.StringLiteral:
+		if _, err := constant.Unquote(n.Value); err != nil {
+			c.diags.Errorf(diag.InvalidEscape, c.nodeRange(n), "%s", err.Error())
+		}
+	case *ast.Var:
+		c.ident(n)
+	case *ast.InfixExpression:
+		c.infix(n)
+		c.fold(n)
+	case *ast.FuncallExpression:
+		c.funcall(n)
+	case *ast.ConvExpression:
+		n.Expression = c.expr(n.Expression)
+	default:
+		panic(fmt.Sprintf("sema: unexpected expression %T", n))
+	}
+	return e
+}
+
+// 識別子を宣言済みの変数に結びつける
+func (c *checker) ident(v *ast.Var) {
+	name := v.Token.Literal
+	obj, ok := c.info.Env.Get(name)
+	if !ok {
+		d := c.diags.Errorf(diag.UndeclaredVariable, c.nodeRange(v), "not exist variable: %s", name)
+		if decl, later := c.decls[name]; later {
+			d.AddNote(c.nodeRange(decl.Name), "%s is declared after its use", name)
+		}
+		return
+	}
+	c.info.Uses[v] = obj
+	v.Pos = obj.CurPos()
+	v.Ctype = obj.GetCtype()
+}
+
+func (c *checker) infix(ie *ast.InfixExpression) {
+	ie.Left = c.expr(ie.Left)
+	ie.Right = c.expr(ie.Right)
+
+	// 読めなかったオペランドの型エラーは、元のエラーと重複するので報告しない
+	if isBad(ie.Left) || isBad(ie.Right) {
+		return
+	}
+
+	ctype, err := resultType(ie.Operator, ie.Left, ie.Right)
+	if err != nil {
+		d := c.diags.Errorf(diag.IncompatibleOperands, diag.TokenRange(c.file, ie.Token), "%s", err.Error())
+		for _, operand := range []ast.Expression{ie.Left, ie.Right} {
+			if operand != nil {
+				d.AddNote(c.nodeRange(operand), "operand has type %s", operand.GetCtype())
+			}
+		}
+		return
+	}
+	ie.Ctype = ctype
+	ie.Left = convert(ie.Left, ctype)
+	ie.Right = convert(ie.Right, ctype)
+}
+
+// 定数式を計算して、値をInfoに記録する
+// オペランドは先に計算してあるので、ここで報告するのはこの演算の診断だけになる
+func (c *checker) fold(ie *ast.InfixExpression) {
+	if ie.Ctype != token.CTYPE_INT {
+		return
+	}
+	x, okx := c.info.Value(ie.Left)
+	y, oky := c.info.Value(ie.Right)
+	// 0での除算は、左辺が定数でなくても報告する
+	if ie.Operator == token.SLASH && oky && y.Int == 0 {
+		c.diags.Warningf(diag.DivisionByZero, c.nodeRange(ie), "division by zero is undefined").
+			AddNote(c.nodeRange(ie.Right), "divisor is 0")
+		return
+	}
+	if !okx || !oky {
+		return
+	}
+
+	v, err := constant.BinaryOp(ie.Operator, x, y)
+	var overflow *constant.OverflowError
+	switch {
+	case errors.As(err, &overflow):
+		c.diags.Warningf(diag.IntegerOverflow, c.nodeRange(ie), "%s", err.Error())
+	case err != nil:
+		return
+	}
+	c.info.Consts[ie] = v
+}
+
+// 関数は宣言がないので、呼び出した名前をそのまま関数として扱う
+func (c *checker) funcall(fe *ast.FuncallExpression) {
+	if v, ok := fe.Function.(*ast.Var); ok {
+		obj := &object.Function{Name: v.Token.Literal}
+		c.info.Uses[v] = obj
+		v.Ctype = obj.GetCtype()
+	} else {
+		fe.Function = c.expr(fe.Function)
+	}
+
+	for i, a := range fe.Args {
+		a = c.expr(a)
+		// 既定の実引数拡張。charはintにして渡す
+		if a != nil && a.GetCtype() == token.CTYPE_CHAR {
+			a = convert(a, token.CTYPE_INT)
+		}
+		fe.Args[i] = a
+	}
+}
+
+// 型が違えば暗黙の型変換を挿入する
+func convert(e ast.Expression, ctype token.Ctype) ast.Expression {
+	if e == nil || e.GetCtype() == ctype {
+		return e
+	}
+	return &ast.ConvExpression{Expression: e, Ctype: ctype}
+}
+
+// 代入できるか。整数どうしは変換できるが、文字列は文字列にしか代入できない
+func assignable(to token.Ctype, from token.Ctype) bool {
+	if to == token.CTYPE_STR || from == token.CTYPE_STR {
+		return to == from
+	}
+	return to != token.CTYPE_VOID && from != token.CTYPE_VOID
+}
+
+func isBad(e ast.Expression) bool {
+	_, ok := e.(*ast.BadExpr)
+	return ok
+}
+
+// 二項演算の結果の型。charどうしの演算もintになる
+func resultType(op string, a ast.Expression, b ast.Expression) (token.Ctype, error) {
+	if a == nil || b == nil {
+		return token.CTYPE_VOID, fmt.Errorf("incompatible operands for %s", op)
+	}
+
+	small := a
+	big := b
+	incompatibleErr := fmt.Errorf("incompatible operands: %s and %s for %s", a.GetCtype(), b.GetCtype(), op)
+
+	if a.GetCtype() > b.GetCtype() {
+		small = b
+		big = a
+	}
+
+	switch small.GetCtype() {
+	case token.CTYPE_VOID:
+		return token.CTYPE_VOID, incompatibleErr
+	case token.CTYPE_INT:
+		switch big.GetCtype() {
+		case token.CTYPE_INT:
+			return token.CTYPE_INT, nil
+		case token.CTYPE_CHAR:
+			return token.CTYPE_INT, nil
+		case token.CTYPE_STR:
+			return token.CTYPE_VOID, incompatibleErr
+		}
+	case token.CTYPE_CHAR:
+		switch big.GetCtype() {
+		case token.CTYPE_CHAR:
+			return token.CTYPE_INT, nil
+		case token.CTYPE_STR:
+			return token.CTYPE_VOID, incompatibleErr
+		}
+	case token.CTYPE_STR:
+		return token.CTYPE_VOID, incompatibleErr
+	}
+
+	return token.CTYPE_VOID, incompatibleErr
+}
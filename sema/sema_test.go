@@ -0,0 +1,213 @@
+package sema
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kijimaD/gogo/ast"
+	"github.com/kijimaD/gogo/diag"
+	"github.com/kijimaD/gogo/lexer"
+	"github.com/kijimaD/gogo/parser"
+	"github.com/kijimaD/gogo/token"
+	"github.com/stretchr/testify/assert"
+)
+
+func check(t *testing.T, input string) (*ast.Program, *Info, *diag.Engine) {
+	t.Helper()
+	p := parser.New(lexer.NewFile("a.c", input))
+	prog := p.ParseProgram()
+	assert.Empty(t, p.Errors())
+
+	engine := diag.NewEngine()
+	info := Check("a.c", prog, engine)
+	return prog, info, engine
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		input string
+	}{
+		{`int a = 1; a + 1;`},
+		{`char a = 'a'; a + 1;`},
+		{`int a = 'a'; char b = 1; a + b`},
+		{`string s = "s"; printf("%s", s)`},
+		{`sum2(1, 'a')`},
+	}
+
+	for _, tt := range tests {
+		_, _, engine := check(t, tt.input)
+		assert.Empty(t, engine.Diagnostics(), tt.input)
+	}
+}
+
+func TestCheckError(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		expect []string
+	}{
+		{
+			name:  "型エラーには各オペランドの型が補足される",
+			input: `1 + "a"`,
+			expect: []string{
+				`a.c:1:3: error: incompatible operands: int and string for + [incompatible-operands]`,
+				`a.c:1:1: note: operand has type int`,
+				`a.c:1:5: note: operand has type string`,
+			},
+		},
+		{
+			name:  "未定義の変数",
+			input: `a`,
+			expect: []string{
+				`a.c:1:1: error: not exist variable: a [undeclared-variable]`,
+			},
+		},
+		{
+			name:  "宣言より前での参照",
+			input: `a; int a = 1`,
+			expect: []string{
+				`a.c:1:1: error: not exist variable: a [undeclared-variable]`,
+				`a.c:1:8: note: a is declared after its use`,
+			},
+		},
+		{
+			name:  "再定義",
+			input: `int a = 1; int a = 2`,
+			expect: []string{
+				`a.c:1:16: error: redefinition of a [redefinition]`,
+				`a.c:1:5: note: previous definition is here`,
+			},
+		},
+		{
+			name:  "型の合わない初期値",
+			input: `int a = "s"`,
+			expect: []string{
+				`a.c:1:9: error: cannot initialize int a with a value of type string [incompatible-init]`,
+				`a.c:1:5: note: a is declared here`,
+			},
+		},
+		{
+			name:  "定数の0で割る",
+			input: `int a = 1; a / 0`,
+			expect: []string{
+				`a.c:1:12: warning: division by zero is undefined [division-by-zero]`,
+				`a.c:1:16: note: divisor is 0`,
+			},
+		},
+		{
+			name:  "定数式のオーバーフロー",
+			input: `2147483647 + 1`,
+			expect: []string{
+				`a.c:1:1: warning: overflow in expression 2147483647 + 1; result is -2147483648 with type int [integer-overflow]`,
+			},
+		},
+		{
+			name:  "解釈できないエスケープシーケンス",
+			input: `string s = "\777"; printf("a\x")`,
+			expect: []string{
+				`a.c:1:12: error: octal escape sequence \777 out of range [invalid-escape]`,
+				`a.c:1:27: error: \x used with no following hex digits [invalid-escape]`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, engine := check(t, tt.input)
+
+			var buf strings.Builder
+			assert.NoError(t, diag.WriteText(&buf, engine.Diagnostics()))
+			assert.Equal(t, strings.Join(tt.expect, "\n")+"\n", buf.String())
+		})
+	}
+}
+
+// 識別子が変数に結びつき、スタック上の位置と型が決まる
+func TestCheckBind(t *testing.T) {
+	prog, info, _ := check(t, `int a = 1; char b = 'x'; a + b; f(a)`)
+
+	assert.Equal(t, []string{"a", "b"}, info.Env.Names())
+
+	uses := map[string]*ast.Var{}
+	ast.Inspect(prog, func(n ast.Node) bool {
+		if v, ok := n.(*ast.Var); ok {
+			if _, ok := info.Uses[v]; ok {
+				uses[v.Token.Literal] = v
+			}
+		}
+		return true
+	})
+
+	a, _ := info.Env.Get("a")
+	b, _ := info.Env.Get("b")
+	assert.Equal(t, a, info.Uses[uses["a"]])
+	assert.Equal(t, b, info.Uses[uses["b"]])
+	assert.Equal(t, 1, uses["a"].Pos)
+	assert.Equal(t, 2, uses["b"].Pos)
+	assert.Equal(t, token.CTYPE_CHAR, uses["b"].Ctype)
+	assert.Equal(t, "FUNCTION", string(info.Uses[uses["f"]].Type()))
+}
+
+// オペランドの型が違えば暗黙の型変換が挿入される
+func TestCheckConversion(t *testing.T) {
+	prog, _, _ := check(t, `char c = 1; c + 2; f(c)`)
+
+	decl := prog.Statements[0].(*ast.DeclStatement)
+	conv, ok := decl.Value.(*ast.ConvExpression)
+	assert.True(t, ok)
+	assert.Equal(t, token.CTYPE_CHAR, conv.Ctype)
+
+	infix := prog.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.InfixExpression)
+	assert.Equal(t, token.CTYPE_INT, infix.Ctype)
+	left, ok := infix.Left.(*ast.ConvExpression)
+	assert.True(t, ok)
+	assert.Equal(t, token.CTYPE_INT, left.Ctype)
+	_, ok = infix.Right.(*ast.IntegerLiteral)
+	assert.True(t, ok)
+
+	call := prog.Statements[2].(*ast.ExpressionStatement).Expression.(*ast.FuncallExpression)
+	_, ok = call.Args[0].(*ast.ConvExpression)
+	assert.True(t, ok)
+
+	// 型変換はソースコードの表示には現れない
+	assert.Equal(t, `(char c = 1)(c + 2)f(c)`, prog.String())
+}
+
+// 定数式は計算した値をInfoに記録する
+func TestCheckFold(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect string // 最後の文の式の値。定数でなければ空
+	}{
+		{`1 + 2 * 3`, `7 (int)`},
+		{`'a' + 1`, `98 (int)`},
+		{`1 - 7 / 2`, `-2 (int)`},
+		{`2147483647 + 1`, `-2147483648 (int)`},
+		{`int a = 1; a + 2 * 3`, ``},
+		{`1 / 0`, ``},
+		{`f(1 + 1)`, ``},
+	}
+
+	for _, tt := range tests {
+		prog, info, _ := check(t, tt.input)
+		stmt := prog.Statements[len(prog.Statements)-1].(*ast.ExpressionStatement)
+		actual := ""
+		if v, ok := info.Value(stmt.Expression); ok {
+			actual = v.String()
+		}
+		assert.Equal(t, tt.expect, actual, tt.input)
+	}
+
+	// ASTは書き換えないので、ダンプやJSONには書かれたとおりの式が出る
+	prog, info, _ := check(t, `int a = 1 + 2; char c = 200 + 100; f(1 + 1)`)
+	assert.Equal(t, `(int a = (1 + 2))(char c = (200 + 100))f((1 + 1))`, prog.String())
+	call := prog.Statements[2].(*ast.ExpressionStatement).Expression.(*ast.FuncallExpression)
+	v, ok := info.Value(call.Args[0])
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), v.Int)
+	// 初期値が定数なら、変数はその値を持つ。charには切り詰めた値が入る
+	a, _ := info.Env.Get("a")
+	assert.Equal(t, "3", a.Inspect())
+	c, _ := info.Env.Get("c")
+	assert.Equal(t, "44", c.Inspect())
+}
@@ -2,8 +2,10 @@
 
 # C言語では、main関数が返した値がプログラム全体としての終了コードになる。終了コードはシェルの$?変数に格納されているので、確認できる。
 
+# GOGOFLAGS=-O2 ./test.sh のように、コンパイラに渡すフラグを指定できる
+
 function compile {
-    echo "$1" | go run . > gogo.s
+    echo "$1" | go run ./cmd/gogo $GOGOFLAGS > gogo.s
     if [ $? -ne 0 ]; then
         echo "Failed to compile $1"
         exit -1
@@ -31,7 +33,7 @@ function test {
 
 function testfail {
   expr="$1"
-  echo "$expr" | go run . > /dev/null 2>&1
+  echo "$expr" | go run ./cmd/gogo > /dev/null 2>&1
   if [ $? -eq 0 ]; then
     echo "Should fail to compile, but succeded: $expr"
     exit -1
@@ -68,14 +70,22 @@ test 4 'int a = 1+1; a+2'
 test 1 'int a = 1;a'
 test 2 'int a = 1;a+1'
 test 97 "char a = 'a';a"
-# test 98 "char a = 'a';a+1" # => なぜか2になる
-# test 3 'int a = 1;a+2' # => なぜか4になる
-# test 4 'int a = 1;a+3' # => なぜか6になる
+test 98 "char a = 'a';a+1"
+test 3 'int a = 1;a+2'
+test 4 'int a = 1;a+3'
+test 7 'int a = 1; int b = 2; b*3+a'
+test 2 "char c = 'b'; c - 'a' + 1"
+test -2 '1-3'
+test -2 '0-5/2'
+test 44 'char c = 200 + 100; c'
+test -2147483648 '2147483647 + 1'
 
 # Function call
 test 25 'sum2(20, 5);'
 test 24 'sum2(20-1, 5);'
 test 15 'sum5(1, 2, 3, 4, 5);'
+test 5 'int a = 2; sum2(a, 3)'
+test x2 'string s = "x"; printf("%s", s); 2'
 # FIXME: printf単独だと1がくっつくのはなぜ? そして後続の式でその数字が上書きされるのはなぜ
 test a1 'printf("%s", "a");'
 test a99 'printf("%s", "a");99;'
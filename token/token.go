@@ -1,12 +1,28 @@
 package token
 
+import "fmt"
+
 type TokenType string
 
 type Token struct {
-	Type    TokenType
-	Literal string
+	Type    TokenType `json:"type"`
+	Literal string    `json:"literal"`
+	Pos     Position  `json:"pos"` // トークンの開始位置
+	End     Position  `json:"end"` // トークンの直後の位置
+}
+
+func (t Token) String() string {
+	return fmt.Sprintf("%s(%q)", t.Type, t.Literal)
 }
 
+// ソースコード上の位置。行と列は1から数える
+type Position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (p Position) IsValid() bool { return p.Line > 0 }
+
 const (
 	ILLEGAL = "ILLEGAL"
 	EOF     = "EOF"
@@ -26,6 +42,8 @@ const (
 	COMMA     = ","
 	LPAREN    = "("
 	RPAREN    = ")"
+	LBRACE    = "{"
+	RBRACE    = "}"
 )
 
 type Ctype int
@@ -36,3 +54,32 @@ const (
 	CTYPE_CHAR
 	CTYPE_STR
 )
+
+func (c Ctype) String() string {
+	switch c {
+	case CTYPE_VOID:
+		return "void"
+	case CTYPE_INT:
+		return "int"
+	case CTYPE_CHAR:
+		return "char"
+	case CTYPE_STR:
+		return "string"
+	default:
+		return "unknown"
+	}
+}
+
+func (c Ctype) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Ctype) UnmarshalText(b []byte) error {
+	for _, t := range []Ctype{CTYPE_VOID, CTYPE_INT, CTYPE_CHAR, CTYPE_STR} {
+		if t.String() == string(b) {
+			*c = t
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown ctype: %s", b)
+}
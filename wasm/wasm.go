@@ -0,0 +1,470 @@
+// WebAssemblyのコード生成
+// 中間表現を、WebAssemblyのテキスト形式(WAT)のモジュールにする。ポインタは32ビット
+// 仮想レジスタと、アドレスを取られない変数はWebAssemblyのローカル変数に置く
+// アドレスを取られる変数は、線形メモリの上の方から下に伸びるスタックに置く。スタックの先頭は$spで指す
+// 呼び出す関数はすべてホストからenvとしてインポートする。printfのような可変長引数の関数も呼べるように、引数の数ごとに別の関数としてインポートする
+//
+// WebAssemblyには任意の場所へのジャンプがないので、基本ブロックは支配木をもとにblock、loop、ifの入れ子にする
+// 方法はRamseyの"Beyond Relooper"による。支配木の子のうち、前向きの辺が2本以上入ってくるブロックは、
+// 親のコードを囲むblockの後ろに置き、brでblockを抜けて進む。後ろ向きの辺が入ってくるブロックはloopで囲み、brで先頭に戻る
+// それ以外の子は、飛ぶ元の分岐の中にそのまま書く。既約でない制御フローは表せないのでエラーにする
+
+package wasm
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kijimaD/gogo/ir"
+	"github.com/kijimaD/gogo/opt"
+)
+
+// 文字列のデータを置き始めるアドレス。0はヌルポインタとして空けておく
+const dataStart = 1024
+
+// 線形メモリの1ページの大きさ
+const pageSize = 65536
+
+// スタック上の領域1つの大きさ
+const slotWidth = 8
+
+// WATのモジュールを書き出す
+type Emitter struct {
+	w io.Writer
+}
+
+func NewEmitter(w io.Writer) *Emitter {
+	return &Emitter{w: w}
+}
+
+// 中間表現のモジュール全体を出力する
+func (e *Emitter) EmitModule(m *ir.Module) error {
+	code, err := Compile(m)
+	if err != nil {
+		return err
+	}
+	for _, line := range code {
+		if _, err := fmt.Fprintln(e.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// インポートする関数。引数の数ごとに別の関数にする
+type host struct {
+	name   string
+	params int
+	result bool
+}
+
+func (h host) id() string {
+	return fmt.Sprintf("$%s/%d", h.name, h.params)
+}
+
+// 中間表現のモジュール全体をWATの行の列にする
+func Compile(m *ir.Module) ([]string, error) {
+	// 文字列はヌル終端にして、dataStartから順に置く
+	addrs := map[string]int{}
+	addr := dataStart
+	data := []string{}
+	for _, d := range m.Data {
+		b, err := d.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, 0)
+		addrs[d.Name] = addr
+		data = append(data, fmt.Sprintf("  (data (i32.const %d) \"%s\")", addr, escape(b)))
+		addr += len(b)
+	}
+	// データのページの上に、スタックのページを1つ置く
+	pages := 1 + (addr+pageSize-1)/pageSize
+
+	hosts := map[host]bool{}
+	for _, f := range m.Funcs {
+		for _, b := range f.Blocks {
+			for _, instr := range b.Instrs {
+				if instr.Op == ir.OpCall {
+					hosts[host{name: instr.Callee, params: len(instr.Args), result: instr.Dst != nil}] = true
+				}
+			}
+		}
+	}
+	imports := make([]host, 0, len(hosts))
+	for h := range hosts {
+		imports = append(imports, h)
+	}
+	sort.Slice(imports, func(i, j int) bool {
+		if imports[i].name != imports[j].name {
+			return imports[i].name < imports[j].name
+		}
+		return imports[i].params < imports[j].params
+	})
+
+	code := []string{"(module"}
+	for _, h := range imports {
+		sig := strings.Repeat(" i32", h.params)
+		if sig != "" {
+			sig = " (param" + sig + ")"
+		}
+		if h.result {
+			sig += " (result i32)"
+		}
+		code = append(code, fmt.Sprintf("  (import \"env\" %q (func %s%s))", h.name, h.id(), sig))
+	}
+	code = append(code, fmt.Sprintf("  (memory (export \"memory\") %d)", pages))
+	code = append(code, fmt.Sprintf("  (global $sp (mut i32) (i32.const %d))", pages*pageSize))
+	code = append(code, data...)
+	for _, f := range m.Funcs {
+		fcode, err := emitFunc(f, addrs)
+		if err != nil {
+			return nil, err
+		}
+		code = append(code, fcode...)
+	}
+	code = append(code, ")")
+	return code, nil
+}
+
+// 関数のスタックフレームとローカル変数
+type frame struct {
+	f       *ir.Func
+	addrs   map[string]int  // 文字列のアドレス
+	allocas map[*ir.Reg]int // 線形メモリに置く変数の、$fpからのオフセット
+	vars    map[*ir.Reg]bool
+	size    int
+	code    []string
+
+	dom     *opt.DomTree
+	rpo     map[*ir.Block]int  // 逆後順での番号
+	headers map[*ir.Block]bool // 後ろ向きの辺が入ってくるブロック。loopで囲む
+	merges  map[*ir.Block]bool // 前向きの辺が2本以上入ってくるブロック。blockの後ろに置く
+}
+
+// アドレスを取られる変数か。loadとstoreのアドレスとしてだけ使われるなら、ローカル変数にできる
+func escapes(f *ir.Func, r *ir.Reg) bool {
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			for i, a := range instr.Args {
+				if a != ir.Value(r) {
+					continue
+				}
+				if instr.Op == ir.OpLoad || (instr.Op == ir.OpStore && i == 1) {
+					continue
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newFrame(f *ir.Func, addrs map[string]int) *frame {
+	fr := &frame{f: f, addrs: addrs, allocas: map[*ir.Reg]int{}, vars: map[*ir.Reg]bool{}}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if instr.Op != ir.OpAlloca {
+				continue
+			}
+			if escapes(f, instr.Dst) {
+				fr.allocas[instr.Dst] = fr.size
+				fr.size += slotWidth
+			} else {
+				fr.vars[instr.Dst] = true
+			}
+		}
+	}
+	// スタックは16バイト境界にそろえる
+	fr.size = (fr.size + 15) / 16 * 16
+	return fr
+}
+
+func (fr *frame) emit(format string, args ...interface{}) {
+	fr.code = append(fr.code, "    "+fmt.Sprintf(format, args...))
+}
+
+func local(r *ir.Reg) string {
+	return "$r" + strconv.Itoa(r.ID)
+}
+
+// 抜けるとbに進むblockのラベル
+func (fr *frame) label(b *ir.Block) string {
+	return "$bb_" + b.Name
+}
+
+// bを先頭とするloopのラベル
+func (fr *frame) loopLabel(b *ir.Block) string {
+	return "$loop_" + b.Name
+}
+
+// 逆後順で、辺の向きとブロックの種類を調べる。後ろ向きの辺の行き先が元を支配しなければ、既約でない
+func (fr *frame) analyze() error {
+	fr.dom = opt.Dominators(fr.f)
+	fr.rpo = map[*ir.Block]int{}
+	fr.headers = map[*ir.Block]bool{}
+	fr.merges = map[*ir.Block]bool{}
+	for i, b := range fr.dom.Order() {
+		fr.rpo[b] = i
+	}
+	forward := map[*ir.Block]int{}
+	for _, b := range fr.dom.Order() {
+		for _, s := range b.Succs() {
+			if fr.rpo[s] > fr.rpo[b] {
+				forward[s]++
+				continue
+			}
+			if !fr.dom.Dominates(s, b) {
+				return fmt.Errorf("@%s: irreducible control flow from %s to %s", fr.f.Name, b.Name, s.Name)
+			}
+			fr.headers[s] = true
+		}
+	}
+	for b, n := range forward {
+		if n >= 2 {
+			fr.merges[b] = true
+		}
+	}
+	return nil
+}
+
+func emitFunc(f *ir.Func, addrs map[string]int) ([]string, error) {
+	fr := newFrame(f, addrs)
+	if err := fr.analyze(); err != nil {
+		return nil, err
+	}
+	result := ""
+	if f.Ret != ir.Void {
+		result = " (result i32)"
+	}
+	code := []string{fmt.Sprintf("  (func $%s (export %q)%s", f.Name, f.Name, result)}
+	locals := []string{}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if _, ok := fr.allocas[instr.Dst]; instr.Dst != nil && !ok {
+				locals = append(locals, local(instr.Dst))
+			}
+		}
+	}
+	for _, name := range locals {
+		code = append(code, fmt.Sprintf("    (local %s i32)", name))
+	}
+	if fr.size > 0 {
+		code = append(code, "    (local $fp i32)")
+	}
+
+	if fr.size > 0 {
+		fr.emit("global.get $sp")
+		fr.emit("i32.const %d", fr.size)
+		fr.emit("i32.sub")
+		fr.emit("local.tee $fp")
+		fr.emit("global.set $sp")
+	}
+	fr.emitTree(f.Blocks[0])
+	// loopやblockの後ろは検証では到達できるとみなされるので、返り値がないことを示す
+	if fr.code[len(fr.code)-1] != "    return" {
+		fr.emit("unreachable")
+	}
+	code = append(code, fr.code...)
+	code = append(code, "  )")
+	return code, nil
+}
+
+// bと、bが支配するブロックを書く。後ろ向きの辺が入ってくるならloopで囲む
+func (fr *frame) emitTree(b *ir.Block) {
+	merges := []*ir.Block{}
+	for _, c := range fr.dom.Children(b) {
+		if fr.merges[c] {
+			merges = append(merges, c)
+		}
+	}
+	// 逆後順で後ろのものほど外側のblockにする
+	sort.Slice(merges, func(i, j int) bool { return fr.rpo[merges[i]] > fr.rpo[merges[j]] })
+	if fr.headers[b] {
+		fr.emit("loop %s", fr.loopLabel(b))
+		fr.emitWithin(b, merges)
+		fr.emit("end")
+	} else {
+		fr.emitWithin(b, merges)
+	}
+}
+
+// bのコードを、mergesのブロックそれぞれに進むblockで囲んで書く。blockの後ろには、そのブロックのコードを置く
+func (fr *frame) emitWithin(b *ir.Block, merges []*ir.Block) {
+	if len(merges) == 0 {
+		for _, instr := range b.Instrs {
+			fr.emitInstr(b, instr)
+		}
+		return
+	}
+	fr.emit("block %s", fr.label(merges[0]))
+	fr.emitWithin(b, merges[1:])
+	fr.emit("end")
+	fr.emitTree(merges[0])
+}
+
+// 値をスタックに積む
+func (fr *frame) push(v ir.Value) {
+	switch v := v.(type) {
+	case *ir.Const:
+		fr.emit("i32.const %d", int32(v.Value))
+	case *ir.Global:
+		fr.emit("i32.const %d", fr.addrs[v.Name])
+	case *ir.Reg:
+		if off, ok := fr.allocas[v]; ok {
+			fr.emit("local.get $fp")
+			if off != 0 {
+				fr.emit("i32.const %d", off)
+				fr.emit("i32.add")
+			}
+			return
+		}
+		fr.emit("local.get %s", local(v))
+	default:
+		log.Fatal("invalid value:", v)
+	}
+}
+
+// 32ビットの値の下位8ビットを符号拡張する
+func (fr *frame) extend8() {
+	fr.emit("i32.const 24")
+	fr.emit("i32.shl")
+	fr.emit("i32.const 24")
+	fr.emit("i32.shr_s")
+}
+
+var binops = map[ir.Op]string{
+	ir.OpAdd: "i32.add",
+	ir.OpSub: "i32.sub",
+	ir.OpMul: "i32.mul",
+	ir.OpDiv: "i32.div_s",
+	ir.OpEq:  "i32.eq",
+	ir.OpNe:  "i32.ne",
+	ir.OpLt:  "i32.lt_s",
+	ir.OpLe:  "i32.le_s",
+	ir.OpGt:  "i32.gt_s",
+	ir.OpGe:  "i32.ge_s",
+}
+
+// 命令を出力する
+// i8の値は、32ビットに符号拡張してローカル変数に置く
+func (fr *frame) emitInstr(b *ir.Block, instr *ir.Instr) {
+	switch op := instr.Op; {
+	case op == ir.OpAlloca:
+		// 領域はフレームを作るときに確保している
+	case op == ir.OpLoad:
+		if r, ok := instr.Args[0].(*ir.Reg); ok && fr.vars[r] {
+			fr.emit("local.get %s", local(r))
+		} else {
+			fr.push(instr.Args[0])
+			if instr.Type == ir.I8 {
+				fr.emit("i32.load8_s")
+			} else {
+				fr.emit("i32.load")
+			}
+		}
+		fr.emit("local.set %s", local(instr.Dst))
+	case op == ir.OpStore:
+		if r, ok := instr.Args[1].(*ir.Reg); ok && fr.vars[r] {
+			fr.push(instr.Args[0])
+			if instr.Type == ir.I8 {
+				fr.extend8()
+			}
+			fr.emit("local.set %s", local(r))
+			break
+		}
+		fr.push(instr.Args[1])
+		fr.push(instr.Args[0])
+		if instr.Type == ir.I8 {
+			fr.emit("i32.store8")
+		} else {
+			fr.emit("i32.store")
+		}
+	case op.IsBinary():
+		fr.push(instr.Args[0])
+		fr.push(instr.Args[1])
+		fr.emit(binops[op])
+		fr.emit("local.set %s", local(instr.Dst))
+	case op == ir.OpTrunc:
+		fr.push(instr.Args[0])
+		if instr.To == ir.I8 {
+			fr.extend8()
+		}
+		fr.emit("local.set %s", local(instr.Dst))
+	case op == ir.OpSext, op == ir.OpCopy:
+		// i8はすでに符号拡張してあり、ポインタも32ビットなので、値はそのままでよい
+		fr.push(instr.Args[0])
+		fr.emit("local.set %s", local(instr.Dst))
+	case op == ir.OpPhi:
+		// 値は飛んでくる前のブロックで書き込んでいる
+	case op == ir.OpCall:
+		for _, a := range instr.Args {
+			fr.push(a)
+		}
+		h := host{name: instr.Callee, params: len(instr.Args), result: instr.Dst != nil}
+		fr.emit("call %s", h.id())
+		if instr.Dst != nil {
+			fr.emit("local.set %s", local(instr.Dst))
+		}
+	case op == ir.OpJmp:
+		fr.emitJump(b, instr.Targets[0])
+	case op == ir.OpBr:
+		fr.push(instr.Args[0])
+		fr.emit("if")
+		fr.emitJump(b, instr.Targets[0])
+		fr.emit("else")
+		fr.emitJump(b, instr.Targets[1])
+		fr.emit("end")
+	case op == ir.OpRet:
+		if len(instr.Args) > 0 {
+			fr.push(instr.Args[0])
+		}
+		if fr.size > 0 {
+			fr.emit("local.get $fp")
+			fr.emit("i32.const %d", fr.size)
+			fr.emit("i32.add")
+			fr.emit("global.set $sp")
+		}
+		fr.emit("return")
+	default:
+		log.Fatal("invalid instruction:", instr)
+	}
+}
+
+// fromからtoに進む。toのphiには、fromから来たときの値を書き込む
+// 値をすべてスタックに積んでから書き込むので、phiどうしで値を入れ替えても壊れない
+// 後ろ向きの辺はloopの先頭に戻り、合流するブロックへはblockを抜けて進む。ほかはfromだけから来るので、その場に書く
+func (fr *frame) emitJump(from *ir.Block, to *ir.Block) {
+	moves := ir.PhiMoves(from, to)
+	for _, m := range moves {
+		fr.push(m.Src)
+	}
+	for i := len(moves) - 1; i >= 0; i-- {
+		fr.emit("local.set %s", local(moves[i].Phi))
+	}
+	switch {
+	case fr.rpo[to] <= fr.rpo[from]:
+		fr.emit("br %s", fr.loopLabel(to))
+	case fr.merges[to]:
+		fr.emit("br %s", fr.label(to))
+	default:
+		fr.emitTree(to)
+	}
+}
+
+// WATの文字列に書けるようにする。表示できない文字と"と\は16進数で書く
+func escape(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			fmt.Fprintf(&sb, "\\%02x", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,220 @@
+package wasm
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/kijimaD/gogo/ir"
+	"github.com/kijimaD/gogo/ir/irtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func emit(t *testing.T, m *ir.Module) string {
+	t.Helper()
+	var buf bytes.Buffer
+	assert.NoError(t, NewEmitter(&buf).EmitModule(m))
+	return buf.String()
+}
+
+// アドレスを取られない変数はローカル変数に置く
+func TestEmitModule(t *testing.T) {
+	expect := `(module
+  (import "env" "printf" (func $printf/2 (param i32 i32) (result i32)))
+  (memory (export "memory") 2)
+  (global $sp (mut i32) (i32.const 131072))
+  (data (i32.const 1024) "a\0a\00")
+  (func $mymain (export "mymain") (result i32)
+    (local $r1 i32)
+    (local $r2 i32)
+    (local $r3 i32)
+    (local $r4 i32)
+    (local $r5 i32)
+    i32.const 1
+    local.set $r1
+    i32.const 300
+    i32.const 24
+    i32.shl
+    i32.const 24
+    i32.shr_s
+    local.set $r2
+    local.get $r1
+    local.set $r3
+    i32.const 1024
+    local.get $r3
+    call $printf/2
+    local.set $r4
+    local.get $r3
+    i32.const 70000
+    i32.add
+    local.set $r5
+    local.get $r5
+    return
+  )
+)
+`
+	assert.Equal(t, expect, emit(t, irtest.Parse(t, `
+data @.s0 = "a\n"
+
+func @mymain() i32 {
+entry:
+	%1 = alloca i32
+	%2 = alloca i8
+	store i32 1, %1
+	store i8 300, %2
+	%3 = load i32 %1
+	%4 = call i32 @printf(ptr @.s0, i32 %3)
+	%5 = add i32 %3, 70000
+	ret i32 %5
+}
+`, 0)))
+}
+
+// 2つのブロックから合流するブロックは、blockの後ろに置き、brで抜けて進む
+// 1つのブロックからしか来ないブロックは、分岐の中にそのまま書く
+func TestEmitModulePhi(t *testing.T) {
+	expect := `(module
+  (memory (export "memory") 2)
+  (global $sp (mut i32) (i32.const 131072))
+  (func $mymain (export "mymain") (result i32)
+    (local $r1 i32)
+    block $bb_b
+    i32.const 1
+    if
+    i32.const 2
+    local.set $r1
+    br $bb_b
+    else
+    i32.const 3
+    local.set $r1
+    br $bb_b
+    end
+    end
+    local.get $r1
+    return
+  )
+)
+`
+	assert.Equal(t, expect, emit(t, irtest.Parse(t, `
+func @mymain() i32 {
+entry:
+	br i32 1, a, b
+a:
+	jmp b
+b:
+	%1 = phi i32 [2, a], [3, entry]
+	ret i32 %1
+}
+`, 0)))
+}
+
+// 後ろ向きの辺が入ってくるブロックはloopで囲み、brで先頭に戻る
+func TestEmitModuleLoop(t *testing.T) {
+	expect := `(module
+  (memory (export "memory") 2)
+  (global $sp (mut i32) (i32.const 131072))
+  (func $mymain (export "mymain") (result i32)
+    (local $r1 i32)
+    (local $r2 i32)
+    i32.const 0
+    local.set $r1
+    loop $loop_loop
+    local.get $r1
+    i32.const 1
+    i32.add
+    local.set $r2
+    local.get $r2
+    if
+    local.get $r2
+    local.set $r1
+    br $loop_loop
+    else
+    local.get $r2
+    return
+    end
+    end
+    unreachable
+  )
+)
+`
+	assert.Equal(t, expect, emit(t, irtest.Parse(t, `
+func @mymain() i32 {
+entry:
+	jmp loop
+loop:
+	%1 = phi i32 [0, entry], [%2, loop]
+	%2 = add i32 %1, 1
+	br i32 %2, loop, done
+done:
+	ret i32 %2
+}
+`, 0)))
+}
+
+// 2つの入口があるループは、blockとloopの入れ子にできない
+func TestEmitModuleIrreducible(t *testing.T) {
+	m := irtest.Parse(t, `
+func @mymain() i32 {
+entry:
+	br i32 1, a, b
+a:
+	jmp b
+b:
+	br i32 1, a, done
+done:
+	ret i32 0
+}
+`, 0)
+	var buf bytes.Buffer
+	assert.EqualError(t, NewEmitter(&buf).EmitModule(m), "@mymain: irreducible control flow from b to a")
+}
+
+// アドレスを渡す変数は、線形メモリのスタックに置く
+func TestEmitModuleStack(t *testing.T) {
+	code := emit(t, irtest.Parse(t, `
+func @mymain() i32 {
+entry:
+	%1 = alloca i32
+	store i32 5, %1
+	%2 = call i32 @scan(ptr %1)
+	%3 = load i32 %1
+	ret i32 %3
+}
+`, 0))
+	assert.Contains(t, code, "    global.get $sp\n    i32.const 16\n    i32.sub\n    local.tee $fp\n    global.set $sp\n")
+	assert.Contains(t, code, "    local.get $fp\n    call $scan/1\n")
+	assert.Contains(t, code, "    local.get $fp\n    i32.const 16\n    i32.add\n    global.set $sp\n    return\n")
+	assert.NotContains(t, code, "(local $r1 i32)")
+}
+
+// 引数の数ごとに別の関数としてインポートする
+func TestEmitModuleImports(t *testing.T) {
+	code := emit(t, irtest.Load(t, "call", 0))
+	assert.Contains(t, code, `(import "env" "printf" (func $printf/2 (param i32 i32) (result i32)))`)
+	assert.Contains(t, code, `(import "env" "printf" (func $printf/10 (param i32 i32 i32 i32 i32 i32 i32 i32 i32 i32) (result i32)))`)
+	assert.Contains(t, code, `(import "env" "sum5" (func $sum5/5 (param i32 i32 i32 i32 i32) (result i32)))`)
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, `abc`, escape([]byte("abc")))
+	assert.Equal(t, `%d\0a\09\5c\22\00\ff`, escape([]byte("%d\n\t\\\"\x00\xff")))
+}
+
+// wat2wasmがあれば、正しいモジュールになっていることを確かめる
+func TestEmitModuleValidate(t *testing.T) {
+	if _, err := exec.LookPath("wat2wasm"); err != nil {
+		t.Skip("wat2wasm is not found")
+	}
+
+	dir := t.TempDir()
+	for _, name := range irtest.Programs {
+		for level := 0; level <= 2; level++ {
+			s := filepath.Join(dir, "a.wat")
+			assert.NoError(t, os.WriteFile(s, []byte(emit(t, irtest.Load(t, name, level))), 0o644))
+			out, err := exec.Command("wat2wasm", "-o", filepath.Join(dir, "a.wasm"), s).CombinedOutput()
+			assert.NoError(t, err, string(out))
+		}
+	}
+}